@@ -0,0 +1,908 @@
+package asm
+
+/*
+	8XC196EA assembler, built from the disassembler's opcode tables run in reverse.
+
+	Source is one instruction per line, operands in the order the Intel manual writes them:
+
+		; comment
+		ORG   0x172100
+		SPEED EQU 0x30
+		start:
+			LD    SPEED, #0x1234           ; direct and immediate
+			ADD   0x32, 0x34, [0x36]+      ; indirect, auto-increment
+			LDB   0x38, 0x04[0x18]         ; short-indexed
+			LD    0x3A, 0x0010[0x18]       ; long-indexed, four hex digits force it
+			ELD   0x3C, 0x10FFFF[0x00]     ; extended-indexed
+			JBC   0x38, 3, start
+			MUL   0x40, #0x0010            ; signed, gets the 0xFE prefix
+			EJMP  start
+		table:
+			DW    start, 0x0000
+			DB    0x01, 0x02
+
+	Registers and displacements can be numbers (0x30, 48, 30H), labels, EQUs or RegObjs mnemonics (SP, WSR).
+	A displacement written with more than two hex digits or using a symbol is always long-indexed.
+*/
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/murdinc/ELMFlash/disasm"
+)
+
+// A run of assembled bytes and where they go
+type Chunk struct {
+	Address int
+	Bytes   []byte
+}
+
+type Program struct {
+	Chunks  []Chunk
+	Symbols map[string]int // labels and EQUs
+}
+
+// Instruction Classes
+////////////////..........
+
+type instrClass int
+
+const (
+	general instrClass = iota
+	shortJump
+	condJump
+	bitJump
+	decJump
+	longJump
+	extJump
+	branch
+	tableJump
+	skip
+)
+
+func class(mnemonic string) instrClass {
+	switch mnemonic {
+	case "SJMP", "SCALL":
+		return shortJump
+	case "JNST", "JNH", "JGT", "JNC", "JNVT", "JNV", "JGE", "JNE", "JST", "JH", "JLE", "JC", "JVT", "JV", "JLT", "JE":
+		return condJump
+	case "JBC", "JBS":
+		return bitJump
+	case "DJNZ", "DJNZW":
+		return decJump
+	case "LJMP", "LCALL":
+		return longJump
+	case "EJMP", "ECALL":
+		return extJump
+	case "BR", "EBR":
+		return branch
+	case "TIJMP":
+		return tableJump
+	case "SKIP":
+		return skip
+	}
+	return general
+}
+
+type operandKind int
+
+const (
+	regOperand operandKind = iota
+	aopOperand
+	countOperand
+)
+
+func kind(varString string) operandKind {
+	switch {
+	case strings.Contains(varString, "aop"), varString == "treg":
+		return aopOperand
+	case varString == "breg/#count":
+		return countOperand
+	}
+	return regOperand
+}
+
+// Byte or word immediate, from the aop type
+func immediateSize(varStrings []string) int {
+	for _, v := range varStrings {
+		if strings.Contains(v, "baop") {
+			return 1
+		}
+	}
+	return 2
+}
+
+type opcode struct {
+	op     byte
+	signed bool
+	instr  disasm.Instruction
+}
+
+// Opcodes by mnemonic, lowest first
+var opcodes = make(map[string][]opcode)
+
+// RegObjs mnemonics, words and longs by their lowest byte
+var registers = make(map[string]int)
+
+func init() {
+	for _, signed := range []bool{false, true} {
+		for op, instr := range disasm.Opcodes(signed) {
+			if instr.Reserved || (op == 0xFE && !signed) {
+				continue
+			}
+			opcodes[instr.Mnemonic] = append(opcodes[instr.Mnemonic], opcode{op: op, signed: signed, instr: instr})
+		}
+	}
+
+	for _, ops := range opcodes {
+		sort.Slice(ops, func(i, j int) bool { return ops[i].op < ops[j].op })
+	}
+
+	for adr, reg := range disasm.RegObjs {
+		name := strings.ToUpper(reg.Mnemonic)
+		if prev, ok := registers[name]; !ok || adr < prev {
+			registers[name] = adr
+		}
+	}
+}
+
+// Assemble
+////////////////..........
+
+type line struct {
+	num      int
+	label    string
+	mnemonic string
+	operands []string
+}
+
+type assembler struct {
+	symbols map[string]int
+	final   bool // second pass, every symbol has to resolve and every range is checked
+	pc      int
+}
+
+// AssembleFile reads and assembles a source file
+func AssembleFile(path string, origin int) (*Program, error) {
+	src, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Assemble(string(src), origin)
+}
+
+// Assemble turns source into bytes, starting at origin until the first ORG
+func Assemble(src string, origin int) (*Program, error) {
+
+	lines, err := parse(src)
+	if err != nil {
+		return nil, err
+	}
+
+	a := &assembler{symbols: make(map[string]int)}
+
+	// First pass finds the labels, second pass encodes with them
+	var sizes []int
+	for pass := 0; pass < 2; pass++ {
+		a.final = pass == 1
+		a.pc = origin
+
+		prog := &Program{Symbols: a.symbols}
+		var chunk *Chunk
+
+		for i, l := range lines {
+			if l.label != "" && !a.final {
+				if _, ok := a.symbols[l.label]; ok {
+					return nil, fmt.Errorf("line %d: %s is already defined", l.num, l.label)
+				}
+				a.symbols[l.label] = a.pc
+			}
+
+			switch l.mnemonic {
+			case "":
+				continue
+
+			case "ORG":
+				if len(l.operands) != 1 {
+					return nil, fmt.Errorf("line %d: ORG takes one address", l.num)
+				}
+				v, err := a.value(l.operands[0])
+				if err != nil {
+					return nil, fmt.Errorf("line %d: %s", l.num, err)
+				}
+				a.pc = v.val
+				chunk = nil
+				continue
+
+			case "EQU":
+				if l.label == "" || len(l.operands) != 1 {
+					return nil, fmt.Errorf("line %d: EQU needs a name and one value", l.num)
+				}
+				v, err := a.value(l.operands[0])
+				if err != nil {
+					return nil, fmt.Errorf("line %d: %s", l.num, err)
+				}
+				a.symbols[l.label] = v.val
+				continue
+			}
+
+			b, err := a.encode(l)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %s", l.num, err)
+			}
+
+			if !a.final {
+				sizes = append(sizes, len(b))
+			} else if sizes[0] != len(b) {
+				return nil, fmt.Errorf("line %d: %s changed size between passes", l.num, lines[i].mnemonic)
+			} else {
+				sizes = sizes[1:]
+			}
+
+			if chunk == nil {
+				prog.Chunks = append(prog.Chunks, Chunk{Address: a.pc})
+				chunk = &prog.Chunks[len(prog.Chunks)-1]
+			}
+			chunk.Bytes = append(chunk.Bytes, b...)
+			a.pc += len(b)
+		}
+
+		if a.final {
+			return prog, nil
+		}
+	}
+
+	return nil, nil
+}
+
+func parse(src string) ([]line, error) {
+	var lines []line
+
+	for n, text := range strings.Split(src, "\n") {
+		l := line{num: n + 1}
+
+		if i := strings.Index(text, ";"); i >= 0 {
+			text = text[:i]
+		}
+		text = strings.TrimSpace(text)
+
+		// Labels
+		if i := strings.Index(text, ":"); i > 0 && isSymbol(text[:i]) {
+			l.label = text[:i]
+			text = strings.TrimSpace(text[i+1:])
+		}
+
+		fields := strings.Fields(text)
+
+		// NAME EQU value
+		if len(fields) >= 2 && strings.ToUpper(fields[1]) == "EQU" {
+			l.label = fields[0]
+			fields = fields[1:]
+			text = strings.TrimSpace(text[len(l.label):])
+		}
+
+		if len(fields) == 0 {
+			if l.label != "" {
+				lines = append(lines, l)
+			}
+			continue
+		}
+
+		l.mnemonic = strings.ToUpper(fields[0])
+		rest := strings.TrimSpace(text[len(fields[0]):])
+
+		// Signed multiply and divide can be written like the disassembler shows them
+		if l.mnemonic == "SGN" && len(fields) > 1 {
+			l.mnemonic = strings.ToUpper(fields[1])
+			rest = strings.TrimSpace(rest[len(fields[1]):])
+		}
+
+		if rest != "" {
+			for _, op := range strings.Split(rest, ",") {
+				op = strings.TrimSpace(op)
+				if op == "" {
+					return nil, fmt.Errorf("line %d: empty operand", l.num)
+				}
+				l.operands = append(l.operands, op)
+			}
+		}
+
+		lines = append(lines, l)
+	}
+
+	return lines, nil
+}
+
+// Encoding
+////////////////..........
+
+func (a *assembler) encode(l line) ([]byte, error) {
+
+	switch l.mnemonic {
+	case "DB":
+		var b []byte
+		for _, op := range l.operands {
+			v, err := a.value(op)
+			if err != nil {
+				return nil, err
+			}
+			if err := a.fits(v.val, -0x80, 0xFF); err != nil {
+				return nil, err
+			}
+			b = append(b, byte(v.val))
+		}
+		return b, nil
+
+	case "DW":
+		var b []byte
+		for _, op := range l.operands {
+			v, err := a.value(op)
+			if err != nil {
+				return nil, err
+			}
+			// Labels become their offset in the page, like the vector and TIJMP tables hold them
+			if !v.symbolic {
+				if err := a.fits(v.val, -0x8000, 0xFFFF); err != nil {
+					return nil, err
+				}
+			}
+			b = append(b, byte(v.val), byte(v.val>>8))
+		}
+		return b, nil
+	}
+
+	candidates := opcodes[l.mnemonic]
+	if l.mnemonic == "BR" {
+		candidates = opcodes["EBR"]
+	}
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("unknown instruction %s", l.mnemonic)
+	}
+
+	ops := l.operands
+	first := candidates[0]
+
+	switch class(l.mnemonic) {
+
+	case shortJump:
+		if err := a.count(l, 1); err != nil {
+			return nil, err
+		}
+		disp, err := a.relative(ops[0], 2, -0x400, 0x3FF)
+		if err != nil {
+			return nil, err
+		}
+		return []byte{first.op | byte(disp>>8)&0x07, byte(disp)}, nil
+
+	case condJump:
+		if err := a.count(l, 1); err != nil {
+			return nil, err
+		}
+		disp, err := a.relative(ops[0], 2, -0x80, 0x7F)
+		if err != nil {
+			return nil, err
+		}
+		return []byte{first.op, byte(disp)}, nil
+
+	case bitJump:
+		if err := a.count(l, 3); err != nil {
+			return nil, err
+		}
+		reg, err := a.register(ops[0])
+		if err != nil {
+			return nil, err
+		}
+		bit, err := a.value(ops[1])
+		if err != nil {
+			return nil, err
+		}
+		if bit.val < 0 || bit.val > 7 {
+			return nil, fmt.Errorf("bit number %d isn't 0 - 7", bit.val)
+		}
+		disp, err := a.relative(ops[2], 3, -0x80, 0x7F)
+		if err != nil {
+			return nil, err
+		}
+		return []byte{first.op | byte(bit.val), reg, byte(disp)}, nil
+
+	case decJump:
+		if err := a.count(l, 2); err != nil {
+			return nil, err
+		}
+		reg, err := a.register(ops[0])
+		if err != nil {
+			return nil, err
+		}
+		disp, err := a.relative(ops[1], 3, -0x80, 0x7F)
+		if err != nil {
+			return nil, err
+		}
+		return []byte{first.op, reg, byte(disp)}, nil
+
+	case longJump:
+		if err := a.count(l, 1); err != nil {
+			return nil, err
+		}
+		disp, err := a.relative(ops[0], 3, -0x8000, 0x7FFF)
+		if err != nil {
+			return nil, err
+		}
+		return []byte{first.op, byte(disp), byte(disp >> 8)}, nil
+
+	case extJump:
+		if err := a.count(l, 1); err != nil {
+			return nil, err
+		}
+		v, err := a.value(ops[0])
+		if err != nil {
+			return nil, err
+		}
+		disp := (v.val - (a.pc + 4)) & 0xFFFFFF
+		return []byte{first.op, byte(disp), byte(disp >> 8), byte(disp >> 16)}, nil
+
+	case branch:
+		if err := a.count(l, 1); err != nil {
+			return nil, err
+		}
+		m, err := a.aop(ops[0])
+		if err != nil {
+			return nil, err
+		}
+		if m.mode != "indirect" || m.inc || m.reg&0x01 == 0x01 {
+			return nil, fmt.Errorf("%s takes an even register in brackets, [reg]", l.mnemonic)
+		}
+		if l.mnemonic == "EBR" {
+			m.reg |= 0x01
+		}
+		return []byte{first.op, m.reg}, nil
+
+	case tableJump:
+		if err := a.count(l, 3); err != nil {
+			return nil, err
+		}
+		tbase, err := a.register(ops[0])
+		if err != nil {
+			return nil, err
+		}
+		index, err := a.aop(ops[1])
+		if err != nil {
+			return nil, err
+		}
+		if index.mode != "indirect" || index.inc {
+			return nil, fmt.Errorf("TIJMP takes its index register in brackets, [reg]")
+		}
+		mask, err := a.aop(ops[2])
+		if err != nil {
+			return nil, err
+		}
+		if mask.mode != "immediate" {
+			return nil, fmt.Errorf("TIJMP takes an immediate mask, #mask")
+		}
+		if err := a.fits(mask.val, 0, 0x7F); err != nil {
+			return nil, err
+		}
+		return []byte{first.op, index.reg, byte(mask.val), tbase}, nil
+
+	case skip:
+		if err := a.count(l, 1); err != nil {
+			return nil, err
+		}
+		v, err := a.value(ops[0])
+		if err != nil {
+			return nil, err
+		}
+		return []byte{first.op, byte(v.val)}, nil
+	}
+
+	return a.general(l, candidates)
+}
+
+// Everything that encodes its operands in reverse, with at most one aop
+func (a *assembler) general(l line, candidates []opcode) ([]byte, error) {
+
+	var matched *opcode
+	var m aopMode
+
+	for i, c := range candidates {
+		if len(c.instr.VarStrings) != len(l.operands) {
+			continue
+		}
+
+		hasAop := false
+		for v, vs := range c.instr.VarStrings {
+			if kind(vs) != aopOperand {
+				continue
+			}
+			hasAop = true
+
+			mode, err := a.aop(l.operands[v])
+			if err != nil {
+				return nil, err
+			}
+
+			want := mode.mode
+			if vs == "treg" {
+				want = "extended-" + want
+			}
+			if want == c.instr.AddressingMode {
+				matched = &candidates[i]
+				m = mode
+			}
+		}
+
+		if !hasAop {
+			matched = &candidates[i]
+		}
+		if matched != nil {
+			break
+		}
+	}
+
+	if matched == nil {
+		return nil, fmt.Errorf("no form of %s takes %s", l.mnemonic, strings.Join(l.operands, ", "))
+	}
+
+	var b []byte
+	if matched.signed {
+		b = append(b, 0xFE)
+	}
+	b = append(b, matched.op)
+
+	vs := matched.instr.VarStrings
+	for v := len(vs) - 1; v >= 0; v-- {
+		switch kind(vs[v]) {
+
+		case aopOperand:
+			enc, err := a.encodeAop(m, matched.instr)
+			if err != nil {
+				return nil, err
+			}
+			b = append(b, enc...)
+
+		case countOperand:
+			c, err := a.aop(l.operands[v])
+			if err != nil {
+				return nil, err
+			}
+			switch c.mode {
+			case "immediate":
+				if err := a.fits(c.val, 0, 0x0F); err != nil {
+					return nil, err
+				}
+				b = append(b, byte(c.val))
+			case "direct":
+				if a.final && c.reg < 0x10 {
+					return nil, fmt.Errorf("a shift count register has to be 0x10 or above, use #count")
+				}
+				b = append(b, c.reg)
+			default:
+				return nil, fmt.Errorf("a shift count is #count or a register")
+			}
+
+		default:
+			reg, err := a.register(l.operands[v])
+			if err != nil {
+				return nil, err
+			}
+			b = append(b, reg)
+		}
+	}
+
+	return b, nil
+}
+
+func (a *assembler) encodeAop(m aopMode, instr disasm.Instruction) ([]byte, error) {
+	switch m.mode {
+
+	case "immediate":
+		if immediateSize(instr.VarStrings) == 1 {
+			if err := a.fits(m.val, -0x80, 0xFF); err != nil {
+				return nil, err
+			}
+			return []byte{byte(m.val)}, nil
+		}
+		if err := a.fits(m.val, -0x8000, 0xFFFF); err != nil {
+			return nil, err
+		}
+		return []byte{byte(m.val), byte(m.val >> 8)}, nil
+
+	case "indirect":
+		if m.reg&0x01 == 0x01 {
+			return nil, fmt.Errorf("indirect register 0x%02X isn't even", m.reg)
+		}
+		if m.inc {
+			return []byte{m.reg | 0x01}, nil
+		}
+		return []byte{m.reg}, nil
+
+	case "indexed":
+		if instr.AddressingMode == "extended-indexed" {
+			if err := a.fits(m.val, 0, 0xFFFFFF); err != nil {
+				return nil, err
+			}
+			return []byte{m.reg, byte(m.val), byte(m.val >> 8), byte(m.val >> 16)}, nil
+		}
+
+		if m.reg&0x01 == 0x01 {
+			return nil, fmt.Errorf("index register 0x%02X isn't even", m.reg)
+		}
+
+		short := !m.symbolic && m.digits <= 2 && m.val >= -0x80 && m.val <= 0xFF
+		if short && m.val > 0x7F && m.digits == 0 {
+			short = false // a decimal 128 - 255 means the address, not a negative byte
+		}
+		if short {
+			return []byte{m.reg, byte(m.val)}, nil
+		}
+
+		if err := a.fits(m.val, -0x8000, 0xFFFF); err != nil {
+			return nil, err
+		}
+		return []byte{m.reg | 0x01, byte(m.val), byte(m.val >> 8)}, nil
+	}
+
+	// direct
+	return []byte{m.reg}, nil
+}
+
+// Operands
+////////////////..........
+
+type aopMode struct {
+	mode     string // direct, immediate, indirect, indexed
+	inc      bool   // [reg]+
+	reg      byte
+	val      int // immediate value or displacement
+	digits   int // hex digits the displacement was written with, 0 if it wasn't hex
+	symbolic bool
+}
+
+func (a *assembler) aop(s string) (aopMode, error) {
+	var m aopMode
+
+	switch {
+	case strings.HasPrefix(s, "#"):
+		v, err := a.value(s[1:])
+		if err != nil {
+			return m, err
+		}
+		m.mode = "immediate"
+		m.val = v.val
+		return m, nil
+
+	case strings.HasPrefix(s, "["):
+		m.mode = "indirect"
+		if strings.HasSuffix(s, "]+") {
+			m.inc = true
+			s = strings.TrimSuffix(s, "+")
+		}
+		if !strings.HasSuffix(s, "]") {
+			return m, fmt.Errorf("missing ] in %s", s)
+		}
+		reg, err := a.register(s[1 : len(s)-1])
+		m.reg = reg
+		return m, err
+
+	case strings.HasSuffix(s, "]"):
+		i := strings.Index(s, "[")
+		if i < 0 {
+			return m, fmt.Errorf("missing [ in %s", s)
+		}
+		v, err := a.value(s[:i])
+		if err != nil {
+			return m, err
+		}
+		reg, err := a.register(s[i+1 : len(s)-1])
+		if err != nil {
+			return m, err
+		}
+		m.mode = "indexed"
+		m.reg = reg
+		m.val = v.val
+		m.digits = v.digits
+		m.symbolic = v.symbolic
+		return m, nil
+	}
+
+	reg, err := a.register(s)
+	m.mode = "direct"
+	m.reg = reg
+	return m, err
+}
+
+func (a *assembler) register(s string) (byte, error) {
+	v, err := a.value(s)
+	if err != nil {
+		return 0, err
+	}
+	if err := a.fits(v.val, 0, 0xFF); err != nil {
+		return 0, fmt.Errorf("register %s: %s", s, err)
+	}
+	return byte(v.val), nil
+}
+
+// Displacement from the end of an instruction of length n to the target in s
+func (a *assembler) relative(s string, n, min, max int) (int, error) {
+	v, err := a.value(s)
+	if err != nil {
+		return 0, err
+	}
+	disp := v.val - (a.pc + n)
+	if a.final && (disp < min || disp > max) {
+		return 0, fmt.Errorf("0x%X is out of range, %d bytes away", v.val, disp)
+	}
+	return disp, nil
+}
+
+func (a *assembler) count(l line, n int) error {
+	if len(l.operands) != n {
+		return fmt.Errorf("%s takes %d operands, got %d", l.mnemonic, n, len(l.operands))
+	}
+	return nil
+}
+
+func (a *assembler) fits(v, min, max int) error {
+	if a.final && (v < min || v > max) {
+		return fmt.Errorf("0x%X doesn't fit in 0x%X - 0x%X", v, min, max)
+	}
+	return nil
+}
+
+// Expressions
+////////////////..........
+
+type value struct {
+	val      int
+	digits   int
+	symbolic bool
+}
+
+// Sums and differences of numbers and symbols
+func (a *assembler) value(s string) (value, error) {
+	var v value
+
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return v, fmt.Errorf("missing value")
+	}
+
+	sign := 1
+	terms := 0
+	for s != "" {
+		switch s[0] {
+		case '+':
+			sign = 1
+			s = strings.TrimSpace(s[1:])
+			continue
+		case '-':
+			sign = -1
+			s = strings.TrimSpace(s[1:])
+			continue
+		}
+
+		end := strings.IndexAny(s, "+-")
+		term := strings.TrimSpace(s)
+		if end > 0 {
+			term = strings.TrimSpace(s[:end])
+			s = strings.TrimSpace(s[end:])
+		} else {
+			s = ""
+		}
+
+		t, err := a.term(term)
+		if err != nil {
+			return v, err
+		}
+
+		v.val += sign * t.val
+		v.symbolic = v.symbolic || t.symbolic
+		if terms == 0 {
+			v.digits = t.digits
+		} else {
+			v.digits = 0
+		}
+		terms++
+		sign = 1
+	}
+
+	return v, nil
+}
+
+func (a *assembler) term(s string) (value, error) {
+	var v value
+
+	if s == "" {
+		return v, fmt.Errorf("missing value")
+	}
+
+	upper := strings.ToUpper(s)
+
+	switch {
+	case strings.HasPrefix(upper, "0X"):
+		n, err := strconv.ParseInt(s[2:], 16, 64)
+		if err != nil {
+			return v, fmt.Errorf("bad number %s", s)
+		}
+		v.val = int(n)
+		v.digits = len(s) - 2
+		return v, nil
+
+	case len(s) > 1 && s[0] >= '0' && s[0] <= '9' && strings.HasSuffix(upper, "H"):
+		n, err := strconv.ParseInt(s[:len(s)-1], 16, 64)
+		if err != nil {
+			return v, fmt.Errorf("bad number %s", s)
+		}
+		v.val = int(n)
+		v.digits = len(s) - 1
+		return v, nil
+
+	case s[0] >= '0' && s[0] <= '9':
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return v, fmt.Errorf("bad number %s", s)
+		}
+		v.val = int(n)
+		return v, nil
+	}
+
+	if !isSymbol(s) {
+		return v, fmt.Errorf("bad value %s", s)
+	}
+
+	v.symbolic = true
+
+	if val, ok := a.symbols[s]; ok {
+		v.val = val
+		return v, nil
+	}
+
+	// Register names the disassembler knows, like SP or WSR
+	if adr, ok := registers[upper]; ok {
+		v.val = adr
+		v.symbolic = false
+		return v, nil
+	}
+
+	if a.final {
+		return v, fmt.Errorf("undefined symbol %s", s)
+	}
+
+	return v, nil
+}
+
+func isSymbol(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i, c := range s {
+		switch {
+		case c == '_', c >= 'A' && c <= 'Z', c >= 'a' && c <= 'z':
+		case c >= '0' && c <= '9' && i > 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// Patching
+////////////////..........
+
+// Patch copies the assembled chunks into a merged image, which is indexed by address
+func (p *Program) Patch(image []byte) error {
+	for _, c := range p.Chunks {
+		if c.Address < 0 || c.Address+len(c.Bytes) > len(image) {
+			return fmt.Errorf("0x%X - 0x%X is outside the 0x%X byte image", c.Address, c.Address+len(c.Bytes)-1, len(image))
+		}
+	}
+
+	for _, c := range p.Chunks {
+		copy(image[c.Address:], c.Bytes)
+	}
+
+	return nil
+}
@@ -0,0 +1,143 @@
+package asm
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/murdinc/ELMFlash/disasm"
+)
+
+// Operand bytes to follow each opcode with, odd first bytes pick long-indexed and auto-increment
+var operandPatterns = [][]byte{
+	{0x30, 0x12, 0x34, 0x56, 0x78},
+	{0x31, 0x12, 0x34, 0x56, 0x78},
+	{0x1C, 0x7F, 0x80, 0x01, 0x02},
+	{0xF0, 0xFF, 0xFF, 0x12, 0x34},
+	{0x0A, 0x80, 0x00, 0x00, 0x00},
+}
+
+func TestRoundTrip(t *testing.T) {
+	const address = 0x172100
+
+	count := 0
+	for _, signed := range []bool{false, true} {
+		for op, instr := range disasm.Opcodes(signed) {
+			if instr.Reserved || (op == 0xFE && !signed) {
+				continue
+			}
+
+			for _, pattern := range operandPatterns {
+				var in []byte
+				if signed {
+					in = append(in, 0xFE)
+				}
+				in = append(in, op)
+				in = append(in, pattern...)
+				in = append(in, make([]byte, 10)...)
+
+				// TIJMP masks are 7 bits
+				if instr.Mnemonic == "TIJMP" {
+					in[2] &= 0x7F
+				}
+
+				parsed, err := disasm.Parse(in, address)
+				if err != nil {
+					t.Fatalf("Parse(% X): %s", in[:6], err)
+				}
+				want := parsed.Raw
+
+				text := Format(parsed)
+				prog, err := Assemble(text, address)
+				if err != nil {
+					t.Errorf("%02X % X: Assemble(%q): %s", op, want, text, err)
+					continue
+				}
+
+				if len(prog.Chunks) != 1 || prog.Chunks[0].Address != address || !bytes.Equal(prog.Chunks[0].Bytes, want) {
+					t.Errorf("%02X: %q assembled to %+v, want % X", op, text, prog.Chunks, want)
+				}
+				count++
+			}
+		}
+	}
+
+	if count == 0 {
+		t.Fatal("no opcodes tested")
+	}
+}
+
+func TestAssembleLabels(t *testing.T) {
+	src := `
+; a little of everything
+		ORG   0x172100
+SPEED	EQU   0x30
+start:	LD    SPEED, #0x1234
+		ADD   0x32, 0x34, [0x36]+
+		LDB   0x38, 0x04[SP]
+		LD    0x3A, 0x0010[0x18]
+		ELD   0x3C, 0x10FFFF[0x00]
+loop:	JBC   0x38, 3, loop
+		SGN MUL 0x40, #0x0010
+		DJNZ  0x3E, loop
+		SJMP  start
+		EJMP  table
+table:	DW    start, 0x0000
+		DB    0x01, 2
+`
+	prog, err := Assemble(src, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []byte{
+		0xA1, 0x34, 0x12, 0x30, // LD
+		0x46, 0x37, 0x34, 0x32, // ADD
+		0xB3, 0x18, 0x04, 0x38, // LDB
+		0xA3, 0x19, 0x10, 0x00, 0x3A, // LD
+		0xE9, 0x00, 0xFF, 0xFF, 0x10, 0x3C, // ELD
+		0x33, 0x38, 0xFD, // JBC
+		0xFE, 0x6D, 0x10, 0x00, 0x40, // MUL
+		0xE0, 0x3E, 0xF5, // DJNZ
+		0x27, 0xDC, // SJMP
+		0xE6, 0x00, 0x00, 0x00, // EJMP
+		0x00, 0x21, 0x00, 0x00, // DW
+		0x01, 0x02, // DB
+	}
+
+	if len(prog.Chunks) != 1 || prog.Chunks[0].Address != 0x172100 {
+		t.Fatalf("chunks: %+v", prog.Chunks)
+	}
+	if !bytes.Equal(prog.Chunks[0].Bytes, want) {
+		t.Errorf("got  % X\nwant % X", prog.Chunks[0].Bytes, want)
+	}
+	if prog.Symbols["table"] != 0x172128 {
+		t.Errorf("table is at 0x%X", prog.Symbols["table"])
+	}
+
+	image := make([]byte, 0x180000)
+	if err := prog.Patch(image); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(image[0x172100:0x172100+len(want)], want) {
+		t.Error("Patch didn't copy the program into the image")
+	}
+
+	if err := prog.Patch(make([]byte, 0x100)); err == nil {
+		t.Error("Patch should refuse a program that doesn't fit")
+	}
+}
+
+func TestAssembleErrors(t *testing.T) {
+	for _, src := range []string{
+		"LD 0x30",                      // missing operand
+		"JE far\nORG 0x1000\nfar: NOP", // out of range
+		"LD 0x30, [0x31]",              // odd indirect register
+		"FOO 0x30",                     // unknown
+		"SJMP nowhere",                 // undefined
+		"SHL 0x30, 0x04",               // count register below 0x10
+	} {
+		if _, err := Assemble(src, 0x172100); err == nil {
+			t.Errorf("Assemble(%q) should fail", src)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package asm
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/murdinc/ELMFlash/disasm"
+)
+
+// Format
+////////////////..........
+
+// Format writes a parsed instruction back out as assembler source that Assemble turns into the same bytes
+func Format(instr disasm.Instruction) string {
+	mnemonic := strings.TrimPrefix(instr.Mnemonic, "SGN ")
+	ops := instr.RawOps
+	next := instr.Address + instr.ByteLength
+
+	switch class(mnemonic) {
+
+	case shortJump:
+		disp := int(instr.Op&0x07)<<8 | int(ops[0])
+		return fmt.Sprintf("%s 0x%X", mnemonic, next+signExtend(disp, 11))
+
+	case condJump:
+		return fmt.Sprintf("%s 0x%X", mnemonic, next+signExtend(int(ops[0]), 8))
+
+	case bitJump:
+		return fmt.Sprintf("%s 0x%02X, %d, 0x%X", mnemonic, ops[0], instr.Op&0x07, next+signExtend(int(ops[1]), 8))
+
+	case decJump:
+		return fmt.Sprintf("%s 0x%02X, 0x%X", mnemonic, ops[0], next+signExtend(int(ops[1]), 8))
+
+	case longJump:
+		return fmt.Sprintf("%s 0x%X", mnemonic, next+signExtend(int(ops[1])<<8|int(ops[0]), 16))
+
+	case extJump:
+		return fmt.Sprintf("%s 0x%X", mnemonic, (next+(int(ops[2])<<16|int(ops[1])<<8|int(ops[0])))&0xFFFFFF)
+
+	case branch:
+		return fmt.Sprintf("%s [0x%02X]", mnemonic, ops[0]&0xFE)
+
+	case tableJump:
+		return fmt.Sprintf("%s 0x%02X, [0x%02X], #0x%02X", mnemonic, ops[2], ops[0], ops[1])
+
+	case skip:
+		return fmt.Sprintf("%s 0x%02X", mnemonic, ops[0])
+	}
+
+	if len(instr.VarStrings) == 0 {
+		return mnemonic
+	}
+
+	// Operands are encoded in the reverse of the order they're written
+	vars := make([]string, len(instr.VarStrings))
+	i := 0
+	for v := len(instr.VarStrings) - 1; v >= 0; v-- {
+		switch kind(instr.VarStrings[v]) {
+
+		case aopOperand:
+			var n int
+			vars[v], n = formatAop(instr, ops[i:])
+			i += n
+
+		case countOperand:
+			if ops[i] < 0x10 {
+				vars[v] = fmt.Sprintf("#%d", ops[i])
+			} else {
+				vars[v] = fmt.Sprintf("0x%02X", ops[i])
+			}
+			i++
+
+		default:
+			vars[v] = fmt.Sprintf("0x%02X", ops[i])
+			i++
+		}
+	}
+
+	return mnemonic + " " + strings.Join(vars, ", ")
+}
+
+func formatAop(instr disasm.Instruction, ops []byte) (string, int) {
+	switch instr.AddressingMode {
+
+	case "immediate":
+		if immediateSize(instr.VarStrings) == 1 {
+			return fmt.Sprintf("#0x%02X", ops[0]), 1
+		}
+		return fmt.Sprintf("#0x%04X", int(ops[1])<<8|int(ops[0])), 2
+
+	case "indirect", "indirect+", "extended-indirect":
+		if ops[0]&0x01 == 0x01 {
+			return fmt.Sprintf("[0x%02X]+", ops[0]&0xFE), 1
+		}
+		return fmt.Sprintf("[0x%02X]", ops[0]), 1
+
+	case "short-indexed":
+		return fmt.Sprintf("0x%02X[0x%02X]", ops[1], ops[0]), 2
+
+	case "long-indexed":
+		return fmt.Sprintf("0x%04X[0x%02X]", int(ops[2])<<8|int(ops[1]), ops[0]&0xFE), 3
+
+	case "extended-indexed":
+		return fmt.Sprintf("0x%06X[0x%02X]", int(ops[3])<<16|int(ops[2])<<8|int(ops[1]), ops[0]), 4
+	}
+
+	// direct
+	return fmt.Sprintf("0x%02X", ops[0]), 1
+}
+
+// Disassemble parses the instruction at the start of b and formats it
+func Disassemble(b []byte, address int) (string, int, error) {
+	in := make([]byte, 10)
+	copy(in, b)
+
+	instr, err := disasm.Parse(in, address)
+	if err != nil {
+		return "", 1, err
+	}
+	if instr.ByteLength > len(b) {
+		return "", len(b), fmt.Errorf("Instruction at 0x%X runs past the end of the data", address)
+	}
+
+	return Format(instr), instr.ByteLength, nil
+}
+
+func signExtend(v int, bits uint) int {
+	shift := 64 - bits
+	return int(int64(v) << shift >> shift)
+}
@@ -0,0 +1,580 @@
+package calibrate
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/murdinc/ELMFlash/tables"
+)
+
+// A2L Export and Import
+////////////////..........
+
+// ASAM MCD-2 MC describes the tables by their ECU addresses in nested /begin ... /end blocks. The exports write
+// a MAP CHARACTERISTIC for each map, a CURVE for each array, a VALUE for each item, and an AXIS_PTS for each array
+// another table names as its axis. The parser only knows the blocks the exports use, and keeps everything else
+// as loose tokens.
+
+// A2LNode is a /begin ... /end block, or the whole file
+type A2LNode struct {
+	Block    string
+	Args     []string // the block's fixed parameters
+	Tokens   []string // the optional parameters, outside the nested blocks
+	Children []*A2LNode
+}
+
+// Fixed parameters of the blocks the parser knows, the rest of a block are optional parameters
+var a2lArgs = map[string]int{
+	"PROJECT":        2,
+	"MODULE":         2,
+	"MOD_COMMON":     1,
+	"MOD_PAR":        1,
+	"MEMORY_SEGMENT": 11,
+	"COMPU_METHOD":   5,
+	"RECORD_LAYOUT":  1,
+	"CHARACTERISTIC": 9,
+	"AXIS_DESCR":     6,
+	"AXIS_PTS":       10,
+	"FORMULA":        1,
+}
+
+// LoadA2L reads and parses an A2L file
+func LoadA2L(path string) (*A2LNode, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	n, err := ParseA2L(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return n, nil
+}
+
+// ParseA2L parses the blocks of an A2L file
+func ParseA2L(src string) (*A2LNode, error) {
+	tokens, err := a2lTokens(src)
+	if err != nil {
+		return nil, err
+	}
+
+	root := &A2LNode{}
+	stack := []*A2LNode{root}
+	for i := 0; i < len(tokens); i++ {
+		top := stack[len(stack)-1]
+		switch tokens[i] {
+		case "/begin":
+			if i+1 >= len(tokens) {
+				return nil, fmt.Errorf("/begin at the end of the file")
+			}
+			n := &A2LNode{Block: tokens[i+1]}
+			i++
+			count := a2lArgs[n.Block]
+			if i+count >= len(tokens) {
+				return nil, fmt.Errorf("%s: %d parameters, the file ends first", n.Block, count)
+			}
+			n.Args = tokens[i+1 : i+1+count]
+			for _, arg := range n.Args {
+				if arg == "/begin" || arg == "/end" {
+					return nil, fmt.Errorf("%s: %d parameters, found %s first", n.Block, count, arg)
+				}
+			}
+			i += count
+			top.Children = append(top.Children, n)
+			stack = append(stack, n)
+		case "/end":
+			if i+1 >= len(tokens) || len(stack) == 1 || tokens[i+1] != top.Block {
+				return nil, fmt.Errorf("/end doesn't close /begin %s", top.Block)
+			}
+			stack = stack[:len(stack)-1]
+			i++
+		default:
+			top.Tokens = append(top.Tokens, tokens[i])
+		}
+	}
+	if len(stack) > 1 {
+		return nil, fmt.Errorf("/begin %s isn't closed", stack[len(stack)-1].Block)
+	}
+	return root, nil
+}
+
+// a2lTokens splits an A2L file into words and strings, leaving out the comments
+func a2lTokens(src string) ([]string, error) {
+	var tokens []string
+	for i := 0; i < len(src); {
+		switch {
+		case strings.ContainsRune(" \t\r\n", rune(src[i])):
+			i++
+		case strings.HasPrefix(src[i:], "/*"):
+			end := strings.Index(src[i+2:], "*/")
+			if end < 0 {
+				return nil, fmt.Errorf("comment isn't closed")
+			}
+			i += end + 4
+		case strings.HasPrefix(src[i:], "//"):
+			end := strings.IndexByte(src[i:], '\n')
+			if end < 0 {
+				end = len(src) - i
+			}
+			i += end
+		case src[i] == '"':
+			var s strings.Builder
+			i++
+			for {
+				if i >= len(src) {
+					return nil, fmt.Errorf("string isn't closed")
+				}
+				if src[i] == '\\' && i+1 < len(src) {
+					s.WriteByte(src[i+1])
+					i += 2
+					continue
+				}
+				if src[i] == '"' {
+					// A doubled quote is a quote
+					if i+1 < len(src) && src[i+1] == '"' {
+						s.WriteByte('"')
+						i += 2
+						continue
+					}
+					i++
+					break
+				}
+				s.WriteByte(src[i])
+				i++
+			}
+			tokens = append(tokens, s.String())
+		default:
+			start := i
+			for i < len(src) && !strings.ContainsRune(" \t\r\n\"", rune(src[i])) {
+				i++
+			}
+			tokens = append(tokens, src[start:i])
+		}
+	}
+	return tokens, nil
+}
+
+// Find returns the blocks named block at any depth under n, in order
+func (n *A2LNode) Find(block string) []*A2LNode {
+	var found []*A2LNode
+	for _, child := range n.Children {
+		if child.Block == block {
+			found = append(found, child)
+		}
+		found = append(found, child.Find(block)...)
+	}
+	return found
+}
+
+// Option returns the count parameters after keyword in the block's optional parameters, nil if it isn't there
+func (n *A2LNode) Option(keyword string, count int) []string {
+	for i, token := range n.Tokens {
+		if token == keyword && i+count < len(n.Tokens) {
+			return n.Tokens[i+1 : i+1+count]
+		}
+	}
+	return nil
+}
+
+// Export
+////////////////..........
+
+// A2L identifiers are C identifiers
+var a2lIdent = regexp.MustCompile(`[^A-Za-z0-9_]+`)
+
+func a2lIdentifier(s string) string {
+	s = strings.Trim(a2lIdent.ReplaceAllString(s, "_"), "_")
+	if s != "" && s[0] >= '0' && s[0] <= '9' {
+		s = "_" + s
+	}
+	return s
+}
+
+func a2lString(s string) string {
+	s = strings.Replace(s, "\\", "\\\\", -1)
+	s = strings.Replace(s, "\"", "\\\"", -1)
+	return "\"" + strings.Replace(s, "\n", " ", -1) + "\""
+}
+
+// a2lType is the data type of the elements
+func (t exportTable) a2lType() string {
+	kind := "U"
+	if t.Signed {
+		kind = "S"
+	}
+	switch t.ElementSize {
+	case 1:
+		return kind + "BYTE"
+	case 2:
+		return kind + "WORD"
+	}
+	return kind + "LONG"
+}
+
+// a2lDefault is what a table is called without a name in the definitions
+func a2lDefault(kind tables.Kind, adr int, axis bool) string {
+	prefix := "Map"
+	switch {
+	case axis:
+		prefix = "Axis"
+	case kind == tables.Array:
+		prefix = "Curve"
+	case kind == tables.Item:
+		prefix = "Value"
+	}
+	return fmt.Sprintf("%s_%X", prefix, adr)
+}
+
+// WriteA2L writes an A2L module describing the tables with their headers at addresses, and the tables defs names,
+// taking the names and conversions from defs
+func (c *Calibration) WriteA2L(w io.Writer, addresses []int, defs *Definitions) error {
+
+	list, skipped := c.exportTables("A2L", addresses, defs)
+
+	byAddress := make(map[int]exportTable)
+	for _, t := range list {
+		byAddress[t.Address] = t
+	}
+
+	// Arrays another table takes its axis from become AXIS_PTS
+	axes := make(map[int]bool)
+	for _, t := range list {
+		for _, link := range t.links() {
+			if a, ok := byAddress[link]; ok && a.decoded.Kind == tables.Array {
+				axes[link] = true
+			}
+		}
+	}
+
+	names := make(map[int]string)
+	used := make(map[string]bool)
+	for _, t := range list {
+		name := ""
+		if t.def != nil {
+			name = a2lIdentifier(t.def.Name)
+		}
+		switch {
+		case name == "":
+			name = a2lDefault(t.decoded.Kind, t.Address, axes[t.Address])
+		case used[name]:
+			name = fmt.Sprintf("%s_%X", name, t.Address)
+		}
+		used[name] = true
+		names[t.Address] = name
+	}
+
+	conversion := func(t exportTable) string {
+		if t.def == nil {
+			return "NO_COMPU_METHOD"
+		}
+		return "CM_" + names[t.Address]
+	}
+
+	layouts := make(map[string]string)
+	for _, t := range list {
+		if axes[t.Address] {
+			layouts["RL_AXIS_"+t.a2lType()] = fmt.Sprintf("AXIS_PTS_X 1 %s INDEX_INCR DIRECT", t.a2lType())
+		} else {
+			layouts["RL_"+t.a2lType()] = fmt.Sprintf("FNC_VALUES 1 %s ROW_DIR DIRECT", t.a2lType())
+		}
+	}
+	var layoutNames []string
+	for name := range layouts {
+		layoutNames = append(layoutNames, name)
+	}
+	sort.Strings(layoutNames)
+
+	fmt.Fprintf(w, "/* Written by ELMFlash, %s: %d tables, %d skipped */\n", c.name, len(list), skipped)
+	fmt.Fprintf(w, "ASAP2_VERSION 1 61\n")
+	fmt.Fprintf(w, "/begin PROJECT ELMFlash \"\"\n")
+	module := a2lIdentifier(c.strategy)
+	if module == "" {
+		module = "ELMFlash"
+	}
+	fmt.Fprintf(w, "  /begin MODULE %s %s\n", module, a2lString(c.strategy))
+	fmt.Fprintf(w, "    /begin MOD_COMMON \"\"\n")
+	fmt.Fprintf(w, "      BYTE_ORDER MSB_LAST\n")
+	fmt.Fprintf(w, "      ALIGNMENT_BYTE 1\n")
+	fmt.Fprintf(w, "      ALIGNMENT_WORD 2\n")
+	fmt.Fprintf(w, "      ALIGNMENT_LONG 2\n")
+	fmt.Fprintf(w, "    /end MOD_COMMON\n")
+	fmt.Fprintf(w, "    /begin MOD_PAR \"\"\n")
+	fmt.Fprintf(w, "      /begin MEMORY_SEGMENT Calibration %s DATA FLASH INTERN 0x%X 0x%X -1 -1 -1 -1 -1\n", a2lString(c.name), c.fileBase, c.fileSize)
+	fmt.Fprintf(w, "      /end MEMORY_SEGMENT\n")
+	fmt.Fprintf(w, "    /end MOD_PAR\n")
+
+	for _, name := range layoutNames {
+		fmt.Fprintf(w, "    /begin RECORD_LAYOUT %s\n", name)
+		fmt.Fprintf(w, "      %s\n", layouts[name])
+		fmt.Fprintf(w, "    /end RECORD_LAYOUT\n")
+	}
+
+	for _, t := range list {
+		if t.def == nil {
+			continue
+		}
+		if t.def.Formula != "" {
+			fmt.Fprintf(w, "    /begin COMPU_METHOD %s \"\" FORM \"%%8.%d\" %s\n", conversion(t), t.def.Decimals, a2lString(t.def.Units))
+			fmt.Fprintf(w, "      /begin FORMULA %s\n", a2lString(formulaWith(t.def.Formula, "X1")))
+			if t.def.Inverse != "" {
+				fmt.Fprintf(w, "        FORMULA_INV %s\n", a2lString(formulaWith(t.def.Inverse, "X1")))
+			}
+			fmt.Fprintf(w, "      /end FORMULA\n")
+			fmt.Fprintf(w, "    /end COMPU_METHOD\n")
+			continue
+		}
+		fmt.Fprintf(w, "    /begin COMPU_METHOD %s \"\" LINEAR \"%%8.%d\" %s\n", conversion(t), t.def.Decimals, a2lString(t.def.Units))
+		fmt.Fprintf(w, "      COEFFS_LINEAR %s %s\n", strconv.FormatFloat(t.def.scale(), 'g', -1, 64), strconv.FormatFloat(t.def.Add, 'g', -1, 64))
+		fmt.Fprintf(w, "    /end COMPU_METHOD\n")
+	}
+
+	for _, t := range list {
+		lo, hi := t.limits()
+		long := ""
+		if t.def != nil {
+			long = t.def.Description
+		}
+		fmt.Fprintf(w, "    /* %s */\n", t.layout())
+
+		if axes[t.Address] {
+			fmt.Fprintf(w, "    /begin AXIS_PTS %s %s 0x%X NO_INPUT_QUANTITY RL_AXIS_%s 0 %s %d %g %g\n", names[t.Address], a2lString(long), t.Start, t.a2lType(), conversion(t), t.Size, lo, hi)
+			fmt.Fprintf(w, "    /end AXIS_PTS\n")
+			continue
+		}
+
+		kind := "MAP"
+		switch t.decoded.Kind {
+		case tables.Array:
+			kind = "CURVE"
+		case tables.Item:
+			kind = "VALUE"
+		}
+		fmt.Fprintf(w, "    /begin CHARACTERISTIC %s %s %s 0x%X RL_%s 0 %s %g %g\n", names[t.Address], a2lString(long), kind, t.Start, t.a2lType(), conversion(t), lo, hi)
+
+		var rowLink, colLink int
+		if t.def != nil {
+			rowLink, _ = ParseAddress(t.def.RowAxis)
+			colLink, _ = ParseAddress(t.def.ColAxis)
+		}
+		if kind != "VALUE" {
+			writeA2LAxis(w, t.Width, byAddress, axes, names, colLink, conversion)
+		}
+		if kind == "MAP" {
+			writeA2LAxis(w, t.Height, byAddress, axes, names, rowLink, conversion)
+		}
+		fmt.Fprintf(w, "    /end CHARACTERISTIC\n")
+	}
+
+	fmt.Fprintf(w, "  /end MODULE\n")
+	_, err := fmt.Fprintf(w, "/end PROJECT\n")
+	return err
+}
+
+// writeA2LAxis writes an axis taken from the AXIS_PTS at link, or numbered 0 up if there isn't one that fits
+func writeA2LAxis(w io.Writer, count int, byAddress map[int]exportTable, axes map[int]bool, names map[int]string, link int, conversion func(exportTable) string) {
+	if a, ok := byAddress[link]; ok && axes[link] && a.Size == count {
+		lo, hi := a.limits()
+		fmt.Fprintf(w, "      /begin AXIS_DESCR COM_AXIS NO_INPUT_QUANTITY %s %d %g %g\n", conversion(a), count, lo, hi)
+		fmt.Fprintf(w, "        AXIS_PTS_REF %s\n", names[link])
+		fmt.Fprintf(w, "      /end AXIS_DESCR\n")
+		return
+	}
+	if link != 0 {
+		log(fmt.Sprintf("A2L - Axis 0x%X isn't an exported array of %d elements, numbering the axis instead", link, count), nil)
+	}
+	fmt.Fprintf(w, "      /begin AXIS_DESCR FIX_AXIS NO_INPUT_QUANTITY NO_COMPU_METHOD %d 0 %d\n", count, count-1)
+	fmt.Fprintf(w, "        FIX_AXIS_PAR 0 0 %d\n", count)
+	fmt.Fprintf(w, "      /end AXIS_DESCR\n")
+}
+
+// links are the header addresses of the tables holding the row and col breakpoints
+func (t exportTable) links() []int {
+	var links []int
+	if t.def == nil {
+		return nil
+	}
+	for _, axis := range []string{t.def.RowAxis, t.def.ColAxis} {
+		if adr, err := ParseAddress(axis); err == nil {
+			links = append(links, adr)
+		}
+	}
+	return links
+}
+
+// ExportA2L writes the A2L to path
+func (c *Calibration) ExportA2L(path string, addresses []int, defs *Definitions) error {
+	f, err := os.Create(path)
+	if err != nil {
+		log("A2L - Error creating file", err)
+		return err
+	}
+	defer f.Close()
+
+	if err := c.WriteA2L(f, addresses, defs); err != nil {
+		log("A2L - Error writing A2L", err)
+		return err
+	}
+
+	log(fmt.Sprintf("A2L - wrote %s", path), nil)
+
+	return nil
+}
+
+// Import
+////////////////..........
+
+// headerAt finds the table whose data starts at adr
+func (c *Calibration) headerAt(adr int) (*tables.Table, bool) {
+	for _, size := range []int{8, 4, 1} {
+		t, err := tables.Decode(c.block, adr-size)
+		if err == nil && t.Start == adr {
+			return t, true
+		}
+	}
+	return nil, false
+}
+
+// ImportA2L seeds defs with the names, descriptions, conversions and axes of the CHARACTERISTICs and AXIS_PTS in
+// a2l whose data starts where one of the calibration's tables does. What defs already has is kept. It returns the
+// number of definitions added to, and of A2L tables that aren't in the calibration. New definitions go under the
+// calibration's strategy.
+func (c *Calibration) ImportA2L(a2l *A2LNode, defs *Definitions) (seeded int, missing int) {
+
+	methods := make(map[string]*A2LNode)
+	for _, n := range a2l.Find("COMPU_METHOD") {
+		methods[n.Args[0]] = n
+	}
+
+	objects := append(a2l.Find("AXIS_PTS"), a2l.Find("CHARACTERISTIC")...)
+
+	// Where the AXIS_PTS headers are, for the CHARACTERISTICs that refer to them
+	headers := make(map[*A2LNode]*tables.Table)
+	axisHeaders := make(map[string]int)
+	for _, n := range objects {
+		adr := n.Args[3]
+		if n.Block == "AXIS_PTS" {
+			adr = n.Args[2]
+		}
+		start, err := strconv.ParseInt(adr, 0, 64)
+		if err != nil {
+			log(fmt.Sprintf("A2L - %s has a bad address %q", n.Args[0], adr), nil)
+			missing++
+			continue
+		}
+		t, ok := c.headerAt(int(start))
+		if !ok {
+			log(fmt.Sprintf("A2L - %s at 0x%X isn't a table in %s", n.Args[0], start, c.name), nil)
+			missing++
+			continue
+		}
+		headers[n] = t
+		if n.Block == "AXIS_PTS" {
+			axisHeaders[n.Args[0]] = t.Address
+		}
+	}
+
+	for _, n := range objects {
+		t, ok := headers[n]
+		if !ok {
+			continue
+		}
+
+		def := defs.Lookup(c.strategy, t.Address)
+		if def == nil {
+			def = &TableDef{Address: t.Address}
+		}
+		before := *def
+
+		if def.Name == "" && n.Args[0] != a2lDefault(t.Kind, t.Address, n.Block == "AXIS_PTS") {
+			def.Name = n.Args[0]
+		}
+		if def.Description == "" {
+			def.Description = n.Args[1]
+		}
+		if m, ok := methods[n.Args[6]]; ok {
+			seedConversion(def, m)
+		}
+
+		// The first axis is X, the cols
+		for i, axis := range n.Find("AXIS_DESCR") {
+			ref := axis.Option("AXIS_PTS_REF", 1)
+			if ref == nil || i > 1 {
+				continue
+			}
+			adr, ok := axisHeaders[ref[0]]
+			if !ok {
+				continue
+			}
+			link := fmt.Sprintf("0x%X", adr)
+			if i == 0 && def.ColAxis == "" {
+				def.ColAxis = link
+			}
+			if i == 1 && def.RowAxis == "" {
+				def.RowAxis = link
+			}
+		}
+
+		if *def != before {
+			if defs.Lookup(c.strategy, t.Address) == nil {
+				defs.Add(c.strategy, def)
+			}
+			seeded++
+		}
+	}
+
+	return seeded, missing
+}
+
+// seedConversion takes the units, decimals and scaling of a linear or formula COMPU_METHOD, if def has none yet
+func seedConversion(def *TableDef, m *A2LNode) {
+	if def.Units == "" {
+		def.Units = m.Args[4]
+	}
+	if format := strings.SplitN(m.Args[3], ".", 2); def.Decimals == 0 && len(format) == 2 {
+		def.Decimals, _ = strconv.Atoi(format[1])
+	}
+	if def.Scale != 0 || def.Add != 0 || def.Formula != "" {
+		return
+	}
+
+	coeffs := func(name string, count int) []float64 {
+		var fs []float64
+		for _, s := range m.Option(name, count) {
+			f, err := strconv.ParseFloat(s, 64)
+			if err != nil {
+				return nil
+			}
+			fs = append(fs, f)
+		}
+		return fs
+	}
+
+	switch m.Args[2] {
+	case "LINEAR":
+		// physical = a * raw + b
+		if k := coeffs("COEFFS_LINEAR", 2); k != nil {
+			def.Scale, def.Add = k[0], k[1]
+		}
+	case "FORM":
+		for _, f := range m.Find("FORMULA") {
+			if checkFormula(f.Args[0]) != nil {
+				continue
+			}
+			def.Formula = formulaWith(f.Args[0], "X")
+			if inv := f.Option("FORMULA_INV", 1); inv != nil && checkFormula(inv[0]) == nil {
+				def.Inverse = formulaWith(inv[0], "X")
+			}
+		}
+	case "RAT_FUNC":
+		// raw = (a * physical² + b * physical + c) / (d * physical² + e * physical + f), linear when a, d and e are 0
+		if k := coeffs("COEFFS", 6); k != nil && k[0] == 0 && k[3] == 0 && k[4] == 0 && k[1] != 0 {
+			def.Scale, def.Add = k[5]/k[1], -k[2]/k[1]
+		}
+	}
+}
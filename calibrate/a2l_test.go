@@ -0,0 +1,156 @@
+package calibrate
+
+import (
+	"bytes"
+	"testing"
+)
+
+// A2L Tests
+////////////////..........
+
+func TestParseA2L(t *testing.T) {
+	src := `ASAP2_VERSION 1 61 /* a comment with /begin in it */
+/begin PROJECT P "a \"quoted\" ""name"""
+  /begin MODULE M ""
+    // line comment /end MODULE
+    /begin COMPU_METHOD CM "" LINEAR "%8.2" "deg"
+      COEFFS_LINEAR 0.5 -10
+    /end COMPU_METHOD
+    /begin UNKNOWN_BLOCK a b c
+    /end UNKNOWN_BLOCK
+  /end MODULE
+/end PROJECT`
+
+	root, err := ParseA2L(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(root.Tokens) != 3 || len(root.Children) != 1 || root.Children[0].Args[1] != `a "quoted" "name"` {
+		t.Fatalf("root %+v", root)
+	}
+	methods := root.Find("COMPU_METHOD")
+	if len(methods) != 1 || methods[0].Args[4] != "deg" {
+		t.Fatalf("COMPU_METHOD %+v", methods)
+	}
+	if k := methods[0].Option("COEFFS_LINEAR", 2); len(k) != 2 || k[1] != "-10" {
+		t.Errorf("COEFFS_LINEAR %v", k)
+	}
+	if methods[0].Option("COEFFS", 6) != nil {
+		t.Error("COEFFS found")
+	}
+	if u := root.Find("UNKNOWN_BLOCK"); len(u) != 1 || len(u[0].Tokens) != 3 {
+		t.Errorf("unknown block %+v", u)
+	}
+
+	for _, bad := range []string{
+		`/begin PROJECT P ""`,
+		`/begin PROJECT P "" /end MODULE`,
+		`/end PROJECT`,
+		`/begin COMPU_METHOD CM "" /end COMPU_METHOD`,
+		`/begin PROJECT P "unclosed`,
+		`/* unclosed`,
+	} {
+		if _, err := ParseA2L(bad); err == nil {
+			t.Errorf("%q parsed", bad)
+		}
+	}
+}
+
+func TestA2LRoundTrip(t *testing.T) {
+	c := loadMP3(t)
+
+	defs := &Definitions{Tables: map[string]*TableDef{
+		"0x10AA60": {Address: 0x10AA60, Name: "Spark Advance", Description: "Base spark", Units: "deg", Scale: 0.5, Add: -10, Decimals: 1, ColAxis: "0x10B06E"},
+		"0x10B06E": {Address: 0x10B06E, Name: "RPM", Units: "rpm", Formula: "X*50", Inverse: "X/50"},
+	}}
+
+	var b bytes.Buffer
+	if err := c.WriteA2L(&b, []int{0x10AB3A, 0x10A3BE}, defs); err != nil {
+		t.Fatal(err)
+	}
+	a2l, err := ParseA2L(b.String())
+	if err != nil {
+		t.Fatalf("%v\n%s", err, b.String())
+	}
+
+	chars := make(map[string]*A2LNode)
+	for _, n := range a2l.Find("CHARACTERISTIC") {
+		chars[n.Args[0]] = n
+	}
+	spark, ok := chars["Spark_Advance"]
+	if !ok || len(chars) != 3 || chars["Map_10AB3A"] == nil || chars["Value_10A3BE"] == nil {
+		t.Fatalf("characteristics %v", chars)
+	}
+	if spark.Args[2] != "MAP" || spark.Args[3] != "0x10AA68" || spark.Args[6] != "CM_Spark_Advance" {
+		t.Errorf("Spark_Advance %v", spark.Args)
+	}
+	axes := spark.Find("AXIS_DESCR")
+	if len(axes) != 2 || axes[0].Args[0] != "COM_AXIS" || axes[0].Option("AXIS_PTS_REF", 1)[0] != "RPM" || axes[1].Args[0] != "FIX_AXIS" || axes[1].Args[3] != "15" {
+		t.Errorf("axes %+v %+v", axes[0], axes[1])
+	}
+	pts := a2l.Find("AXIS_PTS")
+	if len(pts) != 1 || pts[0].Args[0] != "RPM" || pts[0].Args[2] != "0x10B072" || pts[0].Args[7] != "14" {
+		t.Errorf("AXIS_PTS %+v", pts)
+	}
+
+	// Importing it back seeds the definitions it came from, and nothing for the unnamed tables
+	seeded := &Definitions{Tables: make(map[string]*TableDef)}
+	n, missing := c.ImportA2L(a2l, seeded)
+	if n != 2 || missing != 0 || len(seeded.Tables) != 0 || len(seeded.Strategies["DXAI4U0"]) != 2 {
+		t.Fatalf("seeded %d, missing %d: %+v", n, missing, seeded.Strategies)
+	}
+	got := seeded.Lookup("DXAI4U0", 0x10AA60)
+	want := *defs.Tables["0x10AA60"]
+	want.Name = "Spark_Advance"
+	if got == nil || *got != want {
+		t.Errorf("0x10AA60: got %+v, want %+v", got, want)
+	}
+	if rpm := seeded.Lookup("DXAI4U0", 0x10B06E); rpm == nil || rpm.Name != "RPM" || rpm.Formula != "X*50" || rpm.Inverse != "X/50" || rpm.Units != "rpm" {
+		t.Errorf("0x10B06E: %+v", rpm)
+	}
+
+	// What's already defined is kept
+	if n, _ := c.ImportA2L(a2l, defs); n != 0 || defs.Tables["0x10AA60"].Name != "Spark Advance" {
+		t.Errorf("seeded %d over existing definitions", n)
+	}
+}
+
+func TestImportA2L(t *testing.T) {
+	c := loadMP3(t)
+
+	// Another tool's conversion: raw = (4 * physical + 40) / 2
+	a2l, err := ParseA2L(`
+/begin COMPU_METHOD Spark "" RAT_FUNC "%4.1" "deg"
+  COEFFS 0 4 40 0 0 2
+/end COMPU_METHOD
+/begin CHARACTERISTIC KFZW "Ignition" MAP 0x10AA68 L 0 Spark -10 117.5
+/end CHARACTERISTIC
+/begin CHARACTERISTIC Nowhere "" VALUE 0x10AA69 L 0 Spark 0 1
+/end CHARACTERISTIC
+/begin COMPU_METHOD Lambda "" FORM "%5.3" "-"
+  /begin FORMULA "X1/128"
+    FORMULA_INV "X1*128"
+  /end FORMULA
+/end COMPU_METHOD
+/begin CHARACTERISTIC Lambda_Target "" MAP 0x10AB42 L 0 Lambda 0 2
+/end CHARACTERISTIC`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defs := &Definitions{Tables: make(map[string]*TableDef)}
+	n, missing := c.ImportA2L(a2l, defs)
+	if n != 2 || missing != 1 {
+		t.Fatalf("seeded %d, missing %d", n, missing)
+	}
+	def := defs.Strategies["DXAI4U0"]["0x10AA60"]
+	if def == nil || def.Name != "KFZW" || def.Description != "Ignition" || def.Units != "deg" || def.Decimals != 1 {
+		t.Fatalf("0x10AA60: %+v", def)
+	}
+	if def.Physical(60) != 20 {
+		t.Errorf("scale %v add %v", def.Scale, def.Add)
+	}
+	if lambda := defs.Lookup("DXAI4U0", 0x10AB3A); lambda == nil || lambda.Formula != "X/128" || lambda.Inverse != "X*128" || lambda.Decimals != 3 {
+		t.Errorf("0x10AB3A: %+v", lambda)
+	}
+}
@@ -4,15 +4,20 @@ import (
 	"encoding/json"
 	"fmt"
 	"html/template"
+	"io"
+	"io/ioutil"
 	"net/http"
-	"os"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/go-chi/chi"
 	"github.com/go-chi/chi/middleware"
 	"github.com/goware/cors"
 	"github.com/murdinc/ELMFlash/hexstuff"
+	"github.com/murdinc/ELMFlash/image"
+	"github.com/murdinc/ELMFlash/tables"
 	"github.com/toqueteos/webbrowser"
 )
 
@@ -21,7 +26,15 @@ import (
 const debug = false
 
 type Calibration struct {
-	block []byte
+	name     string
+	strategy string
+	block    []byte
+	calStart int
+	fileBase int // address of the first byte of the calibration file
+	fileSize int
+	image    *image.Image
+	defs     *Definitions
+	out      string // where the web page writes the edits
 }
 
 type Content struct {
@@ -36,68 +49,40 @@ type Content struct {
 	ClassFormURL string
 }
 
-var calibrations = map[string]string{
-	"msp":   "MSP.BIN",
-	"mp3":   "MP3.BIN",
-	"mp3x2": "MP3x2.BIN",
-	"p5":    "P5.BIN",
-	"pre":   "PRE2.BIN",
-}
-
-func New(calName string) *Calibration {
-	controller := new(Calibration)
-
-	// Pull in the stuff before the calibration file
-	preCalFile := "./calibrations/" + calibrations["pre"]
-	log(fmt.Sprintf("Disassemble - Pre-calibration File: %s", preCalFile), nil)
-
-	p, err := os.Open(preCalFile)
-	pi, err := p.Stat()
-	preFileSize := pi.Size()
-
-	// Pull in the Calibration file
-	calFile := "./calibrations/" + calibrations[calName]
-	log(fmt.Sprintf("Disassemble - Calibration File: %s", calFile), nil)
-
-	f, err := os.Open(calFile)
-	fi, err := f.Stat()
-	fileSize := fi.Size()
+// New loads a calibration by catalog name or path behind the default pre-calibration
+func New(calName string) (*Calibration, error) {
+	img, err := image.Load(calName)
 	if err != nil {
-		log("Disassemble - Error opening file", err)
-		os.Exit(1)
+		log("Calibrate - Error loading calibration", err)
+		return nil, err
 	}
 
-	log(fmt.Sprintf("Disassemble - [%s] is %d bytes long", calibrations["pre"], preFileSize), nil)
-	log(fmt.Sprintf("Disassemble - [%s] is %d bytes long", calibrations[calName], fileSize), nil)
+	controller := new(Calibration)
+	controller.name = calName
+	controller.strategy = img.Strategy
+	controller.block = img.Block
+	controller.calStart = img.CalStart
+	controller.fileBase = img.Layout.Base - img.Layout.Offset
+	controller.fileSize = img.Layout.Size
+	controller.image = img
+
+	return controller, nil
+}
 
-	// Make some buffers
-	preBlock := make([]byte, preFileSize)
-	calBlock := make([]byte, fileSize)
+// Use names and scales the tables GetTable returns by defs
+func (c *Calibration) Use(defs *Definitions) {
+	c.defs = defs
+}
 
-	// Read in all the bytes
-	n, err := p.Read(preBlock)
-	if err != nil {
-		log("Disassemble - Error reading calibration", err)
-		os.Exit(1)
-	}
-	log(fmt.Sprintf("Disassemble - reading 0x%X bytes from pre-calibration file.", n), nil)
+// Calibrate serves the tables of a calibration, named and scaled by defs, writing the calibration to out after every edit
+func Calibrate(calName string, defs *Definitions, out string, devMode bool) {
 
-	n, err = f.Read(calBlock)
+	calibration, err := New(calName)
 	if err != nil {
-		log("Disassemble - Error reading calibration", err)
-		os.Exit(1)
+		return
 	}
-
-	log(fmt.Sprintf("Disassemble - reading 0x%X bytes from calibration file.", n), nil)
-
-	block := append(preBlock, calBlock...)
-
-	controller.block = block
-
-	return controller
-}
-
-func Calibrate(devMode bool) {
+	calibration.Use(defs)
+	calibration.out = out
 
 	guiLocation := "calibrate/ui/"
 
@@ -121,8 +106,9 @@ func Calibrate(devMode bool) {
 	FileServer(r, "/static", http.Dir(guiLocation))
 
 	// Index and Dashboard
-	r.Get("/", index)
-	r.Get("/table/:type/:address", getTable)
+	r.Get("/", calibration.index)
+	r.Get("/table/{address}", calibration.getTable)
+	r.Post("/table/{address}", calibration.setValue)
 
 	if !devMode {
 		webbrowser.Open("http://localhost:8080/") // TODO race condition?
@@ -154,7 +140,7 @@ func FileServer(r chi.Router, path string, root http.FileSystem) {
 }
 
 func GetMaps(block []byte) []int {
-	regex := string(0x00) + "[" + string(0x00) + "-" + string(0x05) + "]" + string(0x00) + "[" + string(0x00) + "-" + string(0x0F) + "]"
+	regex := "\x00[\x00-\x05]\x00[\x00-\x0F]"
 	re := regexp.MustCompile(regex)
 	matches := re.FindAllIndex(block, -1)
 
@@ -218,7 +204,7 @@ func GetMaps(block []byte) []int {
 	return addresses
 }
 
-func index(w http.ResponseWriter, r *http.Request) {
+func (c *Calibration) index(w http.ResponseWriter, r *http.Request) {
 
 	t, err := template.ParseFiles("calibrate/ui/templates/calibrate.html")
 	if err != nil {
@@ -228,23 +214,40 @@ func index(w http.ResponseWriter, r *http.Request) {
 
 	payload := make(map[string]interface{})
 
-	var tables []Table
-
-	calName := "mp3"
-	calibration := New(calName)
+	var list []Table
 
-	hs, _ := hexstuff.New(calName)
+	hs, err := hexstuff.New(c.name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
 	addresses, _ := hs.TestM1()
 
+	// The defined tables too, the axes among them
+	seen := make(map[int]bool)
+	for _, address := range addresses {
+		seen[address] = true
+	}
+	for _, address := range c.defs.Addresses(c.strategy) {
+		if !seen[address] {
+			addresses = append(addresses, address)
+		}
+	}
+	sort.Ints(addresses)
+
 	for _, address := range addresses {
-		table := calibration.GetTable(address)
+		table, err := c.GetTable(address)
+		if err != nil {
+			log(fmt.Sprintf("Calibrate - Skipping table at 0x%X", address), err)
+			continue
+		}
 
-		tables = append(tables, *table)
+		list = append(list, *table)
 
 	}
 
-	payload["Tables"] = tables
+	payload["Tables"] = list
 	payload["Errors"] = nil
 
 	/*ctx.Render("calibrate.html", Content{Title: "Calibrate", Payload: payload, Calibration: "MSP/MP3", RenderLayout: true})*/
@@ -276,24 +279,59 @@ type Table struct {
 	H8    int
 	H8Str string
 
+	Kind        string
+	ElementSize int // bytes
+	Signed      bool
+	Packing     string
+	RowAxis     int
+	ColAxis     int
+
 	Size  int
 	Start int
 	End   int
 	Data  []int
+
+	// From the definitions
+	Name     string
+	Category string
+	Units    string
+	Title    string // "Spark Advance (deg) vs RPM × Load", or the address if the table isn't defined
+	Decimals int
+	Values   []float64 // Data in Units
+	XAxis    Axis      // the cols
+	YAxis    Axis      // the rows
+
+	decoded *tables.Table
 }
 
-func getTable(w http.ResponseWriter, r *http.Request) {
+// An Axis is what the rows or cols of a table are looked up by
+type Axis struct {
+	Name     string
+	Units    string
+	Decimals int
+	Values   []float64 // the breakpoints, or 0 up if the definitions don't name the table holding them
+}
+
+func (c *Calibration) getTable(w http.ResponseWriter, r *http.Request) {
 	payload := make(map[string]interface{})
 
-	calibration := New("mp3")
-	table := calibration.GetTable(0x10AA60)
+	address, err := ParseAddress(chi.URLParam(r, "address"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	table, err := c.GetTable(address)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
 	payload["Table"] = table
 	payload["Errors"] = nil
 
 	/*ctx.JSONP(iris.StatusOK, "callbackName", Content{Title: "Calibrate", Payload: payload, Calibration: "MSP/MP3", RenderLayout: true})*/
 
-	js, err := json.Marshal(Content{Title: "Calibrate", Payload: payload, Calibration: "MSP/MP3", RenderLayout: true})
+	js, err := json.Marshal(Content{Title: "Calibrate", Payload: payload, Calibration: c.name, RenderLayout: true})
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -304,103 +342,237 @@ func getTable(w http.ResponseWriter, r *http.Request) {
 
 }
 
-// 0x10AA60
-func (c *Calibration) GetTable(index int) *Table {
+// setValue takes an edited cell from the page, the row, col and value in the table's units
+func (c *Calibration) setValue(w http.ResponseWriter, r *http.Request) {
+	address, err := ParseAddress(chi.URLParam(r, "address"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	row, err1 := strconv.Atoi(r.FormValue("row"))
+	col, err2 := strconv.Atoi(r.FormValue("col"))
+	value, err3 := strconv.ParseFloat(strings.TrimSpace(r.FormValue("value")), 64)
+	if err1 != nil || err2 != nil || err3 != nil {
+		http.Error(w, "row, col and value have to be numbers", http.StatusBadRequest)
+		return
+	}
+
+	raw, err := c.SetValue(address, row, col, value)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := c.Save(c.out); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log(fmt.Sprintf("Calibrate - 0x%X [%d, %d] = %v (raw %d), wrote %s", address, row, col, value, raw, c.out), nil)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GetTable decodes the table with its header at index, e.g. 0x10AA60, and applies its definition
+func (c *Calibration) GetTable(index int) (*Table, error) {
 
-	h1 := int(c.block[index])
-	h1Str := fmt.Sprintf("0x%.2X", c.block[index])
+	t, err := tables.Decode(c.block, index)
+	if err != nil {
+		return nil, err
+	}
 
-	h2 := int(c.block[index+1])
-	h2Str := fmt.Sprintf("0x%.2X", c.block[index+1])
+	table := new(Table)
 
-	h3 := int(c.block[index+2])
-	h3Str := fmt.Sprintf("0x%.2X", c.block[index+2])
+	// The raw header bytes, arrays and items have fewer than 8
+	h := make([]int, 8)
+	for i, b := range t.Header {
+		h[i] = int(b)
+	}
 
-	h4 := int(c.block[index+3])
-	h4Str := fmt.Sprintf("0x%.2X", c.block[index+3])
+	table.H1 = h[0]
+	table.H1Str = fmt.Sprintf("0x%.2X", h[0])
 
-	h5 := int(c.block[index+4]) // rows
-	h5Str := fmt.Sprintf("0x%.2X", c.block[index+4])
+	table.H2 = h[1]
+	table.H2Str = fmt.Sprintf("0x%.2X", h[1])
 
-	h6 := int(c.block[index+5]) // cols
-	h6Str := fmt.Sprintf("0x%.2X", c.block[index+5])
+	table.H3 = h[2]
+	table.H3Str = fmt.Sprintf("0x%.2X", h[2])
 
-	h7 := int(c.block[index+6])
-	h7Str := fmt.Sprintf("0x%.2X", c.block[index+6])
+	table.H4 = h[3]
+	table.H4Str = fmt.Sprintf("0x%.2X", h[3])
 
-	h8 := int(c.block[index+7])
-	h8Str := fmt.Sprintf("0x%.2X", c.block[index+7])
+	table.H5 = h[4] // rows
+	table.H5Str = fmt.Sprintf("0x%.2X", h[4])
 
-	height := int(c.block[index+4]) + 1
-	width := int(c.block[index+5]) + 1
+	table.H6 = h[5] // cols
+	table.H6Str = fmt.Sprintf("0x%.2X", h[5])
 
-	// axe flip™
-	if h5&0x10 == 0x10 {
-		width, height = height, width
-	}
+	table.H7 = h[6]
+	table.H7Str = fmt.Sprintf("0x%.2X", h[6])
 
-	size := width * height
-	start := index + 8
-	end := start + size
+	table.H8 = h[7]
+	table.H8Str = fmt.Sprintf("0x%.2X", h[7])
 
-	table := new(Table)
+	table.Kind = t.Kind.String()
+	table.ElementSize = t.Width
+	table.Signed = t.Signed
+	table.Packing = t.Packing.String()
+	table.RowAxis = t.RowAxis
+	table.ColAxis = t.ColAxis
 
-	data := make([]int, size)
+	table.Size = t.Size()
+	table.Start = t.Start
+	table.End = t.End
 
-	for i := range data {
+	table.Address = index
+	table.AddressStr = fmt.Sprintf("0x%.6X", index)
+	table.EndStr = fmt.Sprintf("0x%.6X", t.End)
+	table.Height = t.Rows
+	table.Width = t.Cols
+	table.Data = t.Data
+	table.decoded = t
 
-		val := int(c.block[start+i])
-		/*
-			if h7_1 == 1 && i%2 == 0 {
-				val = int(c.block[start+i]) >> 4
-				val2 := int(c.block[start+i]) & 0xF
-				data[i] = val
-				data[i+1] = val2
+	c.define(table)
 
-			} else if h7_1 == 0 {
-				data[i] = val
-			}
-		*/
-		data[i] = val
-	}
+	return table, nil
 
-	table.H1 = h1
-	table.H1Str = h1Str
+}
 
-	table.H2 = h2
-	table.H2Str = h2Str
+// define names and scales a table by its definition, if it has one
+func (c *Calibration) define(table *Table) {
+	def := c.defs.Lookup(c.strategy, table.Address)
 
-	table.H3 = h3
-	table.H3Str = h3Str
+	table.Values = make([]float64, len(table.Data))
+	for i, raw := range table.Data {
+		table.Values[i] = def.Physical(raw)
+	}
+	table.XAxis = c.axis(def, table.Width, table.ColAxis, false)
+	table.YAxis = c.axis(def, table.Height, table.RowAxis, true)
+
+	table.Name = table.AddressStr
+	if def != nil {
+		table.Category, table.Units, table.Decimals = def.Category, def.Units, def.Decimals
+		if def.Name != "" {
+			table.Name = def.Name
+		}
+	}
+
+	table.Title = table.Name
+	if table.Units != "" {
+		table.Title += " (" + table.Units + ")"
+	}
+	switch table.decoded.Kind {
+	case tables.Map:
+		if def != nil && (def.RowAxis != "" || def.ColAxis != "") {
+			table.Title += " vs " + table.YAxis.Name + " × " + table.XAxis.Name
+		}
+	case tables.Array:
+		if def != nil && def.ColAxis != "" {
+			table.Title += " vs " + table.XAxis.Name
+		}
+	}
+}
+
+// axis reads the breakpoints of the rows or cols from the table def names for them, numbering them 0 up if it
+// doesn't name one that fits
+func (c *Calibration) axis(def *TableDef, count int, input int, rows bool) Axis {
+	axis := Axis{Name: fmt.Sprintf("axis 0x%.2X", input)}
+	for i := 0; i < count; i++ {
+		axis.Values = append(axis.Values, float64(i))
+	}
+	if def == nil {
+		return axis
+	}
 
-	table.H4 = h4
-	table.H4Str = h4Str
+	link := def.ColAxis
+	if rows {
+		link = def.RowAxis
+	}
+	address, err := ParseAddress(link)
+	if link == "" || err != nil {
+		return axis
+	}
+	t, err := tables.Decode(c.block, address)
+	if err != nil || t.Size() != count {
+		log(fmt.Sprintf("Calibrate - Axis %s of 0x%X isn't a table of %d elements", link, def.Address, count), err)
+		return axis
+	}
 
-	table.H5 = h5
-	table.H5Str = h5Str
+	axis.Name = link
+	adef := c.defs.Lookup(c.strategy, address)
+	if adef != nil {
+		if adef.Name != "" {
+			axis.Name = adef.Name
+		}
+		axis.Units, axis.Decimals = adef.Units, adef.Decimals
+	}
+	for i, raw := range t.Data {
+		axis.Values[i] = adef.Physical(raw)
+	}
+	return axis
+}
 
-	table.H6 = h6
-	table.H6Str = h6Str
+// SetValue converts value back to raw by the table's definition and writes it to the element at row, col. It
+// returns the raw value written.
+func (c *Calibration) SetValue(index, row, col int, value float64) (int, error) {
+	t, err := tables.Decode(c.block, index)
+	if err != nil {
+		return 0, err
+	}
+	if t.Packing != tables.Packed {
+		return 0, fmt.Errorf("0x%X: can't write %s data", index, t.Packing)
+	}
+	if row < 0 || row >= t.Rows || col < 0 || col >= t.Cols {
+		return 0, fmt.Errorf("0x%X: no element at %d, %d in %d x %d", index, row, col, t.Rows, t.Cols)
+	}
 
-	table.H7 = h7
-	table.H7Str = h7Str
+	def := c.defs.Lookup(c.strategy, index)
+	raw, err := def.Raw(value, t.Width, t.Signed)
+	if err != nil {
+		return 0, fmt.Errorf("0x%X: %w", index, err)
+	}
 
-	table.H8 = h8
-	table.H8Str = h8Str
+	at := t.Start + (row*t.Cols+col)*t.Width
+	for i := 0; i < t.Width; i++ {
+		c.block[at+i] = byte(raw >> uint(8*i))
+	}
+	return raw, nil
+}
 
-	table.Size = size
-	table.Start = start
-	table.End = end
+// Save writes the calibration to path in the layout it was read in, edits and all
+func (c *Calibration) Save(path string) error {
+	return ioutil.WriteFile(path, c.image.Bytes(), 0644)
+}
 
-	table.Address = index
-	table.AddressStr = fmt.Sprintf("0x%.6X", index)
-	table.EndStr = fmt.Sprintf("0x%.6X", end)
-	table.Height = height
-	table.Width = width
-	table.Data = data
+// WriteTable prints a table in its units, the cols across and the rows down
+func WriteTable(w io.Writer, t *Table) {
+	fmt.Fprintf(w, "%s\n", t.Title)
+	fmt.Fprintf(w, "%s %d x %d at %s", t.Kind, t.Height, t.Width, t.AddressStr)
+	if t.Category != "" {
+		fmt.Fprintf(w, ", %s", t.Category)
+	}
+	fmt.Fprintf(w, "\n\n")
 
-	return table
+	format := func(v float64, decimals int) string {
+		return strconv.FormatFloat(v, 'f', decimals, 64)
+	}
 
+	if t.decoded.Kind != tables.Item {
+		fmt.Fprintf(w, "%10s", "")
+		for _, x := range t.XAxis.Values {
+			fmt.Fprintf(w, "%10s", format(x, t.XAxis.Decimals))
+		}
+		fmt.Fprintf(w, "\n")
+	}
+	for row := 0; row < t.Height; row++ {
+		if t.decoded.Kind == tables.Map {
+			fmt.Fprintf(w, "%10s", format(t.YAxis.Values[row], t.YAxis.Decimals))
+		} else {
+			fmt.Fprintf(w, "%10s", "")
+		}
+		for col := 0; col < t.Width; col++ {
+			fmt.Fprintf(w, "%10s", format(t.Values[row*t.Width+col], t.Decimals))
+		}
+		fmt.Fprintf(w, "\n")
+	}
 }
 
 func log(kind string, err error) {
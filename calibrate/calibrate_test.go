@@ -0,0 +1,185 @@
+package calibrate
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/murdinc/ELMFlash/image"
+	"github.com/murdinc/ELMFlash/tables"
+)
+
+// Calibration Tests
+////////////////..........
+
+func loadMP3(t *testing.T) *Calibration {
+	dir, err := filepath.Abs("../calibrations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	image.Dir = dir
+
+	c, err := New("mp3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestGetTableDefined(t *testing.T) {
+	c := loadMP3(t)
+
+	defs := &Definitions{Strategies: map[string]map[string]*TableDef{"DXAI4U0": {
+		"0x10AA60": {Address: 0x10AA60, Name: "Spark Advance", Category: "Spark", Units: "deg", Scale: 0.5, Add: -10, Decimals: 1, RowAxis: "0x10A588", ColAxis: "0x10B06E"},
+		// Any tables of 15 and 14 elements will do for the axes
+		"0x10A588": {Address: 0x10A588, Name: "Load"},
+		"0x10B06E": {Address: 0x10B06E, Name: "RPM", Units: "rpm", Formula: "X*50"},
+	}}}
+	c.Use(defs)
+
+	table, err := c.GetTable(0x10AA60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if table.Title != "Spark Advance (deg) vs Load × RPM" || table.Category != "Spark" || table.Decimals != 1 {
+		t.Errorf("title %q, category %q", table.Title, table.Category)
+	}
+	if len(table.Values) != 15*14 || table.Values[0] != 38 {
+		t.Errorf("values %v", table.Values)
+	}
+
+	rpm, err := c.GetTable(0x10B06E)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if table.XAxis.Name != "RPM" || table.XAxis.Units != "rpm" || len(table.XAxis.Values) != 14 || table.XAxis.Values[3] != float64(rpm.Data[3]*50) {
+		t.Errorf("x axis %+v", table.XAxis)
+	}
+	if table.YAxis.Name != "Load" || len(table.YAxis.Values) != 15 {
+		t.Errorf("y axis %+v", table.YAxis)
+	}
+
+	// Not defined, the raw values numbered 0 up
+	table, err = c.GetTable(0x10AB3A)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if table.Title != "0x10AB3A" || table.XAxis.Name != "axis 0x05" || table.YAxis.Values[4] != 4 || table.Values[5] != float64(table.Data[5]) {
+		t.Errorf("undefined table: %q %+v %+v", table.Title, table.XAxis, table.YAxis)
+	}
+
+	var b bytes.Buffer
+	WriteTable(&b, table)
+	if lines := strings.Split(b.String(), "\n"); lines[0] != "0x10AB3A" || len(lines) != 3+1+5+1 {
+		t.Errorf("WriteTable:\n%s", b.String())
+	}
+}
+
+func TestSetValue(t *testing.T) {
+	c := loadMP3(t)
+	c.Use(&Definitions{Tables: map[string]*TableDef{
+		"0x10AA60": {Address: 0x10AA60, Name: "Spark Advance", Scale: 0.5, Add: -10},
+	}})
+
+	raw, err := c.SetValue(0x10AA60, 1, 2, 25)
+	if err != nil || raw != 70 {
+		t.Fatalf("raw %d %v", raw, err)
+	}
+	table, err := c.GetTable(0x10AA60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if table.Data[1*14+2] != 70 || table.Values[1*14+2] != 25 {
+		t.Errorf("set %d %v", table.Data[1*14+2], table.Values[1*14+2])
+	}
+
+	// 16-bit, little endian
+	if _, err := c.SetValue(0x10C60E, 14, 7, 0x1234); err != nil {
+		t.Fatal(err)
+	}
+	if table, _ := c.GetTable(0x10C60E); table.Data[len(table.Data)-1] != 0x1234 {
+		t.Errorf("16-bit set 0x%X", table.Data[len(table.Data)-1])
+	}
+
+	for _, bad := range []struct {
+		address, row, col int
+		value             float64
+	}{
+		{0x10AA60, 1, 2, 118}, // over 255 raw
+		{0x10AA60, 15, 0, 0},
+		{0x10AA60, 0, -1, 0},
+		{0x10AE62, 0, 0, 0}, // escaped, can't be written in place
+		{0x10AA68, 0, 0, 0},
+	} {
+		if _, err := c.SetValue(bad.address, bad.row, bad.col, bad.value); err == nil {
+			t.Errorf("%+v set", bad)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "CALIBRATED.BIN")
+	if err := c.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	saved, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(saved) != 0x78000 || saved[0x10AA68+16-0x108000] != 70 {
+		t.Errorf("saved 0x%X bytes", len(saved))
+	}
+}
+
+// Saving keeps the layout the calibration was read in, so exported offsets still line up with the file
+func TestSaveLayouts(t *testing.T) {
+	loadMP3(t)
+
+	for _, test := range []struct {
+		name, layout string
+		address      int
+		mirror       int // offset of the calibration's second copy, 0 if there's one
+	}{
+		{"BACK.MSP.BIN", "196ea-flash", 0x1093F4, 0},
+		{"mp3x2", "196ea-doubled", 0x10AA60, 0x80000},
+	} {
+		c, err := New(test.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Use(&Definitions{})
+		_, original, err := image.ReadFile(test.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := c.SetValue(test.address, 0, 0, 0x11); err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(t.TempDir(), "CALIBRATED.BIN")
+		if err := c.Save(path); err != nil {
+			t.Fatal(err)
+		}
+		saved, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if l, err := image.Detect(saved); err != nil || l.Name != test.layout {
+			t.Errorf("%s: saved as %v, %v", test.name, l, err)
+			continue
+		}
+		table, _ := tables.Decode(c.block, test.address)
+		at := table.Start - c.fileBase
+		if saved[at] != 0x11 || (test.mirror != 0 && saved[at-test.mirror] != 0x11) {
+			t.Errorf("%s: the edit isn't at 0x%X", test.name, at)
+		}
+		saved[at] = original[at]
+		if test.mirror != 0 {
+			saved[at-test.mirror] = original[at-test.mirror]
+		}
+		if !bytes.Equal(saved, original) {
+			t.Errorf("%s: more than the edit changed", test.name)
+		}
+	}
+}
@@ -0,0 +1,274 @@
+package calibrate
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Table Definitions
+////////////////..........
+
+// A TableDef is what has been worked out about a table: its name and how its raw values scale
+type TableDef struct {
+	Address     int `json:"-"`
+	Name        string
+	Category    string // like "Spark" or "Fuel", to group the tables by
+	Description string
+	Units       string
+	Scale       float64 // value = raw * Scale + Add, 1 if left out
+	Add         float64
+	Decimals    int
+
+	// Formulas of X for conversions Scale and Add can't give, like "X*X/64". Without Inverse, raw values are
+	// found by trying every one.
+	Formula string // raw to physical
+	Inverse string // physical to raw
+
+	// Header addresses of the tables holding the breakpoints of the Y axis, the rows, and of the X axis, the
+	// cols, like "0x10A552"
+	RowAxis string
+	ColAxis string
+}
+
+// Definitions is the user-maintained definitions file. Tables are keyed by their header address, under the
+// strategy ID of the calibrations they're in, or in Tables if they're where they are in every strategy.
+type Definitions struct {
+	Tables     map[string]*TableDef
+	Strategies map[string]map[string]*TableDef `json:",omitempty"`
+}
+
+// LoadDefinitions reads a definitions file, a missing file is an empty one
+func LoadDefinitions(path string) (*Definitions, error) {
+	d := &Definitions{Tables: make(map[string]*TableDef)}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return d, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, d); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if d.Tables == nil {
+		d.Tables = make(map[string]*TableDef)
+	}
+
+	sections := []map[string]*TableDef{d.Tables}
+	for _, section := range d.Strategies {
+		sections = append(sections, section)
+	}
+	for _, section := range sections {
+		for key, def := range section {
+			def.Address, err = ParseAddress(key)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", path, err)
+			}
+			for _, axis := range []string{def.RowAxis, def.ColAxis} {
+				if _, err := ParseAddress(axis); axis != "" && err != nil {
+					return nil, fmt.Errorf("%s: %s: %w", path, key, err)
+				}
+			}
+			for _, f := range []string{def.Formula, def.Inverse} {
+				if err := checkFormula(f); f != "" && err != nil {
+					return nil, fmt.Errorf("%s: %s: %w", path, key, err)
+				}
+			}
+		}
+	}
+	return d, nil
+}
+
+// Save writes the definitions, by way of a temporary file so a crash can't leave half of one
+func (d *Definitions) Save(path string) error {
+	data, err := json.MarshalIndent(d, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	err = ioutil.WriteFile(tmp, data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// ParseAddress reads a hex address, with or without the 0x
+func ParseAddress(s string) (int, error) {
+	s = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(s)), "0x")
+	adr, err := strconv.ParseUint(s, 16, 32)
+	if err != nil {
+		return 0, fmt.Errorf("bad address %q", s)
+	}
+	return int(adr), nil
+}
+
+// sections are the tables of strategy, then the tables of every strategy
+func (d *Definitions) sections(strategy string) []map[string]*TableDef {
+	if d == nil {
+		return nil
+	}
+	return []map[string]*TableDef{d.Strategies[strategy], d.Tables}
+}
+
+// Lookup returns the definition of the table with its header at adr in a calibration of strategy, nil if there
+// isn't one
+func (d *Definitions) Lookup(strategy string, adr int) *TableDef {
+	for _, section := range d.sections(strategy) {
+		for _, def := range section {
+			if def.Address == adr {
+				return def
+			}
+		}
+	}
+	return nil
+}
+
+// Add puts def in the tables of strategy, or of every strategy if strategy is ""
+func (d *Definitions) Add(strategy string, def *TableDef) {
+	key := fmt.Sprintf("0x%X", def.Address)
+	if strategy == "" {
+		d.Tables[key] = def
+		return
+	}
+	if d.Strategies == nil {
+		d.Strategies = make(map[string]map[string]*TableDef)
+	}
+	if d.Strategies[strategy] == nil {
+		d.Strategies[strategy] = make(map[string]*TableDef)
+	}
+	d.Strategies[strategy][key] = def
+}
+
+// Addresses returns the header addresses of the tables defined for strategy and the axes they name, in order
+func (d *Definitions) Addresses(strategy string) []int {
+	seen := make(map[int]bool)
+	for _, section := range d.sections(strategy) {
+		for _, def := range section {
+			seen[def.Address] = true
+			for _, axis := range []string{def.RowAxis, def.ColAxis} {
+				if adr, err := ParseAddress(axis); err == nil {
+					seen[adr] = true
+				}
+			}
+		}
+	}
+
+	var adrs []int
+	for adr := range seen {
+		adrs = append(adrs, adr)
+	}
+	sort.Ints(adrs)
+	return adrs
+}
+
+// scale returns the Scale, 1 if left out
+func (t *TableDef) scale() float64 {
+	if t == nil {
+		return 1
+	}
+	if t.Scale == 0 {
+		return 1
+	}
+	return t.Scale
+}
+
+// Equation is the raw to physical conversion in TunerPro's notation, X being the raw value
+func (t *TableDef) Equation() string {
+	if t != nil && t.Formula != "" {
+		return formulaWith(t.Formula, "X")
+	}
+
+	eq := "X"
+	if s := t.scale(); s != 1 {
+		eq += "*" + strconv.FormatFloat(s, 'g', -1, 64)
+	}
+	if t != nil && t.Add != 0 {
+		if t.Add > 0 {
+			eq += "+"
+		}
+		eq += strconv.FormatFloat(t.Add, 'g', -1, 64)
+	}
+	return eq
+}
+
+// Physical scales a raw value, NaN if the Formula doesn't work
+func (t *TableDef) Physical(raw int) float64 {
+	if t != nil && t.Formula != "" {
+		v, err := evalFormula(t.Formula, float64(raw))
+		if err != nil {
+			return math.NaN()
+		}
+		return v
+	}
+
+	v := float64(raw) * t.scale()
+	if t != nil {
+		v += t.Add
+	}
+	return v
+}
+
+// Raw converts a physical value back to the nearest raw value an element of width bytes can hold
+func (t *TableDef) Raw(physical float64, width int, signed bool) (int, error) {
+	min, max := 0, 1<<uint(width*8)-1
+	if signed {
+		min, max = -(max+1)/2, max/2
+	}
+
+	var raw float64
+	switch {
+	case t != nil && t.Inverse != "":
+		v, err := evalFormula(t.Inverse, physical)
+		if err != nil {
+			return 0, err
+		}
+		raw = math.Round(v)
+
+	case t != nil && t.Formula != "":
+		// Try every raw value, there are at most 65536 in the tables that get edited
+		if width > 2 {
+			return 0, fmt.Errorf("%s: needs an Inverse formula to convert %v back", t.Name, physical)
+		}
+		best := math.Inf(1)
+		for r := min; r <= max; r++ {
+			if d := math.Abs(t.Physical(r) - physical); d < best {
+				best, raw = d, float64(r)
+			}
+		}
+
+		// Past the ends, the nearest is out of range when it's half a step away or more, as rounding would be
+		if r := int(raw); r == min || r == max {
+			next := r + 1
+			if r == max {
+				next = r - 1
+			}
+			step := t.Physical(next) - t.Physical(r)
+			past := (physical-t.Physical(r))*step < 0
+			if past && best >= math.Abs(step)/2-1e-9 {
+				raw = math.NaN()
+			}
+		}
+
+	default:
+		v := physical
+		if t != nil {
+			v -= t.Add
+		}
+		raw = math.Round(v / t.scale())
+	}
+
+	if math.IsNaN(raw) || raw < float64(min) || raw > float64(max) {
+		return 0, fmt.Errorf("%v is out of range, %v to %v", physical, t.Physical(min), t.Physical(max))
+	}
+	return int(raw), nil
+}
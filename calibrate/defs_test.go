@@ -0,0 +1,129 @@
+package calibrate
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// Table Definition Tests
+////////////////..........
+
+func TestLoadDefinitions(t *testing.T) {
+	dir := t.TempDir()
+
+	defs, err := LoadDefinitions(filepath.Join(dir, "missing.json"))
+	if err != nil || len(defs.Tables) != 0 {
+		t.Fatalf("missing file: %v %v", defs, err)
+	}
+
+	path := filepath.Join(dir, "tables.json")
+	err = ioutil.WriteFile(path, []byte(`{
+	"Tables": {
+		"0x10AA60": {"Name": "Spark Advance", "Units": "deg", "Scale": 0.5, "Add": -10, "RowAxis": "10A588", "ColAxis": "0x10B06E"},
+		"10a3be": {"Name": "Constant"}
+	},
+	"Strategies": {
+		"DXAI4U0": {"0x10AA60": {"Name": "MP3 Spark Advance", "Category": "Spark"}, "0x10C60E": {"Name": "Dwell"}}
+	}}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defs, err = LoadDefinitions(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spark := defs.Lookup("", 0x10AA60)
+	if spark == nil || spark.Name != "Spark Advance" || defs.Lookup("", 0x10A3BE) == nil || defs.Lookup("", 0x10AA62) != nil {
+		t.Fatalf("lookup: %+v", defs.Tables)
+	}
+	if got := defs.Addresses(""); !reflect.DeepEqual(got, []int{0x10A3BE, 0x10A588, 0x10AA60, 0x10B06E}) {
+		t.Errorf("addresses % X", got)
+	}
+
+	// A strategy's own definitions come first
+	if mp3 := defs.Lookup("DXAI4U0", 0x10AA60); mp3 == nil || mp3.Name != "MP3 Spark Advance" || mp3.Category != "Spark" {
+		t.Errorf("DXAI4U0: %+v", mp3)
+	}
+	if defs.Lookup("DXAI4U0", 0x10A3BE) == nil || defs.Lookup("OTHER", 0x10C60E) != nil {
+		t.Error("strategy fallback")
+	}
+	if got := defs.Addresses("DXAI4U0"); !reflect.DeepEqual(got, []int{0x10A3BE, 0x10A588, 0x10AA60, 0x10B06E, 0x10C60E}) {
+		t.Errorf("DXAI4U0 addresses % X", got)
+	}
+
+	defs.Add("OTHER", &TableDef{Address: 0x10C60E, Name: "Other Dwell"})
+	if d := defs.Lookup("OTHER", 0x10C60E); d == nil || d.Name != "Other Dwell" || defs.Lookup("DXAI4U0", 0x10C60E).Name != "Dwell" {
+		t.Errorf("add: %+v", defs.Strategies)
+	}
+
+	for _, bad := range []string{
+		`{"Tables": {"0x10AA60": {"ColAxis": "axis"}}}`,
+		`{"Strategies": {"DXAI4U0": {"place": {}}}}`,
+		`{"Tables": {"0x10AA60": {"Formula": "X*"}}}`,
+		`{"Tables": {"0x10AA60": {"Inverse": "Y/2"}}}`,
+	} {
+		if err := ioutil.WriteFile(path, []byte(bad), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadDefinitions(path); err == nil {
+			t.Errorf("%s loaded", bad)
+		}
+	}
+}
+
+func TestConversions(t *testing.T) {
+	tests := []struct {
+		def      *TableDef
+		equation string
+		raw      int
+		physical float64
+		width    int
+		signed   bool
+	}{
+		{nil, "X", 7, 7, 1, false},
+		{&TableDef{Scale: 0.5, Add: -10}, "X*0.5-10", 60, 20, 1, false},
+		{&TableDef{Scale: 0.25}, "X*0.25", -8, -2, 1, true},
+		{&TableDef{Formula: "X1 * 100 / 128", Inverse: "X*128/100"}, "X * 100 / 128", 0x60, 75, 1, false},
+		// No inverse, raw values are searched for
+		{&TableDef{Formula: "X*X/64"}, "X*X/64", 200, 625, 2, false},
+	}
+
+	for _, test := range tests {
+		if eq := test.def.Equation(); eq != test.equation {
+			t.Errorf("%+v: equation %q", test.def, eq)
+		}
+		if v := test.def.Physical(test.raw); v != test.physical {
+			t.Errorf("%+v: physical %v", test.def, v)
+		}
+		raw, err := test.def.Raw(test.physical, test.width, test.signed)
+		if err != nil || raw != test.raw {
+			t.Errorf("%+v: raw %d %v", test.def, raw, err)
+		}
+	}
+
+	// Out of range
+	spark := &TableDef{Scale: 0.5, Add: -10}
+	for _, v := range []float64{-11, 118} {
+		if _, err := spark.Raw(v, 1, false); err == nil {
+			t.Errorf("%v converted", v)
+		}
+	}
+	// Searched for, out of range the same
+	searched := &TableDef{Formula: "X*0.5-10"}
+	for _, v := range []float64{-11, -10.25, 117.75, 1000} {
+		if raw, err := searched.Raw(v, 1, false); err == nil {
+			t.Errorf("%v converted to %d", v, raw)
+		}
+	}
+	for _, v := range []float64{-10.2, -9.75, 117.25, 117.5, 117.7} {
+		if _, err := searched.Raw(v, 1, false); err != nil {
+			t.Errorf("%v: %s", v, err)
+		}
+	}
+	if _, err := (&TableDef{Formula: "X/2"}).Raw(1, 4, false); err == nil {
+		t.Error("4 byte search")
+	}
+}
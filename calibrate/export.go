@@ -0,0 +1,91 @@
+package calibrate
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/murdinc/ELMFlash/tables"
+)
+
+// Table Exports
+////////////////..........
+
+// exportTable is a table to export and what it's called
+type exportTable struct {
+	*Table
+	def *TableDef
+}
+
+// exportTables decodes the tables with their headers at addresses and the tables defs names, in order, leaving out
+// the ones an editor couldn't write back: data that isn't stored one element after another, or isn't in the file
+func (c *Calibration) exportTables(format string, addresses []int, defs *Definitions) ([]exportTable, int) {
+	seen := make(map[int]bool)
+	var list []exportTable
+	skipped := 0
+	for _, adr := range append(append([]int{}, addresses...), defs.Addresses(c.strategy)...) {
+		if seen[adr] {
+			continue
+		}
+		seen[adr] = true
+
+		table, err := c.GetTable(adr)
+		if err != nil {
+			log(fmt.Sprintf("%s - Skipping table at 0x%X", format, adr), err)
+			skipped++
+			continue
+		}
+		if table.decoded.Packing != tables.Packed {
+			log(fmt.Sprintf("%s - Skipping table at 0x%X, its data is %s", format, adr, table.Packing), nil)
+			skipped++
+			continue
+		}
+		if table.Start < c.fileBase || table.End > c.fileBase+c.fileSize {
+			log(fmt.Sprintf("%s - Skipping table at 0x%X, it isn't in the calibration file", format, adr), nil)
+			skipped++
+			continue
+		}
+		list = append(list, exportTable{Table: table, def: defs.Lookup(c.strategy, adr)})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Address < list[j].Address })
+
+	return list, skipped
+}
+
+// limits is the physical range of the values
+func (t exportTable) limits() (float64, float64) {
+	min, max := 0, 1<<uint(t.ElementSize*8)-1
+	if t.Signed {
+		min, max = -(max+1)/2, max/2
+	}
+	lo, hi := t.def.Physical(min), t.def.Physical(max)
+	if lo > hi {
+		lo, hi = hi, lo
+	}
+	return lo, hi
+}
+
+func (t exportTable) title() string {
+	if t.def != nil && t.def.Name != "" {
+		return t.def.Name
+	}
+	return fmt.Sprintf("%s 0x%.6X", t.Kind, t.Address)
+}
+
+// layout is where the header is and which inputs the table is looked up by
+func (t exportTable) layout() string {
+	desc := fmt.Sprintf("Header at %s", t.AddressStr)
+	switch t.decoded.Kind {
+	case tables.Map:
+		desc += fmt.Sprintf(", row axis 0x%.2X, col axis 0x%.2X", t.RowAxis, t.ColAxis)
+	case tables.Array:
+		desc += fmt.Sprintf(", axis 0x%.2X", t.ColAxis)
+	}
+	return desc
+}
+
+func (t exportTable) description() string {
+	if t.def != nil && t.def.Description != "" {
+		return t.def.Description + "\n" + t.layout()
+	}
+	return t.layout()
+}
@@ -0,0 +1,168 @@
+package calibrate
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Formulas
+////////////////..........
+
+// A conversion formula is arithmetic on X, the value converted: numbers, + - * /, and parentheses, like
+// "X*0.75-24" or "(X+24)/0.75". X1 works too, as A2L writes it.
+
+// evalFormula works out src for the value x
+func evalFormula(src string, x float64) (float64, error) {
+	p := &formulaParser{src: src, x: x}
+	v, err := p.sum()
+	if err != nil {
+		return 0, fmt.Errorf("formula %q: %w", src, err)
+	}
+	p.space()
+	if p.pos < len(p.src) {
+		return 0, fmt.Errorf("formula %q: unexpected %q", src, p.src[p.pos:])
+	}
+	return v, nil
+}
+
+// checkFormula is nil if src is a formula
+func checkFormula(src string) error {
+	_, err := evalFormula(src, 1)
+	return err
+}
+
+var formulaVar = regexp.MustCompile(`(?i)\bX1?\b`)
+
+// formulaWith writes src with the value named name, X for TunerPro, X1 for A2L
+func formulaWith(src string, name string) string {
+	return formulaVar.ReplaceAllString(src, name)
+}
+
+type formulaParser struct {
+	src string
+	pos int
+	x   float64
+}
+
+func (p *formulaParser) space() {
+	for p.pos < len(p.src) && (p.src[p.pos] == ' ' || p.src[p.pos] == '\t') {
+		p.pos++
+	}
+}
+
+// peek returns the next character, 0 at the end
+func (p *formulaParser) peek() byte {
+	p.space()
+	if p.pos < len(p.src) {
+		return p.src[p.pos]
+	}
+	return 0
+}
+
+func (p *formulaParser) sum() (float64, error) {
+	v, err := p.product()
+	if err != nil {
+		return 0, err
+	}
+	for {
+		switch p.peek() {
+		case '+':
+			p.pos++
+			w, err := p.product()
+			if err != nil {
+				return 0, err
+			}
+			v += w
+		case '-':
+			p.pos++
+			w, err := p.product()
+			if err != nil {
+				return 0, err
+			}
+			v -= w
+		default:
+			return v, nil
+		}
+	}
+}
+
+func (p *formulaParser) product() (float64, error) {
+	v, err := p.unary()
+	if err != nil {
+		return 0, err
+	}
+	for {
+		switch p.peek() {
+		case '*':
+			p.pos++
+			w, err := p.unary()
+			if err != nil {
+				return 0, err
+			}
+			v *= w
+		case '/':
+			p.pos++
+			w, err := p.unary()
+			if err != nil {
+				return 0, err
+			}
+			v /= w
+		default:
+			return v, nil
+		}
+	}
+}
+
+func (p *formulaParser) unary() (float64, error) {
+	switch p.peek() {
+	case '-':
+		p.pos++
+		v, err := p.unary()
+		return -v, err
+	case '+':
+		p.pos++
+		return p.unary()
+	}
+	return p.operand()
+}
+
+func (p *formulaParser) operand() (float64, error) {
+	c := p.peek()
+	switch {
+	case c == '(':
+		p.pos++
+		v, err := p.sum()
+		if err != nil {
+			return 0, err
+		}
+		if p.peek() != ')' {
+			return 0, fmt.Errorf("missing )")
+		}
+		p.pos++
+		return v, nil
+
+	case c == 'X' || c == 'x':
+		p.pos++
+		if p.pos < len(p.src) && p.src[p.pos] == '1' {
+			p.pos++
+		}
+		return p.x, nil
+
+	case c == '.' || (c >= '0' && c <= '9'):
+		start := p.pos
+		for p.pos < len(p.src) && strings.IndexByte("0123456789.eE", p.src[p.pos]) >= 0 {
+			// An exponent can have a sign
+			if (p.src[p.pos] == 'e' || p.src[p.pos] == 'E') && p.pos+1 < len(p.src) && (p.src[p.pos+1] == '-' || p.src[p.pos+1] == '+') {
+				p.pos++
+			}
+			p.pos++
+		}
+		return strconv.ParseFloat(p.src[start:p.pos], 64)
+
+	case c == 0:
+		return 0, fmt.Errorf("ends early")
+	}
+	return 0, fmt.Errorf("unexpected %q", p.src[p.pos:])
+}
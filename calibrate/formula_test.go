@@ -0,0 +1,43 @@
+package calibrate
+
+import (
+	"testing"
+)
+
+// Formula Tests
+////////////////..........
+
+func TestEvalFormula(t *testing.T) {
+	tests := []struct {
+		src  string
+		x    float64
+		want float64
+	}{
+		{"X", 3, 3},
+		{"x1", 3, 3},
+		{"X*0.75-24", 100, 51},
+		{"(X+24)/0.75", 51, 100},
+		{"-X + 2 * 3", 1, 5},
+		{"10 - 4 - 3", 0, 3},
+		{"64 / 4 / 2", 0, 8},
+		{"-(X - 1) * -2", 4, 6},
+		{"1.5e2 + X", 1, 151},
+		{"2.5E-1", 0, 0.25},
+	}
+	for _, test := range tests {
+		got, err := evalFormula(test.src, test.x)
+		if err != nil || got != test.want {
+			t.Errorf("%q with X = %v: got %v %v, want %v", test.src, test.x, got, err, test.want)
+		}
+	}
+
+	for _, bad := range []string{"", "X*", "(X+1", "X+1)", "Y", "2X", "X**2"} {
+		if _, err := evalFormula(bad, 1); err == nil {
+			t.Errorf("%q evaluated", bad)
+		}
+	}
+
+	if got := formulaWith("X1*128/(X1+1)", "X"); got != "X*128/(X+1)" {
+		t.Errorf("formulaWith: %q", got)
+	}
+}
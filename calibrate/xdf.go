@@ -0,0 +1,164 @@
+package calibrate
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/murdinc/ELMFlash/tables"
+)
+
+// XDF Export
+////////////////..........
+
+// TunerPro's XDF describes the tables by their offset in the BIN file, so the calibration file the team
+// already has opens against it unchanged. Each table's uniqueid is its header address, which is what the
+// axis links point at.
+
+// EMBEDDEDDATA type flags
+const (
+	xdfSigned   = 0x01
+	xdfLSBFirst = 0x02
+)
+
+// WriteXDF writes a TunerPro definition of the tables with their headers at addresses, and of the tables defs
+// names, taking the names and scaling from defs
+func (c *Calibration) WriteXDF(w io.Writer, addresses []int, defs *Definitions) error {
+
+	list, skipped := c.exportTables("XDF", addresses, defs)
+
+	exported := make(map[int]*Table)
+	for _, t := range list {
+		exported[t.Address] = t.Table
+	}
+
+	fmt.Fprintf(w, "<!-- Written by ELMFlash -->\n")
+	fmt.Fprintf(w, "<XDFFORMAT version=\"1.60\">\n")
+	fmt.Fprintf(w, "  <XDFHEADER>\n")
+	fmt.Fprintf(w, "    <flags>0x1</flags>\n")
+	fmt.Fprintf(w, "    <deftitle>%s</deftitle>\n", xmlText(c.strategy))
+	fmt.Fprintf(w, "    <description>%s</description>\n", xmlText(fmt.Sprintf("%s, %d tables, %d skipped", c.name, len(list), skipped)))
+	fmt.Fprintf(w, "    <BASEOFFSET offset=\"0\" subtract=\"0\" />\n")
+	fmt.Fprintf(w, "    <DEFAULTS datasizeinbits=\"8\" sigdigits=\"2\" outputtype=\"1\" signed=\"0\" lsbfirst=\"1\" float=\"0\" />\n")
+	fmt.Fprintf(w, "    <REGION type=\"0xFFFFFFFF\" startaddress=\"0x0\" size=\"0x%X\" regionflags=\"0x0\" name=\"Binary File\" desc=\"%s\" />\n", c.fileSize, xmlText(c.name))
+	fmt.Fprintf(w, "  </XDFHEADER>\n")
+
+	for _, t := range list {
+		if t.decoded.Kind == tables.Item {
+			c.writeXDFConstant(w, t)
+			continue
+		}
+		c.writeXDFTable(w, t, exported)
+	}
+
+	_, err := fmt.Fprintf(w, "</XDFFORMAT>\n")
+	return err
+}
+
+func (c *Calibration) writeXDFConstant(w io.Writer, t exportTable) {
+	fmt.Fprintf(w, "  <XDFCONSTANT uniqueid=\"0x%X\" flags=\"0x0\">\n", t.Address)
+	fmt.Fprintf(w, "    <title>%s</title>\n", xmlText(t.title()))
+	fmt.Fprintf(w, "    <description>%s</description>\n", xmlText(t.description()))
+	fmt.Fprintf(w, "    <EMBEDDEDDATA mmedtypeflags=\"0x%.2X\" mmedaddress=\"0x%X\" mmedelementsizebits=\"%d\" />\n", t.typeFlags(), t.Start-c.fileBase, t.ElementSize*8)
+	t.writeOutput(w, "    ")
+	fmt.Fprintf(w, "  </XDFCONSTANT>\n")
+}
+
+func (c *Calibration) writeXDFTable(w io.Writer, t exportTable, exported map[int]*Table) {
+	fmt.Fprintf(w, "  <XDFTABLE uniqueid=\"0x%X\" flags=\"0x0\">\n", t.Address)
+	fmt.Fprintf(w, "    <title>%s</title>\n", xmlText(t.title()))
+	fmt.Fprintf(w, "    <description>%s</description>\n", xmlText(t.description()))
+
+	var rowLink, colLink string
+	if t.def != nil {
+		rowLink, colLink = t.def.RowAxis, t.def.ColAxis
+	}
+	writeXDFAxis(w, "x", t.Width, colLink, exported)
+	writeXDFAxis(w, "y", t.Height, rowLink, exported)
+
+	fmt.Fprintf(w, "    <XDFAXIS id=\"z\">\n")
+	fmt.Fprintf(w, "      <EMBEDDEDDATA mmedtypeflags=\"0x%.2X\" mmedaddress=\"0x%X\" mmedelementsizebits=\"%d\" mmedrowcount=\"%d\" mmedcolcount=\"%d\" mmedmajorstridebits=\"0\" mmedminorstridebits=\"0\" />\n", t.typeFlags(), t.Start-c.fileBase, t.ElementSize*8, t.Height, t.Width)
+	t.writeOutput(w, "      ")
+	fmt.Fprintf(w, "    </XDFAXIS>\n")
+	fmt.Fprintf(w, "  </XDFTABLE>\n")
+}
+
+// writeXDFAxis writes an axis linked to the breakpoint table at link, or numbered 0 up if there isn't one that fits
+func writeXDFAxis(w io.Writer, id string, count int, link string, exported map[int]*Table) {
+	fmt.Fprintf(w, "    <XDFAXIS id=\"%s\" uniqueid=\"0x0\">\n", id)
+	fmt.Fprintf(w, "      <EMBEDDEDDATA mmedelementsizebits=\"8\" mmedmajorstridebits=\"-32\" mmedminorstridebits=\"0\" />\n")
+	fmt.Fprintf(w, "      <indexcount>%d</indexcount>\n", count)
+
+	adr, err := ParseAddress(link)
+	if axis, ok := exported[adr]; link != "" && err == nil && ok && axis.Size == count {
+		fmt.Fprintf(w, "      <embedinfo type=\"3\" linkobjid=\"0x%X\" />\n", adr)
+	} else {
+		if link != "" {
+			log(fmt.Sprintf("XDF - Axis %s isn't an exported table of %d elements, numbering the axis instead", link, count), nil)
+		}
+		fmt.Fprintf(w, "      <embedinfo type=\"1\" />\n")
+		for i := 0; i < count; i++ {
+			fmt.Fprintf(w, "      <LABEL index=\"%d\" value=\"%d\" />\n", i, i)
+		}
+	}
+
+	fmt.Fprintf(w, "      <MATH equation=\"X\">\n")
+	fmt.Fprintf(w, "        <VAR id=\"X\" />\n")
+	fmt.Fprintf(w, "      </MATH>\n")
+	fmt.Fprintf(w, "    </XDFAXIS>\n")
+}
+
+// writeOutput writes the units, range and conversion of the values
+func (t exportTable) writeOutput(w io.Writer, indent string) {
+	lo, hi := t.limits()
+
+	decimals := 0
+	units := ""
+	if t.def != nil {
+		decimals, units = t.def.Decimals, t.def.Units
+	}
+
+	fmt.Fprintf(w, "%s<units>%s</units>\n", indent, xmlText(units))
+	fmt.Fprintf(w, "%s<decimalpl>%d</decimalpl>\n", indent, decimals)
+	fmt.Fprintf(w, "%s<min>%f</min>\n", indent, lo)
+	fmt.Fprintf(w, "%s<max>%f</max>\n", indent, hi)
+	fmt.Fprintf(w, "%s<outputtype>1</outputtype>\n", indent)
+	fmt.Fprintf(w, "%s<MATH equation=\"%s\">\n", indent, xmlText(t.def.Equation()))
+	fmt.Fprintf(w, "%s  <VAR id=\"X\" />\n", indent)
+	fmt.Fprintf(w, "%s</MATH>\n", indent)
+}
+
+func (t exportTable) typeFlags() int {
+	flags := xdfLSBFirst
+	if t.Signed {
+		flags |= xdfSigned
+	}
+	return flags
+}
+
+func xmlText(s string) string {
+	var b bytes.Buffer
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+// ExportXDF writes the XDF to path
+func (c *Calibration) ExportXDF(path string, addresses []int, defs *Definitions) error {
+	f, err := os.Create(path)
+	if err != nil {
+		log("XDF - Error creating file", err)
+		return err
+	}
+	defer f.Close()
+
+	if err := c.WriteXDF(f, addresses, defs); err != nil {
+		log("XDF - Error writing XDF", err)
+		return err
+	}
+
+	log(fmt.Sprintf("XDF - wrote %s", path), nil)
+
+	return nil
+}
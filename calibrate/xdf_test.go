@@ -0,0 +1,99 @@
+package calibrate
+
+import (
+	"bytes"
+	"encoding/xml"
+	"testing"
+)
+
+// XDF Export Tests
+////////////////..........
+
+type xdfAxis struct {
+	ID       string `xml:"id,attr"`
+	Embedded struct {
+		Address string `xml:"mmedaddress,attr"`
+		Bits    int    `xml:"mmedelementsizebits,attr"`
+		Flags   string `xml:"mmedtypeflags,attr"`
+		Rows    int    `xml:"mmedrowcount,attr"`
+		Cols    int    `xml:"mmedcolcount,attr"`
+	} `xml:"EMBEDDEDDATA"`
+	Count int `xml:"indexcount"`
+	Info  struct {
+		Type int    `xml:"type,attr"`
+		Link string `xml:"linkobjid,attr"`
+	} `xml:"embedinfo"`
+	Labels []struct{} `xml:"LABEL"`
+	Units  string     `xml:"units"`
+	Math   struct {
+		Equation string `xml:"equation,attr"`
+	} `xml:"MATH"`
+}
+
+type xdfFile struct {
+	Tables []struct {
+		ID    string    `xml:"uniqueid,attr"`
+		Title string    `xml:"title"`
+		Axes  []xdfAxis `xml:"XDFAXIS"`
+	} `xml:"XDFTABLE"`
+	Constants []struct {
+		ID    string `xml:"uniqueid,attr"`
+		Title string `xml:"title"`
+	} `xml:"XDFCONSTANT"`
+}
+
+func TestWriteXDF(t *testing.T) {
+	c := loadMP3(t)
+
+	defs := &Definitions{Tables: map[string]*TableDef{
+		// 15 rows, 14 cols. The row axis doesn't have 15 elements, so it gets numbered.
+		"0x10AA60": {Address: 0x10AA60, Name: "Spark Advance", Units: "deg", Scale: 0.5, Add: -10, RowAxis: "0x10AB3A", ColAxis: "0x10B06E"},
+		"0x10A3BE": {Address: 0x10A3BE, Name: "Constant"},
+	}}
+
+	var b bytes.Buffer
+	// 0x10AE62 escapes its zeros, which TunerPro can't edit
+	if err := c.WriteXDF(&b, []int{0x10AA60, 0x10AE62, 0x10AA60}, defs); err != nil {
+		t.Fatal(err)
+	}
+
+	var xdf xdfFile
+	if err := xml.Unmarshal(b.Bytes(), &xdf); err != nil {
+		t.Fatalf("%v\n%s", err, b.String())
+	}
+
+	ids := make(map[string]int)
+	for i, table := range xdf.Tables {
+		ids[table.ID] = i
+	}
+	if len(xdf.Tables) != 3 || len(ids) != 3 {
+		t.Fatalf("tables %v", ids)
+	}
+	for _, id := range []string{"0x10AB3A", "0x10B06E"} {
+		if _, ok := ids[id]; !ok {
+			t.Errorf("axis table %s not exported", id)
+		}
+	}
+
+	spark := xdf.Tables[ids["0x10AA60"]]
+	if spark.Title != "Spark Advance" || len(spark.Axes) != 3 {
+		t.Fatalf("0x10AA60: %+v", spark)
+	}
+	x, y, z := spark.Axes[0], spark.Axes[1], spark.Axes[2]
+	if x.ID != "x" || x.Count != 14 || x.Info.Type != 3 || x.Info.Link != "0x10B06E" {
+		t.Errorf("x axis %+v", x)
+	}
+	if y.ID != "y" || y.Count != 15 || y.Info.Type != 1 || len(y.Labels) != 15 {
+		t.Errorf("y axis %+v", y)
+	}
+	if z.ID != "z" || z.Embedded.Address != "0x2A68" || z.Embedded.Bits != 8 || z.Embedded.Rows != 15 || z.Embedded.Cols != 14 {
+		t.Errorf("z axis %+v", z.Embedded)
+	}
+	if z.Units != "deg" || z.Math.Equation != "X*0.5-10" {
+		t.Errorf("z scaling %q %q", z.Units, z.Math.Equation)
+	}
+
+	if len(xdf.Constants) != 1 || xdf.Constants[0].ID != "0x10A3BE" || xdf.Constants[0].Title != "Constant" {
+		t.Errorf("constants %+v", xdf.Constants)
+	}
+}
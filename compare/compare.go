@@ -2,8 +2,9 @@ package compare
 
 import (
 	"fmt"
-	"os"
 	"strings"
+
+	"github.com/murdinc/ELMFlash/image"
 )
 
 // App constants
@@ -15,71 +16,25 @@ type Compare struct {
 	block2 []byte
 }
 
-var calibrations = map[string]string{
-	"msp":   "MSP.BIN",
-	"mp3":   "MP3.BIN",
-	"mp3x2": "MP3x2.BIN",
-	"p5":    "P5.BIN",
-	"pre":   "PRE.BIN",
-	"pre2":  "PRE2.BIN",
-}
-
-func New(preName1 string, calName1 string, preName2 string, calName2 string) *Compare {
-	cmp := new(Compare)
-
-	cmp.block1 = buildCal(preName1, calName1)
-	cmp.block2 = buildCal(preName2, calName2)
-
-	return cmp
-}
-
-func buildCal(preName string, calName string) []byte {
-	// Pull in the stuff before the calibration file
-	preCalFile := "./calibrations/" + calibrations[preName]
-	log(fmt.Sprintf("Disassemble - Pre-calibration File: %s", preCalFile), nil)
-
-	p, err := os.Open(preCalFile)
-	pi, err := p.Stat()
-	preFileSize := pi.Size()
-
-	// Pull in the Calibration file
-	calFile := "./calibrations/" + calibrations[calName]
-	log(fmt.Sprintf("Disassemble - Calibration File: %s", calFile), nil)
-
-	f, err := os.Open(calFile)
-	fi, err := f.Stat()
-	fileSize := fi.Size()
+// New loads two pre-calibration and calibration pairs, each by catalog name or path
+func New(preName1 string, calName1 string, preName2 string, calName2 string) (*Compare, error) {
+	img1, err := image.LoadWith(preName1, calName1)
 	if err != nil {
-		log("Disassemble - Error opening file", err)
-		os.Exit(1)
+		log("Compare - Error loading calibration", err)
+		return nil, err
 	}
 
-	log(fmt.Sprintf("Disassemble - [%s] is %d bytes long", calibrations["pre"], preFileSize), nil)
-	log(fmt.Sprintf("Disassemble - [%s] is %d bytes long", calibrations[calName], fileSize), nil)
-
-	// Make some buffers
-	preBlock := make([]byte, preFileSize)
-	calBlock := make([]byte, fileSize)
-
-	// Read in all the bytes
-	n, err := p.Read(preBlock)
+	img2, err := image.LoadWith(preName2, calName2)
 	if err != nil {
-		log("Disassemble - Error reading calibration", err)
-		os.Exit(1)
+		log("Compare - Error loading calibration", err)
+		return nil, err
 	}
-	log(fmt.Sprintf("Disassemble - reading 0x%X bytes from pre-calibration file.", n), nil)
 
-	n, err = f.Read(calBlock)
-	if err != nil {
-		log("Disassemble - Error reading calibration", err)
-		os.Exit(1)
-	}
-
-	log(fmt.Sprintf("Disassemble - reading 0x%X bytes from calibration file.", n), nil)
-
-	block := append(preBlock, calBlock...)
+	cmp := new(Compare)
+	cmp.block1 = img1.Block
+	cmp.block2 = img2.Block
 
-	return block
+	return cmp, nil
 }
 
 func (c *Compare) Compare() error {
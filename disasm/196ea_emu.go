@@ -0,0 +1,1054 @@
+package disasm
+
+import (
+	"errors"
+	"fmt"
+)
+
+// 8XC196EA Emulator
+//////////////////////////////////////
+
+const (
+	resetAdr            = 0x172080 // After reset, the first instruction is fetched from 0x172080
+	codePage            = 0x170000 // Page FFH on this ECU, 16-bit vectors are added to this
+	addrMask            = 0x1FFFFF // 21 address lines are wired up
+	mapStart            = 0x108000 // Start of the calibration map/table area
+	mapStop             = 0x118000 // End of the calibration map/table area
+	trapVector          = 0x172010 // Software TRAP Instruction
+	unimplementedVector = 0x172012 // Unimplemented Opcode
+)
+
+// SFRs that the CPU itself uses
+const (
+	zeroReg  = 0x00
+	onesReg  = 0x02
+	intMask  = 0x08
+	intMask1 = 0x13
+	wsrReg   = 0x14
+	spReg    = 0x18
+)
+
+// PSW flags, the upper byte of the Program Status Word
+type PSW struct {
+	Z   bool // Zero
+	N   bool // Negative
+	V   bool // Overflow
+	VT  bool // Overflow Trap
+	C   bool // Carry
+	PSE bool // PTS Enable
+	I   bool // Global Interrupt Enable
+	ST  bool // Sticky Bit
+}
+
+// Returns the PSW as the byte that PUSHF / PUSHA put on the stack
+func (p PSW) Byte() byte {
+	var b byte
+	for i, f := range []bool{p.ST, p.I, p.PSE, p.C, p.VT, p.V, p.N, p.Z} {
+		if f {
+			b |= 1 << uint(i)
+		}
+	}
+	return b
+}
+
+// Sets the PSW from the byte that POPF / POPA take off the stack
+func (p *PSW) SetByte(b byte) {
+	p.ST = b&0x01 != 0
+	p.I = b&0x02 != 0
+	p.PSE = b&0x04 != 0
+	p.C = b&0x08 != 0
+	p.VT = b&0x10 != 0
+	p.V = b&0x20 != 0
+	p.N = b&0x40 != 0
+	p.Z = b&0x80 != 0
+}
+
+func (p PSW) String() string {
+	flags := ""
+	for i, f := range []bool{p.Z, p.N, p.V, p.VT, p.C, p.PSE, p.I, p.ST} {
+		name := []string{"Z", "N", "V", "VT", "C", "PSE", "I", "ST"}[i]
+		if f {
+			flags += name + " "
+		} else {
+			flags += "- "
+		}
+	}
+	return flags
+}
+
+// A memory access made by an instruction
+type Access struct {
+	Routine  int // entry address of the subroutine or interrupt routine that made the access
+	PC       int
+	Mnemonic string
+	Address  int
+	Size     int
+	Value    int
+	Write    bool
+}
+
+type Emulator struct {
+	Mem      []byte
+	PC       int
+	PSW      PSW
+	Steps    int
+	Halted   bool
+	Accesses []Access // accesses made inside of the watched range
+	Trace    func(instr Instruction, e *Emulator)
+
+	watchStart int
+	watchStop  int
+	instr      Instruction
+	routines   []int
+}
+
+// Returns an emulator running on a copy of a merged PRE + calibration block
+func NewEmulator(block []byte) *Emulator {
+	e := new(Emulator)
+
+	size := len(block)
+	if size < codePage+0x10000 {
+		size = codePage + 0x10000
+	}
+
+	e.Mem = make([]byte, size)
+	copy(e.Mem, block)
+
+	e.watchStart = mapStart
+	e.watchStop = mapStop
+
+	e.Reset()
+
+	return e
+}
+
+// Watch records every access between start and stop (not including stop) in Accesses
+func (e *Emulator) Watch(start, stop int) {
+	e.watchStart = start
+	e.watchStop = stop
+}
+
+// Reset puts the CPU back into its reset state
+func (e *Emulator) Reset() {
+	e.PC = resetAdr
+	e.PSW = PSW{}
+	e.Halted = false
+	e.routines = []int{resetAdr}
+
+	for adr := 0; adr < 0x18; adr++ {
+		e.Mem[adr] = 0x00
+	}
+	e.Mem[onesReg] = 0xFF
+	e.Mem[onesReg+1] = 0xFF
+
+	// The stack pointer is undefined until the code loads it
+	e.setWord(spReg, 0x0000)
+}
+
+// Interrupt services the interrupt whose vector lives at vec, taking the routine address from the interrupt vector table
+func (e *Emulator) Interrupt(vec int) error {
+	intr, ok := interruptVectors[vec]
+	if !ok {
+		return fmt.Errorf("No interrupt vector at 0x%X", vec)
+	}
+
+	if intr.Type == "PTS Service" {
+		return fmt.Errorf("PTS service is not emulated (%s)", intr.InterruptSource)
+	}
+
+	e.pushPC()
+	e.PSW.I = false
+	e.PC = codePage | e.readExt(vec, 16)
+	e.routines = append(e.routines, e.PC)
+
+	dbg(fmt.Sprintf("Interrupt [%s] - jumping to 0x%X", intr.InterruptSource, e.PC), nil)
+
+	return nil
+}
+
+// Run steps through the code until the CPU halts, an error is hit, or the step limit is reached
+func (e *Emulator) Run(steps int) error {
+	for i := 0; i < steps && !e.Halted; i++ {
+		err := e.Step()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Step runs a single instruction
+func (e *Emulator) Step() error {
+	if e.Halted {
+		return errors.New("CPU is halted")
+	}
+
+	if e.PC+10 > len(e.Mem) {
+		return fmt.Errorf("Program counter out of range: 0x%X", e.PC)
+	}
+
+	instr, err := Parse(e.Mem[e.PC:e.PC+10], e.PC)
+	if err != nil || instr.Mnemonic == "MYSTERY" {
+		// Same as the hardware, hand it to the unimplemented opcode interrupt
+		dbg(fmt.Sprintf("Unimplemented Opcode at 0x%X: %X", e.PC, e.Mem[e.PC:e.PC+2]), err)
+		e.PC++
+		return e.Interrupt(unimplementedVector)
+	}
+
+	e.instr = instr
+
+	if e.Trace != nil {
+		e.Trace(instr, e)
+	}
+
+	next := e.PC + instr.ByteLength
+	ops := instr.RawOps
+
+	e.Steps++
+
+	switch instr.Mnemonic {
+
+	case "SKIP", "NOP", "DPTS", "EPTS":
+		// Nothing to do
+
+	case "CLR":
+		e.setWord(int(ops[0]), 0)
+		e.PSW.Z, e.PSW.N, e.PSW.C, e.PSW.V = true, false, false, false
+
+	case "CLRB":
+		e.setByte(int(ops[0]), 0)
+		e.PSW.Z, e.PSW.N, e.PSW.C, e.PSW.V = true, false, false, false
+
+	case "NOT":
+		val := ^e.getWord(int(ops[0])) & 0xFFFF
+		e.setWord(int(ops[0]), val)
+		e.logic(val, 16)
+
+	case "NOTB":
+		val := ^e.getByte(int(ops[0])) & 0xFF
+		e.setByte(int(ops[0]), val)
+		e.logic(val, 8)
+
+	case "NEG":
+		val := e.sub(0, e.getWord(int(ops[0])), 16, false)
+		e.setWord(int(ops[0]), val)
+
+	case "NEGB":
+		val := e.sub(0, e.getByte(int(ops[0])), 8, false)
+		e.setByte(int(ops[0]), val)
+
+	case "INC":
+		e.setWord(int(ops[0]), e.add(e.getWord(int(ops[0])), 1, 16, false))
+
+	case "INCB":
+		e.setByte(int(ops[0]), e.add(e.getByte(int(ops[0])), 1, 8, false))
+
+	case "DEC":
+		e.setWord(int(ops[0]), e.sub(e.getWord(int(ops[0])), 1, 16, false))
+
+	case "DECB":
+		e.setByte(int(ops[0]), e.sub(e.getByte(int(ops[0])), 1, 8, false))
+
+	case "EXT":
+		val := e.getWord(int(ops[0]))
+		if val&0x8000 != 0 {
+			val |= 0xFFFF0000
+		}
+		e.setLong(int(ops[0]), val)
+		e.logic(val, 32)
+
+	case "EXTB":
+		val := e.getByte(int(ops[0]))
+		if val&0x80 != 0 {
+			val |= 0xFF00
+		}
+		e.setWord(int(ops[0]), val)
+		e.logic(val, 16)
+
+	case "SHR", "SHL", "SHRA", "SHRB", "SHLB", "SHRAB", "SHRL", "SHLL", "SHRAL":
+		e.shift(instr.Mnemonic, ops)
+
+	case "NORML":
+		e.normalize(int(ops[1]), int(ops[0]))
+
+	case "XCH", "XCHB":
+		width := e.width(instr)
+		adr, _ := e.aop(instr, width, false)
+		dest := int(ops[len(ops)-1])
+		a := e.read(adr, width)
+		b := e.read(dest, width)
+		e.write(adr, b, width)
+		e.write(dest, a, width)
+
+	case "LD", "LDB":
+		width := e.width(instr)
+		_, val := e.aop(instr, width, true)
+		e.write(int(ops[len(ops)-1]), val, width)
+
+	case "LDBZE":
+		_, val := e.aop(instr, 8, true)
+		e.setWord(int(ops[len(ops)-1]), val)
+
+	case "LDBSE":
+		_, val := e.aop(instr, 8, true)
+		if val&0x80 != 0 {
+			val |= 0xFF00
+		}
+		e.setWord(int(ops[len(ops)-1]), val)
+
+	case "ST", "STB":
+		width := e.width(instr)
+		adr, _ := e.aop(instr, width, false)
+		e.write(adr, e.read(int(ops[len(ops)-1]), width), width)
+
+	case "AND", "ANDB", "OR", "ORB", "XOR", "XORB", "ADD", "ADDB", "ADDC", "ADDCB", "SUB", "SUBB", "SUBC", "SUBCB":
+		e.arithmetic(instr)
+
+	case "CMP", "CMPB":
+		width := e.width(instr)
+		_, val := e.aop(instr, width, true)
+		e.sub(e.read(int(ops[len(ops)-1]), width), val, width, false)
+
+	case "CMPL":
+		e.sub(e.getLong(int(ops[1])), e.getLong(int(ops[0])), 32, false)
+
+	case "MULU", "MULUB", "SGN MUL", "SGN MULB":
+		e.multiply(instr)
+
+	case "DIVU", "DIVUB", "SGN DIV", "SGN DIVB":
+		e.divide(instr)
+
+	case "PUSH":
+		_, val := e.aop(instr, 16, true)
+		e.push(val)
+
+	case "POP":
+		val := e.pop()
+		adr, _ := e.aop(instr, 16, false)
+		e.write(adr, val, 16)
+
+	case "PUSHF":
+		e.push(int(e.PSW.Byte())<<8 | e.getByte(intMask))
+		e.PSW = PSW{}
+		e.setByte(intMask, 0)
+
+	case "POPF":
+		val := e.pop()
+		e.setByte(intMask, val&0xFF)
+		e.PSW.SetByte(byte(val >> 8))
+
+	case "PUSHA":
+		e.push(int(e.PSW.Byte())<<8 | e.getByte(intMask))
+		e.push(e.getByte(wsrReg)<<8 | e.getByte(intMask1))
+		e.PSW = PSW{}
+		e.setByte(intMask, 0)
+		e.setByte(intMask1, 0)
+
+	case "POPA":
+		val := e.pop()
+		e.setByte(intMask1, val&0xFF)
+		e.setByte(wsrReg, val>>8)
+		val = e.pop()
+		e.setByte(intMask, val&0xFF)
+		e.PSW.SetByte(byte(val >> 8))
+
+	case "BMOV", "BMOVI":
+		ptrs := e.getLong(int(ops[1]))
+		count := e.getWord(int(ops[0]))
+		src := ptrs & 0xFFFF
+		dst := ptrs >> 16
+		for ; count > 0; count-- {
+			e.write(dst, e.read(src, 16), 16)
+			src = (src + 2) & 0xFFFF
+			dst = (dst + 2) & 0xFFFF
+		}
+		e.setWord(int(ops[0]), 0)
+
+	case "EBMOVI":
+		ptrs := int(ops[1]) & 0xFC
+		count := e.getWord(int(ops[0]))
+		src := e.getLong(ptrs) & 0xFFFFFF
+		dst := e.getLong(ptrs+4) & 0xFFFFFF
+		for ; count > 0; count-- {
+			e.writeExt(dst, e.readExt(src, 16), 16)
+			src += 2
+			dst += 2
+		}
+		e.setLong(ptrs, src)
+		e.setLong(ptrs+4, dst)
+		e.setWord(int(ops[0]), 0)
+
+	case "ELD", "ELDB", "EST", "ESTB":
+		e.extended(instr)
+
+	case "SJMP", "LJMP", "EJMP":
+		next = e.target(instr)
+
+	case "SCALL", "LCALL", "ECALL":
+		e.PC = next
+		e.pushPC()
+		next = e.target(instr)
+		e.routines = append(e.routines, next)
+
+	case "BR":
+		next = (e.PC & 0xFF0000) | e.getWord(int(ops[0]&0xFE))
+
+	case "EBR":
+		next = e.getTreg(int(ops[0]&0xFE)) & addrMask
+
+	case "TIJMP":
+		index := e.read(e.getWord(int(ops[0])), 8) & int(ops[1])
+		tbase := e.getWord(int(ops[2]))
+		next = codePage | e.readExt(codePage|((tbase+index*2)&0xFFFF), 16)
+
+	case "RET":
+		next = e.popPC()
+		if len(e.routines) > 1 {
+			e.routines = e.routines[:len(e.routines)-1]
+		}
+
+	case "RST":
+		e.Reset()
+		return nil
+
+	case "TRAP":
+		e.PC = next
+		return e.Interrupt(trapVector)
+
+	case "IDLPD":
+		e.Halted = true
+
+	case "DI":
+		e.PSW.I = false
+
+	case "EI":
+		e.PSW.I = true
+
+	case "CLRC":
+		e.PSW.C = false
+
+	case "SETC":
+		e.PSW.C = true
+
+	case "CLRVT":
+		e.PSW.VT = false
+
+	case "JBC", "JBS":
+		bit := e.getByte(int(ops[0])) >> (instr.Op & 0x07) & 0x01
+		if (bit == 1) == (instr.Mnemonic == "JBS") {
+			next = e.target(instr)
+		}
+
+	case "DJNZ":
+		val := (e.getByte(int(ops[0])) - 1) & 0xFF
+		e.setByte(int(ops[0]), val)
+		if val != 0 {
+			next = e.target(instr)
+		}
+
+	case "DJNZW":
+		val := (e.getWord(int(ops[0])) - 1) & 0xFFFF
+		e.setWord(int(ops[0]), val)
+		if val != 0 {
+			next = e.target(instr)
+		}
+
+	case "JNST", "JNH", "JGT", "JNC", "JNVT", "JNV", "JGE", "JNE", "JST", "JH", "JLE", "JC", "JVT", "JV", "JLT", "JE":
+		if e.condition(instr.Mnemonic) {
+			next = e.target(instr)
+		}
+
+	default:
+		e.PC++
+		return e.Interrupt(unimplementedVector)
+	}
+
+	e.PC = next & addrMask
+
+	return nil
+}
+
+// Conditional jump tests
+func (e *Emulator) condition(mnemonic string) bool {
+	p := &e.PSW
+
+	switch mnemonic {
+	case "JST":
+		return p.ST
+	case "JNST":
+		return !p.ST
+	case "JH":
+		return p.C && !p.Z
+	case "JNH":
+		return !p.C || p.Z
+	case "JGT":
+		return !p.N && !p.Z
+	case "JLE":
+		return p.N || p.Z
+	case "JC":
+		return p.C
+	case "JNC":
+		return !p.C
+	case "JV":
+		return p.V
+	case "JNV":
+		return !p.V
+	case "JGE":
+		return !p.N
+	case "JLT":
+		return p.N
+	case "JE":
+		return p.Z
+	case "JNE":
+		return !p.Z
+	case "JVT":
+		// Both of the overflow trap jumps clear VT
+		vt := p.VT
+		p.VT = false
+		return vt
+	case "JNVT":
+		vt := p.VT
+		p.VT = false
+		return !vt
+	}
+	return false
+}
+
+// Jump and call destinations, relative displacements are sign extended and stay inside the current 64K page
+func (e *Emulator) target(instr Instruction) int {
+	ops := instr.RawOps
+	next := instr.Address + instr.ByteLength
+	page := next & 0xFF0000
+	disp := 0
+
+	switch instr.Mnemonic {
+	case "SJMP", "SCALL":
+		disp = getOffset([]byte{instr.Op, ops[0]})
+	case "LJMP", "LCALL":
+		disp = int(int16(uint16(ops[1])<<8 | uint16(ops[0])))
+	case "EJMP", "ECALL":
+		disp = int(ops[2])<<16 | int(ops[1])<<8 | int(ops[0])
+		if disp&0x800000 != 0 {
+			disp -= 0x1000000
+		}
+		return (next + disp) & addrMask
+	case "JBC", "JBS", "DJNZ", "DJNZW":
+		disp = int(int8(ops[1]))
+	default:
+		disp = int(int8(ops[0]))
+	}
+
+	return page | ((next + disp) & 0xFFFF)
+}
+
+// Operand width of an instruction in bits
+func (e *Emulator) width(instr Instruction) int {
+	switch instr.Mnemonic {
+	case "XCHB", "LDB", "STB", "ANDB", "ORB", "XORB", "ADDB", "ADDCB", "SUBB", "SUBCB", "CMPB", "ELDB", "ESTB":
+		return 8
+	}
+	return 16
+}
+
+// aop resolves the addressing mode operand (always the first operand bytes) into an address,
+// and reads width bits from it when load is set. Immediate operands return an address of -1.
+func (e *Emulator) aop(instr Instruction, width int, load bool) (int, int) {
+	ops := instr.RawOps
+	adr := -1
+	val := 0
+
+	switch instr.AddressingMode {
+
+	case "direct":
+		adr = int(ops[0])
+
+	case "immediate":
+		val = int(ops[0])
+		if width == 16 {
+			val |= int(ops[1]) << 8
+		}
+		return adr, val
+
+	case "indirect", "indirect+":
+		reg := int(ops[0] & 0xFE)
+		adr = e.getWord(reg)
+		if instr.AutoIncrement {
+			e.setWord(reg, (adr+width/8)&0xFFFF)
+		}
+
+	case "short-indexed":
+		reg := int(ops[0] & 0xFE)
+		adr = (e.getWord(reg) + int(int8(ops[1]))) & 0xFFFF
+
+	case "long-indexed":
+		reg := int(ops[0] & 0xFE)
+		adr = (e.getWord(reg) + (int(ops[2])<<8 | int(ops[1]))) & 0xFFFF
+	}
+
+	if load {
+		val = e.read(adr, width)
+	}
+
+	return adr, val
+}
+
+// Two and three operand logic and arithmetic
+func (e *Emulator) arithmetic(instr Instruction) {
+	ops := instr.RawOps
+	width := e.width(instr)
+	_, val := e.aop(instr, width, true)
+
+	dest := int(ops[len(ops)-1])
+	src := dest
+	if instr.VarCount == 3 {
+		src = int(ops[len(ops)-2])
+	}
+	a := e.read(src, width)
+
+	var res int
+	switch instr.Mnemonic {
+	case "AND", "ANDB":
+		res = a & val
+		e.logic(res, width)
+	case "OR", "ORB":
+		res = a | val
+		e.logic(res, width)
+	case "XOR", "XORB":
+		res = a ^ val
+		e.logic(res, width)
+	case "ADD", "ADDB":
+		res = e.add(a, val, width, false)
+	case "ADDC", "ADDCB":
+		res = e.add(a, val, width, true)
+	case "SUB", "SUBB":
+		res = e.sub(a, val, width, false)
+	case "SUBC", "SUBCB":
+		res = e.sub(a, val, width, true)
+	}
+
+	e.write(dest, res, width)
+}
+
+func (e *Emulator) multiply(instr Instruction) {
+	ops := instr.RawOps
+	signed := instr.Signed
+	byteMode := instr.Mnemonic == "MULUB" || instr.Mnemonic == "SGN MULB"
+
+	width := 16
+	if byteMode {
+		width = 8
+	}
+	_, val := e.aop(instr, width, true)
+
+	dest := int(ops[len(ops)-1])
+	src := dest
+	if instr.VarCount == 3 {
+		src = int(ops[len(ops)-2])
+	}
+	a := e.read(src, width)
+
+	if signed {
+		a = signExtend(a, width)
+		val = signExtend(val, width)
+	}
+
+	res := a * val
+	if byteMode {
+		e.setWord(dest, res&0xFFFF)
+	} else {
+		e.setLong(dest, res&0xFFFFFFFF)
+	}
+}
+
+func (e *Emulator) divide(instr Instruction) {
+	ops := instr.RawOps
+	signed := instr.Signed
+	byteMode := instr.Mnemonic == "DIVUB" || instr.Mnemonic == "SGN DIVB"
+
+	width := 16
+	if byteMode {
+		width = 8
+	}
+	_, divisor := e.aop(instr, width, true)
+
+	dest := int(ops[len(ops)-1])
+	dividend := e.read(dest, width*2)
+
+	if signed {
+		dividend = signExtend(dividend, width*2)
+		divisor = signExtend(divisor, width)
+	}
+
+	if divisor == 0 {
+		// Results are undefined, the hardware sets V
+		e.PSW.V = true
+		e.PSW.VT = true
+		return
+	}
+
+	quotient := dividend / divisor
+	remainder := dividend % divisor
+	mask := 1<<uint(width) - 1
+
+	if signed {
+		e.PSW.V = quotient > mask>>1 || quotient < -(mask>>1)-1
+	} else {
+		e.PSW.V = quotient > mask
+	}
+	if e.PSW.V {
+		e.PSW.VT = true
+	}
+
+	e.write(dest, (remainder&mask)<<uint(width)|quotient&mask, width*2)
+}
+
+// ELD, ELDB, EST, ESTB
+func (e *Emulator) extended(instr Instruction) {
+	ops := instr.RawOps
+	width := e.width(instr)
+
+	treg := int(ops[0] & 0xFE)
+	reg := int(ops[len(ops)-1])
+	adr := e.getTreg(treg)
+
+	if instr.AddressingMode == "extended-indexed" {
+		adr += int(ops[3])<<16 | int(ops[2])<<8 | int(ops[1])
+	} else if ops[0]&0x01 == 0x01 {
+		e.setLong(treg, adr+width/8)
+	}
+
+	adr &= addrMask
+
+	if instr.Mnemonic == "ELD" || instr.Mnemonic == "ELDB" {
+		e.write(reg, e.readExt(adr, width), width)
+	} else {
+		e.writeExt(adr, e.read(reg, width), width)
+	}
+}
+
+func (e *Emulator) shift(mnemonic string, ops []byte) {
+	count := int(ops[0])
+	if count >= 0x10 {
+		count = e.getByte(count) & 0x1F
+	}
+
+	width := 16
+	switch mnemonic {
+	case "SHRB", "SHLB", "SHRAB":
+		width = 8
+	case "SHRL", "SHLL", "SHRAL":
+		width = 32
+	}
+
+	dest := int(ops[1])
+	val := e.read(dest, width)
+	mask := 1<<uint(width) - 1
+	sign := 1 << uint(width-1)
+
+	e.PSW.ST = false
+	e.PSW.V = false
+
+	for i := 0; i < count; i++ {
+		switch mnemonic {
+		case "SHL", "SHLB", "SHLL":
+			e.PSW.C = val&sign != 0
+			val = (val << 1) & mask
+			if (val&sign != 0) != e.PSW.C {
+				e.PSW.V = true
+				e.PSW.VT = true
+			}
+		default:
+			if e.PSW.C {
+				e.PSW.ST = true
+			}
+			e.PSW.C = val&1 != 0
+			if mnemonic == "SHRA" || mnemonic == "SHRAB" || mnemonic == "SHRAL" {
+				val = (val >> 1) | (val & sign)
+			} else {
+				val >>= 1
+			}
+		}
+	}
+
+	e.PSW.Z = val == 0
+	e.PSW.N = val&sign != 0
+	e.write(dest, val, width)
+}
+
+func (e *Emulator) normalize(lreg, breg int) {
+	val := e.getLong(lreg)
+	count := 0
+
+	for count < 31 && val&0x80000000 == 0 && val != 0 {
+		val = (val << 1) & 0xFFFFFFFF
+		count++
+	}
+
+	e.setLong(lreg, val)
+	e.setByte(breg, count)
+
+	e.PSW.Z = val == 0
+	e.PSW.N = val&0x80000000 != 0
+	e.PSW.C = false
+}
+
+// Flags for AND, OR, XOR, NOT, EXT
+func (e *Emulator) logic(val, width int) {
+	e.PSW.Z = val&(1<<uint(width)-1) == 0
+	e.PSW.N = val&(1<<uint(width-1)) != 0
+	e.PSW.C = false
+	e.PSW.V = false
+}
+
+// Addition with flags, carry adds in the C flag and leaves Z set only if it was already set
+func (e *Emulator) add(a, b, width int, carry bool) int {
+	mask := 1<<uint(width) - 1
+	sign := 1 << uint(width-1)
+
+	c := 0
+	if carry && e.PSW.C {
+		c = 1
+	}
+
+	sum := a + b + c
+	res := sum & mask
+
+	e.setFlags(res, width, carry)
+	e.PSW.C = sum > mask
+	e.PSW.V = (a&sign == b&sign) && (res&sign != a&sign)
+	if e.PSW.V {
+		e.PSW.VT = true
+	}
+
+	return res
+}
+
+// Subtraction with flags, C is set when there is no borrow
+func (e *Emulator) sub(a, b, width int, borrow bool) int {
+	mask := 1<<uint(width) - 1
+	sign := 1 << uint(width-1)
+
+	c := 0
+	if borrow && !e.PSW.C {
+		c = 1
+	}
+
+	diff := a - b - c
+	res := diff & mask
+
+	e.setFlags(res, width, borrow)
+	e.PSW.C = diff >= 0
+	e.PSW.V = (a&sign != b&sign) && (res&sign != a&sign)
+	if e.PSW.V {
+		e.PSW.VT = true
+	}
+
+	return res
+}
+
+func (e *Emulator) setFlags(res, width int, sticky bool) {
+	if sticky {
+		e.PSW.Z = e.PSW.Z && res == 0
+	} else {
+		e.PSW.Z = res == 0
+	}
+	e.PSW.N = res&(1<<uint(width-1)) != 0
+}
+
+func signExtend(val, width int) int {
+	sign := 1 << uint(width-1)
+	if val&sign != 0 {
+		return val - (sign << 1)
+	}
+	return val
+}
+
+// Stack
+func (e *Emulator) push(val int) {
+	sp := (e.getWord(spReg) - 2) & 0xFFFF
+	e.setWord(spReg, sp)
+	e.write(sp, val, 16)
+}
+
+func (e *Emulator) pop() int {
+	sp := e.getWord(spReg)
+	val := e.read(sp, 16)
+	e.setWord(spReg, (sp+2)&0xFFFF)
+	return val
+}
+
+// The 24-bit PC takes up two words on the stack
+func (e *Emulator) pushPC() {
+	sp := (e.getWord(spReg) - 4) & 0xFFFF
+	e.setWord(spReg, sp)
+	e.write(sp, e.PC&0xFFFFFF, 32)
+}
+
+func (e *Emulator) popPC() int {
+	sp := e.getWord(spReg)
+	pc := e.read(sp, 32) & addrMask
+	e.setWord(spReg, (sp+4)&0xFFFF)
+	return pc
+}
+
+// Memory
+////////////////..........
+
+// Maps a 16-bit data address into the 24-bit address space
+func (e *Emulator) phys(adr int) int {
+	adr &= 0xFFFF
+
+	// A copy of internal ROM (FF2400–FF3FFFH) if CCB1.2=0
+	if adr >= 0x2400 && adr <= 0x3FFF {
+		return codePage | adr
+	}
+	return adr
+}
+
+// Maps a 24-bit address, page FFH code/data RAM is the same as page 00H
+func (e *Emulator) physExt(adr int) int {
+	adr &= addrMask
+	if adr >= codePage+0x0400 && adr <= codePage+0x0FFF {
+		return adr - codePage
+	}
+	return adr
+}
+
+func (e *Emulator) read(adr, width int) int {
+	return e.readExt(e.phys(adr), width)
+}
+
+func (e *Emulator) write(adr, val, width int) {
+	e.writeExt(e.phys(adr), val, width)
+}
+
+func (e *Emulator) readExt(adr, width int) int {
+	adr = e.physExt(adr)
+	val := 0
+
+	for i := 0; i < width/8; i++ {
+		if adr+i < len(e.Mem) {
+			val |= int(e.Mem[adr+i]) << uint(i*8)
+		}
+	}
+
+	e.watch(adr, width, val, false)
+
+	return val
+}
+
+func (e *Emulator) writeExt(adr, val, width int) {
+	adr = e.physExt(adr)
+
+	e.watch(adr, width, val, true)
+
+	for i := 0; i < width/8; i++ {
+		a := adr + i
+
+		// The zero and ones registers can't be written
+		if a < 0x04 || a >= len(e.Mem) {
+			continue
+		}
+
+		// Flash can only be changed with the erase / program routines
+		if a >= 0x100000 && (a < codePage+0x0400 || a > codePage+0x0FFF) {
+			dbg(fmt.Sprintf("Write to flash at 0x%X from 0x%X ignored", a, e.PC), nil)
+			continue
+		}
+
+		e.Mem[a] = byte(val >> uint(i*8))
+	}
+}
+
+func (e *Emulator) watch(adr, width, val int, write bool) {
+	if adr >= e.watchStart && adr < e.watchStop {
+		routine := e.routines[len(e.routines)-1]
+		e.Accesses = append(e.Accesses, Access{Routine: routine, PC: e.PC, Mnemonic: e.instr.Mnemonic, Address: adr, Size: width / 8, Value: val, Write: write})
+	}
+}
+
+// Register file helpers, registers are never watched
+func (e *Emulator) getByte(reg int) int {
+	return int(e.Mem[reg&0xFFFF])
+}
+
+func (e *Emulator) getWord(reg int) int {
+	reg &= 0xFFFE
+	return int(e.Mem[reg]) | int(e.Mem[reg+1])<<8
+}
+
+func (e *Emulator) getLong(reg int) int {
+	reg &= 0xFFFC
+	return e.getWord(reg) | e.getWord(reg+2)<<16
+}
+
+// 24-bit pointers, a treg of ZERO_REG is used for absolute addresses
+func (e *Emulator) getTreg(reg int) int {
+	if reg&0xFFFC == zeroReg {
+		return 0
+	}
+	return e.getLong(reg) & 0xFFFFFF
+}
+
+func (e *Emulator) setByte(reg, val int) {
+	reg &= 0xFFFF
+	if reg < 0x04 {
+		return
+	}
+	e.Mem[reg] = byte(val)
+}
+
+func (e *Emulator) setWord(reg, val int) {
+	e.setByte(reg&0xFFFE, val)
+	e.setByte(reg&0xFFFE+1, val>>8)
+}
+
+func (e *Emulator) setLong(reg, val int) {
+	e.setWord(reg&0xFFFC, val)
+	e.setWord(reg&0xFFFC+2, val>>16)
+}
+
+// Emulate runs the calibration from the reset address and logs what it reads from the map area
+func (h *DisAsm) Emulate(steps int, trace bool) error {
+
+	h.GetInterrupts()
+
+	e := NewEmulator(h.block)
+
+	if trace {
+		e.Trace = func(instr Instruction, e *Emulator) {
+			address := addSpaces(fmt.Sprintf("[0x%X]", instr.Address), 20)
+			shortDesc := addSpaces(fmt.Sprintf("%s %X", instr.Mnemonic, instr.Raw), 45)
+			flags := addSpaces(fmt.Sprintf("SP: 0x%.4X  PSW: %s", e.getWord(spReg), e.PSW), 45)
+			log(address+shortDesc+flags+instr.PseudoCode, nil)
+		}
+	}
+
+	log(fmt.Sprintf("Emulate - starting at 0x%X, running %d steps", e.PC, steps), nil)
+
+	err := e.Run(steps)
+	if err != nil {
+		log(fmt.Sprintf("Emulate - stopped at 0x%X after %d steps", e.PC, e.Steps), err)
+	}
+
+	for _, access := range e.Accesses {
+		kind := "READ "
+		if access.Write {
+			kind = "WRITE"
+		}
+
+		routine := fmt.Sprintf("SUBROUTINE_ 0x%X", access.Routine)
+		if name := h.intRoutineNames[access.Routine]; name != "" {
+			routine = "INTERRUPT ROUTINE_ " + name
+		}
+
+		address := addSpaces(fmt.Sprintf("[0x%X]", access.PC), 20)
+		shortDesc := addSpaces(fmt.Sprintf("%s %s 0x%X (%d bytes) = 0x%X", kind, access.Mnemonic, access.Address, access.Size, access.Value), 60)
+
+		log(address+shortDesc+routine, nil)
+	}
+
+	log(fmt.Sprintf("Emulate - ran %d steps, PC: 0x%X, map accesses: %d", e.Steps, e.PC, len(e.Accesses)), nil)
+
+	return err
+}
@@ -0,0 +1,104 @@
+package disasm
+
+import (
+	"testing"
+)
+
+// Emulator Tests
+////////////////..........
+
+const testStack = 0x0200
+
+// newTestEmulator returns an emulator on an empty block with code at adr and a stack in internal RAM
+func newTestEmulator(adr int, code ...byte) *Emulator {
+	e := NewEmulator(nil)
+	copy(e.Mem[adr:], code)
+	e.PC = adr
+	e.setWord(spReg, testStack)
+	return e
+}
+
+func step(t *testing.T, e *Emulator, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		if err := e.Step(); err != nil {
+			t.Fatalf("step at 0x%X: %s", e.PC, err)
+		}
+	}
+}
+
+func TestEmulatorInterrupt(t *testing.T) {
+	// TRAP at 0x172100, its routine at 0x173000 returns
+	e := newTestEmulator(0x172100, 0xF7)
+	e.Mem[trapVector], e.Mem[trapVector+1] = 0x00, 0x30
+	e.Mem[0x173000] = 0xF0
+
+	// The same offset in the register file isn't the vector
+	e.Mem[trapVector&0xFFFF], e.Mem[trapVector&0xFFFF+1] = 0x34, 0x12
+
+	e.PSW.I = true
+	step(t, e, 1)
+	if e.PC != 0x173000 || e.PSW.I {
+		t.Fatalf("TRAP went to 0x%X, interrupts %t", e.PC, e.PSW.I)
+	}
+	if sp, ret := e.getWord(spReg), e.read(testStack-4, 32); sp != testStack-4 || ret != 0x172101 {
+		t.Errorf("stack at 0x%X holds 0x%X", sp, ret)
+	}
+	if len(e.routines) != 2 || e.routines[1] != 0x173000 {
+		t.Errorf("routines %X", e.routines)
+	}
+
+	step(t, e, 1)
+	if e.PC != 0x172101 || e.getWord(spReg) != testStack {
+		t.Errorf("RET went to 0x%X with the stack at 0x%X", e.PC, e.getWord(spReg))
+	}
+
+	// PTS vectors aren't serviced
+	for vec, intr := range interruptVectors {
+		if intr.Type == "PTS Service" {
+			if err := e.Interrupt(vec); err == nil {
+				t.Errorf("0x%X: PTS serviced", vec)
+			}
+			break
+		}
+	}
+}
+
+func TestEmulatorPushfPopf(t *testing.T) {
+	e := newTestEmulator(0x172100, 0xF2, 0xF3)
+	e.PSW = PSW{Z: true, C: true, I: true, ST: true}
+	e.setByte(intMask, 0x5A)
+
+	step(t, e, 1)
+	if e.PSW != (PSW{}) || e.getByte(intMask) != 0 {
+		t.Errorf("PUSHF left %s, mask 0x%.2X", e.PSW, e.getByte(intMask))
+	}
+	if val := e.read(testStack-2, 16); val != 0x8B5A {
+		t.Errorf("PUSHF pushed 0x%.4X", val)
+	}
+
+	e.PSW.N = true
+	step(t, e, 1)
+	if e.PSW != (PSW{Z: true, C: true, I: true, ST: true}) || e.getByte(intMask) != 0x5A || e.getWord(spReg) != testStack {
+		t.Errorf("POPF left %s, mask 0x%.2X", e.PSW, e.getByte(intMask))
+	}
+}
+
+func TestEmulatorCallAcrossPages(t *testing.T) {
+	// ECALL from page 17H to 0x140000 and back
+	e := newTestEmulator(0x172100, 0xF1, 0xFC, 0xDE, 0xFC)
+	e.Mem[0x140000] = 0xF0
+
+	step(t, e, 1)
+	if e.PC != 0x140000 {
+		t.Fatalf("ECALL went to 0x%X", e.PC)
+	}
+	if ret := e.read(testStack-4, 32); ret != 0x172104 {
+		t.Errorf("ECALL pushed 0x%X", ret)
+	}
+
+	step(t, e, 1)
+	if e.PC != 0x172104 || e.getWord(spReg) != testStack {
+		t.Errorf("RET went to 0x%X with the stack at 0x%X", e.PC, e.getWord(spReg))
+	}
+}
@@ -28,9 +28,15 @@ func Parse(in []byte, address int) (Instruction, error) {
 		instruction.Signed = signed
 		instruction.Address = address
 
+		// The first operand byte comes after the prefix on signed instructions
+		first := 1
+		if signed {
+			first = 2
+		}
+
 		// Check for Indexed Addressing Mode Instruction Type
 		if instruction.AddressingMode == "indexed" && instruction.VariableLength == true {
-			if in[1]&1 == 1 {
+			if in[first]&1 == 1 {
 				instruction.ByteLength++
 				instruction.AddressingMode = "long-indexed"
 			} else {
@@ -39,8 +45,8 @@ func Parse(in []byte, address int) (Instruction, error) {
 		}
 
 		// Check for Indirect Addressing Mode Instruction Type
-		if instruction.AddressingMode == "indirect" {
-			if in[1]&1 == 1 {
+		if instruction.AddressingMode == "indirect" && instruction.ByteLength > 1 {
+			if in[first]&1 == 1 {
 				instruction.AddressingMode = "indirect+"
 				instruction.AutoIncrement = true
 			}
@@ -314,29 +320,23 @@ func (instr *Instruction) Jump(s string, v int) {
 // Do Pseudo
 func (instr *Instruction) doPseudo() {
 	var v [3]string
+	var src1 string // first source of the three operand instructions
 
-Loop:
 	for _, varStr := range instr.VarStrings {
 
-		if instr.Mnemonic == "DJNZ" || instr.Mnemonic == "DJNZW" {
-			v[0] = instr.Vars["cadd"].Value
-			v[1] = instr.Vars["breg"].Value
-			break Loop
-		}
-
 		val := instr.Vars[varStr].Value
 		val = strings.Replace(val, "[R_00 ~(Zero Register)]", "", 1)
 		val = strings.Replace(val, "R_", "$r_", 1)
 		val = strings.Replace(val, "[$r_00]", "", 1)
 		val = strings.Replace(val, "$r_00", "0x00", 1)
 		val = strings.Replace(val, "$r_02", "0x11", 1)
-		val = strings.Replace(val, " ~(", " (", 1)
+		val = strings.Replace(val, " ~(", " (", -1)
 		val = strings.Replace(val, " ~", "", 1)
 		val = strings.Replace(val, "$r_02 (Ones Register)", "0x11", 1)
 		val = strings.Replace(val, " (Ones Register)", "", 1)
 		val = strings.Replace(val, "#", "0x", 1)
 
-		val = strings.Replace(val, " ( GP Reg RAM )", "", 1)
+		val = strings.Replace(val, " ( GP Reg RAM )", "", -1)
 
 		switch instr.Vars[varStr].Type {
 		case "DEST":
@@ -347,13 +347,21 @@ Loop:
 			v[0] = val
 		case "PTRS":
 			v[0] = val
-		case "BYTEREG":
+		case "BYTEREG", "IMMED":
 			v[2] = val
+		case "SRC1":
+			src1 = val
 		default:
 			v[1] = val
 		}
 	}
 
+	// Two operand instructions use the destination as the first source
+	lhs := v[0]
+	if src1 != "" {
+		lhs = src1
+	}
+
 	switch instr.Mnemonic {
 
 	case "CLR", "CLRB":
@@ -374,9 +382,12 @@ Loop:
 	case "JBC":
 		instr.PseudoCode = fmt.Sprintf("if bitno: (%s) of %s is clear { JUMP TO: %s }", v[1], v[2], v[0])
 
-	case "LJMP", "SJMP", "EBR", "EJMP":
+	case "LJMP", "SJMP", "BR", "EBR", "EJMP":
 		instr.PseudoCode = fmt.Sprintf("JUMP TO: %s", v[0])
 
+	case "TIJMP":
+		instr.PseudoCode = fmt.Sprintf("JUMP TO: TABLE %s[(%s & %s) * 2]", v[0], v[1], v[2])
+
 	case "ECALL", "CALL", "SCALL", "LCALL":
 		instr.PseudoCode = fmt.Sprintf("CALL SUB_ %s", v[0])
 
@@ -389,8 +400,8 @@ Loop:
 	case "CMPB", "CMP", "CMPL":
 		instr.PseudoCode = fmt.Sprintf("if (%s == %s) {", v[0], v[1])
 
-	case "ANDB", "AND", "ADDB":
-		instr.PseudoCode = fmt.Sprintf("%s = %s & %s", v[0], v[0], v[1])
+	case "ANDB", "AND":
+		instr.PseudoCode = fmt.Sprintf("%s = %s & %s", v[0], lhs, v[1])
 
 	case "ORB", "OR", "XOR", "XORB":
 		instr.PseudoCode = fmt.Sprintf("%s = %s %s %s", v[0], v[0], instr.Mnemonic, v[1])
@@ -398,25 +409,25 @@ Loop:
 	case "NOT", "NOTB", "NEG", "NEGB":
 		instr.PseudoCode = fmt.Sprintf("%s = %s %s %s", v[0], v[0], instr.Mnemonic, v[0])
 
-	case "ADD", "ADDC", "ADDCB":
-		instr.PseudoCode = fmt.Sprintf("%s = %s + %s", v[0], v[0], v[1])
+	case "ADD", "ADDB", "ADDC", "ADDCB":
+		instr.PseudoCode = fmt.Sprintf("%s = %s + %s", v[0], lhs, v[1])
 
 	case "XCH", "XCHB":
 		instr.PseudoCode = fmt.Sprintf("%s <=%s=> %s", v[0], instr.Mnemonic, v[1])
 
 	case "SUB", "SUBC", "SUBCB", "SUBB":
-		instr.PseudoCode = fmt.Sprintf("%s = %s - %s", v[0], v[0], v[1])
+		instr.PseudoCode = fmt.Sprintf("%s = %s - %s", v[0], lhs, v[1])
 
 	case "MUL", "MULB", "MULU", "MULUB", "SGN MUL", "SGN MULB":
-		instr.PseudoCode = fmt.Sprintf("%s = %s * %s", v[0], v[0], v[1])
+		instr.PseudoCode = fmt.Sprintf("%s = %s * %s", v[0], lhs, v[1])
 
 	case "DIV", "DIVU", "DIVUB", "SGN DIVB", "SGN DIV":
 		instr.PseudoCode = fmt.Sprintf("%s = %s / %s", v[0], v[0], v[1])
 
-	case "SHR", "SHRL", "SHRAL", "SHRB":
+	case "SHR", "SHRL", "SHRB", "SHRA", "SHRAL", "SHRAB":
 		instr.PseudoCode = fmt.Sprintf("%s >> %s", v[0], v[1])
 
-	case "SHL", "SHLL", "SHLB", "SHRA":
+	case "SHL", "SHLL", "SHLB":
 		instr.PseudoCode = fmt.Sprintf("%s << %s", v[0], v[1])
 
 	case "DEC", "DECB":
@@ -428,10 +439,10 @@ Loop:
 	case "LD", "LDB", "ELD", "ELDB", "STB", "ESTB", "ST", "EST", "LDBZE", "LDBSE":
 		instr.PseudoCode = fmt.Sprintf("%s = %s", v[0], v[1])
 
-	case "NORML": // TODO
-		instr.PseudoCode = fmt.Sprintf("NORMALIZE %s (todo)", v[0])
+	case "NORML":
+		instr.PseudoCode = fmt.Sprintf("NORMALIZE %s, SHIFT COUNT TO %s", v[1], v[0])
 
-	case "BMOV", "BMOVI":
+	case "BMOV", "BMOVI", "EBMOVI":
 		instr.PseudoCode = fmt.Sprintf("BMOV %s count(%s) (todo)", v[0], v[1])
 
 	case "DJNZ", "DJNZW":
@@ -509,7 +520,7 @@ func (instr *Instruction) doSCALL() {
 // JBC
 func (instr *Instruction) doJBC() {
 	vars := map[string]Variable{}
-	offset := int(instr.RawOps[1])
+	offset := int(int8(instr.RawOps[1]))
 
 	breg := VarObjs["breg"]
 
@@ -546,7 +557,7 @@ func (instr *Instruction) doJBC() {
 // JBS
 func (instr *Instruction) doJBS() {
 	vars := map[string]Variable{}
-	offset := int(instr.RawOps[1])
+	offset := int(int8(instr.RawOps[1]))
 
 	breg := VarObjs["breg"]
 
@@ -583,7 +594,7 @@ func (instr *Instruction) doJBS() {
 // CONDJMP
 func (instr *Instruction) doCONDJMP() {
 	vars := map[string]Variable{}
-	offset := int(instr.RawOps[0])
+	offset := int(int8(instr.RawOps[0]))
 
 	str := "0x%X"
 	val := instr.Address + instr.ByteLength + offset
@@ -635,18 +646,18 @@ func (instr *Instruction) doE0() {
 
 	case 0xE0, 0xE1:
 		// DJNZ, DJNZW
-		offset := int(instr.RawOps[1])
+		offset := int(int8(instr.RawOps[1]))
 
-		breg := VarObjs["breg"]
+		reg := VarObjs[instr.VarStrings[0]]
 
 		val := int(instr.RawOps[0])
 		str := "R_%X"
 		str = regName(str, val)
 		instr.XRef(str, val)
 
-		breg.Value = fmt.Sprintf(str, val)
-		breg.Type = instr.VarTypes[0]
-		vars["breg"] = breg
+		reg.Value = fmt.Sprintf(str, val)
+		reg.Type = instr.VarTypes[0]
+		vars[instr.VarStrings[0]] = reg
 
 		val = instr.Address + instr.ByteLength + offset
 		str = "0x%X"
@@ -746,6 +757,57 @@ func (instr *Instruction) doE0() {
 
 		instr.Checked = true
 
+	case 0xE2:
+		// TIJMP
+
+		index := VarObjs["wreg"]
+		val := int(instr.RawOps[0])
+		str := "[R_%02X]"
+		str = regName(str, val)
+		instr.XRef(str, val)
+		index.Value = fmt.Sprintf(str, val)
+		index.Type = instr.VarTypes[1]
+		vars["INDEX"] = index
+
+		mask := VarObjs["baop"]
+		mask.Value = fmt.Sprintf("0x%02X", instr.RawOps[1])
+		mask.Type = instr.VarTypes[2]
+		vars["#MASK"] = mask
+
+		// The table targets are only known once the crawler has tracked TBASE
+		tbase := VarObjs["wreg"]
+		val = int(instr.RawOps[2])
+		str = "R_%02X"
+		str = regName(str, val)
+		instr.XRef(str, val)
+		tbase.Value = fmt.Sprintf(str, val)
+		tbase.Type = instr.VarTypes[0]
+		vars["TBASE"] = tbase
+
+		instr.Checked = true
+
+	case 0xE4:
+		// EBMOVI, the count register comes first
+		cnt := VarObjs["wreg"]
+		val := int(instr.RawOps[0])
+		str := "R_%02X"
+		str = regName(str, val)
+		instr.XRef(str, val)
+		cnt.Value = fmt.Sprintf(str, val)
+		cnt.Type = instr.VarTypes[1]
+		vars["wreg"] = cnt
+
+		ptrs := VarObjs["prt2_reg"]
+		val = int(instr.RawOps[1])
+		str = "R_%02X"
+		str = regName(str, val)
+		instr.XRef(str, val)
+		ptrs.Value = fmt.Sprintf(str, val)
+		ptrs.Type = instr.VarTypes[0]
+		vars["prt2_reg"] = ptrs
+
+		instr.Checked = true
+
 	case 0xE3:
 		// BR / EBR
 
@@ -761,10 +823,10 @@ func (instr *Instruction) doE0() {
 			val &= 0xFE
 		}
 
+		// The destination is only known once the crawler has tracked the register
 		vo := VarObjs[instr.VarStrings[0]]
 		str := "[R_%02X]"
 		str = regName(str, val)
-		instr.Jump(str, val)
 		instr.XRef(str, val)
 
 		vo.Value = fmt.Sprintf(str, val)
@@ -780,11 +842,12 @@ func (instr *Instruction) doE0() {
 		b1 := instr.RawOps[0]
 		b2 := instr.RawOps[1]
 
-		offset := int(b2)<<8 | int(b1)
+		offset := int(int16(b2)<<8 | int16(b1))
 
+		// Wraps inside the current 64K page
 		cadd := VarObjs["cadd"]
 		str := "0x%X"
-		val := int(instr.Address + instr.ByteLength + offset)
+		val := instr.Address&0xFF0000 | (instr.Address+instr.ByteLength+offset)&0xFFFF
 
 		str = regName(str, val)
 		if instr.Mnemonic == "LCALL" {
@@ -829,117 +892,9 @@ func (instr *Instruction) doC0() {
 		}
 
 	} else {
-
-		switch instr.AddressingMode {
-
-		case "immediate":
-			for i, varStr := range instr.VarStrings {
-				vo := VarObjs[varStr]
-
-				val := int(instr.RawOps[1])<<8 | int(instr.RawOps[0])
-				str := "#%04X"
-				str = regName(str, val)
-				instr.XRef(str, val)
-
-				vo.Value = fmt.Sprintf(str, val)
-				vo.Type = instr.VarTypes[i]
-				vars[varStr] = vo
-			}
-			instr.Checked = true
-
-		case "indirect", "indirect+":
-			b := len(instr.RawOps) - 1
-			for i, varStr := range instr.VarStrings {
-				str := "R_%02X"
-				val := int(instr.RawOps[b] & 0xFE)
-				if b == 0 {
-					str = "[R_%02X]"
-					if instr.AutoIncrement == true {
-						str = str + "+"
-						val = val & 0xFE
-					}
-				}
-
-				str = regName(str, val)
-
-				vo := VarObjs[varStr]
-				vo.Value = fmt.Sprintf(str, val)
-				vo.Type = instr.VarTypes[i]
-				vars[varStr] = vo
-				b--
-			}
-			instr.Checked = true
-
-		case "indexed", "short-indexed":
-
-			// byte offset
-			b := len(instr.RawOps) - 1
-			for i, varStr := range instr.VarStrings {
-				vo := VarObjs[varStr]
-				val := int(instr.RawOps[b])
-				str := "R_%02X"
-				str = regName(str, val)
-				instr.XRef(str, val)
-
-				if i+1 == instr.VarCount {
-
-					offset := int(instr.RawOps[b])
-					offStr := "0x%02X"
-					offStr = regName(offStr, offset)
-					instr.XRef(offStr, offset)
-
-					val = int(instr.RawOps[b-1] & 0xFE)
-					str = "[R_%02X"
-
-					str = fmt.Sprintf(offStr+str+"]", offset, val)
-					str = regName(str, val)
-					vo.Value = str
-				} else {
-					vo.Value = fmt.Sprintf(str, val)
-				}
-
-				vo.Type = instr.VarTypes[i]
-				vars[varStr] = vo
-				b--
-			}
-			instr.Checked = true
-
-		case "long-indexed":
-
-			// word offset
-			b := len(instr.RawOps) - 1
-			for i, varStr := range instr.VarStrings {
-				vo := VarObjs[varStr]
-				val := int(instr.RawOps[b])
-				str := "R_%02X"
-
-				if i+1 == instr.VarCount {
-
-					offset := int(instr.RawOps[b])<<8 | int(instr.RawOps[b-1])
-					offStr := "0x%04X"
-					offStr = regName(offStr, offset)
-					instr.XRef(offStr, offset)
-
-					val := int(instr.RawOps[b-2] & 0xFE)
-					str := "[R_%02X"
-					str = regName(str, val)
-					instr.XRef(str, val)
-
-					value := fmt.Sprintf(offStr+str+"]", offset, val)
-					vo.Value = value
-				} else {
-					str = regName(str, val)
-					vo.Value = fmt.Sprintf(str, val)
-					instr.XRef(str, val)
-				}
-
-				vo.Type = instr.VarTypes[i]
-				vars[varStr] = vo
-				b--
-			}
-			instr.Checked = true
-		}
-
+		// Everything else is laid out like the middle opcodes
+		instr.doMIDDLE()
+		return
 	}
 
 	instr.Vars = vars
@@ -951,7 +906,13 @@ func (instr *Instruction) doC0() {
 func (instr *Instruction) do00() {
 	vars := map[string]Variable{}
 
-	if instr.Op == 0x1F || instr.Op == 0x1D {
+	// XCH and XCHB have indexed forms laid out like the middle opcodes
+	if instr.Op == 0x0B || instr.Op == 0x1B {
+		instr.doMIDDLE()
+		return
+	}
+
+	if strings.HasPrefix(instr.AddressingMode, "extended") {
 		switch instr.AddressingMode {
 
 		case "extended-indexed":
@@ -1024,10 +985,12 @@ func (instr *Instruction) do00() {
 			val := int(instr.RawOps[b])
 			str := "R_%02X"
 			str = regName(str, val)
-			instr.XRef(str, val)
 
+			// Shift counts below 0x10 are immediates, not registers
 			if (instr.Op&0x08 == 0x08) && b == 0 && instr.Op != 0x0F && (instr.RawOps[0] < 0x10) {
 				str = "#%02X"
+			} else {
+				instr.XRef(str, val)
 			}
 
 			vo.Value = fmt.Sprintf(str, val)
@@ -1065,7 +1028,7 @@ func (instr *Instruction) doMIDDLE() {
 		instr.Checked = true
 
 	case "immediate":
-		if instr.Op&0x10 == 0x10 {
+		if instr.VarStrings[len(instr.VarStrings)-1] == "baop" {
 			// byte const
 			b := len(instr.RawOps) - 1
 			for i, varStr := range instr.VarStrings {
@@ -1209,6 +1172,14 @@ func (instr *Instruction) doMIDDLE() {
 
 }
 
+// Opcodes returns the opcode table, signed ones are the opcodes that follow the 0xFE prefix
+func Opcodes(signed bool) map[byte]Instruction {
+	if signed {
+		return signedInstructions
+	}
+	return unsignedInstructions
+}
+
 var unsignedInstructions = map[byte]Instruction{
 	0x00: Instruction{
 		Mnemonic:        "SKIP",
@@ -1295,7 +1266,7 @@ var unsignedInstructions = map[byte]Instruction{
 		ByteLength:      2,
 		VarCount:        1,
 		VarTypes:        []string{"DEST"},
-		VarStrings:      []string{"breg"},
+		VarStrings:      []string{"wreg"},
 		AddressingMode:  "direct",
 		Description:     "DECREMENT WORD.",
 		LongDescription: "Decrements the value of the operand by one.",
@@ -1635,11 +1606,11 @@ var unsignedInstructions = map[byte]Instruction{
 		Mnemonic:        "XCHB",
 		ByteLength:      4,
 		VarCount:        2,
-		VarTypes:        []string{"DEST", "COUNT"},
-		VarStrings:      []string{"breg", "breg/#count"},
+		VarTypes:        []string{"DEST", "SRC"},
+		VarStrings:      []string{"breg", "baop"},
 		AddressingMode:  "indexed",
-		Description:     "ARITHMETIC RIGHT SHIFT BYTE.",
-		LongDescription: "Shifts the destination byte operand to the right as many times as specified by the count operand. The count may be specified either as an immediate value in the range of 0 to 15 (0FH), inclusive, or as the content of any register (10–0FFH) with a value in the range of 0 to 31 (1FH), inclusive. If the original high order bit value was “0,” zeros are shifted in. If the value was “1,” ones are shifted in. The last bit shifted out is saved in the carry flag.",
+		Description:     "EXCHANGE BYTE.",
+		LongDescription: "Exchanges the value of the source byte operand with that of the destination byte operand.",
 		VariableLength:  true,
 		AutoIncrement:   false,
 		Flags:           Flags{},
@@ -4822,7 +4793,7 @@ var unsignedInstructions = map[byte]Instruction{
 		Mnemonic:        "TIJMP",
 		ByteLength:      4,
 		VarCount:        3,
-		VarTypes:        []string{"TBASE", "INDEX", "#MASK"}, // TODO XXX
+		VarTypes:        []string{"ADDR", "SRC", "IMMED"},
 		VarStrings:      []string{"TBASE", "INDEX", "#MASK"},
 		AddressingMode:  "indexed",
 		Description:     "TABLE INDIRECT JUMP.",
@@ -0,0 +1,168 @@
+package disasm
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// Golden Opcode Tests
+////////////////..........
+
+// testdata/196ea_opc.golden has one instruction per line, parsed at goldenAddress:
+//
+//	bytes | mnemonic | addressing mode | operands | jumps, calls and xrefs | pseudo-code
+//
+// The bytes are the whole instruction, so every line checks ByteLength too.
+const goldenFile = "testdata/196ea_opc.golden"
+const goldenAddress = 0x172100
+
+type goldenCase struct {
+	line int
+	raw  []byte
+	want string
+}
+
+func readGolden(t *testing.T) []goldenCase {
+	f, err := os.Open(goldenFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var cases []goldenCase
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		text := scanner.Text()
+		if strings.TrimSpace(text) == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		fields := strings.SplitN(text, " | ", 2)
+		if len(fields) != 2 {
+			t.Fatalf("%s:%d: no fields", goldenFile, n)
+		}
+
+		raw, err := hex.DecodeString(strings.Replace(fields[0], " ", "", -1))
+		if err != nil {
+			t.Fatalf("%s:%d: %s", goldenFile, n, err)
+		}
+
+		cases = append(cases, goldenCase{line: n, raw: raw, want: fields[1]})
+	}
+
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	return cases
+}
+
+func addresses(m map[int]bool) string {
+	var adrs []int
+	for adr := range m {
+		adrs = append(adrs, adr)
+	}
+	sort.Ints(adrs)
+
+	var s []string
+	for _, adr := range adrs {
+		s = append(s, fmt.Sprintf("0x%X", adr))
+	}
+	return strings.Join(s, ",")
+}
+
+// describe writes everything after the bytes of a golden line
+func describe(instr Instruction) string {
+	var operands []string
+	for _, name := range instr.VarStrings {
+		operands = append(operands, name+"="+instr.Vars[name].Value)
+	}
+
+	jumps, calls, xrefs := map[int]bool{}, map[int]bool{}, map[int]bool{}
+	for adr := range instr.Jumps {
+		jumps[adr] = true
+	}
+	for adr := range instr.Calls {
+		calls[adr] = true
+	}
+	for adr := range instr.XRefs {
+		xrefs[adr] = true
+	}
+	targets := fmt.Sprintf("jumps=%s calls=%s xrefs=%s", addresses(jumps), addresses(calls), addresses(xrefs))
+
+	return strings.Join([]string{instr.Mnemonic, instr.AddressingMode, strings.Join(operands, "; "), targets, instr.PseudoCode}, " | ")
+}
+
+func parseGolden(raw []byte) (Instruction, error) {
+	// Pad so a wrong ByteLength reads zeros instead of running off the end
+	in := make([]byte, len(raw)+10)
+	copy(in, raw)
+	return Parse(in, goldenAddress)
+}
+
+func TestOpcodeGolden(t *testing.T) {
+	for _, c := range readGolden(t) {
+		instr, err := parseGolden(c.raw)
+		if err != nil {
+			t.Errorf("%s:%d: % X: %s", goldenFile, c.line, c.raw, err)
+			continue
+		}
+
+		if instr.ByteLength != len(c.raw) {
+			t.Errorf("%s:%d: % X: ByteLength %d, want %d", goldenFile, c.line, c.raw, instr.ByteLength, len(c.raw))
+			continue
+		}
+
+		if !instr.Checked {
+			t.Errorf("%s:%d: % X: operands weren't decoded", goldenFile, c.line, c.raw)
+		}
+
+		if got := describe(instr); got != c.want {
+			t.Errorf("%s:%d: % X\n got: %s\nwant: %s", goldenFile, c.line, c.raw, got, c.want)
+		}
+	}
+}
+
+// Every opcode in both tables, in each addressing mode its first operand byte can pick, needs a golden line
+func TestOpcodeCoverage(t *testing.T) {
+	covered := make(map[string]bool)
+	for _, c := range readGolden(t) {
+		instr, err := parseGolden(c.raw)
+		if err == nil {
+			covered[fmt.Sprintf("%t %02X %s", instr.Signed, instr.Op, instr.AddressingMode)] = true
+		}
+	}
+
+	for _, signed := range []bool{false, true} {
+		for op, entry := range Opcodes(signed) {
+			if entry.Reserved || (op == 0xFE && !signed) {
+				continue
+			}
+
+			for _, first := range []byte{0x34, 0x35} {
+				var raw []byte
+				if signed {
+					raw = append(raw, 0xFE)
+				}
+				raw = append(raw, op, first, 0x36, 0x38, 0x3A, 0x3C)
+
+				instr, err := parseGolden(raw)
+				if err != nil {
+					t.Errorf("% X: %s", raw, err)
+					continue
+				}
+
+				key := fmt.Sprintf("%t %02X %s", signed, op, instr.AddressingMode)
+				if !covered[key] {
+					t.Errorf("no golden line for %s (%s %s)", instr.Mnemonic, key, hex.EncodeToString(instr.Raw))
+					covered[key] = true // once is enough
+				}
+			}
+		}
+	}
+}
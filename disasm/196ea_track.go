@@ -0,0 +1,170 @@
+package disasm
+
+import "fmt"
+
+// Register Tracking
+////////////////..........
+
+// Bytes of the register file known to hold a constant along the path being crawled
+type regConsts map[int]byte
+
+// Instructions that only read the registers they reference
+var readsOnly = map[string]bool{
+	"CMP":   true,
+	"CMPB":  true,
+	"CMPL":  true,
+	"PUSH":  true,
+	"JBC":   true,
+	"JBS":   true,
+	"BR":    true,
+	"EBR":   true,
+	"TIJMP": true,
+}
+
+// get returns the n byte value held at reg, if every byte of it is known
+func (r regConsts) get(reg, n int) (int, bool) {
+	val := 0
+	for i := n - 1; i >= 0; i-- {
+		b, ok := r[reg+i]
+		if reg+i <= 0x01 {
+			b, ok = 0x00, true // ZERO_REG
+		}
+		if !ok {
+			return 0, false
+		}
+		val = val<<8 | int(b)
+	}
+	return val, true
+}
+
+func (r regConsts) set(reg, n, val int) {
+	for i := 0; i < n; i++ {
+		r[reg+i] = byte(val >> uint(8*i))
+	}
+}
+
+func (r regConsts) forget(reg int) {
+	// Registers move in up to long words, and the auto-increment bit hides the real address
+	for adr := reg &^ 1; adr < reg+4; adr++ {
+		if adr == wsrReg {
+			// A new window moves everything
+			for k := range r {
+				delete(r, k)
+			}
+			return
+		}
+		delete(r, adr)
+	}
+}
+
+// update follows what instr does to the registers
+func (r regConsts) update(instr Instruction) {
+
+	switch instr.Mnemonic {
+	case "SCALL", "LCALL", "ECALL":
+		// No idea what the subroutine leaves behind
+		for k := range r {
+			delete(r, k)
+		}
+		return
+	}
+
+	ops := instr.RawOps
+
+	// The source of a register copy, read before the registers the instruction references are forgotten
+	var src int
+	var srcOk bool
+	switch {
+	case instr.Mnemonic == "LD" && instr.AddressingMode == "direct":
+		src, srcOk = r.get(int(ops[0]), 2)
+	case instr.Mnemonic == "LDB" && instr.AddressingMode == "direct":
+		src, srcOk = r.get(int(ops[0]), 1)
+	}
+
+	if !readsOnly[instr.Mnemonic] {
+		for adr := range instr.XRefs {
+			if adr < 0x400 {
+				r.forget(adr)
+			}
+		}
+	}
+
+	switch {
+	case instr.Mnemonic == "LD" && instr.AddressingMode == "immediate":
+		r.set(int(ops[2]), 2, int(ops[1])<<8|int(ops[0]))
+
+	case instr.Mnemonic == "LDB" && instr.AddressingMode == "immediate":
+		r.set(int(ops[1]), 1, int(ops[0]))
+
+	case instr.Mnemonic == "LDBZE" && instr.AddressingMode == "immediate":
+		r.set(int(ops[1]), 2, int(ops[0]))
+
+	case instr.Mnemonic == "LD" && instr.AddressingMode == "direct" && srcOk:
+		r.set(int(ops[1]), 2, src)
+		r.set(int(ops[0]), 2, src)
+
+	case instr.Mnemonic == "LDB" && instr.AddressingMode == "direct" && srcOk:
+		r.set(int(ops[1]), 1, src)
+		r.set(int(ops[0]), 1, src)
+
+	case instr.Mnemonic == "CLR":
+		r.set(int(ops[0]), 2, 0)
+
+	case instr.Mnemonic == "CLRB":
+		r.set(int(ops[0]), 1, 0)
+	}
+}
+
+// Indirect Branches
+////////////////..........
+
+// Destinations of a BR, EBR or TIJMP that can be worked out from the tracked registers
+func (h *DisAsm) indirectTargets(instr Instruction, r regConsts) []int {
+	var targets []int
+
+	switch instr.Mnemonic {
+
+	case "BR":
+		// Stays in the current page
+		if val, ok := r.get(int(instr.RawOps[0]), 2); ok {
+			targets = append(targets, instr.Address&0xFF0000|val)
+		}
+
+	case "EBR":
+		if val, ok := r.get(int(instr.RawOps[0]&0xFE), 3); ok {
+			targets = append(targets, val&addrMask)
+		}
+
+	case "TIJMP":
+		// Table of words in page FF, masked index times two
+		tbase, ok := r.get(int(instr.RawOps[2]), 2)
+		if !ok {
+			break
+		}
+
+		// Only the indexes the mask lets through, a mask like 0x0C reaches 0, 4, 8 and 12
+		mask := int(instr.RawOps[1]) & 0x7F
+		for i := 0; i <= mask; i++ {
+			if i&mask != i {
+				continue
+			}
+			entry := codePage | ((tbase + i*2) & 0xFFFF)
+			if entry+1 >= len(h.block) {
+				break
+			}
+			targets = append(targets, codePage|int(h.block[entry+1])<<8|int(h.block[entry]))
+		}
+	}
+
+	// Only keep the ones that land inside the image
+	var valid []int
+	for _, adr := range targets {
+		if adr >= 0 && adr+10 <= len(h.block) {
+			valid = append(valid, adr)
+		} else {
+			dbg(fmt.Sprintf("%s at 0x%X resolves outside the image: 0x%X", instr.Mnemonic, instr.Address, adr), nil)
+		}
+	}
+
+	return valid
+}
@@ -0,0 +1,88 @@
+package disasm
+
+import (
+	"reflect"
+	"testing"
+)
+
+// Register Tracking Tests
+////////////////..........
+
+// trackTargets parses code at adr, tracking the registers, and returns the targets of its last instruction
+func trackTargets(t *testing.T, h *DisAsm, adr int, code []byte) []int {
+	t.Helper()
+	copy(h.block[adr:], code)
+
+	consts := make(regConsts)
+	for pc := adr; ; {
+		instr, err := Parse(h.block[pc:pc+10], pc)
+		if err != nil {
+			t.Fatalf("0x%X: %s", pc, err)
+		}
+		pc += instr.ByteLength
+		if pc >= adr+len(code) {
+			return h.indirectTargets(instr, consts)
+		}
+		consts.update(instr)
+	}
+}
+
+func TestIndirectTargets(t *testing.T) {
+	h := &DisAsm{block: make([]byte, codePage+0x10000)}
+
+	// A jump table of four words in page FF
+	copy(h.block[0x173100:], []byte{0x00, 0x20, 0x10, 0x20, 0x20, 0x20, 0x30, 0x20})
+
+	// And one of seven, for a mask with gaps
+	for i := 0; i < 7; i++ {
+		h.block[0x173200+i*2], h.block[0x173200+i*2+1] = byte(i*0x10), 0x20
+	}
+
+	tests := []struct {
+		name string
+		code []byte
+		want []int
+	}{
+		{"LD then BR", []byte{
+			0xA1, 0x00, 0x30, 0x40, // LD R_40, #0x3000
+			0xE3, 0x40, // BR [R_40]
+		}, []int{0x173000}},
+		{"LD, copied, then BR", []byte{
+			0xA1, 0x00, 0x30, 0x40, // LD R_40, #0x3000
+			0xA0, 0x40, 0x46, // LD R_46, R_40
+			0xE3, 0x46, // BR [R_46]
+		}, []int{0x173000}},
+		{"BR after a call", []byte{
+			0xA1, 0x00, 0x30, 0x40, // LD R_40, #0x3000
+			0xEF, 0x00, 0x00, // LCALL
+			0xE3, 0x40, // BR [R_40]
+		}, nil},
+		{"TIJMP table", []byte{
+			0xA1, 0x00, 0x31, 0x42, // LD R_42, #0x3100
+			0xE2, 0x44, 0x03, 0x42, // TIJMP R_42, [R_44], #0x03
+		}, []int{0x172000, 0x172010, 0x172020, 0x172030}},
+		{"TIJMP mask with gaps", []byte{
+			0xA1, 0x00, 0x32, 0x42, // LD R_42, #0x3200
+			0xE2, 0x44, 0x06, 0x42, // TIJMP R_42, [R_44], #0x06
+		}, []int{0x172000, 0x172020, 0x172040, 0x172060}},
+		{"TIJMP without a table base", []byte{
+			0xE2, 0x44, 0x03, 0x42, // TIJMP R_42, [R_44], #0x03
+		}, nil},
+	}
+
+	for _, test := range tests {
+		got := trackTargets(t, h, 0x172100, test.code)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %X, want %X", test.name, got, test.want)
+		}
+	}
+
+	// The mask is an immediate, it isn't a register read
+	instr, _ := Parse([]byte{0xE2, 0x44, 0x03, 0x42, 0, 0, 0, 0, 0, 0}, 0x172100)
+	if mask := instr.Vars["#MASK"]; mask.Type != "IMMED" || mask.Value != "0x03" {
+		t.Errorf("#MASK is %+v", mask)
+	}
+	if _, ok := instr.XRefs[0x03]; ok {
+		t.Error("#MASK cross referenced as a register")
+	}
+}
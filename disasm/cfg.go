@@ -0,0 +1,445 @@
+package disasm
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Control Flow Graph
+//////////////////////////////////////
+
+type EdgeType string
+
+const (
+	Fallthrough   EdgeType = "fallthrough"
+	Conditional   EdgeType = "conditional"
+	Unconditional EdgeType = "unconditional"
+	CallEdge      EdgeType = "call"
+	Return        EdgeType = "return"
+)
+
+// Return edges go back to whoever called the function, so they point here
+const ReturnAddress = -1
+
+type Edge struct {
+	From     int // address of the block the edge leaves from
+	To       int // address of the block the edge goes to, or ReturnAddress
+	Type     EdgeType
+	Mnemonic string
+}
+
+// A basic block, a run of instructions that is only entered at the top and only left at the bottom
+type Block struct {
+	Start        int // address of the first instruction
+	End          int // address of the byte after the last instruction
+	Instructions Instructions
+	Succs        []Edge
+	Preds        []Edge
+	Function     int // entry address of the first function found to own this block
+}
+
+// Last returns the instruction that ends the block
+func (b *Block) Last() Instruction {
+	return b.Instructions[len(b.Instructions)-1]
+}
+
+type Function struct {
+	Entry   int
+	Name    string
+	Start   int   // lowest address of any of its blocks
+	End     int   // address of the byte after its highest block
+	Blocks  []int // start addresses of the blocks reachable from the entry without calls, sorted
+	Callers []Call
+	Calls   []int // entry addresses of the functions it calls
+	Returns bool  // true if any of its blocks end with a RET
+}
+
+type CFG struct {
+	Blocks    map[int]*Block
+	Functions map[int]*Function
+
+	blockOf map[int]int // instruction address to the start of its block
+}
+
+// BlockAt returns the block that holds the instruction at adr
+func (g *CFG) BlockAt(adr int) (*Block, bool) {
+	start, ok := g.blockOf[adr]
+	if !ok {
+		return nil, false
+	}
+	return g.Blocks[start], true
+}
+
+// SortedBlocks returns the block addresses in order
+func (g *CFG) SortedBlocks() []int {
+	var adrs []int
+	for adr := range g.Blocks {
+		adrs = append(adrs, adr)
+	}
+	sort.Ints(adrs)
+	return adrs
+}
+
+// SortedFunctions returns the function entry addresses in order
+func (g *CFG) SortedFunctions() []int {
+	var adrs []int
+	for adr := range g.Functions {
+		adrs = append(adrs, adr)
+	}
+	sort.Ints(adrs)
+	return adrs
+}
+
+// Kind of control transfer an instruction makes
+func flowType(instr Instruction) EdgeType {
+	switch instr.Mnemonic {
+	case "SJMP", "LJMP", "EJMP", "BR", "EBR", "TIJMP":
+		return Unconditional
+	case "SCALL", "LCALL", "ECALL":
+		return CallEdge
+	case "RET":
+		return Return
+	case "JNST", "JNH", "JGT", "JNC", "JNVT", "JNV", "JGE", "JNE", "JST", "JH", "JLE", "JC", "JVT", "JV", "JLT", "JE", "JBC", "JBS", "DJNZ", "DJNZW":
+		return Conditional
+	}
+	return Fallthrough
+}
+
+// Branch targets of an instruction that point at code
+func (h *DisAsm) targets(instr Instruction) []int {
+	var adrs []int
+
+	switch flowType(instr) {
+	case CallEdge:
+		for adr := range instr.Calls {
+			adrs = append(adrs, adr)
+		}
+	case Conditional, Unconditional:
+		for adr := range instr.Jumps {
+			adrs = append(adrs, adr)
+		}
+	}
+
+	sort.Ints(adrs)
+	return adrs
+}
+
+// CFG builds the control flow graph out of the crawl results, crawling first if needed
+func (h *DisAsm) CFG() (*CFG, error) {
+
+	if h.opcodes == nil {
+		err := h.Crawl()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(h.opcodes) == 0 {
+		return nil, fmt.Errorf("No instructions found to build a graph from")
+	}
+
+	g := new(CFG)
+	g.Blocks = make(map[int]*Block)
+	g.Functions = make(map[int]*Function)
+	g.blockOf = make(map[int]int)
+
+	// Entry points of the program
+	entries := map[int]bool{resetAdr: true}
+	for _, adr := range h.intRoutineAdrs {
+		entries[adr] = true
+	}
+	for adr := range h.subroutines {
+		entries[adr] = true
+	}
+
+	// Find the leaders, the first instruction of every block
+	leaders := make(map[int]bool)
+	for adr := range entries {
+		leaders[adr] = true
+	}
+	for _, instr := range h.opcodes {
+		if flowType(instr) != Fallthrough || instr.Mnemonic == "RST" {
+			leaders[instr.Address+instr.ByteLength] = true
+			for _, adr := range h.targets(instr) {
+				leaders[adr] = true
+			}
+		}
+	}
+
+	// Cut the sorted instructions up into blocks
+	var block *Block
+	for i, instr := range h.opcodes {
+		if block == nil || leaders[instr.Address] || h.opcodes[i-1].Address+h.opcodes[i-1].ByteLength != instr.Address {
+			block = &Block{Start: instr.Address}
+			g.Blocks[block.Start] = block
+		}
+
+		block.Instructions = append(block.Instructions, instr)
+		block.End = instr.Address + instr.ByteLength
+		g.blockOf[instr.Address] = block.Start
+	}
+
+	// Connect them
+	for _, start := range g.SortedBlocks() {
+		block := g.Blocks[start]
+		last := block.Last()
+		next := block.End
+
+		switch flowType(last) {
+		case Conditional:
+			for _, adr := range h.targets(last) {
+				g.connect(start, adr, Conditional, last.Mnemonic)
+			}
+			g.connect(start, next, Fallthrough, last.Mnemonic)
+
+		case Unconditional:
+			for _, adr := range h.targets(last) {
+				g.connect(start, adr, Unconditional, last.Mnemonic)
+			}
+
+		case CallEdge:
+			for _, adr := range h.targets(last) {
+				g.connect(start, adr, CallEdge, last.Mnemonic)
+			}
+			g.connect(start, next, Fallthrough, last.Mnemonic)
+
+		case Return:
+			g.connect(start, ReturnAddress, Return, last.Mnemonic)
+
+		default:
+			if last.Mnemonic != "RST" {
+				g.connect(start, next, Fallthrough, last.Mnemonic)
+			}
+		}
+	}
+
+	// Work out the function boundaries by walking from each entry without following calls or returns
+	var sortedEntries []int
+	for adr := range entries {
+		sortedEntries = append(sortedEntries, adr)
+	}
+	sort.Ints(sortedEntries)
+
+	for _, entry := range sortedEntries {
+		if _, ok := g.Blocks[entry]; !ok {
+			continue
+		}
+
+		fn := &Function{Entry: entry, Name: h.functionName(entry), Start: entry, End: entry, Callers: h.subroutines[entry]}
+		calls := make(map[int]bool)
+
+		seen := map[int]bool{entry: true}
+		stack := []int{entry}
+		for len(stack) > 0 {
+			adr := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+
+			block := g.Blocks[adr]
+			fn.Blocks = append(fn.Blocks, adr)
+			if block.Function == 0 {
+				block.Function = entry
+			}
+			if block.Start < fn.Start {
+				fn.Start = block.Start
+			}
+			if block.End > fn.End {
+				fn.End = block.End
+			}
+
+			for _, edge := range block.Succs {
+				switch edge.Type {
+				case Return:
+					fn.Returns = true
+					continue
+				case CallEdge:
+					calls[edge.To] = true
+					continue
+				}
+
+				// Another function's entry is a tail call, not part of this one
+				if entries[edge.To] && edge.To != entry {
+					continue
+				}
+
+				if _, ok := g.Blocks[edge.To]; ok && !seen[edge.To] {
+					seen[edge.To] = true
+					stack = append(stack, edge.To)
+				}
+			}
+		}
+
+		sort.Ints(fn.Blocks)
+		for adr := range calls {
+			fn.Calls = append(fn.Calls, adr)
+		}
+		sort.Ints(fn.Calls)
+
+		g.Functions[entry] = fn
+	}
+
+	log(fmt.Sprintf("CFG - [%d] blocks in [%d] functions", len(g.Blocks), len(g.Functions)), nil)
+
+	return g, nil
+}
+
+func (g *CFG) connect(from, to int, kind EdgeType, mnemonic string) {
+	edge := Edge{From: from, To: to, Type: kind, Mnemonic: mnemonic}
+
+	g.Blocks[from].Succs = append(g.Blocks[from].Succs, edge)
+	if block, ok := g.Blocks[to]; ok {
+		block.Preds = append(block.Preds, edge)
+	}
+}
+
+func (h *DisAsm) functionName(entry int) string {
+	if name := h.intRoutineNames[entry]; name != "" {
+		return "INTERRUPT ROUTINE_ " + name
+	}
+	if entry == resetAdr {
+		return "RESET_ " + fmt.Sprintf("0x%X", entry)
+	}
+	return fmt.Sprintf("SUBROUTINE_ 0x%X", entry)
+}
+
+// Graphviz
+////////////////..........
+
+// ExportCFG writes one Graphviz DOT file per function into dir
+func (h *DisAsm) ExportCFG(dir string) error {
+	g, err := h.CFG()
+	if err != nil {
+		log("CFG - Error building graph", err)
+		return err
+	}
+
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		log("CFG - Error creating output directory", err)
+		return err
+	}
+
+	for _, entry := range g.SortedFunctions() {
+		name := filepath.Join(dir, fmt.Sprintf("0x%X.dot", entry))
+
+		f, err := os.Create(name)
+		if err != nil {
+			log("CFG - Error creating file", err)
+			return err
+		}
+
+		err = g.WriteDOT(f, entry)
+		f.Close()
+		if err != nil {
+			log("CFG - Error writing file", err)
+			return err
+		}
+	}
+
+	log(fmt.Sprintf("CFG - wrote [%d] graphs to %s", len(g.Functions), dir), nil)
+
+	return nil
+}
+
+var edgeStyles = map[EdgeType]string{
+	Fallthrough:   `style=dashed, color="gray40"`,
+	Conditional:   `color="darkgreen"`,
+	Unconditional: `color="blue"`,
+	CallEdge:      `color="purple", style=dotted`,
+	Return:        `color="red"`,
+}
+
+// WriteDOT writes the function starting at entry as a Graphviz DOT digraph
+func (g *CFG) WriteDOT(w io.Writer, entry int) error {
+	fn, ok := g.Functions[entry]
+	if !ok {
+		return fmt.Errorf("No function at 0x%X", entry)
+	}
+
+	var sb strings.Builder
+
+	fmt.Fprintf(&sb, "digraph %s {\n", dotQuote(fn.Name))
+	fmt.Fprintf(&sb, "\tlabel=%s;\n\tlabelloc=t;\n", dotQuote(fn.Name))
+	sb.WriteString("\tnode [shape=box, fontname=\"Courier\", fontsize=10];\n\n")
+
+	inside := make(map[int]bool)
+	for _, adr := range fn.Blocks {
+		inside[adr] = true
+	}
+
+	outside := make(map[string]string)
+
+	for _, adr := range fn.Blocks {
+		block := g.Blocks[adr]
+
+		label := ""
+		for _, instr := range block.Instructions {
+			label += fmt.Sprintf("0x%X  %s  %s\\l", instr.Address, addSpaces(instr.Mnemonic, 6), dotEscape(instr.PseudoCode))
+		}
+		fmt.Fprintf(&sb, "\t\"0x%X\" [label=\"%s\"];\n", adr, label)
+	}
+
+	sb.WriteString("\n")
+
+	for _, adr := range fn.Blocks {
+		for _, edge := range g.Blocks[adr].Succs {
+			to := fmt.Sprintf("0x%X", edge.To)
+
+			switch {
+			case edge.Type == Return:
+				to = "RETURN"
+				outside[to] = "shape=oval, color=\"red\""
+			case edge.Type == CallEdge:
+				to = fmt.Sprintf("SUBROUTINE_ 0x%X", edge.To)
+				if g.Functions[edge.To] != nil {
+					to = g.Functions[edge.To].Name
+				}
+				outside[to] = "shape=oval, color=\"purple\""
+			case inside[edge.To]:
+			case g.Functions[edge.To] != nil:
+				to = g.Functions[edge.To].Name
+				outside[to] = "shape=oval"
+			default:
+				outside[to] = "shape=oval, style=dashed"
+			}
+
+			fmt.Fprintf(&sb, "\t\"0x%X\" -> %s [%s, label=%s];\n", edge.From, dotQuote(to), edgeStyles[edge.Type], dotQuote(string(edge.Type)))
+		}
+	}
+
+	if len(outside) > 0 {
+		sb.WriteString("\n")
+		var names []string
+		for name := range outside {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(&sb, "\t%s [%s];\n", dotQuote(name), outside[name])
+		}
+	}
+
+	sb.WriteString("}\n")
+
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+func dotEscape(s string) string {
+	s = strings.Replace(s, "\\", "\\\\", -1)
+	s = strings.Replace(s, "\"", "\\\"", -1)
+	s = strings.Replace(s, "\t", " ", -1)
+	s = strings.Replace(s, "\n", " ", -1)
+	s = strings.Replace(s, "{", "\\{", -1)
+	s = strings.Replace(s, "}", "\\}", -1)
+	s = strings.Replace(s, "<", "\\<", -1)
+	s = strings.Replace(s, ">", "\\>", -1)
+	return s
+}
+
+func dotQuote(s string) string {
+	return "\"" + strings.Replace(s, "\"", "\\\"", -1) + "\""
+}
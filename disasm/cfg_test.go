@@ -0,0 +1,108 @@
+package disasm
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+// Control Flow Graph Tests
+////////////////..........
+
+// A loop calling a subroutine with an if in it, laid out from the reset address
+var cfgProgram = []byte{
+	0xA1, 0x05, 0x00, 0x30, // 172080 LD R_30, #0x0005
+	0xEF, 0x06, 0x00, // 172084 LCALL 0x17208D
+	0xE0, 0x30, 0xFA, // 172087 DJNZ R_30, 0x172084
+	0xE7, 0xFD, 0xFF, // 17208A LJMP 0x17208A
+	0xDF, 0x02, // 17208D JE 0x172091
+	0x07, 0x32, // 17208F INC R_32
+	0xF0, // 172091 RET
+}
+
+// newCFGTest hands CFG the program as if it had been crawled
+func newCFGTest(t *testing.T) *DisAsm {
+	h := &DisAsm{
+		block:       make([]byte, codePage+0x10000),
+		subroutines: make(map[int][]Call),
+		xrefs:       make(map[int][]XRef),
+		jumps:       make(map[int][]Jump),
+		crawled:     make(map[int]int),
+	}
+	copy(h.block[resetAdr:], cfgProgram)
+
+	// The TRAP vector points at the subroutine
+	h.block[trapVector], h.block[trapVector+1] = 0x8D, 0x20
+	h.vectorAdr = map[int]string{trapVector: interruptVectors[trapVector].InterruptSource}
+
+	for pc := resetAdr; pc < resetAdr+len(cfgProgram); {
+		instr, err := Parse(h.block[pc:pc+10], pc)
+		if err != nil {
+			t.Fatalf("0x%X: %s", pc, err)
+		}
+		h.opcodes = append(h.opcodes, instr)
+		for adr, calls := range instr.Calls {
+			h.subroutines[adr] = append(h.subroutines[adr], calls...)
+		}
+		for adr, xrefs := range instr.XRefs {
+			h.xrefs[adr] = append(h.xrefs[adr], xrefs...)
+		}
+		for adr, jumps := range instr.Jumps {
+			h.jumps[adr] = append(h.jumps[adr], jumps...)
+		}
+		for i := 0; i < instr.ByteLength; i++ {
+			h.crawled[pc+i] = 1
+		}
+		pc += instr.ByteLength
+	}
+	return h
+}
+
+// describeCFG writes a line for every block with its edges, then one for every function
+func describeCFG(g *CFG) string {
+	var sb strings.Builder
+	for _, adr := range g.SortedBlocks() {
+		block := g.Blocks[adr]
+		fmt.Fprintf(&sb, "block 0x%X-0x%X function 0x%X preds %d\n", block.Start, block.End, block.Function, len(block.Preds))
+		for _, edge := range block.Succs {
+			to := fmt.Sprintf("0x%X", edge.To)
+			if edge.To == ReturnAddress {
+				to = "RETURN"
+			}
+			fmt.Fprintf(&sb, "\t%s 0x%X -> %s (%s)\n", edge.Type, edge.From, to, edge.Mnemonic)
+		}
+	}
+	for _, entry := range g.SortedFunctions() {
+		fn := g.Functions[entry]
+		fmt.Fprintf(&sb, "function %s 0x%X-0x%X blocks %X calls %X returns %t\n", fn.Name, fn.Start, fn.End, fn.Blocks, fn.Calls, fn.Returns)
+	}
+	return sb.String()
+}
+
+func TestCFGGolden(t *testing.T) {
+	g, err := newCFGTest(t).CFG()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var dot bytes.Buffer
+	if err := g.WriteDOT(&dot, resetAdr); err != nil {
+		t.Fatal(err)
+	}
+
+	for file, got := range map[string]string{"testdata/cfg.golden": describeCFG(g), "testdata/cfg.dot.golden": dot.String()} {
+		want, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != string(want) {
+			t.Errorf("%s doesn't match, got:\n%s", file, got)
+		}
+	}
+
+	if err := g.WriteDOT(&dot, 0x172084); err == nil {
+		t.Error("a graph of a block that isn't a function")
+	}
+}
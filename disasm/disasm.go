@@ -2,9 +2,10 @@ package disasm
 
 import (
 	"fmt"
-	"os"
 	"sort"
 	"strings"
+
+	"github.com/murdinc/ELMFlash/image"
 )
 
 // App constants
@@ -13,76 +14,52 @@ const debug = false
 
 type DisAsm struct {
 	block           []byte
+	calStart        int            // where the calibration file starts in block
 	intRoutineAdrs  []int          // slice of interrupt routine addresses for start locations
 	intRoutineNames map[int]string // address of interrupt routine locations and name
 	vectorAdr       map[int]string // address of interrupt vector locations and name
 	memStarts       map[int]string // Starts of memory map Locations
 	memStops        map[int]string // Ends of memory map Locations
 	skip            map[int]int
-}
 
-var calibrations = map[string]string{
-	"msp":   "MSP.BIN",
-	"mp3":   "MP3.BIN",
-	"mp3x2": "MP3x2.BIN",
-	"p5":    "P5.BIN",
-	"pre":   "PRE2.BIN",
+	// Crawl results
+	opcodes     Instructions   // every instruction found, sorted by address
+	subroutines map[int][]Call // subroutine addresses and the calls to them
+	xrefs       map[int][]XRef // referenced addresses and the instructions referencing them
+	jumps       map[int][]Jump // jump destinations and the jumps to them
+	mapRefs     []MapRef       // calls passing a pointer into the calibration
+	crawled     map[int]int    // 1 = crawled, 3 = parse error
+	returns     int
+	errors      int
 }
 
-func New(calName string) *DisAsm {
-	controller := new(DisAsm)
-
-	// Pull in the stuff before the calibration file
-	preCalFile := "./calibrations/" + calibrations["pre"]
-	log(fmt.Sprintf("Disassemble - Pre-calibration File: %s", preCalFile), nil)
-
-	p, err := os.Open(preCalFile)
-	pi, err := p.Stat()
-	preFileSize := pi.Size()
-
-	// Pull in the Calibration file
-	calFile := "./calibrations/" + calibrations[calName]
-	log(fmt.Sprintf("Disassemble - Calibration File: %s", calFile), nil)
-
-	f, err := os.Open(calFile)
-	fi, err := f.Stat()
-	fileSize := fi.Size()
-	if err != nil {
-		log("Disassemble - Error opening file", err)
-		os.Exit(1)
-	}
-
-	log(fmt.Sprintf("Disassemble - [%s] is %d bytes long", calibrations["pre"], preFileSize), nil)
-	log(fmt.Sprintf("Disassemble - [%s] is %d bytes long", calibrations[calName], fileSize), nil)
-
-	// Make some buffers
-	preBlock := make([]byte, preFileSize)
-	calBlock := make([]byte, fileSize)
-
-	// Read in all the bytes
-	n, err := p.Read(preBlock)
-	if err != nil {
-		log("Disassemble - Error reading calibration", err)
-		os.Exit(1)
-	}
-	log(fmt.Sprintf("Disassemble - reading 0x%X bytes from pre-calibration file.", n), nil)
-
-	n, err = f.Read(calBlock)
+// New loads a calibration by catalog name or path behind the default pre-calibration
+func New(calName string) (*DisAsm, error) {
+	img, err := image.Load(calName)
 	if err != nil {
-		log("Disassemble - Error reading calibration", err)
-		os.Exit(1)
+		log("Disassemble - Error loading calibration", err)
+		return nil, err
 	}
 
-	log(fmt.Sprintf("Disassemble - reading 0x%X bytes from calibration file.", n), nil)
+	controller := new(DisAsm)
+	controller.block = img.Block
+	controller.calStart = img.CalStart
 
-	block := append(preBlock, calBlock...)
+	return controller, nil
+}
 
-	controller.block = block
+// Image returns the merged pre-calibration and calibration image, indexed by address
+func (h *DisAsm) Image() []byte {
+	return h.block
+}
 
-	return controller
+// CalibrationStart returns where the calibration file starts in the image
+func (h *DisAsm) CalibrationStart() int {
+	return h.calStart
 }
 
-func (h *DisAsm) DisAsm() error {
+// Crawl follows the code from the reset and interrupt routine addresses, and keeps what it finds on the DisAsm
+func (h *DisAsm) Crawl() error {
 
 	h.GetInterrupts()
 	h.GetMemoryMap()
@@ -93,6 +70,7 @@ func (h *DisAsm) DisAsm() error {
 	subroutines := make(map[int][]Call)
 	xrefs := make(map[int][]XRef)
 	jumps := make(map[int][]Jump)
+	var mapRefs []MapRef
 	other := make(map[int]bool)
 	crawled := make(map[int]int)
 	returns := 0
@@ -112,11 +90,16 @@ func (h *DisAsm) DisAsm() error {
 			pc = pcs[p]
 		}
 
+		// Constants loaded into registers along the current path
+		consts := make(regConsts)
+
 	Loop:
 		for {
 
 			// Sub and Jumps, or break if out of range
 			if pc+10 > len(h.block) {
+				consts = make(regConsts)
+
 				if pc != 0xFFFFFF {
 					crawled[pc] = 1
 					pc &= 0x17FFFF
@@ -156,6 +139,7 @@ func (h *DisAsm) DisAsm() error {
 			}
 
 			if crawled[pc] == 1 {
+				mapRefs = append(mapRefs, h.joinArgs(pc, consts)...)
 				pc = 0xFFFFFF
 				continue Loop
 			}
@@ -176,6 +160,27 @@ func (h *DisAsm) DisAsm() error {
 				continue Loop
 			}
 
+			// Work out where indirect branches go from the registers we've tracked
+			switch instr.Mnemonic {
+			case "BR", "EBR", "TIJMP":
+				targets := h.indirectTargets(instr, consts)
+				for _, adr := range targets {
+					instr.Jump("0x%X", adr)
+				}
+				if len(targets) == 1 {
+					instr.PseudoCode += fmt.Sprintf(" => 0x%X", targets[0])
+				} else if len(targets) > 1 {
+					instr.PseudoCode += fmt.Sprintf(" => [%d] TARGETS", len(targets))
+				}
+			}
+
+			// Table pointers loaded for a lookup routine
+			if flowType(instr) == CallEdge {
+				mapRefs = append(mapRefs, mapArgs(instr, consts)...)
+			}
+
+			consts.update(instr)
+
 			// Append our instruction to our opcodes list
 			opcodes = append(opcodes, instr)
 
@@ -193,20 +198,23 @@ func (h *DisAsm) DisAsm() error {
 			for JumpAdd, JumpVal := range instr.Jumps {
 				// If this is not a conditional jump, point the program counter at the address
 				switch instr.Mnemonic {
-				case "SJMP", "EJMP", "LJMP", "TIJMP":
+				case "SJMP", "EJMP", "LJMP", "EBR", "BR":
 					jumps[JumpAdd] = append(jumps[JumpAdd], JumpVal...)
 					//log(instr.Mnemonic, nil)
 					pc = JumpAdd
 					continue Loop
-				case "EBR", "BR":
-					pc = 0xFFFFFF // TODO!!!!!!!!
-					continue Loop
 				default:
 					jumps[JumpAdd] = append(jumps[JumpAdd], JumpVal...)
 				}
 
 			}
 
+			// Indirect branches we couldn't resolve, and jump tables whose targets are all queued as jumps
+			if instr.Mnemonic == "EBR" || instr.Mnemonic == "BR" || instr.Mnemonic == "TIJMP" {
+				pc = 0xFFFFFF
+				continue Loop
+			}
+
 			// Subroutine Returns and Resets {
 			if instr.Mnemonic == "RET" || instr.Mnemonic == "RST" {
 				returns++
@@ -228,6 +236,32 @@ func (h *DisAsm) DisAsm() error {
 
 	sort.Sort(opcodes)
 
+	h.opcodes = opcodes
+	h.subroutines = subroutines
+	h.xrefs = xrefs
+	h.jumps = jumps
+	h.mapRefs = mapRefs
+	h.crawled = crawled
+	h.returns = returns
+	h.errors = errors
+
+	return nil
+}
+
+func (h *DisAsm) DisAsm() error {
+
+	err := h.Crawl()
+	if err != nil {
+		return err
+	}
+
+	opcodes := h.opcodes
+	subroutines := h.subroutines
+	xrefs := h.xrefs
+	jumps := h.jumps
+	crawled := h.crawled
+	errors := h.errors
+
 	// Print out the stuff before the Assembly
 	for chkAdr := 0; chkAdr < opcodes[0].Address; chkAdr++ {
 
@@ -304,35 +338,7 @@ func (h *DisAsm) DisAsm() error {
 
 		if instr.Ignore == false {
 
-			if instr.Mnemonic == "CMPB" || instr.Mnemonic == "CMP" {
-				switch opcodes[index+1].Mnemonic {
-
-				//case "JNST":
-				case "JNH":
-					instr.PseudoCode = strings.Replace(instr.PseudoCode, "==", "<=", 1)
-				case "JGT":
-					instr.PseudoCode = strings.Replace(instr.PseudoCode, "==", ">", 1)
-				//case "JNC":
-				//case "JNVT":
-				//case "JNV":
-				case "JGE":
-					instr.PseudoCode = strings.Replace(instr.PseudoCode, ">=", "!=", 1)
-				case "JNE":
-					instr.PseudoCode = strings.Replace(instr.PseudoCode, "==", "!=", 1)
-				//case "JST":
-				case "JH":
-					instr.PseudoCode = strings.Replace(instr.PseudoCode, "==", ">", 1)
-				case "JLE":
-					instr.PseudoCode = strings.Replace(instr.PseudoCode, "==", "<=", 1)
-				//case "JC":
-				//case "JVT":
-				//case "JV":
-				case "JLT":
-					instr.PseudoCode = strings.Replace(instr.PseudoCode, "==", "<", 1)
-
-				}
-
-			}
+			instr.PseudoCode = compareCode(opcodes, index)
 
 			address := addSpaces(fmt.Sprintf("[0x%X]", instr.Address), 20)
 			//shortDesc := addSpaces(fmt.Sprintf("%s %s", instr.Description, instr.Mnemonic), 45)
@@ -418,6 +424,47 @@ func (h *DisAsm) DisAsm() error {
 	return nil
 }
 
+// Fill in the comparison of a CMP from the jump that follows it
+func compareCode(opcodes Instructions, index int) string {
+	instr := opcodes[index]
+	if index+1 >= len(opcodes) {
+		return instr.PseudoCode
+	}
+	next := opcodes[index+1]
+
+	if instr.Mnemonic == "CMPB" || instr.Mnemonic == "CMP" {
+		switch next.Mnemonic {
+
+		//case "JNST":
+		case "JNH":
+			return strings.Replace(instr.PseudoCode, "==", "<=", 1)
+		case "JGT":
+			return strings.Replace(instr.PseudoCode, "==", ">", 1)
+		//case "JNC":
+		//case "JNVT":
+		//case "JNV":
+		case "JGE":
+			return strings.Replace(instr.PseudoCode, ">=", "!=", 1)
+		case "JNE":
+			return strings.Replace(instr.PseudoCode, "==", "!=", 1)
+		//case "JST":
+		case "JH":
+			return strings.Replace(instr.PseudoCode, "==", ">", 1)
+		case "JLE":
+			return strings.Replace(instr.PseudoCode, "==", "<=", 1)
+		//case "JC":
+		//case "JVT":
+		//case "JV":
+		case "JLT":
+			return strings.Replace(instr.PseudoCode, "==", "<", 1)
+
+		}
+
+	}
+
+	return instr.PseudoCode
+}
+
 func addSpaces(s string, w int) string {
 	if len(s) < w {
 		s += strings.Repeat(" ", w-len(s))
@@ -0,0 +1,166 @@
+package disasm
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+// JSON Listing
+////////////////..........
+
+type Listing struct {
+	Instructions []ListingInstruction
+	XRefs        map[string][]XRef // keyed by referenced address
+	Calls        map[string][]Call // keyed by subroutine address
+	Jumps        map[string][]Jump // keyed by jump destination
+	Interrupts   []ListingInterrupt
+	MemoryMap    MemLocations
+	Uncrawled    []ByteRange
+	Errors       int
+}
+
+type ListingInstruction struct {
+	Address        int
+	Raw            string // hex
+	Op             int
+	Mnemonic       string
+	Description    string
+	AddressingMode string
+	Signed         bool
+	Operands       []Operand
+	PseudoCode     string
+	Checked        bool
+}
+
+type Operand struct {
+	Name  string // baop, breg, etc
+	Type  string // DEST, SRC, etc
+	Value string
+}
+
+type ListingInterrupt struct {
+	Name    string
+	Vector  int
+	Routine int
+}
+
+// Bytes the crawler never parsed as code, Stop is inclusive like MemLocation
+type ByteRange struct {
+	Start      int
+	Stop       int
+	ParseError bool
+}
+
+func listingKey(adr int) string {
+	return fmt.Sprintf("0x%06X", adr)
+}
+
+// Listing crawls the image if needed and returns everything the text listing would show
+func (h *DisAsm) Listing() (*Listing, error) {
+
+	if h.opcodes == nil {
+		err := h.Crawl()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	l := &Listing{
+		XRefs:     make(map[string][]XRef),
+		Calls:     make(map[string][]Call),
+		Jumps:     make(map[string][]Jump),
+		MemoryMap: memMap,
+		Errors:    h.errors,
+	}
+
+	for index, instr := range h.opcodes {
+		li := ListingInstruction{
+			Address:        instr.Address,
+			Raw:            hex.EncodeToString(instr.Raw),
+			Op:             int(instr.Op),
+			Mnemonic:       instr.Mnemonic,
+			Description:    instr.Description,
+			AddressingMode: instr.AddressingMode,
+			Signed:         instr.Signed,
+			PseudoCode:     compareCode(h.opcodes, index),
+			Checked:        instr.Checked,
+		}
+
+		for _, name := range instr.VarStrings {
+			if v, ok := instr.Vars[name]; ok {
+				li.Operands = append(li.Operands, Operand{Name: name, Type: v.Type, Value: v.Value})
+			}
+		}
+
+		l.Instructions = append(l.Instructions, li)
+	}
+
+	for adr, refs := range h.xrefs {
+		l.XRefs[listingKey(adr)] = refs
+	}
+	for adr, calls := range h.subroutines {
+		l.Calls[listingKey(adr)] = calls
+	}
+	for adr, jumps := range h.jumps {
+		l.Jumps[listingKey(adr)] = jumps
+	}
+
+	for vec, name := range h.vectorAdr {
+		routine := int(h.block[vec+1])<<8 | int(h.block[vec]) + codePage
+		l.Interrupts = append(l.Interrupts, ListingInterrupt{Name: name, Vector: vec, Routine: routine})
+	}
+	sort.Slice(l.Interrupts, func(i, j int) bool { return l.Interrupts[i].Vector < l.Interrupts[j].Vector })
+
+	// Runs of bytes that aren't part of an instruction
+	for adr := 0; adr < len(h.block); adr++ {
+		if h.crawled[adr] == 1 {
+			continue
+		}
+
+		r := ByteRange{Start: adr, ParseError: h.crawled[adr] == 3}
+		for adr+1 < len(h.block) && h.crawled[adr+1] != 1 && (h.crawled[adr+1] == 3) == r.ParseError {
+			adr++
+		}
+		r.Stop = adr
+
+		l.Uncrawled = append(l.Uncrawled, r)
+	}
+
+	return l, nil
+}
+
+// WriteJSON writes the listing as a single JSON document
+func (h *DisAsm) WriteJSON(w io.Writer) error {
+	l, err := h.Listing()
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(l)
+}
+
+// ExportJSON writes the listing to a file
+func (h *DisAsm) ExportJSON(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		log("Disassemble - Error creating file", err)
+		return err
+	}
+	defer f.Close()
+
+	err = h.WriteJSON(f)
+	if err != nil {
+		log("Disassemble - Error writing JSON", err)
+		return err
+	}
+
+	log(fmt.Sprintf("Disassemble - wrote listing to %s", path), nil)
+
+	return nil
+}
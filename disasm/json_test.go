@@ -0,0 +1,43 @@
+package disasm
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+)
+
+// JSON Listing Tests
+////////////////..........
+
+const listingGolden = "testdata/listing.json.golden"
+
+func TestListingGolden(t *testing.T) {
+	var out bytes.Buffer
+	if err := newCFGTest(t).WriteJSON(&out); err != nil {
+		t.Fatal(err)
+	}
+
+	var l Listing
+	if err := json.Unmarshal(out.Bytes(), &l); err != nil {
+		t.Fatal(err)
+	}
+	if len(l.MemoryMap) != len(memMap) {
+		t.Errorf("%d memory locations, want %d", len(l.MemoryMap), len(memMap))
+	}
+
+	// The memory map is the same for every image, leave it out of the golden file
+	l.MemoryMap = nil
+	got, err := json.MarshalIndent(l, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want, err := ioutil.ReadFile(listingGolden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(append(got, '\n'), want) {
+		t.Errorf("%s doesn't match, got:\n%s", listingGolden, got)
+	}
+}
@@ -0,0 +1,255 @@
+package disasm
+
+import (
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/murdinc/ELMFlash/tables"
+)
+
+// Map Finder
+////////////////..........
+
+// The code hands a table to a lookup routine as a 24-bit pointer to its data, loaded into a long register
+// right before the call:
+//
+//	LD   0x8C, #0xB76E
+//	LD   0x8E, #0x0010
+//	...
+//	ECALL lookup
+//
+// so the tables can be found from the calls instead of from patterns in the bytes.
+
+// Subroutines need pointers to at least this many tables to count as lookup routines
+const minLookupTables = 2
+
+// A MapRef is a call that passes a pointer into the calibration to a subroutine
+type MapRef struct {
+	From    int // address of the call
+	Routine int // the subroutine called
+	Reg     int // register holding the pointer
+	Pointer int
+}
+
+// A Lookup is a subroutine the code passes table pointers to, the shared interpolation routines
+type Lookup struct {
+	Address int
+	Reg     int // register the pointer is passed in
+	Tables  int // distinct tables passed to it
+	Calls   []MapRef
+}
+
+// A CodeMap is a table found from the code that reads it
+type CodeMap struct {
+	Pointer int
+	Table   *tables.Table // the header in front of Pointer, nil if there isn't one
+	Reads   []MapRef
+}
+
+// Header returns the address of the table's header, or the pointer if it has none
+func (m CodeMap) Header() int {
+	if m.Table != nil {
+		return m.Table.Address
+	}
+	return m.Pointer
+}
+
+// mapArgs returns the calibration pointers held in long registers when instr calls a subroutine
+func mapArgs(instr Instruction, r regConsts) []MapRef {
+	var regs []int
+	for reg := range r {
+		if reg%4 == 0 && reg < 0x400 {
+			regs = append(regs, reg)
+		}
+	}
+	sort.Ints(regs)
+
+	var refs []MapRef
+	for _, reg := range regs {
+		val, ok := r.get(reg, 4)
+		if !ok || val < mapStart || val >= mapStop {
+			continue
+		}
+		for adr := range instr.Calls {
+			refs = append(refs, MapRef{From: instr.Address, Routine: adr, Reg: reg, Pointer: val})
+		}
+	}
+	return refs
+}
+
+// joinArgs follows a path that runs into code already crawled as far as its next call, since the tables
+// are often picked in branches that all jump to the same call
+func (h *DisAsm) joinArgs(pc int, r regConsts) []MapRef {
+	if !r.hasPointer() {
+		return nil
+	}
+
+	consts := make(regConsts)
+	for k, v := range r {
+		consts[k] = v
+	}
+
+	for i := 0; i < maxJoinSteps && pc+10 <= len(h.block); i++ {
+		instr, err := Parse(h.block[pc:pc+10], pc)
+		if err != nil {
+			return nil
+		}
+
+		switch flowType(instr) {
+		case CallEdge:
+			return mapArgs(instr, consts)
+		case Return:
+			return nil
+		case Unconditional:
+			targets := h.targets(instr)
+			if len(targets) != 1 {
+				return nil
+			}
+			consts.update(instr)
+			pc = targets[0]
+			continue
+		}
+
+		consts.update(instr)
+		pc += instr.ByteLength
+	}
+	return nil
+}
+
+// Instructions followed past a join before giving up on finding the call
+const maxJoinSteps = 16
+
+// hasPointer is true if a long register holds a pointer into the calibration
+func (r regConsts) hasPointer() bool {
+	for reg := range r {
+		if val, ok := r.get(reg&^3, 4); ok && val >= mapStart && val < mapStop {
+			return true
+		}
+	}
+	return false
+}
+
+// header finds the map or array header whose data starts at ptr
+func (h *DisAsm) header(ptr int) *tables.Table {
+	for _, size := range []int{8, 4} {
+		t, err := tables.Decode(h.block, ptr-size)
+		if err == nil && t.Start == ptr && t.Kind != tables.Item {
+			return t
+		}
+	}
+	return nil
+}
+
+// FindMaps crawls the image if needed, then works out the lookup routines and the tables passed to them
+func (h *DisAsm) FindMaps() ([]Lookup, []CodeMap, error) {
+
+	if h.opcodes == nil {
+		err := h.Crawl()
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	byRoutine := make(map[int][]MapRef)
+	for _, ref := range h.mapRefs {
+		byRoutine[ref.Routine] = append(byRoutine[ref.Routine], ref)
+	}
+
+	var lookups []Lookup
+	isLookup := make(map[int]bool)
+	for adr, refs := range byRoutine {
+		pointers := make(map[int]bool)
+		regs := make(map[int]int)
+		for _, ref := range refs {
+			pointers[ref.Pointer] = true
+			regs[ref.Reg]++
+		}
+		if len(pointers) < minLookupTables {
+			continue
+		}
+
+		l := Lookup{Address: adr, Tables: len(pointers), Calls: refs}
+		for reg, n := range regs {
+			if n > regs[l.Reg] || (n == regs[l.Reg] && reg < l.Reg) {
+				l.Reg = reg
+			}
+		}
+		lookups = append(lookups, l)
+		isLookup[adr] = true
+	}
+	sort.Slice(lookups, func(i, j int) bool { return lookups[i].Address < lookups[j].Address })
+
+	byPointer := make(map[int]*CodeMap)
+	for _, ref := range h.mapRefs {
+		if !isLookup[ref.Routine] {
+			continue
+		}
+		m, ok := byPointer[ref.Pointer]
+		if !ok {
+			m = &CodeMap{Pointer: ref.Pointer, Table: h.header(ref.Pointer)}
+			byPointer[ref.Pointer] = m
+		}
+		m.Reads = append(m.Reads, ref)
+	}
+
+	var maps []CodeMap
+	for _, m := range byPointer {
+		sort.Slice(m.Reads, func(i, j int) bool { return m.Reads[i].From < m.Reads[j].From })
+		maps = append(maps, *m)
+	}
+	sort.Slice(maps, func(i, j int) bool { return maps[i].Pointer < maps[j].Pointer })
+
+	return lookups, maps, nil
+}
+
+// MapAddresses returns the header addresses of the tables read through lookup routines, for the scripts and exports
+func (h *DisAsm) MapAddresses() ([]int, error) {
+	_, maps, err := h.FindMaps()
+	if err != nil {
+		return nil, err
+	}
+
+	var adrs []int
+	for _, m := range maps {
+		if m.Table != nil {
+			adrs = append(adrs, m.Table.Address)
+		}
+	}
+	return adrs, nil
+}
+
+// WriteMaps writes the lookup routines, then every table with the code that reads it
+func (h *DisAsm) WriteMaps(w io.Writer) error {
+	lookups, maps, err := h.FindMaps()
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "Lookup routines: %d\n", len(lookups))
+	for _, l := range lookups {
+		fmt.Fprintf(w, "  SUB_%X  pointer in 0x%.2X  %d tables, %d calls\n", l.Address, l.Reg, l.Tables, len(l.Calls))
+	}
+
+	headers := 0
+	for _, m := range maps {
+		if m.Table != nil {
+			headers++
+		}
+	}
+	fmt.Fprintf(w, "\nTables: %d (%d with headers)\n", len(maps), headers)
+
+	for _, m := range maps {
+		desc := fmt.Sprintf("0x%.6X  no header", m.Pointer)
+		if m.Table != nil {
+			desc = m.Table.String()
+		}
+		fmt.Fprintf(w, "  %s\n", desc)
+
+		for _, ref := range m.Reads {
+			fmt.Fprintf(w, "      read by SUB_%X from 0x%X\n", ref.Routine, ref.From)
+		}
+	}
+
+	return nil
+}
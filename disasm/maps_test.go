@@ -0,0 +1,77 @@
+package disasm
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/murdinc/ELMFlash/image"
+)
+
+// Map Finder Tests
+////////////////..........
+
+// loadTestImage loads a calibration from ../calibrations behind the default pre-calibration
+func loadTestImage(t *testing.T, calName string) *DisAsm {
+	t.Helper()
+	dir, err := filepath.Abs("../calibrations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	image.Dir = dir
+
+	h, err := New(calName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func TestFindMaps(t *testing.T) {
+	h := loadTestImage(t, "mp3")
+	lookups, maps, err := h.FindMaps()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	regs := make(map[int]int)
+	for _, l := range lookups {
+		regs[l.Address] = l.Reg
+	}
+	if len(lookups) > 10 || regs[0x147D54] != 0x44 || regs[0x147FFD] != 0x8C {
+		t.Errorf("lookup routines: %+v", regs)
+	}
+
+	found := make(map[int]CodeMap)
+	for _, m := range maps {
+		if m.Table != nil && m.Table.Start != m.Pointer {
+			t.Errorf("0x%X: header %s", m.Pointer, m.Table)
+		}
+		found[m.Header()] = m
+	}
+
+	tests := []struct {
+		header  int
+		routine int
+		from    int
+	}{
+		{0x10D6D8, 0x147B1C, 0x1567B9},
+		{0x10EB20, 0x147C10, 0x14CD11},
+		{0x10B7F6, 0x147EB7, 0x1421E6},
+		// Picked in a branch that jumps to a call another branch crawled first
+		{0x10BA00, 0x147EB7, 0x14219A},
+	}
+	for _, test := range tests {
+		m, ok := found[test.header]
+		if !ok || m.Table == nil {
+			t.Errorf("0x%X: not found", test.header)
+			continue
+		}
+		read := false
+		for _, ref := range m.Reads {
+			read = read || (ref.Routine == test.routine && ref.From == test.from)
+		}
+		if !read {
+			t.Errorf("0x%X: reads %+v", test.header, m.Reads)
+		}
+	}
+}
@@ -0,0 +1,307 @@
+package disasm
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Ghidra / IDA Scripts
+////////////////..........
+
+type SymbolKind string
+
+const (
+	RegisterSymbol  SymbolKind = "register"
+	VectorSymbol    SymbolKind = "vector"
+	FunctionSymbol  SymbolKind = "function"
+	MapSymbol       SymbolKind = "map"
+	MemRegionSymbol SymbolKind = "region"
+)
+
+// A name and comment for an address, or for the Start - Stop range of a region
+type Symbol struct {
+	Kind    SymbolKind
+	Address int
+	Stop    int // inclusive, regions only
+	Name    string
+	Comment string
+}
+
+var notIdent = regexp.MustCompile(`[^A-Za-z0-9_]+`)
+
+func symbolName(s string) string {
+	return strings.Trim(notIdent.ReplaceAllString(s, "_"), "_")
+}
+
+// Symbols collects everything ELMFlash knows about the image, maps are the table addresses found by hexstuff
+func (h *DisAsm) Symbols(maps []int) ([]Symbol, error) {
+
+	if h.opcodes == nil {
+		err := h.Crawl()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var symbols []Symbol
+	named := make(map[int]int) // address to index in symbols
+
+	add := func(s Symbol) {
+		if i, ok := named[s.Address]; ok && s.Kind != MemRegionSymbol {
+			// Keep the first name, but don't lose what else we know about it
+			if s.Comment != "" && !strings.Contains(symbols[i].Comment, s.Comment) {
+				symbols[i].Comment = strings.TrimSpace(symbols[i].Comment + "; " + s.Comment)
+			}
+			return
+		}
+		if s.Kind != MemRegionSymbol {
+			named[s.Address] = len(symbols)
+		}
+		symbols = append(symbols, s)
+	}
+
+	for _, loc := range memMap {
+		add(Symbol{Kind: MemRegionSymbol, Address: loc.Start, Stop: loc.Stop, Name: fmt.Sprintf("%s_%X", symbolName(loc.Name), loc.Start), Comment: loc.Description})
+	}
+
+	var regs []int
+	for adr := range RegObjs {
+		regs = append(regs, adr)
+	}
+	sort.Ints(regs)
+	for _, adr := range regs {
+		reg := RegObjs[adr]
+		add(Symbol{Kind: RegisterSymbol, Address: adr, Name: symbolName(reg.Mnemonic), Comment: strings.TrimSpace(reg.Description)})
+	}
+
+	var vecs []int
+	for adr := range interruptVectors {
+		vecs = append(vecs, adr)
+	}
+	sort.Ints(vecs)
+	for _, vec := range vecs {
+		intr := interruptVectors[vec]
+		routine := int(h.block[vec+1])<<8 | int(h.block[vec]) + codePage
+		add(Symbol{Kind: VectorSymbol, Address: vec, Name: fmt.Sprintf("VEC_%s_%X", symbolName(intr.Mnemonic), vec), Comment: fmt.Sprintf("%s (%s) -> 0x%X", intr.InterruptSource, intr.Type, routine)})
+	}
+
+	var routines []int
+	for adr := range h.intRoutineNames {
+		routines = append(routines, adr)
+	}
+	sort.Ints(routines)
+	add(Symbol{Kind: FunctionSymbol, Address: resetAdr, Name: "RESET", Comment: "Reset address"})
+	for _, adr := range routines {
+		if h.crawled[adr] != 1 {
+			continue
+		}
+		name := h.intRoutineNames[adr]
+		add(Symbol{Kind: FunctionSymbol, Address: adr, Name: "ISR_" + symbolName(name), Comment: "INTERRUPT ROUTINE_ " + name})
+	}
+
+	var subs []int
+	for adr := range h.subroutines {
+		subs = append(subs, adr)
+	}
+	sort.Ints(subs)
+	for _, adr := range subs {
+		add(Symbol{Kind: FunctionSymbol, Address: adr, Name: fmt.Sprintf("SUB_%X", adr), Comment: fmt.Sprintf("Called from %d places", len(h.subroutines[adr]))})
+	}
+
+	for _, adr := range maps {
+		if adr+8 > len(h.block) {
+			continue
+		}
+		rows := int(h.block[adr+4]) + 1
+		cols := int(h.block[adr+5]) + 1
+		add(Symbol{Kind: MapSymbol, Address: adr, Name: fmt.Sprintf("MAP_%X", adr), Comment: fmt.Sprintf("%d x %d table, data at 0x%X", rows, cols, adr+8)})
+	}
+
+	return symbols, nil
+}
+
+func scriptQuote(s string) string {
+	s = strings.Replace(s, "\\", "\\\\", -1)
+	s = strings.Replace(s, "\"", "\\\"", -1)
+	s = strings.Replace(s, "\n", "\\n", -1)
+	return "\"" + s + "\""
+}
+
+const ghidraHeader = `# ELMFlash symbols for %s
+# Load the merged image (pre-calibration + calibration) at address 0 first.
+#@category ELMFlash
+
+from ghidra.program.model.symbol import SourceType
+
+memory = currentProgram.getMemory()
+
+def region(start, stop, name, comment):
+    addr = toAddr(start)
+    if memory.getBlock(addr) is None:
+        try:
+            block = memory.createUninitializedBlock(name, addr, stop - start + 1, False)
+            block.setComment(comment)
+            return
+        except Exception as e:
+            print("region %%s: %%s" %% (name, e))
+    if memory.contains(addr):
+        setPlateComment(addr, "%%s\n%%s" %% (name, comment))
+
+def label(adr, name, comment):
+    addr = toAddr(adr)
+    try:
+        createLabel(addr, name, True, SourceType.USER_DEFINED)
+    except Exception as e:
+        print("label %%s: %%s" %% (name, e))
+    if comment and memory.contains(addr):
+        setEOLComment(addr, comment)
+
+def vector(adr, name, comment):
+    try:
+        createWord(toAddr(adr))
+    except Exception:
+        pass
+    label(adr, name, comment)
+
+def function(adr, name, comment):
+    addr = toAddr(adr)
+    disassemble(addr)
+    if getFunctionAt(addr) is None:
+        createFunction(addr, name)
+    label(adr, name, comment)
+
+def table(adr, name, comment):
+    label(adr, name, comment)
+    setPlateComment(toAddr(adr), comment)
+
+`
+
+const idcHeader = `// ELMFlash symbols for %s
+// Load the merged image (pre-calibration + calibration) at address 0 first.
+
+#include <idc.idc>
+
+static region(start, stop, name, comment) {
+	if (get_segm_start(start) == BADADDR) {
+		add_segm_ex(start, stop + 1, 0, 1, saRelByte, scPub, ADDSEG_NOSREG);
+		set_segm_name(start, name);
+	}
+	set_cmt(start, name + ": " + comment, 1);
+}
+
+static label(ea, name, comment) {
+	set_name(ea, name, SN_NOWARN | SN_NOCHECK);
+	if (comment != "") {
+		set_cmt(ea, comment, 0);
+	}
+}
+
+static vector(ea, name, comment) {
+	create_word(ea);
+	label(ea, name, comment);
+}
+
+static function(ea, name, comment) {
+	create_insn(ea);
+	add_func(ea, BADADDR);
+	label(ea, name, comment);
+}
+
+static table(ea, name, comment) {
+	label(ea, name, comment);
+	set_cmt(ea, comment, 1);
+}
+
+static main() {
+`
+
+var scriptCalls = map[SymbolKind]string{
+	RegisterSymbol: "label",
+	VectorSymbol:   "vector",
+	FunctionSymbol: "function",
+	MapSymbol:      "table",
+}
+
+// WriteGhidraScript writes a Ghidra Python script that applies the symbols to a loaded image
+func (h *DisAsm) WriteGhidraScript(w io.Writer, title string, maps []int) error {
+	symbols, err := h.Symbols(maps)
+	if err != nil {
+		return err
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, ghidraHeader, title)
+
+	for _, s := range symbols {
+		if s.Kind == MemRegionSymbol {
+			fmt.Fprintf(&sb, "region(0x%06X, 0x%06X, %s, %s)\n", s.Address, s.Stop, scriptQuote(s.Name), scriptQuote(s.Comment))
+		} else {
+			fmt.Fprintf(&sb, "%s(0x%06X, %s, %s)\n", scriptCalls[s.Kind], s.Address, scriptQuote(s.Name), scriptQuote(s.Comment))
+		}
+	}
+
+	fmt.Fprintf(&sb, "\nprint(\"ELMFlash - applied %d symbols\")\n", len(symbols))
+
+	_, err = io.WriteString(w, sb.String())
+	return err
+}
+
+// WriteIDCScript writes the same script as an IDA IDC file
+func (h *DisAsm) WriteIDCScript(w io.Writer, title string, maps []int) error {
+	symbols, err := h.Symbols(maps)
+	if err != nil {
+		return err
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, idcHeader, title)
+
+	for _, s := range symbols {
+		if s.Kind == MemRegionSymbol {
+			fmt.Fprintf(&sb, "\tregion(0x%06X, 0x%06X, %s, %s);\n", s.Address, s.Stop, scriptQuote(s.Name), scriptQuote(s.Comment))
+		} else {
+			fmt.Fprintf(&sb, "\t%s(0x%06X, %s, %s);\n", scriptCalls[s.Kind], s.Address, scriptQuote(s.Name), scriptQuote(s.Comment))
+		}
+	}
+
+	fmt.Fprintf(&sb, "\n\tmsg(\"ELMFlash - applied %d symbols\\n\");\n}\n", len(symbols))
+
+	_, err = io.WriteString(w, sb.String())
+	return err
+}
+
+// ExportScript writes a Ghidra (format "ghidra") or IDA (format "idc") script to path
+func (h *DisAsm) ExportScript(format, path, title string, maps []int) error {
+	var write func(io.Writer, string, []int) error
+	switch format {
+	case "ghidra":
+		write = h.WriteGhidraScript
+	case "idc":
+		write = h.WriteIDCScript
+	default:
+		err := fmt.Errorf("Unknown script format: %s", format)
+		log("Script - Error", err)
+		return err
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		log("Script - Error creating file", err)
+		return err
+	}
+	defer f.Close()
+
+	err = write(f, title, maps)
+	if err != nil {
+		log("Script - Error writing script", err)
+		return err
+	}
+
+	log(fmt.Sprintf("Script - wrote %s script to %s", format, path), nil)
+
+	return nil
+}
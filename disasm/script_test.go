@@ -0,0 +1,75 @@
+package disasm
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Script Tests
+////////////////..........
+
+func TestScripts(t *testing.T) {
+	h := loadTestImage(t, "mp3")
+	maps := []int{0x10AA60}
+
+	tests := []struct {
+		write func(w *bytes.Buffer) error
+		want  []string
+	}{
+		{func(w *bytes.Buffer) error { return h.WriteGhidraScript(w, "MP3", maps) }, []string{
+			"# ELMFlash symbols for MP3",
+			`function(0x172080, "RESET", "Reset address")`,
+			`table(0x10AA60, "MAP_10AA60", `,
+			`label(0x000018, "SP", `,
+			"print(\"ELMFlash - applied ",
+		}},
+		{func(w *bytes.Buffer) error { return h.WriteIDCScript(w, "MP3", maps) }, []string{
+			"// ELMFlash symbols for MP3",
+			`function(0x172080, "RESET", "Reset address");`,
+			`table(0x10AA60, "MAP_10AA60", `,
+			"\tregion(0x",
+		}},
+	}
+
+	for i, test := range tests {
+		var out bytes.Buffer
+		if err := test.write(&out); err != nil {
+			t.Fatal(err)
+		}
+		for _, want := range test.want {
+			if !strings.Contains(out.String(), want) {
+				t.Errorf("script %d is missing %q", i, want)
+			}
+		}
+	}
+}
+
+func TestExportScript(t *testing.T) {
+	h := loadTestImage(t, "mp3")
+	dir, err := ioutil.TempDir("", "elmflash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "MP3.py")
+	if err := h.ExportScript("ghidra", path, "MP3", nil); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ioutil.ReadFile(path); err != nil || !bytes.HasPrefix(data, []byte("# ELMFlash symbols for MP3")) {
+		t.Errorf("%s: %v", path, err)
+	}
+
+	// An unknown format doesn't leave a file behind
+	path = filepath.Join(dir, "MP3.txt")
+	if err := h.ExportScript("txt", path, "MP3", nil); err == nil {
+		t.Error("wrote a txt script")
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("%s was created", path)
+	}
+}
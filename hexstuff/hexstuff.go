@@ -2,9 +2,10 @@ package hexstuff
 
 import (
 	"fmt"
-	"os"
 	"regexp"
 
+	"github.com/murdinc/ELMFlash/image"
+	"github.com/murdinc/ELMFlash/tables"
 	"github.com/murdinc/legacy-cli"
 )
 
@@ -17,70 +18,21 @@ type HexStuff struct {
 	block       []byte
 }
 
+// New loads a calibration by catalog name or path behind the default pre-calibration
 func New(calName string) (*HexStuff, error) {
-	controller := new(HexStuff)
-
-	controller.Calibration = calName
-
-	// Pull in the stuff before the calibration file
-	preCalFile := "./calibrations/" + calibrations["pre"]
-	log(fmt.Sprintf("TestM1 - Pre-calibration File: %s", preCalFile), nil)
-
-	p, err := os.Open(preCalFile)
-	pi, err := p.Stat()
-	preFileSize := pi.Size()
-
-	// Pull in the Calibration file
-	calFile := "./calibrations/" + calibrations[calName]
-	log(fmt.Sprintf("TestM1 - Calibration File: %s", calFile), nil)
-
-	f, err := os.Open(calFile)
-	fi, err := f.Stat()
-	fileSize := fi.Size()
+	img, err := image.Load(calName)
 	if err != nil {
-		log("TestM1 - Error opening file", err)
+		log("TestM1 - Error loading calibration", err)
 		return nil, err
 	}
 
-	log(fmt.Sprintf("TestM1 - [%s] is %d bytes long", calibrations["pre"], preFileSize), nil)
-	log(fmt.Sprintf("TestM1 - [%s] is %d bytes long", calibrations[calName], fileSize), nil)
-
-	// Make some buffers
-	preBlock := make([]byte, 0x108000)
-	calBlock := make([]byte, 0x78000)
-
-	// Read in all the bytes
-	n, err := p.Read(preBlock)
-	if err != nil {
-		log("TestM1 - Error reading calibration", err)
-		return &HexStuff{}, err
-	}
-	log(fmt.Sprintf("TestM1 - reading 0x%X bytes from pre-calibration file.", n), nil)
-
-	n, err = f.Read(calBlock)
-	if err != nil {
-		log("TestM1 - Error reading calibration", err)
-		return &HexStuff{}, err
-	}
-
-	log(fmt.Sprintf("TestM1 - reading 0x%X bytes from calibration file.", n), nil)
-
-	block := append(preBlock, calBlock...)
-
-	controller.block = block
-
-	log(fmt.Sprintf("Length: 0x%X", len(block)), nil)
+	controller := new(HexStuff)
+	controller.Calibration = calName
+	controller.block = img.Block
 
 	return controller, nil
 }
 
-var calibrations = map[string]string{
-	"msp": "MSP.BIN",
-	"mp3": "MP3.BIN",
-	"p5":  "P5.BIN",
-	"pre": "PRE.BIN",
-}
-
 func (h *HexStuff) TestM1() ([]int, error) {
 
 	var addresses []int
@@ -112,14 +64,15 @@ Loop:
 				continue Loop
 			}
 
-			height := int(h.block[index+4]) + 1
-			width := int(h.block[index+5]) + 1
+			t, err := tables.Decode(h.block, index)
 
 			// Hope?
-			if height <= 1 || height > 32 || width > 50 {
+			if err != nil || t.Kind != tables.Map || t.Rows > 32 || t.Cols > 50 {
 				index += 2
 				continue Loop
 			}
+			height := t.Rows
+			width := t.Cols
 
 			h2 := h.block[index+1] + 1
 			h4 := h.block[index+3] + 1
@@ -133,8 +86,8 @@ Loop:
 				count++
 
 				size := width * height
-				start := index + 8
-				end := start + size
+				start := t.Start
+				end := t.End
 
 				sixteen := (int(h.block[index+7]) << 8) | int(h.block[index+6])
 
@@ -159,12 +112,7 @@ Loop:
 
 				addresses = append(addresses, index)
 
-				previous = end
-
-				// Round up if odd?
-				if previous%2 != 0 {
-					previous++
-				}
+				previous = t.Next()
 
 				index = previous
 
@@ -221,21 +169,13 @@ Loop:
 			break Loop
 		}
 
-		dataType := ""
-		cols := 0
-		rows := 0
-		size := 0
-		padCount := 0
-
-		end := index
-
 		h1 := h.block[index]
 		h2 := h.block[index+1]
 		h3 := h.block[index+2]
 		h4 := h.block[index+3]
 		h5 := h.block[index+4]
 		//h6 := h.block[index+5]
-		h7 := h.block[index+6]
+		//h7 := h.block[index+6]
 		//h8 := h.block[index+7]
 
 		// Skip the weird stuff that the code touches.
@@ -276,164 +216,41 @@ Loop:
 			continue Loop
 		}
 
-		//fmt.Printf("Index: 0x%X	-	TESTING: H1: 0x%X	H2: 0x%X	H3: 0x%X	H4: 0x%X	H5: 0x%X	H7: 0x%X	H8: 0x%X\n\n", index, h1, h2, h3, h4, h5, h7, h8)
-
-		// 4 Byte Match
-		if h1 == 0x02 {
-			//fmt.Printf("If #3 Index: 0x%X...\n", index)
-
-			size = 4
-			end = index + size + 1
-
-			count++
-
-			if previousEnd > 1 && previousEnd < index { // byte match
-				fmt.Printf("###############################################################\n PREVIOUS END: 0x%X [%d bytes]\n MISSED: %X \n###############################################################\n\n\n\n", previousEnd, len(h.block[previousEnd:index]), h.block[previousEnd:index])
+		t, err := tables.Decode(h.block, index)
+		if err != nil {
+			// Word aligned headers that aren't maps or arrays are skipped whole
+			if index%2 == 0 && (h1 == 0x00 || h1 == 0x40 || h1 == 0x60 || h1 == 0x80) && h2&0xF8 == 0x00 {
+				index++
 			}
-
-			match := fmt.Sprintf(" 4 BYTES MATCH # %d	-	ADDRESS: 0x%X	END: 0x%X	[%d bytes]\n 0x %X\n", count, index, end, size, h.block[index:end])
-			log(match, nil)
-
-			addresses = append(addresses, index)
-
-			previousEnd = end + padCount
-
-			index = previousEnd - 1
-
 			continue Loop
 		}
 
-		//fmt.Printf("HERE Index: 0x%X...\n", index)
-
-		// Word Aligned Stuff
-		if index%2 == 0 && (h1 == 0x00 || h1 == 0x40 || h1 == 0x60 || h1 == 0x80) && h2&0xF8 == 0x00 {
-			//fmt.Printf("If #1 Index: 0x%X...\n", index)
-
-			// 40 00 60 00 0C
-			// A0 00 00 08 06 09 04 09 00
-			// 00 02 00 02 16 0D 08 09 FE FE
-			if ((h3 == 0x00 && h4&0xF8 == 0x00) || (h3&0x1F == 0x00 && h4 == 0x00)) && h5 > 0x00 { // 3D Maps!
-				//fmt.Printf("If #2 Index: 0x%X...\n", index)
-				dataType = "3D Map"
+		count++
 
-				cols = int(h.block[index+4]) + 1
-				rows = int(h.block[index+5]) + 1
-
-				size = cols * rows
-
-				// two byte mode?
-				if h2 == 0x01 {
-					size *= 2
-				}
-
-				end = index + size + 8
-
-				if (h2 == 0x02 || h2 == 0x04) && h7&0x01 == 0x01 {
-					// Account for escaped 0x00
-					for di := index + 8; di < end+padCount; di += 2 {
-						if h.block[di] == 0x00 {
-							padCount += 1
-						}
-					}
-				}
-
-				count++
-
-				if previousEnd > 1 && previousEnd < index {
-					fmt.Printf("###############################################################\n PREVIOUS END: 0x%X [%d bytes]\n MISSED: %X \n###############################################################\n\n\n\n", previousEnd, len(h.block[previousEnd:index]), h.block[previousEnd:index])
-				}
-
-				match := fmt.Sprintf(" 3D MATCH # %d	-	ADDRESS: 0x%X	END: 0x%X	%d x %d	[%d bytes]	[padded: %d]	Type: %s\n 0x %X \n", count, index, end, cols, rows, size, padCount, dataType, h.block[index:end+padCount])
-				log(match, nil)
-
-				addresses = append(addresses, index)
-
-				previousEnd = end + padCount
-
-				// Round up if not word aligned
-				if previousEnd%2 != 0 {
-					previousEnd++
-				}
-
-				index = previousEnd - 1
-
-				continue Loop
-
-				// 00 02 0D 09 60 50
-			} else if h3&0xF0 == 0x00 && h3 > 0x00 { // Arrays!
-				//00 00 00 02 00
-				//fmt.Printf("If #3 Index: 0x%X...\n", index)
-				dataType = "Array"
-
-				size = int(h3) + 1
-
-				// two byte mode?
-				if h1 == 0x40 && h4&0x04 == 0x04 {
-					fmt.Printf("If #4 Index: 0x%X...\n", index)
-					size *= 2
-				}
-
-				end = index + size + 4
-
-				// Account for escaped 0x0*
-				if h2 == 0x04 && h4 == 0x05 {
-					for di := index + 4; di < end+padCount-1; di++ {
-						if di%2 == 0x00 && h.block[di]&0x0F == 0x00 {
-							padCount += 1
-						}
-					}
-				}
-
-				// alternate pad 1
-				if h1 == 0x00 && (h2 == 0x00 && h3 == 0x07 && h4 == 0x05) {
-					for di := index + 4; di < end+padCount; di += 1 {
-						if h.block[di] < 0x05 && padCount < size {
-							padCount += 1
-						}
-					}
-				}
-
-				// alternate pad 2
-				// 00 02 0D 09
-				if h1 == 0x00 && (h2 == 0x02 && h3 == 0x0D && h4 == 0x09) {
-					for di := index + 4; di < end+padCount; di++ {
-						if h.block[di] < h2 && h.block[di] > 0x00 {
-							padCount += 1
-							di++
-						}
-					}
-				}
-
-				count++
-
-				if previousEnd < index {
-					fmt.Printf("###############################################################\n PREVIOUS END: 0x%X [%d bytes]\n MISSED: %X \n###############################################################\n\n\n\n", previousEnd, len(h.block[previousEnd:index]), h.block[previousEnd:index])
-				}
-
-				match := fmt.Sprintf(" ARRAY MATCH # %d	-	ADDRESS: 0x%X	END: 0x%X	[%d bytes]	[padded: %d]	Type: %s\n 0x %X\n", count, index, end+padCount, size, padCount, dataType, h.block[index:end+padCount])
-				log(match, nil)
-
-				addresses = append(addresses, index)
-
-				previousEnd = end + padCount
-
-				// Round up if not word aligned
-				if previousEnd%2 != 0 {
-					previousEnd++
-				}
-
-				index = previousEnd - 1
-
-				continue Loop
+		if previousEnd > 1 && previousEnd < index {
+			fmt.Printf("###############################################################\n PREVIOUS END: 0x%X [%d bytes]\n MISSED: %X \n###############################################################\n\n\n\n", previousEnd, len(h.block[previousEnd:index]), h.block[previousEnd:index])
+		}
 
-			} else {
-				index++
-
-				continue Loop
-			}
+		size := t.Size() * t.Width
+		padCount := t.End - t.Start - size
 
+		switch t.Kind {
+		case tables.Item:
+			match := fmt.Sprintf(" 4 BYTES MATCH # %d	-	ADDRESS: 0x%X	END: 0x%X	[%d bytes]\n 0x %X\n", count, index, t.End, size, h.block[index:t.End])
+			log(match, nil)
+		case tables.Map:
+			match := fmt.Sprintf(" 3D MATCH # %d	-	ADDRESS: 0x%X	END: 0x%X	%d x %d	[%d bytes]	[padded: %d]	Type: %s\n 0x %X \n", count, index, t.End-padCount, t.Rows, t.Cols, size, padCount, t.Kind, h.block[index:t.End])
+			log(match, nil)
+		case tables.Array:
+			match := fmt.Sprintf(" ARRAY MATCH # %d	-	ADDRESS: 0x%X	END: 0x%X	[%d bytes]	[padded: %d]	Type: %s\n 0x %X\n", count, index, t.End, size, padCount, t.Kind, h.block[index:t.End])
+			log(match, nil)
 		}
+		dbg(t.String(), nil)
+
+		addresses = append(addresses, index)
 
+		previousEnd = t.Next()
+		index = previousEnd - 1
 	}
 
 	for _, address := range addresses {
@@ -447,7 +264,7 @@ Loop:
 }
 
 func FindMatch(block []byte) [][]int {
-	regex := string(0x00) + "[" + string(0x00) + "-" + string(0x05) + "]" + string(0x00) + "[" + string(0x00) + "-" + string(0x0F) + "]"
+	regex := "\x00[\x00-\x05]\x00[\x00-\x0F]"
 
 	re := regexp.MustCompile(regex)
 	matches := re.FindAllIndex(block, -1)
@@ -0,0 +1,183 @@
+package image
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// App constants
+////////////////..........
+const debug = false
+
+// Dir is where catalog names and bare file names are looked up
+var Dir = "./calibrations/"
+
+// DefaultPre is the catalog name of the pre-calibration Load puts in front of a calibration
+const DefaultPre = "pre"
+
+// Catalog maps short names to files in Dir
+var Catalog = map[string]string{
+	"msp":   "MSP.BIN",
+	"mp3":   "MP3.BIN",
+	"mp3x2": "MP3x2.BIN",
+	"pre":   "PRE2.BIN",
+	"pre1":  "PRE.BIN",
+	"pre2":  "PRE2.BIN",
+}
+
+// A pre-calibration and calibration loaded into one block, indexed by address
+type Image struct {
+	Name     string // calibration name or path, as given
+	PreFile  string // file the pre-calibration was read from, if the layout needs one
+	CalFile  string // file the calibration was read from
+	Layout   *Layout
+	File     []byte // the calibration file as read
+	Strategy string
+	Block    []byte
+	CalStart int // address of the first calibration byte
+}
+
+// Calibration returns the part of the block that came from the calibration file
+func (i *Image) Calibration() []byte {
+	return i.Block[i.CalStart:]
+}
+
+// Bytes returns the calibration file in its own layout, with the bytes it loaded read back from the block, edits and all
+func (i *Image) Bytes() []byte {
+	l := i.Layout
+	out := make([]byte, len(i.File))
+	copy(out, i.File)
+	copy(out[l.Offset:], i.Block[l.Base:])
+	if l.Mirrored {
+		copy(out, l.Calibration(out))
+	}
+	return out
+}
+
+// Names returns the catalog names, sorted
+func Names() []string {
+	var names []string
+	for name := range Catalog {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Resolve turns a catalog name, a file name in Dir, or any path into a file path
+func Resolve(name string) (string, error) {
+	if file, ok := Catalog[strings.ToLower(name)]; ok {
+		return filepath.Join(Dir, file), nil
+	}
+
+	for _, path := range []string{name, filepath.Join(Dir, name)} {
+		if fi, err := os.Stat(path); err == nil && !fi.IsDir() {
+			return path, nil
+		}
+	}
+
+	return "", fmt.Errorf("Unknown calibration: %s, give a file path or one of %s", name, strings.Join(Names(), ", "))
+}
+
+// ReadFile resolves name and reads the whole file
+func ReadFile(name string) (string, []byte, error) {
+	path, err := Resolve(name)
+	if err != nil {
+		return "", nil, err
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return path, nil, err
+	}
+	if len(data) == 0 {
+		return path, nil, fmt.Errorf("%s is empty", path)
+	}
+
+	log(fmt.Sprintf("Image - [%s] is 0x%X bytes long", path, len(data)), nil)
+
+	return path, data, nil
+}
+
+// Load reads a calibration behind the default pre-calibration
+func Load(calName string) (*Image, error) {
+	return LoadWith(DefaultPre, calName)
+}
+
+// LoadWith reads a calibration in any supported layout, on top of a pre-calibration if the layout needs one
+func LoadWith(preName string, calName string) (*Image, error) {
+	calFile, cal, err := ReadFile(calName)
+	if err != nil {
+		return nil, err
+	}
+
+	layout, err := Detect(cal)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", calFile, err)
+	}
+	if !layout.Supported {
+		return nil, fmt.Errorf("%s is a %s image (%s), only %s images can be analysed", calFile, layout.Family, layout.Name, Family196EA)
+	}
+
+	log(fmt.Sprintf("Image - [%s] is a %s image (%s)", calFile, layout.Family, layout.Description), nil)
+
+	data := cal[layout.Offset:]
+	size := layout.Base + len(data)
+
+	var preFile string
+	var pre []byte
+	if layout.Pre {
+		preFile, pre, err = ReadFile(preName)
+		if err != nil {
+			return nil, err
+		}
+		if len(pre) > size {
+			size = len(pre)
+		}
+	}
+
+	// Anything neither file covers reads like erased flash
+	block := make([]byte, size)
+	for i := range block {
+		block[i] = 0xFF
+	}
+	copy(block, pre)
+	copy(block[layout.Base:], data)
+
+	log(fmt.Sprintf("Image - Length: 0x%X, calibration at 0x%X", len(block), CalStart), nil)
+
+	return &Image{
+		Name:     calName,
+		PreFile:  preFile,
+		CalFile:  calFile,
+		Layout:   layout,
+		File:     cal,
+		Strategy: layout.Strategy(cal),
+		Block:    block,
+		CalStart: CalStart,
+	}, nil
+}
+
+// Debug Function
+////////////////..........
+func dbg(kind string, err error) {
+	if debug {
+		if err == nil {
+			fmt.Printf("### [DEBUG LOG - %s]\n\n", kind)
+		} else {
+			fmt.Printf("### [DEBUG ERROR - %s]: %s\n\n", kind, err)
+		}
+	}
+}
+
+func log(kind string, err error) {
+	if err == nil {
+		fmt.Printf(" %s\n", kind)
+	} else {
+		fmt.Printf("[ERROR - %s]: %s\n", kind, err)
+	}
+}
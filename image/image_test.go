@@ -0,0 +1,76 @@
+package image
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Image Tests
+////////////////..........
+
+func TestResolve(t *testing.T) {
+	useTestDir(t)
+
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"mp3", filepath.Join(Dir, "MP3.BIN")},
+		{"MP3", filepath.Join(Dir, "MP3.BIN")},
+		{"pre", filepath.Join(Dir, "PRE2.BIN")},
+		{"QOAP4C0.BIN", filepath.Join(Dir, "QOAP4C0.BIN")},
+		{filepath.Join(Dir, "MSP.BIN"), filepath.Join(Dir, "MSP.BIN")},
+	}
+	for _, test := range tests {
+		if path, err := Resolve(test.name); err != nil || path != test.want {
+			t.Errorf("%s: got %s, %v", test.name, path, err)
+		}
+	}
+
+	for _, name := range []string{"nope", "NOPE.BIN", "."} {
+		if path, err := Resolve(name); err == nil {
+			t.Errorf("%s resolved to %s", name, path)
+		}
+	}
+}
+
+func TestReadFile(t *testing.T) {
+	useTestDir(t)
+
+	path, data, err := ReadFile("msp")
+	if err != nil || path != filepath.Join(Dir, "MSP.BIN") || len(data) != 0x78000 {
+		t.Errorf("msp: %s, 0x%X bytes, %v", path, len(data), err)
+	}
+
+	empty, err := ioutil.TempFile("", "elmflash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	empty.Close()
+	defer os.Remove(empty.Name())
+
+	if _, _, err := ReadFile(empty.Name()); err == nil {
+		t.Error("read an empty file")
+	}
+	if _, err := Load(empty.Name()); err == nil {
+		t.Error("loaded an empty file")
+	}
+}
+
+func TestLoadWith(t *testing.T) {
+	useTestDir(t)
+
+	img, err := LoadWith("pre1", "mp3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.PreFile != filepath.Join(Dir, "PRE.BIN") || img.CalFile != filepath.Join(Dir, "MP3.BIN") || img.Strategy != "DXAI4U0" || img.Layout.Name != "196ea-cal" {
+		t.Errorf("got %+v", img)
+	}
+
+	if _, err := LoadWith("nope", "mp3"); err == nil {
+		t.Error("loaded without a pre-calibration")
+	}
+}
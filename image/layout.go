@@ -0,0 +1,146 @@
+package image
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// Flash Layouts
+////////////////..........
+
+type Family string
+
+const (
+	Family196EA Family = "8XC196EA" // Intel 196EA with a 28F400 flash, the ECU the rest of ELMFlash knows
+	FamilyEEC   Family = "Ford EEC" // 8061/8065 strategies, recognised but not analysed
+)
+
+// CalStart is where the calibration area of a 196EA flash starts, after the 32K boot block
+const CalStart = 0x108000
+
+// A Layout says where the bytes of a file go in the address space
+type Layout struct {
+	Name        string
+	Family      Family
+	Description string
+	Size        int  // file size in bytes
+	Offset      int  // first byte of the file that is loaded
+	Base        int  // address the byte at Offset is loaded at
+	Pre         bool // loaded on top of a pre-calibration
+	Mirrored    bool // the calibration area is also at the start of the file
+	Supported   bool // the 196EA tools can analyse it
+	match       func(data []byte) bool
+}
+
+// Every 196EA calibration starts with six erased bytes and the strategy file name
+var strategyHeader = []byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}
+
+// Ford EEC banks start with the same four bytes
+var eecBankHeader = []byte{0xFF, 0xFA, 0x27, 0xFE}
+
+func isCalibration(data []byte) bool {
+	return bytes.HasPrefix(data, strategyHeader) && bytes.Equal(data[13:17], []byte(".HEX"))
+}
+
+var Layouts = []Layout{
+	Layout{
+		Name:        "196ea-cal",
+		Family:      Family196EA,
+		Description: "Calibration, the flash without its boot block",
+		Size:        0x78000,
+		Base:        CalStart,
+		Pre:         true,
+		Supported:   true,
+		match:       isCalibration,
+	},
+	Layout{
+		Name:        "196ea-flash",
+		Family:      Family196EA,
+		Description: "Full 28F400 dump, boot block then calibration",
+		Size:        0x80000,
+		Base:        0x100000,
+		Pre:         true,
+		Supported:   true,
+		match: func(data []byte) bool {
+			return isCalibration(data[0x8000:])
+		},
+	},
+	Layout{
+		Name:        "196ea-doubled",
+		Family:      Family196EA,
+		Description: "Calibration followed by a full dump of the same flash",
+		Size:        0xF8000,
+		Offset:      0x78000,
+		Base:        0x100000,
+		Pre:         true,
+		Mirrored:    true,
+		Supported:   true,
+		match: func(data []byte) bool {
+			return isCalibration(data) && bytes.Equal(data[:0x78000], data[0x80000:])
+		},
+	},
+	Layout{
+		Name:        "196ea-merged",
+		Family:      Family196EA,
+		Description: "Pre-calibration and calibration already merged",
+		Size:        0x180000,
+		Supported:   true,
+		match: func(data []byte) bool {
+			return isCalibration(data[CalStart:])
+		},
+	},
+	Layout{
+		Name:        "eec-2bank",
+		Family:      FamilyEEC,
+		Description: "Two bank EEC strategy, banks at 0x0 and 0x1A000 of the file, identified but not loaded",
+		Size:        0x36000,
+		Base:        0x2000,
+		match: func(data []byte) bool {
+			return bytes.HasPrefix(data, eecBankHeader) && bytes.HasPrefix(data[0x1A000:], eecBankHeader)
+		},
+	},
+}
+
+// Detect finds the layout of a calibration file from its size and contents
+func Detect(data []byte) (*Layout, error) {
+	for i := range Layouts {
+		l := &Layouts[i]
+		if len(data) == l.Size && l.match(data) {
+			return l, nil
+		}
+	}
+
+	return nil, fmt.Errorf("Can't place a 0x%X byte image, it doesn't match any known flash layout", len(data))
+}
+
+// Strategy returns the strategy name from a 196EA calibration header, like DXAI4U0
+func (l *Layout) Strategy(data []byte) string {
+	cal := l.Calibration(data)
+	if cal == nil {
+		return ""
+	}
+	return string(cal[6:13])
+}
+
+// Calibration returns the calibration area of a 196EA file, what gets written to flash from CalStart up
+func (l *Layout) Calibration(data []byte) []byte {
+	if l.Family != Family196EA {
+		return nil
+	}
+	return data[l.Offset+CalStart-l.Base:]
+}
+
+// Identify reads a file and returns its layout and strategy name
+func Identify(name string) (*Layout, string, error) {
+	_, data, err := ReadFile(name)
+	if err != nil {
+		return nil, "", err
+	}
+
+	l, err := Detect(data)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return l, l.Strategy(data), nil
+}
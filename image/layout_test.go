@@ -0,0 +1,132 @@
+package image
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+)
+
+// Layout Tests
+////////////////..........
+
+func useTestDir(t *testing.T) {
+	dir, err := filepath.Abs("../calibrations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	Dir = dir
+}
+
+func TestDetect(t *testing.T) {
+	useTestDir(t)
+
+	tests := []struct {
+		file     string
+		layout   string
+		strategy string
+	}{
+		{"MP3.BIN", "196ea-cal", "DXAI4U0"},
+		{"MSP.BIN", "196ea-cal", "QOAP4C0"},
+		{"QJAAEA0.BIN", "196ea-cal", "QJAAEA0"},
+		{"BACK.MSP.BIN", "196ea-flash", "QOAP4C0"},
+		{"MP3x2.BIN", "196ea-doubled", "DXAI4U0"},
+		{"DKAM0IN.BIN", "eec-2bank", ""},
+		{"QEAH0M3.BIN", "eec-2bank", ""},
+	}
+	for _, test := range tests {
+		l, strategy, err := Identify(test.file)
+		if err != nil {
+			t.Errorf("%s: %s", test.file, err)
+			continue
+		}
+		if l.Name != test.layout || strategy != test.strategy {
+			t.Errorf("%s: got %s %q, want %s %q", test.file, l.Name, strategy, test.layout, test.strategy)
+		}
+	}
+
+	// A pre-calibration isn't a calibration, and neither is a calibration cut short
+	_, mp3, err := ReadFile("mp3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range []string{"PRE.BIN", "PRE2.BIN"} {
+		if l, _, err := Identify(file); err == nil {
+			t.Errorf("%s detected as %s", file, l.Name)
+		}
+	}
+	if l, err := Detect(mp3[:0x70000]); err == nil {
+		t.Errorf("short calibration detected as %s", l.Name)
+	}
+	if l, err := Detect(make([]byte, 0x78000)); err == nil {
+		t.Errorf("blank calibration detected as %s", l.Name)
+	}
+
+	// A loaded image is the merged layout
+	img, err := Load("mp3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l, err := Detect(img.Block); err != nil || l.Name != "196ea-merged" || l.Strategy(img.Block) != "DXAI4U0" {
+		t.Errorf("merged image: %v, %v", l, err)
+	}
+}
+
+func TestLoadLayouts(t *testing.T) {
+	useTestDir(t)
+
+	_, mp3, err := ReadFile("mp3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, msp, err := ReadFile("msp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, pre, err := ReadFile(DefaultPre)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every 196EA layout puts its calibration at CalStart, on top of the same pre-calibration
+	tests := []struct {
+		name string
+		cal  []byte
+	}{
+		{"mp3", mp3},
+		{"mp3x2", mp3},
+		{"BACK.MSP.BIN", msp},
+	}
+	for _, test := range tests {
+		img, err := Load(test.name)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if len(img.Block) != 0x180000 || img.CalStart != CalStart || !bytes.Equal(img.Calibration(), test.cal) {
+			t.Errorf("%s: 0x%X bytes, calibration at 0x%X doesn't match", test.name, len(img.Block), img.CalStart)
+		}
+		if !bytes.Equal(img.Block[:0x100000], pre[:0x100000]) {
+			t.Errorf("%s: pre-calibration doesn't match", test.name)
+		}
+	}
+
+	// The boot block of a full dump replaces the pre-calibration's
+	img, err := Load("BACK.MSP.BIN")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, back, err := ReadFile("BACK.MSP.BIN")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(img.Block[0x100000:CalStart], back[:0x8000]) {
+		t.Error("BACK.MSP.BIN: boot block doesn't match")
+	}
+
+	// Recognised, but not something the 196EA tools can load
+	for _, name := range []string{"DKAM0IN.BIN", "PRE.BIN"} {
+		if _, err := Load(name); err == nil {
+			t.Errorf("%s loaded", name)
+		}
+	}
+}
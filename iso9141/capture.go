@@ -0,0 +1,297 @@
+package iso9141
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Captures
+////////////////..........
+
+// A Capture records everything a Device sends to the ELM327 and reads back, one line each:
+//
+//	2016-06-03T21:47:47.123456789-07:00 > "221100"
+//	2016-06-03T21:47:47.180000000-07:00 < "NO DATA\r\r>"
+//
+// > is sent to the ELM327, < is read from it, the bytes are quoted the way Go quotes a string.
+type Capture struct {
+	w  io.Writer
+	mu sync.Mutex
+}
+
+// NewCapture records to w
+func NewCapture(w io.Writer) *Capture {
+	return &Capture{w: w}
+}
+
+const (
+	captureSent     = '>'
+	captureReceived = '<'
+)
+
+func (c *Capture) record(dir byte, data []byte) {
+	if c == nil || len(data) == 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(c.w, "%s %c %s\n", time.Now().Format(time.RFC3339Nano), dir, strconv.Quote(string(data)))
+}
+
+// close closes the writer if it's a file or anything else that needs closing
+func (c *Capture) close() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if closer, ok := c.w.(io.Closer); ok {
+		closer.Close()
+	}
+}
+
+// CaptureTo records the rest of the session to w, nil stops recording, DisconnectDevice closes w if it's an io.Closer
+func (d *Device) CaptureTo(w io.Writer) {
+	if w == nil {
+		d.capture = nil
+		return
+	}
+	d.capture = NewCapture(w)
+}
+
+// ConnectCapture is Connect recording the whole session to w, setup included, so it can be replayed.
+// DisconnectDevice closes w if it's an io.Closer, so does a failed connect.
+func ConnectCapture(t Transport, w io.Writer) (*Device, error) {
+	c := NewCapture(w)
+	d, err := connect(t, c)
+	if err != nil {
+		c.close()
+	}
+	return d, err
+}
+
+// A CaptureLine is one line of a capture file
+type CaptureLine struct {
+	Time time.Time
+	Sent bool // to the ELM327, otherwise read from it
+	Data []byte
+}
+
+// LoadCapture reads a capture file
+func LoadCapture(path string) ([]CaptureLine, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var lines []CaptureLine
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(text, " ", 3)
+		if len(parts) != 3 || (parts[1] != string(captureSent) && parts[1] != string(captureReceived)) {
+			return nil, fmt.Errorf("%s:%d: not a capture line", path, n)
+		}
+		ts, err := time.Parse(time.RFC3339Nano, parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, n, err)
+		}
+		data, err := strconv.Unquote(parts[2])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: bad data %s", path, n, parts[2])
+		}
+
+		lines = append(lines, CaptureLine{Time: ts, Sent: parts[1] == string(captureSent), Data: []byte(data)})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return lines, nil
+}
+
+// Replay
+////////////////..........
+
+// Replay plays a capture back as the ELM327. Every command has to be the one the capture sent next,
+// and each read gets the next reply it recorded, so the code under test has to say exactly what it said before.
+type Replay struct {
+	lines []CaptureLine
+	pos   int
+	line  []byte
+	out   []byte
+}
+
+// NewReplay replays lines
+func NewReplay(lines []CaptureLine) *Replay {
+	return &Replay{lines: lines}
+}
+
+// Done is true once every line of the capture has been played
+func (r *Replay) Done() bool {
+	return r.pos == len(r.lines) && len(r.out) == 0
+}
+
+// Write takes commands, each one has to match the next one sent in the capture
+func (r *Replay) Write(p []byte) (int, error) {
+	for i, c := range p {
+		if c != '\r' {
+			r.line = append(r.line, c)
+			continue
+		}
+
+		cmd := string(r.line)
+		r.line = r.line[:0]
+
+		// Replies the code never read are skipped, like the ELM327 would have dropped them
+		for r.pos < len(r.lines) && !r.lines[r.pos].Sent {
+			r.pos++
+		}
+		if r.pos == len(r.lines) {
+			return i, fmt.Errorf("Replay: sent %q after the end of the capture", cmd)
+		}
+		if want := string(r.lines[r.pos].Data); cmd != want {
+			return i, fmt.Errorf("Replay: sent %q, the capture sent %q", cmd, want)
+		}
+		r.pos++
+		r.out = nil
+	}
+	return len(p), nil
+}
+
+// Read hands back the capture's replies one at a time, the way the ELM327 sends them
+func (r *Replay) Read(p []byte) (int, error) {
+	if len(r.out) == 0 {
+		if r.pos == len(r.lines) || r.lines[r.pos].Sent {
+			return 0, io.EOF
+		}
+		r.out = r.lines[r.pos].Data
+		r.pos++
+	}
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
+
+func (r *Replay) Close() error {
+	return nil
+}
+
+// A capture file played back as the ELM327, for regression tests and bug reports
+type ReplayTransport struct {
+	Path string
+}
+
+func (t ReplayTransport) Open() (io.ReadWriteCloser, error) {
+	lines, err := LoadCapture(t.Path)
+	if err != nil {
+		return nil, err
+	}
+	return NewReplay(lines), nil
+}
+
+func (t ReplayTransport) String() string {
+	return "replay:" + t.Path
+}
+
+// Decoding
+////////////////..........
+
+// Service names, by request ID
+var serviceNames = map[byte]string{
+	0x01: "OBD Current Data",
+	0x02: "OBD Freeze Frame",
+	0x03: "OBD Read DTCs",
+	0x04: "OBD Clear DTCs",
+	0x09: "OBD Vehicle Info",
+	0x10: "Start Diagnostic Session",
+	0x11: "ECU Reset",
+	0x21: "Read Data By Local ID",
+	0x22: "Read Data By Common ID",
+	0x23: "Read Memory By Address",
+	0x27: "Security Access",
+	0x31: "Start Routine",
+	0x32: "Stop Routine",
+	0x34: "Request Download",
+	0x35: "Request Upload",
+	0x36: "Transfer Data",
+	0x37: "Request Transfer Exit",
+	0x3E: "Tester Present",
+	0xA0: "Wake Up",
+}
+
+func serviceName(sid byte) string {
+	if name, ok := serviceNames[sid]; ok {
+		return name
+	}
+	return fmt.Sprintf("Service %.2X", sid)
+}
+
+// DecodeMessage describes one request or answer, without its header and checksum
+func DecodeMessage(msg []byte) string {
+	if len(msg) == 0 {
+		return ""
+	}
+	sid := msg[0]
+
+	switch {
+	case sid == errResp && len(msg) >= 3 && msg[2] == 0x00:
+		return fmt.Sprintf("%s: done", serviceName(msg[1]))
+	case sid == errResp && len(msg) >= 3:
+		return newNegativeResponse(msg[1], msg[2]).Error()
+	case sid >= 0x40 && serviceNames[sid-0x40] != "":
+		return fmt.Sprintf("%s: OK", serviceName(sid-0x40))
+	}
+	return serviceName(sid)
+}
+
+// DecodeCapture pretty prints a capture as the services that went back and forth
+func DecodeCapture(w io.Writer, lines []CaptureLine) {
+	for _, l := range lines {
+		ts := l.Time.Format("15:04:05.000")
+		text := strings.TrimSpace(strings.Trim(string(l.Data), "\r\n>"))
+
+		if l.Sent {
+			if strings.HasPrefix(strings.ToUpper(text), "AT") {
+				fmt.Fprintf(w, "%s  -> %-30s ELM327 command\n", ts, text)
+				continue
+			}
+			msg, err := hex.DecodeString(strings.Replace(text, " ", "", -1))
+			if err != nil {
+				fmt.Fprintf(w, "%s  -> %-30s\n", ts, text)
+				continue
+			}
+			fmt.Fprintf(w, "%s  -> % -30X %s\n", ts, msg, DecodeMessage(msg))
+			continue
+		}
+
+		// Answers come back as frames run together, headers and checksums included
+		raw, err := hex.DecodeString(strings.NewReplacer(" ", "", "\r", "", "\n", "").Replace(text))
+		if err != nil || len(raw) < 5 {
+			fmt.Fprintf(w, "%s  <- %s\n", ts, strings.Replace(text, "\r", " ", -1))
+			continue
+		}
+		for len(raw) > 0 {
+			length := int(raw[0]>>4) + 1
+			if length < 5 || length > len(raw) {
+				fmt.Fprintf(w, "%s  <- % X\n", ts, raw)
+				break
+			}
+			msg := raw[3 : length-1]
+			fmt.Fprintf(w, "%s  <- % -30X %s\n", ts, msg, DecodeMessage(msg))
+			raw = raw[length:]
+		}
+	}
+}
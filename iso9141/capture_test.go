@@ -0,0 +1,165 @@
+package iso9141
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Capture Tests
+////////////////..........
+
+// session is what a teammate might have run when something went wrong
+func session(d *Device) (string, error) {
+	ctx := context.Background()
+	var out strings.Builder
+
+	resp, err := d.Msg(ctx, []byte{0x22, 0x11, 0x00})
+	if err != nil {
+		return "", err
+	}
+	out.WriteString(strings.ToUpper(toString(resp.Message)) + "\n")
+
+	v, err := d.ReadPID(ctx, 0x0C)
+	if err != nil {
+		return "", err
+	}
+	out.WriteString(v.String() + "\n")
+
+	// A PID it doesn't have
+	_, err = d.ReadPID(ctx, 0x10)
+	out.WriteString(err.Error() + "\n")
+
+	vin, err := d.VIN(ctx)
+	if err != nil {
+		return "", err
+	}
+	out.WriteString(vin + "\n")
+	return out.String(), nil
+}
+
+func captureSession(t *testing.T) (string, string) {
+	sim, _ := newTestSim(t, "mp3")
+
+	var capture bytes.Buffer
+	d, err := ConnectCapture(PipeTransport{Port: NewSim(sim.Memory)}, &capture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := session(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "session.capture")
+	if err := ioutil.WriteFile(path, capture.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path, want
+}
+
+func TestCaptureReplay(t *testing.T) {
+	path, want := captureSession(t)
+
+	lines, err := LoadCapture(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !lines[0].Sent || string(lines[0].Data) != "AT D" || lines[1].Sent {
+		t.Errorf("capture starts with %+v", lines[:2])
+	}
+
+	// The same session played back gets the same answers, and uses the whole capture
+	replay := NewReplay(lines)
+	d, err := Connect(PipeTransport{Port: replay})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := session(d)
+	if err != nil || got != want {
+		t.Errorf("replay got %q, %v\nwant %q", got, err, want)
+	}
+	if !replay.Done() {
+		t.Error("capture not played to the end")
+	}
+
+	// Anything the capture didn't send is an error
+	tr, err := ParseTransport("replay:" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err = Connect(tr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = d.Msg(context.Background(), []byte{0x22, 0x11, 0x01})
+	if err == nil || !strings.Contains(err.Error(), `the capture sent "221100"`) {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestDecodeCapture(t *testing.T) {
+	path, _ := captureSession(t)
+
+	lines, err := LoadCapture(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	DecodeCapture(&out, lines)
+	for _, want := range []string{
+		"-> AT D",
+		"ELM327 command",
+		"-> 22 11 00",
+		"Read Data By Common ID\n",
+		"<- 62 11 00 44 58 41 49 34 55 30",
+		"Read Data By Common ID: OK",
+		"-> 01 0C",
+		"OBD Current Data: OK",
+		"Recieved error from ECU for service 01: 12 - Sub Function Not Supported - Invalid Format (fatal)",
+		"<- 49 02 05 30 30 30 30",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("missing %q:\n%s", want, out.String())
+		}
+	}
+
+	for _, bad := range []string{"nope", "2016-06-03T21:47:47Z ? \"AT D\"", "2016-06-03T21:47:47Z > AT D"} {
+		path := filepath.Join(t.TempDir(), "bad.capture")
+		ioutil.WriteFile(path, []byte(bad+"\n"), 0644)
+		if _, err := LoadCapture(path); err == nil {
+			t.Errorf("%q: no error", bad)
+		}
+	}
+}
+
+type closeBuffer struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (b *closeBuffer) Close() error {
+	b.closed = true
+	return nil
+}
+
+func TestCaptureClose(t *testing.T) {
+	sim, _ := newTestSim(t, "mp3")
+
+	var capture closeBuffer
+	d, err := ConnectCapture(PipeTransport{Port: NewSim(sim.Memory)}, &capture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if capture.closed {
+		t.Fatal("closed while connected")
+	}
+	d.DisconnectDevice()
+	if !capture.closed {
+		t.Error("DisconnectDevice didn't close the capture")
+	}
+}
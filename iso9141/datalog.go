@@ -0,0 +1,207 @@
+package iso9141
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Datalogging
+////////////////..........
+
+// A Param is one value read out of a local ID (21) or common ID (22) answer
+type Param struct {
+	Name    string
+	Request string  // hex, the service and ID to ask for, like 221100 or 210C
+	Offset  int     // first byte of the value in the answer's data, after the ID
+	Size    int     // 1, 2 or 4 bytes, big endian, 1 if left out
+	Signed  bool    // two's complement
+	Scale   float64 // value = raw * Scale + Add, 1 if left out
+	Add     float64
+	Units   string
+}
+
+// LogOptions controls how often and for how long LogData polls the ECU
+type LogOptions struct {
+	Rate    time.Duration // time between samples
+	Samples int           // stop after this many samples, 0 runs until ctx is done
+}
+
+// LoadParams reads a definition file, a json list of Params
+func LoadParams(path string) ([]Param, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var params []Param
+	if err := json.Unmarshal(data, &params); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if len(params) == 0 {
+		return nil, fmt.Errorf("%s: no parameters", path)
+	}
+
+	for _, p := range params {
+		if _, err := p.request(); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	return params, nil
+}
+
+// request is the message that reads p
+func (p Param) request() ([]byte, error) {
+	msg, err := hex.DecodeString(strings.Replace(p.Request, " ", "", -1))
+	switch {
+	case err != nil:
+		return nil, fmt.Errorf("%s: bad request %q: %w", p.Name, p.Request, err)
+	case len(msg) == 2 && msg[0] == 0x21, len(msg) == 3 && msg[0] == 0x22:
+	default:
+		return nil, fmt.Errorf("%s: request %q isn't a local ID (21 xx) or common ID (22 xx xx)", p.Name, p.Request)
+	}
+
+	switch p.Size {
+	case 0, 1, 2, 4:
+	default:
+		return nil, fmt.Errorf("%s: size %d, want 1, 2 or 4", p.Name, p.Size)
+	}
+	return msg, nil
+}
+
+// Column is the CSV header for p
+func (p Param) Column() string {
+	if p.Units == "" {
+		return p.Name
+	}
+	return fmt.Sprintf("%s (%s)", p.Name, p.Units)
+}
+
+// Decode scales p out of the data of an answer, the bytes after the ID
+func (p Param) Decode(data []byte) (float64, error) {
+	size := p.Size
+	if size == 0 {
+		size = 1
+	}
+	if p.Offset < 0 || p.Offset+size > len(data) {
+		return 0, fmt.Errorf("%s: wants bytes %d-%d of a %d byte answer", p.Name, p.Offset, p.Offset+size-1, len(data))
+	}
+
+	var raw uint32
+	for _, b := range data[p.Offset : p.Offset+size] {
+		raw = raw<<8 | uint32(b)
+	}
+
+	value := float64(raw)
+	if p.Signed {
+		shift := uint(32 - 8*size)
+		value = float64(int32(raw<<shift) >> shift)
+	}
+
+	scale := p.Scale
+	if scale == 0 {
+		scale = 1
+	}
+	return value*scale + p.Add, nil
+}
+
+// answerData is what the ECU answered for msg, without the service, ID and checksum
+func answerData(msg []byte, resp Packet) ([]byte, error) {
+	if len(resp.Message) < len(msg)+1 || resp.Message[0] != msg[0]+0x40 {
+		return nil, fmt.Errorf("%w: % X for % X", ErrBadResponse, resp.Message, msg)
+	}
+	data := append([]byte(nil), resp.Message[len(msg):len(resp.Message)-1]...)
+	return append(data, resp.Data...), nil
+}
+
+// LogData polls the IDs params are read from at opts.Rate, writing each sample as a CSV row to w
+func (d *Device) LogData(ctx context.Context, params []Param, opts LogOptions, w io.Writer) error {
+	if opts.Rate <= 0 {
+		return fmt.Errorf("Bad sample rate %s", opts.Rate)
+	}
+
+	// Each ID is asked for once a sample, however many params come from it
+	var requests [][]byte
+	index := make(map[string]int)
+	for _, p := range params {
+		msg, err := p.request()
+		if err != nil {
+			return err
+		}
+		if _, ok := index[string(msg)]; !ok {
+			index[string(msg)] = len(requests)
+			requests = append(requests, msg)
+		}
+		if msg[0] == 0x21 && d.SecurityMode == false {
+			err := d.EnableSecurity(ctx)
+			if err != nil {
+				log("LogData - Unable to enter secutiy mode!", err)
+				return err
+			}
+		}
+	}
+
+	out := csv.NewWriter(w)
+	header := []string{"Time", "Elapsed"}
+	for _, p := range params {
+		header = append(header, p.Column())
+	}
+	out.Write(header)
+	out.Flush()
+
+	ticker := time.NewTicker(opts.Rate)
+	defer ticker.Stop()
+
+	start := time.Now()
+	for n := 1; ; n++ {
+		now := time.Now()
+		answers := make([][]byte, len(requests))
+		for i, msg := range requests {
+			resp, err := d.Msg(ctx, msg)
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if err == nil {
+				answers[i], err = answerData(msg, resp)
+			}
+			if err != nil {
+				dbg(fmt.Sprintf("LogData - %X", msg), err)
+			}
+		}
+
+		row := []string{now.Format(time.RFC3339Nano), strconv.FormatFloat(now.Sub(start).Seconds(), 'f', 3, 64)}
+		for _, p := range params {
+			msg, _ := p.request()
+			value, err := p.Decode(answers[index[string(msg)]])
+			if err != nil {
+				// A missed answer is an empty cell, the trace carries on
+				row = append(row, "")
+				continue
+			}
+			row = append(row, strconv.FormatFloat(value, 'f', -1, 64))
+		}
+		out.Write(row)
+		out.Flush()
+		if err := out.Error(); err != nil {
+			log("LogData - Error writing to file", err)
+			return err
+		}
+
+		if n == opts.Samples {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
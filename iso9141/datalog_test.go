@@ -0,0 +1,114 @@
+package iso9141
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Datalogging Tests
+////////////////..........
+
+func TestLoadParams(t *testing.T) {
+	dir := t.TempDir()
+
+	path := filepath.Join(dir, "good.json")
+	ioutil.WriteFile(path, []byte(`[{"Name": "RPM", "Request": "22 1234", "Size": 2, "Units": "rpm"}, {"Name": "Load", "Request": "210C"}]`), 0644)
+	params, err := LoadParams(path)
+	if err != nil || len(params) != 2 || params[0].Column() != "RPM (rpm)" || params[1].Column() != "Load" {
+		t.Fatalf("got %+v, %v", params, err)
+	}
+
+	for _, bad := range []string{
+		`[]`,
+		`[{"Name": "RPM", "Request": "2312"}]`,
+		`[{"Name": "RPM", "Request": "22 12"}]`,
+		`[{"Name": "RPM", "Request": "nope"}]`,
+		`[{"Name": "RPM", "Request": "221234", "Size": 3}]`,
+	} {
+		path := filepath.Join(dir, "bad.json")
+		ioutil.WriteFile(path, []byte(bad), 0644)
+		if _, err := LoadParams(path); err == nil {
+			t.Errorf("%s: no error", bad)
+		}
+	}
+}
+
+func TestParamDecode(t *testing.T) {
+	data := []byte{0x0B, 0xB8, 0xFF, 0x80}
+	tests := []struct {
+		p    Param
+		want float64
+	}{
+		{Param{Size: 2}, 3000},
+		{Param{Offset: 2, Signed: true, Scale: 0.5}, -0.5},
+		{Param{Offset: 3, Scale: 0.5, Add: -40}, 24},
+		{Param{Offset: 2, Size: 2, Signed: true}, -128},
+		{Param{Size: 4}, 0x0BB8FF80},
+	}
+	for _, test := range tests {
+		got, err := test.p.Decode(data)
+		if err != nil || got != test.want {
+			t.Errorf("%+v: got %v, %v", test.p, got, err)
+		}
+	}
+
+	if _, err := (Param{Offset: 3, Size: 2}).Decode(data); err == nil {
+		t.Error("read past the answer")
+	}
+}
+
+func TestLogData(t *testing.T) {
+	sim, d := newTestSim(t, "mp3")
+	sim.CommonIDs[0x1234] = []byte{0x0B, 0xB8, 0xFE}
+	sim.LocalIDs[0x0C] = []byte{0x80}
+
+	params := []Param{
+		{Name: "RPM", Request: "221234", Size: 2, Units: "rpm"},
+		{Name: "Spark", Request: "221234", Offset: 2, Signed: true, Scale: 0.5, Units: "deg"},
+		{Name: "Load", Request: "210C", Scale: 0.5, Units: "%"},
+		{Name: "Missing", Request: "221235"},
+	}
+
+	var out bytes.Buffer
+	err := d.LogData(context.Background(), params, LogOptions{Rate: time.Millisecond, Samples: 3}, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rows, err := csv.NewReader(&out).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 4 {
+		t.Fatalf("%d rows, want a header and 3 samples", len(rows))
+	}
+
+	want := []string{"Time", "Elapsed", "RPM (rpm)", "Spark (deg)", "Load (%)", "Missing"}
+	for i := range want {
+		if rows[0][i] != want[i] {
+			t.Errorf("header %q, want %q", rows[0], want)
+			break
+		}
+	}
+	for _, row := range rows[1:] {
+		if _, err := time.Parse(time.RFC3339Nano, row[0]); err != nil {
+			t.Error(err)
+		}
+		if row[2] != "3000" || row[3] != "-1" || row[4] != "64" || row[5] != "" {
+			t.Errorf("got %q", row)
+		}
+	}
+
+	// Each ID is asked for once a sample
+	if got := countRequests(sim, 0x22); got != 2*3 {
+		t.Errorf("%d common ID requests, want %d", got, 2*3)
+	}
+	if got := countRequests(sim, 0x21); got != 3 {
+		t.Errorf("%d local ID requests, want 3", got)
+	}
+}
@@ -0,0 +1,244 @@
+package iso9141
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/cheggaaa/pb"
+)
+
+// Downloads
+////////////////..........
+
+const (
+	downloadStart = 0x108000
+	downloadStop  = 0x180000
+	downloadBlock = 0x400
+)
+
+// A Journal records the blocks of a download that are verified and written to the part file, so an interrupted download can carry on where it stopped
+type Journal struct {
+	Start     int
+	Stop      int
+	BlockSize int
+	Strategy  string         // what the ECU reported, blocks of another ECU's download can't be mixed in
+	Blocks    map[int]uint32 // crc32 of each finished block, by address
+}
+
+func journalPath(outfile string) string {
+	return "./" + outfile + ".journal"
+}
+
+func partPath(outfile string) string {
+	return "./" + outfile + ".part"
+}
+
+// RestartDownload throws away an interrupted download, so the next DownloadBIN starts from the beginning
+func RestartDownload(outfile string) error {
+	for _, path := range []string{journalPath(outfile), partPath(outfile)} {
+		err := os.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadJournal picks up the journal left by an interrupted download of the ECU running strategy, dropping any block
+// the part file no longer agrees with. A download from another ECU can't be resumed.
+func loadJournal(outfile string, part *os.File, strategy string) (*Journal, error) {
+	j := &Journal{Start: downloadStart, Stop: downloadStop, BlockSize: downloadBlock, Strategy: strategy, Blocks: make(map[int]uint32)}
+
+	data, err := ioutil.ReadFile(journalPath(outfile))
+	if err != nil {
+		return j, nil
+	}
+
+	var old Journal
+	err = json.Unmarshal(data, &old)
+	if err != nil || old.Start != j.Start || old.Stop != j.Stop || old.BlockSize != j.BlockSize {
+		log("DownloadBIN - Ignoring a journal from a different download", err)
+		return j, nil
+	}
+	if old.Strategy != strategy {
+		return nil, fmt.Errorf("%s is a download from an ECU reporting %q, this one reports %q, restart it to start over", partPath(outfile), old.Strategy, strategy)
+	}
+
+	block := make([]byte, j.BlockSize)
+	for addr, sum := range old.Blocks {
+		_, err := part.ReadAt(block, int64(addr-j.Start))
+		if err == nil && crc32.ChecksumIEEE(block) == sum {
+			j.Blocks[addr] = sum
+		}
+	}
+	return j, nil
+}
+
+// save writes the journal next to the part file, by way of a temporary file so a crash can't leave half of one
+func (j *Journal) save(outfile string) error {
+	data, err := json.Marshal(j)
+	if err != nil {
+		return err
+	}
+
+	tmp := journalPath(outfile) + ".tmp"
+	err = ioutil.WriteFile(tmp, data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, journalPath(outfile))
+}
+
+// DownloadBIN downloads the calibration to ./<outfile><timestamp>.BIN.
+// Every block is read until two reads agree and journaled as it's written, so a download that fails or is cancelled resumes from ./<outfile>.journal.
+func (d *Device) DownloadBIN(ctx context.Context, outfile string) error {
+	// Make sure we have Security Access
+	if d.SecurityMode == false {
+		err := d.EnableSecurity(ctx)
+		if err != nil {
+			log("DownloadBIN - Unable to enter secutiy mode!", err)
+			return err
+		}
+	}
+
+	// Which ECU this is, so a resumed download is from the same one
+	var strategy string
+	if d.Dummy != true {
+		var err error
+		strategy, err = d.strategy(ctx)
+		if err != nil {
+			log("DownloadBIN - [FAIL", err)
+			return err
+		}
+		log(fmt.Sprintf("ECU Strategy: %s", strategy), nil)
+	}
+
+	part, err := os.OpenFile(partPath(outfile), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		log("DownloadBIN - Error opening file", err)
+		return err
+	}
+	defer part.Close()
+
+	j, err := loadJournal(outfile, part, strategy)
+	if err != nil {
+		log("DownloadBIN - Can't resume", err)
+		return err
+	}
+	total := (j.Stop - j.Start) / j.BlockSize
+
+	if len(j.Blocks) > 0 {
+		log(fmt.Sprintf("Resuming Download, %d of %d blocks already done...", len(j.Blocks), total), nil)
+	} else {
+		log("Starting Download...", nil)
+	}
+	bar := pb.StartNew(total)
+	bar.Set(len(j.Blocks))
+
+	for addr := j.Start; addr < j.Stop; addr += j.BlockSize {
+		if _, ok := j.Blocks[addr]; ok {
+			continue
+		}
+
+		block, err := d.VerifiedBlock(ctx, addr, j.BlockSize)
+		if err != nil {
+			log(fmt.Sprintf("DownloadBIN - Stopped at 0x%.6X, run it again to resume", addr), err)
+			return err
+		}
+		dbg(fmt.Sprintf("BLOCK: %X\n\n", block), nil)
+
+		_, err = part.WriteAt(block, int64(addr-j.Start))
+		if err == nil {
+			err = part.Sync()
+		}
+		if err != nil {
+			log("DownloadBIN - Error writing to file", err)
+			return err
+		}
+
+		j.Blocks[addr] = crc32.ChecksumIEEE(block)
+		err = j.save(outfile)
+		if err != nil {
+			log("DownloadBIN - Error writing journal", err)
+			return err
+		}
+		bar.Increment()
+	}
+
+	// Check the whole image against the journal before it gets its final name
+	data := make([]byte, j.Stop-j.Start)
+	_, err = part.ReadAt(data, 0)
+	if err != nil {
+		log("DownloadBIN - Error reading back file", err)
+		return err
+	}
+	for addr, sum := range j.Blocks {
+		if crc32.ChecksumIEEE(data[addr-j.Start:addr-j.Start+j.BlockSize]) != sum {
+			err := fmt.Errorf("Block 0x%.6X changed on disk", addr)
+			log("DownloadBIN - [FAIL", err)
+			delete(j.Blocks, addr)
+			j.save(outfile)
+			return err
+		}
+	}
+
+	ts := time.Now().Format(time.RFC3339)
+	final := "./" + outfile + ts + ".BIN"
+	err = os.Rename(partPath(outfile), final)
+	if err != nil {
+		log("DownloadBIN - Error renaming file", err)
+		return err
+	}
+	os.Remove(journalPath(outfile))
+
+	bar.FinishPrint("Download Finished!")
+	log(fmt.Sprintf("Saved %s", final), nil)
+	return nil
+}
+
+// VerifiedBlock downloads a block until two reads in a row agree, backing off after each failure, up to Limits.Attempts failures
+func (d *Device) VerifiedBlock(ctx context.Context, start, length int) ([]byte, error) {
+	var last []byte
+	var err error
+	wait := d.Limits.Backoff
+
+	for failures := 0; failures < d.Limits.Attempts; {
+		var block []byte
+		block, err = d.DownloadBlock(ctx, start, length)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if nr := AsNegativeResponse(err); nr != nil && !nr.Retryable() {
+			return nil, err
+		}
+		if err == nil && last != nil && bytes.Equal(block, last) {
+			return block, nil
+		}
+
+		if err == nil && last == nil {
+			last = block
+			continue
+		}
+
+		if err == nil {
+			err = fmt.Errorf("Block 0x%.6X read back differently", start)
+			last = block
+		}
+
+		// Whatever went wrong, the ECU or the line needs a moment, so wait longer each time
+		failures++
+		dbg(fmt.Sprintf("VerifiedBlock - 0x%.6X failed %d times, waiting %s", start, failures, wait), err)
+		if sleep(ctx, wait) != nil {
+			return nil, ctx.Err()
+		}
+		wait *= 2
+	}
+
+	return nil, err
+}
@@ -0,0 +1,168 @@
+package iso9141
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/murdinc/ELMFlash/image"
+)
+
+// Download Tests
+////////////////..........
+
+func fastRetries(d *Device) {
+	d.Limits.Backoff = time.Millisecond
+}
+
+func countRequests(sim *Sim, sid byte) int {
+	n := 0
+	for _, req := range sim.Requests {
+		if req[0] == sid {
+			n++
+		}
+	}
+	return n
+}
+
+func TestDownloadFlakyLine(t *testing.T) {
+	sim, d := newTestSim(t, "mp3")
+	fastRetries(d)
+
+	want, err := ioutil.ReadFile(filepath.Join(image.Dir, "MP3.BIN"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every 5th block request is busy, every 7th pending, and every 11th comes back with a bad byte
+	n := 0
+	sim.Fault = func(msg []byte, frames [][]byte) [][]byte {
+		if msg[0] != 0x35 {
+			return frames
+		}
+		n++
+		switch {
+		case n%5 == 0:
+			return negative(0x35, 0x21)
+		case n%7 == 0:
+			return negative(0x35, 0x78)
+		case n%11 == 0:
+			bad := append([]byte(nil), frames[1]...)
+			bad[1] ^= 0xFF
+			return append([][]byte{frames[0], bad}, frames[2:]...)
+		}
+		return frames
+	}
+
+	inTempDir(t, func(dir string) {
+		err := d.DownloadBIN(context.Background(), "DOWNLOAD")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := readOutput(t, dir, "DOWNLOAD"); !bytes.Equal(got, want) {
+			t.Errorf("downloaded 0x%X bytes that don't match MP3.BIN", len(got))
+		}
+		if _, err := os.Stat(journalPath("DOWNLOAD")); !os.IsNotExist(err) {
+			t.Errorf("journal left behind: %v", err)
+		}
+	})
+}
+
+func TestDownloadResume(t *testing.T) {
+	sim, d := newTestSim(t, "mp3")
+	fastRetries(d)
+
+	want, err := ioutil.ReadFile(filepath.Join(image.Dir, "MP3.BIN"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The line drops for good after 100 blocks
+	sim.Fault = func(msg []byte, frames [][]byte) [][]byte {
+		if msg[0] == 0x35 && countRequests(sim, 0x35) > 200 {
+			return nil
+		}
+		return frames
+	}
+
+	inTempDir(t, func(dir string) {
+		err := d.DownloadBIN(context.Background(), "DOWNLOAD")
+		if err == nil {
+			t.Fatal("download over a dead line finished")
+		}
+		if matches, _ := filepath.Glob("DOWNLOAD*.BIN"); len(matches) != 0 {
+			t.Fatalf("unfinished download was named %v", matches)
+		}
+
+		// Mess up a block in the part file, it has to be fetched again
+		part, err := os.OpenFile(partPath("DOWNLOAD"), os.O_RDWR, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		part.WriteAt([]byte{0x00, 0x00}, 0x400*10)
+		part.Close()
+
+		sim.Fault = nil
+		sim.Requests = nil
+		err = d.DownloadBIN(context.Background(), "DOWNLOAD")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Two reads for each of the 380 blocks left, and the one that was messed up
+		if got := countRequests(sim, 0x35); got != 2*381 {
+			t.Errorf("resumed with %d block requests, want %d", got, 2*381)
+		}
+		if got := readOutput(t, dir, "DOWNLOAD"); !bytes.Equal(got, want) {
+			t.Errorf("downloaded 0x%X bytes that don't match MP3.BIN", len(got))
+		}
+	})
+}
+
+func TestDownloadOtherECU(t *testing.T) {
+	sim, d := newTestSim(t, "mp3")
+	fastRetries(d)
+
+	// The line drops for good after 10 blocks
+	sim.Fault = func(msg []byte, frames [][]byte) [][]byte {
+		if msg[0] == 0x35 && countRequests(sim, 0x35) > 20 {
+			return nil
+		}
+		return frames
+	}
+
+	inTempDir(t, func(dir string) {
+		if err := d.DownloadBIN(context.Background(), "DOWNLOAD"); err == nil {
+			t.Fatal("download over a dead line finished")
+		}
+		before, err := ioutil.ReadFile(journalPath("DOWNLOAD"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Another ECU on the bench, its blocks can't finish the first one's image
+		sim.Fault = nil
+		sim.CommonIDs[0x1100] = []byte("QOAP4C0")
+		sim.Requests = nil
+		if err := d.DownloadBIN(context.Background(), "DOWNLOAD"); err == nil {
+			t.Fatal("resumed the download of another ECU")
+		}
+		if countRequests(sim, 0x35) != 0 {
+			t.Error("read blocks from the other ECU")
+		}
+		if after, _ := ioutil.ReadFile(journalPath("DOWNLOAD")); !bytes.Equal(after, before) {
+			t.Error("the journal changed")
+		}
+
+		// Starting over is fine
+		RestartDownload("DOWNLOAD")
+		if err := d.DownloadBIN(context.Background(), "DOWNLOAD"); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
@@ -0,0 +1,111 @@
+package iso9141
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Errors
+////////////////..........
+
+var (
+	ErrNoData         = errors.New("No data")         // the ELM327 heard nothing back from the ECU
+	ErrUnknownCommand = errors.New("Unknown command") // the ELM327 answered ?
+	ErrBadResponse    = errors.New("Bad response")    // a reply we can't unpack, usually noise on the K-line
+	ErrNotConnected   = errors.New("No connection")
+)
+
+// Negative response codes the tester acts on, the rest are only in errCodes
+const (
+	NRCGeneralReject        = 0x10
+	NRCNotSupported         = 0x11
+	NRCBusy                 = 0x21 // busy, repeat the request
+	NRCConditionsNotCorrect = 0x22
+	NRCRoutineNotComplete   = 0x23
+	NRCSecurityDenied       = 0x33
+	NRCInvalidKey           = 0x35
+	NRCExceededAttempts     = 0x36
+	NRCTimeDelayNotExpired  = 0x37
+	NRCTransferSuspended    = 0x71
+	NRCTransferAborted      = 0x72
+	NRCTransferChecksum     = 0x77
+	NRCResponsePending      = 0x78 // the answer is coming, don't ask again
+	NRCIncorrectByteCount   = 0x79
+)
+
+// Class says what a tester should do about a negative response
+type Class int
+
+const (
+	Fatal          Class = iota // the request is wrong or can't be served, sending it again won't help
+	Retryable                   // conditions, sequence or transfer trouble that another try can get past
+	Busy                        // busy (0x21), pending (0x78) or in progress (0x23), the ECU needs time
+	SecurityDenied              // security access is missing, wrong or locked out
+)
+
+func (c Class) String() string {
+	switch c {
+	case Retryable:
+		return "retryable"
+	case Busy:
+		return "busy"
+	case SecurityDenied:
+		return "security denied"
+	}
+	return "fatal"
+}
+
+// Classify sorts a negative response code by what to do about it
+func Classify(code byte) Class {
+	switch code {
+	case NRCBusy, NRCResponsePending, NRCRoutineNotComplete:
+		return Busy
+	case NRCSecurityDenied, NRCInvalidKey, NRCExceededAttempts, NRCTimeDelayNotExpired:
+		return SecurityDenied
+	case NRCGeneralReject, NRCConditionsNotCorrect, NRCTransferSuspended, NRCTransferAborted, NRCTransferChecksum, NRCIncorrectByteCount:
+		return Retryable
+	}
+	return Fatal
+}
+
+// NegativeResponse is the ECU refusing a request, 7F <service> <code>
+type NegativeResponse struct {
+	Service byte
+	Code    byte
+	Class   Class
+}
+
+func newNegativeResponse(service, code byte) *NegativeResponse {
+	return &NegativeResponse{Service: service, Code: code, Class: Classify(code)}
+}
+
+func (e *NegativeResponse) Error() string {
+	desc := fmt.Sprintf("%.2X - Unknown", e.Code)
+	if int(e.Code) < len(errCodes) && errCodes[e.Code] != "" {
+		desc = errCodes[e.Code]
+	}
+	return fmt.Sprintf("Recieved error from ECU for service %.2X: %s (%s)", e.Service, desc, e.Class)
+}
+
+// Retryable is true when sending the request again can work, after waiting for a busy ECU or getting security access again
+func (e *NegativeResponse) Retryable() bool {
+	return e.Class != Fatal && e.Code != NRCExceededAttempts
+}
+
+// ResponseCode returns the negative response code carried by err, or 0 when the ECU didn't refuse anything
+func ResponseCode(err error) byte {
+	var nr *NegativeResponse
+	if errors.As(err, &nr) {
+		return nr.Code
+	}
+	return 0
+}
+
+// AsNegativeResponse returns the negative response in err, or nil when the ECU didn't refuse anything
+func AsNegativeResponse(err error) *NegativeResponse {
+	var nr *NegativeResponse
+	if errors.As(err, &nr) {
+		return nr
+	}
+	return nil
+}
@@ -0,0 +1,322 @@
+package iso9141
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Error and Timeout Tests
+////////////////..........
+
+func TestNegativeResponseError(t *testing.T) {
+	_, d := newTestSim(t, "mp3")
+
+	_, err := d.Msg(context.Background(), []byte{0x99})
+	var nr *NegativeResponse
+	if !errors.As(err, &nr) || nr.Service != 0x99 || nr.Code != 0x11 || ResponseCode(err) != 0x11 {
+		t.Fatalf("got %#v", err)
+	}
+
+	if ResponseCode(ErrNoData) != 0 || ResponseCode(nil) != 0 {
+		t.Error("a code from an error that isn't a negative response")
+	}
+}
+
+func TestParseMalformed(t *testing.T) {
+	tests := []struct {
+		name  string
+		frame string
+	}{
+		{"short response pending frame", "0510F57F2178AA"},
+		{"short frame", "0110F5AABBCC"},
+		{"packed frame past the end", "8410F56122AAAA0010F5AA"},
+	}
+
+	for _, test := range tests {
+		p := Packet{Message: []byte(test.frame)}
+		p.parse()
+		if !errors.Is(p.Error, ErrBadResponse) || p.ErrCode != 0xFF {
+			t.Errorf("%s: got %v, 0x%.2X", test.name, p.Error, p.ErrCode)
+		}
+	}
+}
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		code      byte
+		class     Class
+		retryable bool
+	}{
+		{NRCBusy, Busy, true},
+		{NRCResponsePending, Busy, true},
+		{NRCRoutineNotComplete, Busy, true},
+		{NRCConditionsNotCorrect, Retryable, true},
+		{NRCTransferChecksum, Retryable, true},
+		{NRCInvalidKey, SecurityDenied, true},
+		{NRCExceededAttempts, SecurityDenied, false},
+		{NRCNotSupported, Fatal, false},
+		{0x31, Fatal, false},
+		{0xEE, Fatal, false},
+	}
+
+	for _, test := range tests {
+		nr := newNegativeResponse(0x35, test.code)
+		if nr.Class != test.class || nr.Retryable() != test.retryable {
+			t.Errorf("0x%.2X: got %s, %t", test.code, nr.Class, nr.Retryable())
+		}
+		if !strings.Contains(nr.Error(), test.class.String()) {
+			t.Errorf("0x%.2X: %q doesn't say it's %s", test.code, nr.Error(), test.class)
+		}
+	}
+}
+
+func TestBusyRepeat(t *testing.T) {
+	sim, d := newTestSim(t, "mp3")
+	fastRetries(d)
+	ctx := context.Background()
+
+	// Busy twice, then the answer
+	busy := 2
+	sim.Fault = func(msg []byte, frames [][]byte) [][]byte {
+		if msg[0] == 0x22 && busy > 0 {
+			busy--
+			return negative(0x22, NRCBusy)
+		}
+		return frames
+	}
+
+	resp, err := d.Msg(ctx, []byte{0x22, 0x11, 0x00})
+	if err != nil || resp.Message[0] != 0x62 || countRequests(sim, 0x22) != 3 {
+		t.Errorf("got % X, %v after %d requests", resp.Message, err, countRequests(sim, 0x22))
+	}
+
+	// Always busy is given up on after Limits.Attempts
+	sim.Requests = nil
+	sim.Fault = func(msg []byte, frames [][]byte) [][]byte {
+		return negative(msg[0], NRCBusy)
+	}
+
+	_, err = d.Msg(ctx, []byte{0x22, 0x11, 0x00})
+	if ResponseCode(err) != NRCBusy || countRequests(sim, 0x22) != d.Limits.Attempts {
+		t.Errorf("got %v after %d requests", err, countRequests(sim, 0x22))
+	}
+}
+
+func TestResponsePending(t *testing.T) {
+	sim, d := newTestSim(t, "mp3")
+
+	// Pending frames ahead of the answer in the same reply
+	sim.Fault = func(msg []byte, frames [][]byte) [][]byte {
+		pending := append(negative(msg[0], NRCResponsePending), negative(msg[0], NRCResponsePending)...)
+		return append(pending, frames...)
+	}
+
+	resp, err := d.Msg(context.Background(), []byte{0x22, 0x11, 0x00})
+	if err != nil || resp.Message[0] != 0x62 || countRequests(sim, 0x22) != 1 {
+		t.Errorf("got % X, %v after %d requests", resp.Message, err, countRequests(sim, 0x22))
+	}
+}
+
+// A dongle that answers every request with pending, and the real answer a little later
+func pendingDevice(t *testing.T, answer []byte) *Device {
+	client, server := net.Pipe()
+	t.Cleanup(func() { client.Close(); server.Close() })
+
+	frames := &Sim{headers: true}
+	go func() {
+		reader := bufio.NewReader(server)
+		for {
+			cmd, err := reader.ReadString('\r')
+			if err != nil {
+				return
+			}
+			if strings.HasPrefix(cmd, "AT") {
+				server.Write([]byte("OK\r\r>"))
+				continue
+			}
+			server.Write([]byte(frames.frame([]byte{errResp, 0x31, NRCResponsePending}) + "\r\r>"))
+			time.Sleep(20 * time.Millisecond)
+			if answer != nil {
+				server.Write([]byte(frames.frame(answer) + "\r\r>"))
+			}
+		}
+	}()
+
+	return &Device{port: client, Limits: DefaultLimits}
+}
+
+func TestResponsePendingLater(t *testing.T) {
+	d := pendingDevice(t, []byte{0x71, 0xA2})
+
+	resp, err := d.Msg(context.Background(), []byte{0x31, 0xA2})
+	if err != nil || !bytes.HasPrefix(resp.Message, []byte{0x71, 0xA2}) {
+		t.Errorf("got % X, %v", resp.Message, err)
+	}
+
+	// Pending for longer than Limits.Pending
+	d = pendingDevice(t, nil)
+	d.Limits.Pending = 50 * time.Millisecond
+
+	start := time.Now()
+	_, err = d.Msg(context.Background(), []byte{0x31, 0xA2})
+	if !errors.Is(err, os.ErrDeadlineExceeded) || time.Since(start) > time.Second {
+		t.Errorf("got %v after %s", err, time.Since(start))
+	}
+}
+
+func TestRoutineLimits(t *testing.T) {
+	sim, d := newTestSim(t, "mp3")
+	d.Limits.Routine = 100 * time.Millisecond
+	ctx := context.Background()
+
+	if err := d.EnableSecurity(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// A routine the ECU doesn't have fails at once
+	sim.Requests = nil
+	err := d.RunRoutine(ctx, Routine{Start: []byte{0x31, 0xA9}, Stop: []byte{0x32, 0xA9, 0x00}, Running: []byte{NRCRoutineNotComplete}})
+	if ResponseCode(err) != 0x31 || countRequests(sim, 0x31) != 1 {
+		t.Errorf("got %v after %d tries", err, countRequests(sim, 0x31))
+	}
+
+	// A routine that keeps being rejected is given up on after Limits.Attempts
+	sim.Requests = nil
+	sim.Fault = func(msg []byte, frames [][]byte) [][]byte {
+		if msg[0] == 0x31 {
+			return negative(0x31, NRCGeneralReject)
+		}
+		return frames
+	}
+	err = d.RunRoutine(ctx, RoutineCheck)
+	if err == nil || countRequests(sim, 0x31) != d.Limits.Attempts {
+		t.Errorf("got %v after %d tries", err, countRequests(sim, 0x31))
+	}
+
+	// A positive answer to the start is started, not tried again
+	sim.Requests = nil
+	sim.Fault = func(msg []byte, frames [][]byte) [][]byte {
+		if msg[0] == 0x31 {
+			return positive(0x71, msg[1])
+		}
+		return frames
+	}
+	err = d.RunRoutine(ctx, RoutineCheck)
+	if err != nil || countRequests(sim, 0x31) != 1 {
+		t.Errorf("got %v after %d tries", err, countRequests(sim, 0x31))
+	}
+
+	// A routine that never finishes is given up on after Limits.Routine
+	sim.Fault = func(msg []byte, frames [][]byte) [][]byte {
+		if msg[0] == 0x32 {
+			return negative(0x32, NRCRoutineNotComplete)
+		}
+		return frames
+	}
+	err = d.RunRoutine(ctx, RoutineCheck)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestWakeLimit(t *testing.T) {
+	sim, d := newTestSim(t, "mp3")
+	d.Limits.Wake = 100 * time.Millisecond
+
+	// An ECU that never wakes up
+	sim.Fault = func(msg []byte, frames [][]byte) [][]byte {
+		if msg[0] == 0xA0 {
+			return nil
+		}
+		return frames
+	}
+
+	err := d.EnableSecurity(context.Background())
+	if !errors.Is(err, context.DeadlineExceeded) || d.SecurityMode {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestCancelDownload(t *testing.T) {
+	sim, d := newTestSim(t, "mp3")
+
+	// Ctrl-C in the middle of a block
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sim.Fault = func(msg []byte, frames [][]byte) [][]byte {
+		if msg[0] == 0x35 && countRequests(sim, 0x35) == 20 {
+			cancel()
+		}
+		return frames
+	}
+
+	inTempDir(t, func(dir string) {
+		err := d.DownloadBIN(ctx, "DOWNLOAD")
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("got %v", err)
+		}
+
+		// The transfer was closed, and nothing was asked for after it
+		last := sim.Requests[len(sim.Requests)-1]
+		if !bytes.Equal(last, []byte{0x37, 0x82}) || sim.transfer != nil {
+			t.Errorf("left the ECU after % X", last)
+		}
+		if _, err := os.Stat(journalPath("DOWNLOAD")); err != nil {
+			t.Errorf("no journal to resume from: %v", err)
+		}
+	})
+}
+
+// A dongle that takes commands and never answers
+func silentDevice(t *testing.T) *Device {
+	client, server := net.Pipe()
+	t.Cleanup(func() { client.Close(); server.Close() })
+
+	go func() {
+		buf := make([]byte, 256)
+		for {
+			if _, err := server.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+
+	return &Device{port: client, Limits: DefaultLimits}
+}
+
+func TestResponseTimeout(t *testing.T) {
+	d := silentDevice(t)
+	d.Limits.Response = 50 * time.Millisecond
+
+	start := time.Now()
+	_, err := d.Msg(context.Background(), []byte{0x22, 0x11, 0x00})
+	if !errors.Is(err, os.ErrDeadlineExceeded) || time.Since(start) > time.Second {
+		t.Errorf("got %v after %s", err, time.Since(start))
+	}
+}
+
+func TestCancelMsg(t *testing.T) {
+	d := silentDevice(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	start := time.Now()
+	_, err := d.Msg(ctx, []byte{0x22, 0x11, 0x00})
+	if !errors.Is(err, context.Canceled) || time.Since(start) > time.Second {
+		t.Errorf("got %v after %s", err, time.Since(start))
+	}
+
+	// Nothing is sent once ctx is done
+	_, err = d.Msg(ctx, []byte{0x22, 0x11, 0x00})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v", err)
+	}
+}
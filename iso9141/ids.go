@@ -0,0 +1,277 @@
+package iso9141
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ID Definitions
+////////////////..........
+
+// A Scan is what a CommonIdDump or LocalIdDump file holds, the answer to each ID that answered
+type Scan struct {
+	Name    string // file name, without the directory
+	Service byte   // 0x22 for common IDs, 0x21 for local IDs
+	Values  map[int][]byte
+}
+
+var scanPrefixes = map[string]byte{"Common ID: ": 0x22, "Local ID: ": 0x21}
+
+// LoadScan reads the lines of a scan file, "Common ID: 1100 Response: 4458414934553000"
+func LoadScan(path string) (*Scan, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scan := &Scan{Name: filepath.Base(path), Values: make(map[int][]byte)}
+	lines := bufio.NewScanner(f)
+	for n := 1; lines.Scan(); n++ {
+		line := strings.TrimSpace(lines.Text())
+		if line == "" {
+			continue
+		}
+
+		var service byte
+		for prefix, sid := range scanPrefixes {
+			if strings.HasPrefix(line, prefix) {
+				service = sid
+				line = strings.TrimPrefix(line, prefix)
+			}
+		}
+		parts := strings.SplitN(line, " Response:", 2)
+		if service == 0 || len(parts) != 2 || (scan.Service != 0 && scan.Service != service) {
+			return nil, fmt.Errorf("%s:%d: not a common or local ID scan line", path, n)
+		}
+		scan.Service = service
+
+		id, err := hex.DecodeString(parts[0])
+		if err != nil || len(id) == 0 || len(id) > 2 {
+			return nil, fmt.Errorf("%s:%d: bad ID %q", path, n, parts[0])
+		}
+		value, err := hex.DecodeString(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: bad response: %w", path, n, err)
+		}
+
+		key := 0
+		for _, b := range id {
+			key = key<<8 | int(b)
+		}
+		scan.Values[key] = value
+	}
+	if err := lines.Err(); err != nil {
+		return nil, err
+	}
+	if len(scan.Values) == 0 {
+		return nil, fmt.Errorf("%s: no IDs", path)
+	}
+	return scan, nil
+}
+
+// IDs returns the IDs in the scan, in order
+func (s *Scan) IDs() []int {
+	var ids []int
+	for id := range s.Values {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+// Request is the message that reads id, in the hex Param.Request takes
+func (s *Scan) Request(id int) string {
+	if s.Service == 0x21 {
+		return fmt.Sprintf("21%.2X", id)
+	}
+	return fmt.Sprintf("22%.4X", id)
+}
+
+// A Sample is the answer an ID gave in one scan
+type Sample struct {
+	Scan  string
+	Value string // hex
+}
+
+// An IDDef is everything known about one ID, what the scans saw and what it has been worked out to mean
+type IDDef struct {
+	Param
+	Length  int // bytes in the last answer
+	Samples []Sample
+	Notes   string
+}
+
+// IDStore is the definitions database, IDs by their request
+type IDStore struct {
+	IDs map[string]*IDDef
+}
+
+// LoadIDStore reads a definitions file, a file that doesn't exist yet is an empty store
+func LoadIDStore(path string) (*IDStore, error) {
+	s := &IDStore{IDs: make(map[string]*IDDef)}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if s.IDs == nil {
+		s.IDs = make(map[string]*IDDef)
+	}
+	for request, def := range s.IDs {
+		def.Request = request
+	}
+	return s, nil
+}
+
+// Save writes the store, by way of a temporary file so a crash can't leave half of one
+func (s *IDStore) Save(path string) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	err = ioutil.WriteFile(tmp, data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Add records the answer of every ID in scan, adding the IDs seen for the first time. Adding the same scan again changes nothing.
+func (s *IDStore) Add(scan *Scan) (added int) {
+	for _, id := range scan.IDs() {
+		value := scan.Values[id]
+		request := scan.Request(id)
+
+		def, ok := s.IDs[request]
+		if !ok {
+			def = &IDDef{Param: Param{Request: request}}
+			s.IDs[request] = def
+			added++
+		}
+		def.Length = len(value)
+
+		sample := Sample{Scan: scan.Name, Value: fmt.Sprintf("%X", value)}
+		seen := false
+		for i := range def.Samples {
+			if def.Samples[i].Scan == scan.Name {
+				def.Samples[i] = sample
+				seen = true
+			}
+		}
+		if !seen {
+			def.Samples = append(def.Samples, sample)
+		}
+	}
+	return added
+}
+
+// Requests returns the IDs in the store, in order
+func (s *IDStore) Requests() []string {
+	var requests []string
+	for request := range s.IDs {
+		requests = append(requests, request)
+	}
+	sort.Strings(requests)
+	return requests
+}
+
+// Params returns the IDs that have been given a name, ready for LogData
+func (s *IDStore) Params() []Param {
+	var params []Param
+	for _, request := range s.Requests() {
+		if p := s.IDs[request].Param; p.Name != "" {
+			params = append(params, p)
+		}
+	}
+	return params
+}
+
+// Name is what the store calls request, or "" if it hasn't been named
+func (s *IDStore) Name(request string) string {
+	if def, ok := s.IDs[request]; ok {
+		return def.Name
+	}
+	return ""
+}
+
+// Diffs
+////////////////..........
+
+// A ScanDiff is an ID that answered differently in two scans, Before or After is nil when it only answered in one
+type ScanDiff struct {
+	Request string
+	Before  []byte
+	After   []byte
+	Changed []int // offsets of the bytes that differ
+}
+
+// DiffScans finds the IDs whose answers changed between two scans of the same service
+func DiffScans(before, after *Scan) ([]ScanDiff, error) {
+	if before.Service != after.Service {
+		return nil, fmt.Errorf("can't diff a %X scan against a %X scan", before.Service, after.Service)
+	}
+
+	ids := before.IDs()
+	for _, id := range after.IDs() {
+		if _, ok := before.Values[id]; !ok {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+
+	var diffs []ScanDiff
+	for _, id := range ids {
+		b, a := before.Values[id], after.Values[id]
+		if bytes.Equal(a, b) && (a == nil) == (b == nil) {
+			continue
+		}
+
+		diff := ScanDiff{Request: before.Request(id), Before: b, After: a}
+		for i := 0; i < len(a) || i < len(b); i++ {
+			if i >= len(a) || i >= len(b) || a[i] != b[i] {
+				diff.Changed = append(diff.Changed, i)
+			}
+		}
+		diffs = append(diffs, diff)
+	}
+	return diffs, nil
+}
+
+// WriteDiffs prints the diffs, with the names the store has for them
+func WriteDiffs(w io.Writer, diffs []ScanDiff, store *IDStore) {
+	for _, diff := range diffs {
+		name := ""
+		if store != nil && store.Name(diff.Request) != "" {
+			name = " (" + store.Name(diff.Request) + ")"
+		}
+
+		switch {
+		case diff.Before == nil:
+			fmt.Fprintf(w, "%s%s: new, %X\n", diff.Request, name, diff.After)
+		case diff.After == nil:
+			fmt.Fprintf(w, "%s%s: gone, was %X\n", diff.Request, name, diff.Before)
+		default:
+			fmt.Fprintf(w, "%s%s: %X -> %X, bytes %v\n", diff.Request, name, diff.Before, diff.After, diff.Changed)
+		}
+	}
+	fmt.Fprintf(w, "%d IDs changed\n", len(diffs))
+}
@@ -0,0 +1,146 @@
+package iso9141
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// ID Definition Tests
+////////////////..........
+
+func writeScan(t *testing.T, dir, name string, lines ...string) string {
+	path := filepath.Join(dir, name)
+	err := ioutil.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadScan(t *testing.T) {
+	sim, d := newTestSim(t, "mp3")
+	sim.LocalIDs[0x01] = []byte{0x12, 0x34, 0x56, 0x78}
+	sim.LocalIDs[0x0C] = []byte{0x00, 0x80}
+
+	// A scan straight from LocalIdDump
+	inTempDir(t, func(dir string) {
+		err := d.LocalIdDump(context.Background(), "LOCAL_ID")
+		if err != nil {
+			t.Fatal(err)
+		}
+		matches, _ := filepath.Glob("LOCAL_ID*.BIN")
+		if len(matches) != 1 {
+			t.Fatalf("scan files %v", matches)
+		}
+
+		scan, err := LoadScan(matches[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if scan.Service != 0x21 || len(scan.Values) != 2 || scan.Request(0x0C) != "210C" || !bytes.Equal(scan.Values[0x01], []byte{0x34, 0x56, 0x78}) {
+			t.Errorf("got %+v", scan)
+		}
+	})
+
+	dir := t.TempDir()
+	for _, lines := range [][]string{
+		{},
+		{"Common ID: 1100 Response: 12", "Local ID: 01 Response: 12"},
+		{"Common ID: 11 00 Response: 12"},
+		{"Common ID: 1100 Response: 1"},
+		{"Common ID: 1100"},
+	} {
+		if _, err := LoadScan(writeScan(t, dir, "bad", lines...)); err == nil {
+			t.Errorf("%q: no error", lines)
+		}
+	}
+}
+
+func TestIDStore(t *testing.T) {
+	dir := t.TempDir()
+	idle, err := LoadScan(writeScan(t, dir, "idle.BIN", "Common ID: 1100 Response: 4458", "Common ID: 1234 Response: 0320", "Common ID: 1240 Response: "))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "ids.json")
+	store, err := LoadIDStore(path)
+	if err != nil || len(store.IDs) != 0 {
+		t.Fatalf("got %+v, %v", store, err)
+	}
+	if added := store.Add(idle); added != 3 {
+		t.Errorf("added %d IDs, want 3", added)
+	}
+	if added := store.Add(idle); added != 0 || len(store.IDs["221234"].Samples) != 1 {
+		t.Error("adding a scan twice changed the store")
+	}
+
+	// Name one of them, and it comes back as a Param to log
+	store.IDs["221234"].Name = "RPM"
+	store.IDs["221234"].Size = 2
+	store.IDs["221234"].Units = "rpm"
+	if err := store.Save(path); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err = LoadIDStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	def := store.IDs["221234"]
+	if def.Length != 2 || len(def.Samples) != 1 || def.Samples[0] != (Sample{Scan: "idle.BIN", Value: "0320"}) {
+		t.Errorf("got %+v", def)
+	}
+	params := store.Params()
+	if len(params) != 1 || params[0].Request != "221234" || params[0].Column() != "RPM (rpm)" {
+		t.Errorf("got %+v", params)
+	}
+
+	// A second scan adds a sample and keeps the name
+	revved, err := LoadScan(writeScan(t, dir, "revved.BIN", "Common ID: 1234 Response: 0BB8"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Add(revved)
+	if def := store.IDs["221234"]; def.Name != "RPM" || len(def.Samples) != 2 || def.Samples[1].Value != "0BB8" {
+		t.Errorf("got %+v", def)
+	}
+}
+
+func TestDiffScans(t *testing.T) {
+	dir := t.TempDir()
+	before, _ := LoadScan(writeScan(t, dir, "before.BIN", "Common ID: 1100 Response: 4458", "Common ID: 1234 Response: 03201A", "Common ID: 1240 Response: 00"))
+	after, _ := LoadScan(writeScan(t, dir, "after.BIN", "Common ID: 1100 Response: 4458", "Common ID: 1234 Response: 0BB81A", "Common ID: 1250 Response: 01"))
+
+	diffs, err := DiffScans(before, after)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diffs) != 3 {
+		t.Fatalf("got %+v", diffs)
+	}
+	if diffs[0].Request != "221234" || len(diffs[0].Changed) != 2 || diffs[0].Changed[0] != 0 || diffs[0].Changed[1] != 1 {
+		t.Errorf("got %+v", diffs[0])
+	}
+	if diffs[1].Request != "221240" || diffs[1].After != nil || diffs[2].Request != "221250" || diffs[2].Before != nil {
+		t.Errorf("got %+v", diffs[1:])
+	}
+
+	store := &IDStore{IDs: map[string]*IDDef{"221234": {Param: Param{Name: "RPM"}}}}
+	var out bytes.Buffer
+	WriteDiffs(&out, diffs, store)
+	for _, want := range []string{"221234 (RPM): 03201A -> 0BB81A, bytes [0 1]", "221240: gone, was 00", "221250: new, 01", "3 IDs changed"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("missing %q:\n%s", want, out.String())
+		}
+	}
+
+	local, _ := LoadScan(writeScan(t, dir, "local.BIN", "Local ID: 01 Response: 00"))
+	if _, err := DiffScans(before, local); err == nil {
+		t.Error("diffed a local ID scan against a common ID scan")
+	}
+}
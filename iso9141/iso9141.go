@@ -2,18 +2,14 @@ package iso9141
 
 import (
 	"bufio"
+	"context"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
-	"math/rand"
 	"os"
 	"strings"
 	"time"
-
-	"github.com/cheggaaa/pb"
-	serial "github.com/huin/goserial"
 )
 
 // App constants
@@ -61,23 +57,6 @@ var errCodes = []string{
 	0xFF: "FF - No Data",
 }
 
-var calibrations = map[string]string{
-	"msp": "MSP.BIN",
-	"mp3": "MP3.BIN",
-}
-
-var Algos = []SecAlgo{
-	SecAlgo{ID: 0x4C, Seed: []byte{0xAB, 0xED, 0xCC}, Key: []byte{0x84, 0xC4}},
-	SecAlgo{ID: 0x67, Seed: []byte{0xD3, 0xFB, 0x8C}, Key: []byte{0xAB, 0xD9}},
-	// TODO
-}
-
-type SecAlgo struct {
-	ID   byte
-	Seed []byte
-	Key  []byte
-}
-
 // OBD Types
 ////////////////..........
 type Packet struct {
@@ -92,23 +71,43 @@ type Packet struct {
 	DataAddr int
 }
 
-// Connection represents an OBD-II serial connection
+// Connection represents an OBD-II connection to an ELM327
 type Device struct {
 	Packet       Packet
-	serial       io.ReadWriteCloser
-	location     string
-	baud         int
+	port         io.ReadWriteCloser
+	transport    Transport
+	capture      *Capture
 	lastHeader   []byte
 	SecurityMode bool
 	Dummy        bool
+	Limits       Limits
+}
+
+// Limits bound how long a Device waits for the ECU and how many times it tries again
+type Limits struct {
+	Response time.Duration // one request and its answer
+	Routine  time.Duration // a routine, from start to stop
+	Wake     time.Duration // waiting for the ignition to be cycled before security access
+	Pending  time.Duration // waiting out response pending (0x78) answers to one request
+	Attempts int           // tries at a request the ECU is busy for, starting a routine or reading a block before giving up
+	Backoff  time.Duration // first wait after a failed block, doubled after each failure, and the wait before repeating a busy request
+}
+
+var DefaultLimits = Limits{
+	Response: 5 * time.Second,
+	Routine:  30 * time.Second,
+	Wake:     2 * time.Minute,
+	Pending:  30 * time.Second,
+	Attempts: 8,
+	Backoff:  250 * time.Millisecond,
 }
 
 // Device Functions
 ////////////////..........
 
-func (d *Device) EcuId() error {
+func (d *Device) EcuId(ctx context.Context) error {
 	ecuIdCommand := []byte{0x10} // note: flipped most and least significant bytes
-	idResp, err := d.Msg(ecuIdCommand)
+	idResp, err := d.Msg(ctx, ecuIdCommand)
 	if err != nil {
 		log("EcuId", err)
 		return err
@@ -119,62 +118,25 @@ func (d *Device) EcuId() error {
 	return nil
 }
 
-// TEST
-func (d *Device) Test() error {
-	return nil
-}
-
-// Reads an ECU memory in Security mode (faster)
-func (d *Device) DownloadBIN(outfile string) error {
-	// Make sure we have Security Access
-	if d.SecurityMode == false {
-		err := d.EnableSecurity()
-		if err != nil {
-			log("RunRoutine - Unable to enter secutiy mode!", err)
-			return err
-		}
-	}
-
-	// Open a file for writing
-	ts := time.Now().Format(time.RFC3339)
-	f, err := os.Create("./" + outfile + ts + ".BIN")
-
-	defer f.Close()
-
-	fmt.Println("./" + outfile + ts + ".BIN")
+// strategy reads the name of the strategy the ECU runs, like DXAI4U0
+func (d *Device) strategy(ctx context.Context) (string, error) {
+	resp, err := d.Msg(ctx, []byte{0x22, 0x11, 0x00})
 	if err != nil {
-		log("DownloadBIN - Error opening file", err)
-		return err
+		return "", fmt.Errorf("Can't read the ECU strategy: %s", err)
 	}
-
-	log("Starting Download...", nil)
-	bar := pb.StartNew(480)
-
-	for i := 0x108000; i < 0x017FFFF; i = i + 0x0400 {
-		bar.Increment()
-		addr := i
-
-		block, err := d.DownloadBlock(addr, 1024)
-		if err != nil {
-			return err
-		}
-		dbg(fmt.Sprintf("BLOCK: %X\n\n", block), nil)
-
-		n, err := f.Write(block)
-		if err != nil {
-			log("DownloadBIN - Error writing to file", err)
-			return err
-		}
-		dbg(fmt.Sprintf("DownloadBIN - wrote %d bytes", n), nil)
-
-		f.Sync()
+	if len(resp.Message) < 4 {
+		return "", fmt.Errorf("Bad ECU strategy response: %X", resp.Message)
 	}
-	bar.FinishPrint("Download Finished!")
+	return strings.TrimSpace(string(resp.Message[3 : len(resp.Message)-1])), nil
+}
+
+// TEST
+func (d *Device) Test() error {
 	return nil
 }
 
 // DumpBIN will read an entire bin in mode 23 (no auth)
-func (d Device) DumpBIN(outfile string) error {
+func (d Device) DumpBIN(ctx context.Context, outfile string) error {
 	// Open a file for writing
 	ts := time.Now().Format(time.RFC3339)
 	f, err := os.Create("./" + outfile + ts + ".BIN")
@@ -190,12 +152,15 @@ func (d Device) DumpBIN(outfile string) error {
 	log("Starting Dump...", nil)
 	//bar := pb.StartNew(480)
 	for i := 0x000000; i < 0x200000; i = i + 4 {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
 		addr := i
 		dumpCommand := []byte{0x23, byte(addr >> 16), byte(addr >> 8), byte(i)}
 
 		// Read some bytes
 		log(fmt.Sprintf("Requesting Address: 0x%X \n", dumpCommand[1:]), nil)
-		msgResp, err := d.Msg(dumpCommand)
+		msgResp, err := d.Msg(ctx, dumpCommand)
 		if err != nil {
 			log(fmt.Sprintf("DumpBIN - Error accessing Address:  %X", dumpCommand[1:]), err)
 			return err
@@ -221,120 +186,7 @@ func (d Device) DumpBIN(outfile string) error {
 }
 
 // Uploads a BIN file
-func (d *Device) UploadBIN(calName string) error {
-
-	// Pull in the Calibration file
-	calFile := "./calibrations/" + calibrations[calName]
-	log(fmt.Sprintf("Calibration File: %s", calFile), nil)
-
-	f, err := os.Open(calFile)
-	if err != nil {
-		log("UploadBIN - Error opening file", err)
-		return err
-	}
-
-	// Make sure we have Security Access
-	if d.SecurityMode == false {
-		err := d.EnableSecurity()
-		if err != nil {
-			log("RunRoutine - Unable to enter secutiy mode!", err)
-			return err
-		}
-	}
-
-	// Request by PID
-	_, err = d.Msg([]byte{0x22, 0x11, 0x00})
-	if err != nil {
-		return err
-	}
-
-	// Read some bytes
-	_, err = d.Msg([]byte{0x23, 0x10, 0x80, 0x80})
-	if err != nil {
-		return err
-	}
-
-	// Delete BIN on ECU
-	err = d.RunRoutine([]byte{0x31, 0xA1}, []byte{0x32, 0xA1, 0x00}, []byte{0x22, 0x23})
-	if err != nil {
-		dbg("UploadBIN - Routine 31 A1", err)
-	}
-
-	// Make a 1024 byte buffer
-	block := make([]byte, 1024)
-
-	// Write
-	count := 0
-	log("Starting Upload...", nil)
-	bar := pb.StartNew(480)
-	writeOffset := 0x10FC00
-	for i := 0x007C00; count < 480; i -= 0x0400 {
-		//writeOffset := 0x10FC00
-		if count != 0 && count%32 == 0 {
-			i += 0x10000
-			writeOffset += 0x10000
-			dbg("Requesting modulo 32", nil)
-		}
-
-		if count == 96 {
-			writeOffset += 0x80000
-			dbg("Requesting count number 96", nil)
-		}
-
-		count++
-		bar.Increment()
-
-		dbg(fmt.Sprintf("Requesting count %d", count), nil)
-
-		// Seek to new offset
-		readAddr64 := int64(i)
-		readOffset, err := f.Seek(readAddr64, 0)
-
-		// Read 1024 bytes
-		n, err := f.Read(block)
-		if err != nil {
-			log("UploadBIN - Error reading calibration", err)
-			return err
-		}
-		dbg(fmt.Sprintf("UploadBIN - reading %d bytes from offset: 0x%X", n, readOffset), nil)
-
-		// Get the destination addresses
-		//writeAddr := writeOffset + int(readOffset)
-		dbg(fmt.Sprintf("UploadBIN - writing %d bytes to offset 0x%X", n, writeOffset), nil)
-
-		// Append the Checksum
-		crc := uint16(0x0000)
-		for i := 0; i < len(block); i++ {
-			crc = crc + uint16(block[i])
-		}
-
-		chkh := byte(crc >> 8)
-		chkl := byte(crc)
-
-		dbg(fmt.Sprintf("UploadBIN - appending checksum: 0x%X 0x%X", chkh, chkl), nil)
-		blockChk := append(block, chkh, chkl)
-
-		// Upload the Calibration
-		err = d.UploadBlock(writeOffset, 1024, blockChk)
-		if err != nil {
-			return err
-		}
-
-		writeOffset -= 0x0400
-	}
-
-	bar.FinishPrint("Upload Finished!")
-
-	// Run Routine A3
-	err = d.RunRoutine([]byte{0x31, 0xA3, 0x1F, 0x3F}, []byte{0x32, 0xA3, 0x00}, []byte{0x22, 0x23})
-	if err != nil {
-		dbg("UploadBIN - Routine A3 [FAIL] [", err)
-	}
-
-	return nil
-}
-
-func (d *Device) CommonIdDump(outfile string) error {
+func (d *Device) CommonIdDump(ctx context.Context, outfile string) error {
 	// Open a file for writing
 	ts := time.Now().Format(time.RFC3339)
 	f, _ := os.Create("./" + outfile + ts + ".BIN")
@@ -343,13 +195,16 @@ func (d *Device) CommonIdDump(outfile string) error {
 	defer f.Close()
 
 	for i := 0x0000; i < 0x0FFFF; i++ {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
 		//i1 := byte(i >> 16)
 		i2 := byte(i >> 8)
 		i3 := byte(i)
 		//commonIdCommand := []byte{0x22, i3, i2, i1} // note: flipped most and least significant bytes
 		commonIdCommand := []byte{0x22, i2, i3}
 		log(fmt.Sprintf("Trying Command: %X \n", commonIdCommand), nil)
-		msgResp, err := d.Msg(commonIdCommand)
+		msgResp, err := d.Msg(ctx, commonIdCommand)
 		if err != nil {
 			dbg(fmt.Sprintf("CMD %X", commonIdCommand), err)
 		} else {
@@ -369,9 +224,9 @@ func (d *Device) CommonIdDump(outfile string) error {
 
 }
 
-func (d *Device) LocalIdDump(outfile string) error {
+func (d *Device) LocalIdDump(ctx context.Context, outfile string) error {
 	if d.SecurityMode == false {
-		err := d.EnableSecurity()
+		err := d.EnableSecurity(ctx)
 		if err != nil {
 			log("DownloadBlock - Unable to enter secutiy mode!", err)
 			return err
@@ -386,10 +241,13 @@ func (d *Device) LocalIdDump(outfile string) error {
 	defer f.Close()
 
 	for i := 0x00; i < 0x0FF; i++ {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
 		i1 := byte(i)
 		localIdCommand := []byte{0x21, i1}
 		log(fmt.Sprintf("Trying Command: %X \n", localIdCommand), nil)
-		msgResp, err := d.Msg(localIdCommand)
+		msgResp, err := d.Msg(ctx, localIdCommand)
 		if err != nil {
 			dbg(fmt.Sprintf("CMD %X", localIdCommand), err)
 		} else {
@@ -409,9 +267,9 @@ func (d *Device) LocalIdDump(outfile string) error {
 
 }
 
-func (d *Device) DownloadBlock(start, length int) ([]byte, error) {
+func (d *Device) DownloadBlock(ctx context.Context, start, length int) ([]byte, error) {
 	if d.SecurityMode == false {
-		err := d.EnableSecurity()
+		err := d.EnableSecurity(ctx)
 		if err != nil {
 			log("DownloadBlock - Unable to enter secutiy mode!", err)
 			return nil, err
@@ -433,30 +291,41 @@ func (d *Device) DownloadBlock(start, length int) ([]byte, error) {
 	// Request Download Transfer
 	dbg(fmt.Sprintf("Requesting Bytes: 0x%.6X - 0x%.6X", start, start+length-1), nil)
 	downloadCommand := []byte{0x35, 0x82, l1, l2, s1, s2, s3}
-	resp, err := d.Msg(downloadCommand)
+	resp, err := d.Msg(ctx, downloadCommand)
 	if err != nil {
+		// Security Access timed out, get it again on the next try
+		if nr := AsNegativeResponse(err); nr != nil && nr.Class == SecurityDenied {
+			d.SecurityMode = false
+		}
 		log("DownloadBlock [FAIL] [", err)
 		return []byte{}, err
 	}
 
-	// Request Download Transfer Exit
+	// Request Download Transfer Exit, even when ctx is done, so the ECU isn't left in the transfer
+	exitCtx, cancel := d.cleanup()
+	defer cancel()
 	exitCommand := []byte{0x37, 0x82}
-	_, err = d.Msg(exitCommand)
+	_, err = d.Msg(exitCtx, exitCommand)
 	if err != nil {
 		log("DownloadBlock [FAIL] [", err)
 		return []byte{}, err
 	}
 
 	// Trim the data to proper size
+	if len(resp.Data) < length {
+		err = fmt.Errorf("Short block at 0x%.6X, got %d of %d bytes", start, len(resp.Data), length)
+		log("DownloadBlock [FAIL] [", err)
+		return []byte{}, err
+	}
 	resp.Data = resp.Data[:length]
 
 	resp.DataAddr = start
 	return resp.Data, nil
 }
 
-func (d *Device) UploadBlock(start, length int, block []byte) error {
+func (d *Device) UploadBlock(ctx context.Context, start, length int, block []byte) error {
 	if d.SecurityMode == false {
-		err := d.EnableSecurity()
+		err := d.EnableSecurity(ctx)
 		if err != nil {
 			log("UploadBlock - Unable to enter secutiy mode!", err)
 			return err
@@ -478,7 +347,7 @@ func (d *Device) UploadBlock(start, length int, block []byte) error {
 	// Request Upload Transfer
 	dbg(fmt.Sprintf("Requesting to upload Bytes: 0x%.6X - 0x%.6X", start, start+length-1), nil)
 	uploadCommand := []byte{0x34, 0x82, l1, l2, s1, s2, s3}
-	_, err := d.Msg(uploadCommand)
+	_, err := d.Msg(ctx, uploadCommand)
 	if err != nil {
 		dbg("UploadBlock - Request Upload - 34 82 [FAIL] [", err)
 		return err
@@ -501,9 +370,17 @@ func (d *Device) UploadBlock(start, length int, block []byte) error {
 				end = len(block)
 			}
 
+			if err = ctx.Err(); err != nil {
+				break
+			}
+
 			uploadBlock := append([]byte{0x36}, block[i:end]...)
 			if d.Dummy != true {
-				_, err = d.Msg(uploadBlock)
+				_, err = d.Msg(ctx, uploadBlock)
+				if err != nil {
+					dbg("UploadBlock - Transfer Data - 36 [FAIL] [", err)
+					break
+				}
 			} else {
 				dbg(fmt.Sprintf("%X", uploadBlock), nil)
 			}
@@ -518,23 +395,45 @@ func (d *Device) UploadBlock(start, length int, block []byte) error {
 
 	}
 
-	// Request Download/Upload Transfer Exit
+	// Request Download/Upload Transfer Exit, even after a failure, so the ECU isn't left in the transfer.
+	// It throws away a block that didn't all arrive.
+	exitCtx, cancel := d.cleanup()
+	defer cancel()
 	exitCommand := []byte{0x37, 0x82}
-	_, err = d.Msg(exitCommand)
+	_, exitErr := d.Msg(exitCtx, exitCommand)
 	if err != nil {
-		dbg("UploadBlock - Request Transfer Exit - 37 82 [FAIL] [", err)
+		return err
+	}
+	if exitErr != nil {
+		dbg("UploadBlock - Request Transfer Exit - 37 82 [FAIL] [", exitErr)
+		return exitErr
 	}
 
 	// Run Routine A2
-	err = d.RunRoutine([]byte{0x31, 0xA2}, []byte{0x32, 0xA2, 0x00}, []byte{0x23})
+	err = d.RunRoutine(ctx, RoutineCheck)
 	if err != nil {
 		dbg("UploadBlock - Routine A2 [FAIL] [", err)
+		return err
 	}
 
 	return nil
 }
 
-func (d *Device) RunRoutine(start, stop, success []byte) error {
+// A Routine is started with 31 and then asked with 32 until it says it's done
+type Routine struct {
+	Start   []byte
+	Stop    []byte
+	Running []byte // negative response codes that answer a start when the routine is running
+}
+
+var (
+	RoutineErase  = Routine{Start: []byte{0x31, 0xA1}, Stop: []byte{0x32, 0xA1, 0x00}, Running: []byte{NRCConditionsNotCorrect, NRCRoutineNotComplete}}
+	RoutineCheck  = Routine{Start: []byte{0x31, 0xA2}, Stop: []byte{0x32, 0xA2, 0x00}, Running: []byte{NRCRoutineNotComplete}}
+	RoutineFinish = Routine{Start: []byte{0x31, 0xA3, 0x1F, 0x3F}, Stop: []byte{0x32, 0xA3, 0x00}, Running: []byte{NRCConditionsNotCorrect, NRCRoutineNotComplete}}
+)
+
+func (d *Device) RunRoutine(ctx context.Context, r Routine) error {
+	start, stop := r.Start, r.Stop
 
 	if d.Dummy == true {
 		dbg(fmt.Sprintf("%X", start), nil)
@@ -544,111 +443,156 @@ func (d *Device) RunRoutine(start, stop, success []byte) error {
 
 	// Make sure we have Security Access
 	if d.SecurityMode == false {
-		err := d.EnableSecurity()
+		err := d.EnableSecurity(ctx)
 		if err != nil {
 			log("RunRoutine - Unable to enter secutiy mode!", err)
 			return err
 		}
 	}
 
-	done := false
+	ctx, cancel := context.WithTimeout(ctx, d.Limits.Routine)
+	defer cancel()
 
 	// Start Routine
-	for !done {
-		resp, err := d.Msg(start)
+	started := false
+	for try := 0; try < d.Limits.Attempts && !started; try++ {
+		_, err := d.Msg(ctx, start)
+		if ctx.Err() != nil {
+			return fmt.Errorf("Routine %X didn't start: %w", start, ctx.Err())
+		}
 
-		if resp.Error != nil {
-			if contains(resp.ErrCode, success) {
-				dbg("Start Routine [PASS]!", nil)
-				break
-			} else {
-				dbg("Start Routine [FAIL] [", err)
-			}
+		// A positive answer or one of the Running codes means it started, only a retryable refusal is worth another try
+		nr := AsNegativeResponse(err)
+		if err == nil || (nr != nil && contains(nr.Code, r.Running)) {
+			dbg("Start Routine [PASS]!", nil)
+			started = true
+		} else if nr == nil || !nr.Retryable() {
+			return fmt.Errorf("Routine %X: %w", start, err)
+		} else {
+			dbg("Start Routine [FAIL] [", err)
 		}
 	}
+	if !started {
+		return fmt.Errorf("Routine %X didn't start", start)
+	}
 
-	// Stop Routine
-	for !done {
-		resp, _ := d.Msg(stop)
-
-		errCode := resp.Message[(len(resp.Message) - 2)]
+	// Stop Routine, the ECU answers "not complete" until it's done
+	for {
+		resp, err := d.Msg(ctx, stop)
+		if ctx.Err() != nil {
+			return fmt.Errorf("Routine %X didn't finish: %w", stop, ctx.Err())
+		}
+		if nr := AsNegativeResponse(err); nr != nil && !nr.Retryable() {
+			return fmt.Errorf("Routine %X: %w", stop, err)
+		}
 
-		if resp.Message[0] == errResp && errCode == 0x00 {
+		if len(resp.Message) >= 3 && resp.Message[0] == errResp && resp.Message[len(resp.Message)-2] == 0x00 {
 			msg := fmt.Sprintf("Stop Routine [PASS] - Response: %X", resp.Message)
 			dbg(msg, nil)
-			break
-		} else {
-			msg := fmt.Sprintf("Stop Routine [FAIL] - Response: %X", resp.Message)
-			dbg(msg, nil)
+			return nil
 		}
-	}
 
-	return nil
+		msg := fmt.Sprintf("Stop Routine [FAIL] - Response: %X", resp.Message)
+		dbg(msg, nil)
+	}
 }
 
-func (d *Device) EnableSecurity() error {
+func (d *Device) EnableSecurity(ctx context.Context) error {
 
 	if d.Dummy == true {
 		return nil
 	}
 
-	// Pick a random security key, because why not?
-	rand.Seed(time.Now().UTC().UnixNano())
-	algo := Algos[rand.Intn(len(Algos))]
-
-	awake := false
-	for !awake {
+	// Wait for the ignition to be cycled, as long as Limits.Wake
+	wake, cancel := context.WithTimeout(ctx, d.Limits.Wake)
+	defer cancel()
+	for {
 		initialCommand := []byte{0xA0}
-		resp, _ := d.Msg(initialCommand)
+		resp, _ := d.Msg(wake, initialCommand)
+		if wake.Err() != nil {
+			return fmt.Errorf("ECU didn't wake up: %w", wake.Err())
+		}
+
 		if resp.Error != nil {
-			if resp.ErrCode != 0xFF && (resp.Message[0] != 0xE0) {
+			if resp.ErrCode != 0xFF && len(resp.Message) > 0 && (resp.Message[0] != 0xE0) {
 				log("Turn Ignition off...", nil)
 			} else {
 				log("Turn Ignition on...", nil)
 			}
-		} else if resp.Error == nil && resp.Message[0] == 0xE0 {
+			sleep(wake, time.Second)
+		} else if len(resp.Message) > 0 && resp.Message[0] == 0xE0 {
 			dbg("FEPS [PASS]", nil)
 			break
+		} else {
+			sleep(wake, time.Second)
 		}
 	}
 
-	// Setup Security Algorithm
-	a0 := []byte{0x31, 0xA0, 0x02, 0x00, algo.ID, 0x01}
-	_, err := d.Msg(a0)
-	if err != nil {
-		dbg("EnableSecurity - Set Algo [FAIL] [", err)
-	} else {
-		dbg("EnableSecurity - Set Algo [PASS]", nil)
-	}
+	// Try each algorithm we can compute keys for, a wrong key counts against the ECU's attempt limit so only send real ones
+	var lastErr error
+	for _, id := range SupportedAlgorithms() {
 
-	// Request Security Seed
-	getSeed := []byte{0x27, 0x01}
-	_, err = d.Msg(getSeed)
-	if err != nil {
-		dbg("EnableSecurity - Request seed FAIL", err)
-	} else {
-		dbg("EnableSecurity - Request Seed [PASS]", nil)
-	}
+		// Setup Security Algorithm
+		a0 := []byte{0x31, 0xA0, 0x02, 0x00, id, 0x01}
+		_, err := d.Msg(ctx, a0)
+		if err != nil {
+			dbg(fmt.Sprintf("EnableSecurity - Set Algo 0x%.2X [FAIL] [", id), err)
+			lastErr = err
+			continue
+		}
+		dbg(fmt.Sprintf("EnableSecurity - Set Algo 0x%.2X [PASS]", id), nil)
+
+		// Request Security Seed
+		resp, err := d.Msg(ctx, []byte{0x27, 0x01})
+		if err == nil {
+			resp.Message, err = ParseSeed(resp)
+		}
+		if err != nil {
+			dbg("EnableSecurity - Request seed FAIL", err)
+			lastErr = err
+			continue
+		}
+		seed := resp.Message
+		dbg(fmt.Sprintf("EnableSecurity - Request Seed [PASS] - Seed: %X", seed), nil)
+
+		if unlocked(seed) {
+			d.SecurityMode = true
+			return nil
+		}
+
+		key, err := ComputeKey(id, seed)
+		if err != nil {
+			dbg(fmt.Sprintf("EnableSecurity - Algo 0x%.2X can't answer the seed", id), err)
+			lastErr = err
+			continue
+		}
+
+		// Submit Security Key
+		submitKey := append([]byte{0x27, 0x02}, key...)
+		_, err = d.Msg(ctx, submitKey)
+		if err != nil {
+			dbg("EnableSecurity - Submit Key] [FAIL", err)
+			lastErr = err
+			continue
+		}
 
-	// Submit Security Key
-	submitKey := append([]byte{0x27, 0x02}, algo.Key...)
-	_, err = d.Msg(submitKey)
-	if err != nil {
-		dbg("EnableSecurity - Submit Key] [FAIL", err)
-	} else {
 		dbg("EnableSecurity - Submit Key [PASS]", nil)
 		d.SecurityMode = true
+		return nil
 	}
 
-	return nil
+	if lastErr == nil {
+		return fmt.Errorf("Security access denied: no algorithm to try")
+	}
+	return fmt.Errorf("Security access denied: %w", lastErr)
 }
 
 func (d Device) Send(packet Packet) Packet {
 
 	// Check for open connection
-	if d.serial == nil {
-		dbg("No serial connection!", nil)
-		return Packet{}
+	if d.port == nil {
+		dbg("No connection!", nil)
+		return Packet{Error: ErrNotConnected}
 	}
 
 	var send string
@@ -662,9 +606,11 @@ func (d Device) Send(packet Packet) Packet {
 		dbg("Sending]: ["+send, nil)
 	}
 
-	_, err := d.serial.Write(append(packet.Message, []byte("\r")...))
+	d.capture.record(captureSent, packet.Message)
+	_, err := d.port.Write(append(packet.Message, []byte("\r")...))
 	if err != nil {
-		dbg("Error sending packet to serial device!", nil)
+		dbg("Error sending packet to device!", nil)
+		return Packet{Error: err}
 	}
 
 	// Wait for our reply
@@ -674,23 +620,30 @@ func (d Device) Send(packet Packet) Packet {
 func (d Device) Receive() Packet {
 
 	// Read OBD-II response, loop until a response is generated
-	reader := bufio.NewReader(d.serial)
+	reader := bufio.NewReader(d.port)
 	reply, err := reader.ReadBytes(EOL)
+	d.capture.record(captureReceived, reply)
 	reply = []byte(strings.Trim(string(reply[:]), "\r\n>"))
 	dbg("Received]: ["+string(reply), nil)
 
 	reply = []byte(strings.TrimSuffix(string(reply[:]), "<DATA ERROR"))
 
-	if (err != nil) || (string(reply) == "?") {
-		errMsg := errors.New("Unknown command")
-		return Packet{Error: errMsg}
+	if err != nil {
+		return Packet{Error: err, ErrCode: 0xFF}
+	}
+	if string(reply) == "?" {
+		return Packet{Error: ErrUnknownCommand}
 	}
 	resp := Packet{Message: reply}
 
 	strResp := string(resp.Message)
 	// Check for ERROR
-	if (strings.Contains(strResp, "?")) || (strings.Contains(strResp, "ERROR")) || (strings.Contains(strResp, "NO DATA")) {
-		resp.Error = errors.New("Response: [" + strResp + "]")
+	if strings.Contains(strResp, "NO DATA") {
+		resp.Error = fmt.Errorf("%w: [%s]", ErrNoData, strResp)
+	} else if (strings.Contains(strResp, "?")) || (strings.Contains(strResp, "ERROR")) {
+		resp.Error = fmt.Errorf("%w: [%s]", ErrBadResponse, strResp)
+	}
+	if resp.Error != nil {
 		resp.Message = nil
 		resp.ErrCode = 0xFF
 	}
@@ -702,15 +655,36 @@ func New(test bool) *Device {
 	if test {
 		device := new(Device)
 		device.Dummy = true
+		device.Limits = DefaultLimits
 		return device
 	}
 
 	device := new(Device)
-	device.FindDevice()
+	device.Limits = DefaultLimits
 	device.ConnectDevice()
 	return device
 }
 
+// Open sets up an ELM327 that is already connected, like a Sim
+func Open(port io.ReadWriteCloser) (*Device, error) {
+	return open(port, nil)
+}
+
+func open(port io.ReadWriteCloser, capture *Capture) (*Device, error) {
+	device := new(Device)
+	device.port = port
+	device.capture = capture
+	device.Limits = DefaultLimits
+
+	err := device.setup()
+	if err != nil {
+		log("Open - [FAIL", err)
+		return nil, err
+	}
+
+	return device, nil
+}
+
 func (d Device) Cmd(cmd string) (string, error) {
 	command := Packet{Message: []byte(cmd)}
 	resp := d.Send(command)
@@ -725,13 +699,37 @@ func (d Device) Cmd(cmd string) (string, error) {
 	return strResp, resp.Error
 }
 
-func (d *Device) Msg(msg []byte) (Packet, error) {
+// Msg sends a request and returns the ECU's answer.
+// The protocol rules for a busy ECU are handled here: a busy (0x21) request is repeated after Limits.Backoff, up to Limits.Attempts times,
+// and a response pending (0x78) is waited out for the real answer without asking again, for as long as Limits.Pending.
+func (d *Device) Msg(ctx context.Context, msg []byte) (Packet, error) {
 
 	if d.Dummy == true {
 		dbg(fmt.Sprintf("%X", msg), nil)
 		return Packet{}, nil
 	}
 
+	for try := 1; ; try++ {
+		resp, err := d.exchange(ctx, msg)
+		if ResponseCode(err) != NRCBusy || try >= d.Limits.Attempts {
+			return resp, err
+		}
+
+		dbg(fmt.Sprintf("Msg - ECU busy, repeating %X", msg), err)
+		if sleep(ctx, d.Limits.Backoff) != nil {
+			return Packet{Error: ctx.Err()}, ctx.Err()
+		}
+	}
+}
+
+// exchange sends one request and reads its answer, waiting past any response pending
+func (d *Device) exchange(ctx context.Context, msg []byte) (Packet, error) {
+	if ctx.Err() != nil {
+		return Packet{Error: ctx.Err()}, ctx.Err()
+	}
+	done := d.watch(ctx)
+	defer func() { done() }()
+
 	str := toString(msg)
 	msg = []byte(str)
 	message := Packet{Message: msg}
@@ -742,43 +740,117 @@ func (d *Device) Msg(msg []byte) (Packet, error) {
 		dbg("Prepare]: [Header already correctly set", nil)
 	} else {
 		headerMsg := Packet{Message: append([]byte("AT SH"), message.Header...)}
-		d.Send(headerMsg)
+		resp := d.Send(headerMsg)
+		if resp.Error != nil {
+			if ctx.Err() != nil {
+				resp.Error = ctx.Err()
+			}
+			return resp, resp.Error
+		}
 		d.lastHeader = message.Header
 	}
 
 	// Send the message
 	resp := d.Send(message)
 
-	// Check if we have a ELM error already
-	if resp.Error != nil {
-		return resp, resp.Error
+	pending, cancel := context.WithTimeout(ctx, d.Limits.Pending)
+	defer cancel()
+	for {
+		// A read cut short by ctx is ctx's error, not the port's
+		if resp.Error != nil && ctx.Err() != nil {
+			resp.Error = ctx.Err()
+		}
+
+		// Check if we have a ELM error already
+		if resp.Error != nil {
+			return resp, resp.Error
+		}
+
+		resp.parse()
+		if resp.ErrCode != NRCResponsePending {
+			return resp, resp.Error
+		}
+
+		// The answer comes later, on its own
+		dbg("Msg - Response pending", resp.Error)
+		if pending.Err() != nil {
+			return resp, resp.Error
+		}
+		done()
+		done = d.watch(pending)
+		resp = d.Receive()
 	}
+}
 
+// parse unpacks the frames the ELM327 printed, any response pending frames in front of the answer are skipped
+func (p *Packet) parse() {
 	// Organize
-	hex := toHex(resp.Message)
-	resp.Header = hex[0:3]
-	length := int(hex[0]>>4) + 1
-	resp.unPack(hex[length:])
-	resp.Message = hex[3:length]
-	resp.Checksum = hex[(len(hex) - 1)]
+	hex, err := hex.DecodeString(string(p.Message))
+	length := frameLength(hex)
+	if err != nil || length == 0 {
+		p.badResponse()
+		return
+	}
+
+	for length < len(hex) && hex[3] == errResp && hex[length-2] == NRCResponsePending {
+		hex = hex[length:]
+		length = frameLength(hex)
+		if length == 0 {
+			p.badResponse()
+			return
+		}
+	}
+
+	p.Header = hex[0:3]
+	if !p.unPack(hex[length:]) {
+		p.badResponse()
+		return
+	}
+	p.Message = hex[3:length]
+	p.Checksum = hex[(len(hex) - 1)]
 
 	// Detect errors
 	errCode := hex[(len(hex) - 2)]
-	if resp.Message[0] == errResp && errCode != 0x00 {
-		resp.Error = errors.New("Recieved error from ECU: " + errCodes[errCode])
-		resp.ErrCode = errCode
+	if p.Message[0] == errResp && errCode != 0x00 {
+		var service byte
+		if len(p.Message) > 1 {
+			service = p.Message[1]
+		}
+		p.Error = newNegativeResponse(service, errCode)
+		p.ErrCode = errCode
 	}
+}
 
-	return resp, resp.Error
+// badResponse marks a reply that can't be unpacked
+func (p *Packet) badResponse() {
+	p.Error = fmt.Errorf("%w: [%s]", ErrBadResponse, p.Message)
+	p.ErrCode = 0xFF
 }
 
-func (p *Packet) unPack(in []byte) {
+// frameLength is the length of the frame at the front of in, 0 if it's shorter than a header, one byte and a
+// checksum or runs past the end
+func frameLength(in []byte) int {
+	if len(in) < 5 {
+		return 0
+	}
+	length := int(in[0]>>4) + 1
+	if length < 5 || length > len(in) {
+		return 0
+	}
+	return length
+}
+
+// unPack splits the packed frames following the first one, false if one of them is malformed
+func (p *Packet) unPack(in []byte) bool {
 	var unpacked []Packet
 	var data []byte
 
 	for start := 0; start < len(in)-1; {
 		// Find a single packed packet
-		length := int(in[start]>>4) + 1
+		length := frameLength(in[start:])
+		if length == 0 {
+			return false
+		}
 		end := start + length
 		single := in[start:end]
 
@@ -795,6 +867,7 @@ func (p *Packet) unPack(in []byte) {
 
 	p.Data = data
 	p.Multi = unpacked
+	return true
 }
 
 func (p *Packet) DataLen() int {
@@ -839,30 +912,86 @@ func toHex(in []byte) []byte {
 
 func (d *Device) ConnectDevice() {
 
-	if len(d.location) < 1 {
-		d.FindDevice()
+	if d.transport == nil {
+		t, err := ParseTransport("")
+		if err != nil {
+			log("ConnectDevice - [FAIL", err)
+			os.Exit(1)
+		}
+		d.transport = t
 	}
 
-	dbg("Setting up connection to device: "+d.location, nil)
-	//fmt.Printf("Creating new device... [%v %v]\n", d.location, d.baud)
-	config := &serial.Config{
-		Name: d.location,
-		Baud: d.baud,
+	// Attempt to open the connection
+	dbg("Opening connection to device: "+d.transport.String(), nil)
+	port, err := d.transport.Open()
+	if err != nil {
+		log("ConnectDevice - [FAIL", err)
+		os.Exit(1)
 	}
 
-	var conn io.ReadWriteCloser
+	// Create OBD-II connection
+	d.port = port
 
-	// Attempt to open serial connection
-	dbg("Opening serial connection to device: "+d.location, nil)
-	conn, err := serial.OpenPort(config)
+	err = d.setup()
 	if err != nil {
-		log("ConnectDevice - [FAIL", err)
+		log("Try turning the ignition to position 0 and then position 1 again.", nil)
 		os.Exit(1)
 	}
+}
 
-	// Create OBD-II connection
-	d.serial = conn
+// deadliner is a port that can time out a read, like a TCP connection or a pty. A serial port can't, the ELM327's own timeout has to do there.
+type deadliner interface {
+	SetReadDeadline(t time.Time) error
+}
+
+// watch bounds the next exchange on the port by Limits.Response and ctx, call the returned func when it's done
+func (d *Device) watch(ctx context.Context) func() {
+	dl, ok := d.port.(deadliner)
+	if !ok {
+		return func() {}
+	}
+
+	deadline := time.Now().Add(d.Limits.Response)
+	if t, ok := ctx.Deadline(); ok && t.Before(deadline) {
+		deadline = t
+	}
+	dl.SetReadDeadline(deadline)
+
+	// Cancelling ctx cuts the read short
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			dl.SetReadDeadline(time.Now())
+		case <-done:
+		}
+	}()
+
+	return func() {
+		close(done)
+		dl.SetReadDeadline(time.Time{})
+	}
+}
+
+// cleanup is for the messages that put the ECU back in a known state after ctx is done, they get their own short deadline
+func (d *Device) cleanup() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), d.Limits.Response)
+}
 
+// sleep waits for t, or until ctx is done
+func sleep(ctx context.Context, t time.Duration) error {
+	timer := time.NewTimer(t)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+func (d *Device) setup() error {
 	// AT D - Sets All Defaults
 	// AT E0 - Disable device echo
 	// AT L0 - Disable line feed
@@ -877,33 +1006,26 @@ func (d *Device) ConnectDevice() {
 	// Run set of commands to properly setup our communication with the car
 	commands := []string{"AT D", "AT E0", "AT S0", "AT SP 3", "AT H1", "AT L0", "AT AL", "AT SI", "AT CAF0", "AT AT1"}
 	for _, c := range commands {
+		done := d.watch(context.Background())
 		pkt := Packet{Message: []byte(c)}
 		resp := d.Send(pkt)
+		done()
 		if resp.Error != nil {
 			dbg("Setup Command Failure: "+c, nil)
-			log("Try turning the ignition to position 0 and then position 1 again.", nil)
-			os.Exit(1)
+			return fmt.Errorf("Setup Command Failure: %s: %s", c, resp.Error)
 		}
 	}
-}
-
-func (d *Device) FindDevice() bool {
-	contents, _ := ioutil.ReadDir("/dev")
 
-	// Look for what is mostly likely the Arduino device
-	for _, f := range contents {
-		if strings.Contains(f.Name(), "STY3M") && strings.Contains(f.Name(), "tty") {
-			d.location = "/dev/" + f.Name()
-			d.baud = baud
-			dbg("Found Device: "+d.location, nil)
-			return true
-		}
-	}
-	return false
+	return nil
 }
 
 func (d *Device) DisconnectDevice() {
-
+	if d.port != nil {
+		d.port.Close()
+		d.port = nil
+	}
+	d.capture.close()
+	d.capture = nil
 }
 
 func contains(n byte, h []byte) bool {
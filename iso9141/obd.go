@@ -0,0 +1,308 @@
+package iso9141
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// OBD-II (SAE J1979)
+////////////////..........
+
+// Standard modes
+const (
+	ModeCurrentData = 0x01
+	ModeFreezeFrame = 0x02
+	ModeReadDTCs    = 0x03
+	ModeClearDTCs   = 0x04
+	ModeVehicleInfo = 0x09
+)
+
+// Mode 09 info types
+const (
+	InfoVIN            = 0x02
+	InfoCalibrationIDs = 0x04
+	InfoCVNs           = 0x06
+)
+
+// A PID is how one standard parameter is scaled, A and B are the first two data bytes
+type PID struct {
+	Name   string
+	Units  string
+	Size   int
+	Decode func(b []byte) float64 // nil for bit fields, which are shown raw
+}
+
+func pidA(scale, add float64) func(b []byte) float64 {
+	return func(b []byte) float64 { return float64(b[0])*scale + add }
+}
+
+func pidAB(scale, add float64) func(b []byte) float64 {
+	return func(b []byte) float64 { return float64(int(b[0])<<8|int(b[1]))*scale + add }
+}
+
+// The mode 01/02 PIDs a 9141 ECU of this age answers
+var standardPIDs = map[byte]PID{
+	0x01: {Name: "Monitor status", Size: 4},
+	0x02: {Name: "Freeze frame DTC", Size: 2},
+	0x03: {Name: "Fuel system status", Size: 2},
+	0x04: {Name: "Calculated load", Units: "%", Size: 1, Decode: pidA(100.0/255, 0)},
+	0x05: {Name: "Coolant temperature", Units: "C", Size: 1, Decode: pidA(1, -40)},
+	0x06: {Name: "Short term fuel trim bank 1", Units: "%", Size: 1, Decode: pidA(100.0/128, -100)},
+	0x07: {Name: "Long term fuel trim bank 1", Units: "%", Size: 1, Decode: pidA(100.0/128, -100)},
+	0x08: {Name: "Short term fuel trim bank 2", Units: "%", Size: 1, Decode: pidA(100.0/128, -100)},
+	0x09: {Name: "Long term fuel trim bank 2", Units: "%", Size: 1, Decode: pidA(100.0/128, -100)},
+	0x0A: {Name: "Fuel pressure", Units: "kPa", Size: 1, Decode: pidA(3, 0)},
+	0x0B: {Name: "Intake manifold pressure", Units: "kPa", Size: 1, Decode: pidA(1, 0)},
+	0x0C: {Name: "Engine speed", Units: "rpm", Size: 2, Decode: pidAB(0.25, 0)},
+	0x0D: {Name: "Vehicle speed", Units: "km/h", Size: 1, Decode: pidA(1, 0)},
+	0x0E: {Name: "Timing advance", Units: "deg", Size: 1, Decode: pidA(0.5, -64)},
+	0x0F: {Name: "Intake air temperature", Units: "C", Size: 1, Decode: pidA(1, -40)},
+	0x10: {Name: "Mass air flow", Units: "g/s", Size: 2, Decode: pidAB(0.01, 0)},
+	0x11: {Name: "Throttle position", Units: "%", Size: 1, Decode: pidA(100.0/255, 0)},
+	0x12: {Name: "Secondary air status", Size: 1},
+	0x13: {Name: "O2 sensors present", Size: 1},
+	0x14: {Name: "O2 sensor bank 1 sensor 1", Units: "V", Size: 2, Decode: pidA(0.005, 0)},
+	0x15: {Name: "O2 sensor bank 1 sensor 2", Units: "V", Size: 2, Decode: pidA(0.005, 0)},
+	0x16: {Name: "O2 sensor bank 1 sensor 3", Units: "V", Size: 2, Decode: pidA(0.005, 0)},
+	0x17: {Name: "O2 sensor bank 1 sensor 4", Units: "V", Size: 2, Decode: pidA(0.005, 0)},
+	0x18: {Name: "O2 sensor bank 2 sensor 1", Units: "V", Size: 2, Decode: pidA(0.005, 0)},
+	0x19: {Name: "O2 sensor bank 2 sensor 2", Units: "V", Size: 2, Decode: pidA(0.005, 0)},
+	0x1A: {Name: "O2 sensor bank 2 sensor 3", Units: "V", Size: 2, Decode: pidA(0.005, 0)},
+	0x1B: {Name: "O2 sensor bank 2 sensor 4", Units: "V", Size: 2, Decode: pidA(0.005, 0)},
+	0x1C: {Name: "OBD standard", Size: 1},
+	0x1F: {Name: "Run time since start", Units: "s", Size: 2, Decode: pidAB(1, 0)},
+	0x21: {Name: "Distance with MIL on", Units: "km", Size: 2, Decode: pidAB(1, 0)},
+	0x2F: {Name: "Fuel level", Units: "%", Size: 1, Decode: pidA(100.0/255, 0)},
+	0x33: {Name: "Barometric pressure", Units: "kPa", Size: 1, Decode: pidA(1, 0)},
+	0x42: {Name: "Control module voltage", Units: "V", Size: 2, Decode: pidAB(0.001, 0)},
+	0x46: {Name: "Ambient air temperature", Units: "C", Size: 1, Decode: pidA(1, -40)},
+}
+
+// A PIDValue is one PID as the ECU answered it
+type PIDValue struct {
+	PID   byte
+	Name  string
+	Units string
+	Value float64 // only set when Scaled
+	Raw   []byte
+}
+
+// Scaled is true when Value means something, bit fields and PIDs we don't know only have Raw
+func (v PIDValue) Scaled() bool {
+	p, ok := standardPIDs[v.PID]
+	return ok && p.Decode != nil
+}
+
+func (v PIDValue) String() string {
+	name := v.Name
+	if name == "" {
+		name = "Unknown"
+	}
+	if !v.Scaled() {
+		return fmt.Sprintf("%.2X %s: % X", v.PID, name, v.Raw)
+	}
+	return fmt.Sprintf("%.2X %s: %.2f %s", v.PID, name, v.Value, v.Units)
+}
+
+func decodePID(pid byte, data []byte) (PIDValue, error) {
+	v := PIDValue{PID: pid, Raw: data}
+	p, ok := standardPIDs[pid]
+	if !ok {
+		return v, nil
+	}
+
+	v.Name, v.Units = p.Name, p.Units
+	if len(data) < p.Size {
+		return v, fmt.Errorf("%w: PID %.2X answered % X", ErrBadResponse, pid, data)
+	}
+	v.Raw = data[:p.Size]
+	if p.Decode != nil {
+		v.Value = p.Decode(data)
+	}
+	return v, nil
+}
+
+// A DTC is a diagnostic trouble code as the ECU stores it, the top two bits are the system
+type DTC uint16
+
+func (c DTC) String() string {
+	return fmt.Sprintf("%c%.4X", "PCBU"[c>>14], uint16(c)&0x3FFF)
+}
+
+// frames splits an answer back into the frames it came in, each without its checksum
+func frames(resp Packet) [][]byte {
+	if len(resp.Message) < 2 {
+		return nil
+	}
+	out := [][]byte{resp.Message[:len(resp.Message)-1]}
+	for _, m := range resp.Multi {
+		out = append(out, m.Message)
+	}
+	return out
+}
+
+// obd sends a standard request and checks the answer is for it, returning its frames
+func (d *Device) obd(ctx context.Context, msg []byte) ([][]byte, error) {
+	resp, err := d.Msg(ctx, msg)
+	if err != nil {
+		return nil, err
+	}
+
+	all := frames(resp)
+	if len(all) == 0 {
+		return nil, fmt.Errorf("%w: empty answer to % X", ErrBadResponse, msg)
+	}
+	for _, f := range all {
+		if len(f) < len(msg) || f[0] != msg[0]+0x40 || (len(msg) > 1 && f[1] != msg[1]) {
+			return nil, fmt.Errorf("%w: % X for % X", ErrBadResponse, f, msg)
+		}
+	}
+	return all, nil
+}
+
+// SupportedPIDs asks the ECU which PIDs of mode 01, 02 or 09 it answers, following the bitmaps up as far as they go.
+// The bitmap PIDs themselves (00, 20, 40...) are left out.
+func (d *Device) SupportedPIDs(ctx context.Context, mode byte) ([]byte, error) {
+	var supported []byte
+	for base := 0x00; base <= 0xE0; base += 0x20 {
+		msg := []byte{mode, byte(base)}
+		skip := 2 // 41 00
+		switch mode {
+		case ModeFreezeFrame:
+			msg = append(msg, 0x00) // frame 0
+			skip = 3
+		case ModeVehicleInfo:
+			skip = 3 // 49 00 01, the message count
+		}
+
+		all, err := d.obd(ctx, msg)
+		if err != nil {
+			if base > 0 && ResponseCode(err) != 0 {
+				break
+			}
+			return supported, err
+		}
+		bitmap := all[0][skip:]
+		if len(bitmap) < 4 {
+			return supported, fmt.Errorf("%w: bitmap % X", ErrBadResponse, all[0])
+		}
+
+		// The last bit only says the next bitmap is there, it isn't a PID to read
+		for i := 0; i < 31; i++ {
+			if bitmap[i/8]&(0x80>>uint(i%8)) != 0 {
+				supported = append(supported, byte(base+i+1))
+			}
+		}
+		if bitmap[3]&0x01 == 0 {
+			break
+		}
+	}
+	return supported, nil
+}
+
+// ReadPID reads a mode 01 PID
+func (d *Device) ReadPID(ctx context.Context, pid byte) (PIDValue, error) {
+	all, err := d.obd(ctx, []byte{ModeCurrentData, pid})
+	if err != nil {
+		return PIDValue{PID: pid}, err
+	}
+	return decodePID(pid, all[0][2:])
+}
+
+// FreezeFrame reads a PID as it was stored with the freeze frame DTC, frame 0 is the only one 9141 ECUs keep
+func (d *Device) FreezeFrame(ctx context.Context, pid, frame byte) (PIDValue, error) {
+	all, err := d.obd(ctx, []byte{ModeFreezeFrame, pid, frame})
+	if err != nil {
+		return PIDValue{PID: pid}, err
+	}
+	if all[0][2] != frame {
+		return PIDValue{PID: pid}, fmt.Errorf("%w: frame %d for frame %d", ErrBadResponse, all[0][2], frame)
+	}
+	return decodePID(pid, all[0][3:])
+}
+
+// ReadDTCs reads the stored trouble codes, three to a frame
+func (d *Device) ReadDTCs(ctx context.Context) ([]DTC, error) {
+	all, err := d.obd(ctx, []byte{ModeReadDTCs})
+	if err != nil {
+		return nil, err
+	}
+
+	var codes []DTC
+	for _, f := range all {
+		for i := 1; i+1 < len(f); i += 2 {
+			if c := DTC(f[i])<<8 | DTC(f[i+1]); c != 0 {
+				codes = append(codes, c)
+			}
+		}
+	}
+	return codes, nil
+}
+
+// ClearDTCs clears the trouble codes, freeze frame and monitor results, the MIL goes out
+func (d *Device) ClearDTCs(ctx context.Context) error {
+	_, err := d.obd(ctx, []byte{ModeClearDTCs})
+	return err
+}
+
+// VehicleInfo reads a mode 09 info type, putting its numbered frames back together
+func (d *Device) VehicleInfo(ctx context.Context, info byte) ([]byte, error) {
+	all, err := d.obd(ctx, []byte{ModeVehicleInfo, info})
+	if err != nil {
+		return nil, err
+	}
+
+	// 49 <info> <n> and 4 bytes
+	for _, f := range all {
+		if len(f) < 3 {
+			return nil, fmt.Errorf("%w: % X", ErrBadResponse, f)
+		}
+	}
+	sort.SliceStable(all, func(i, j int) bool { return all[i][2] < all[j][2] })
+
+	var data []byte
+	for _, f := range all {
+		data = append(data, f[3:]...)
+	}
+	return data, nil
+}
+
+// VIN reads the vehicle identification number
+func (d *Device) VIN(ctx context.Context) (string, error) {
+	data, err := d.VehicleInfo(ctx, InfoVIN)
+	if err != nil {
+		return "", err
+	}
+	// The 17 characters are padded out to whole frames with leading zeros
+	return strings.TrimLeft(string(data), "\x00"), nil
+}
+
+// CalibrationIDs reads the calibration IDs, 16 characters each
+func (d *Device) CalibrationIDs(ctx context.Context) ([]string, error) {
+	data, err := d.VehicleInfo(ctx, InfoCalibrationIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []string
+	for i := 0; i+16 <= len(data); i += 16 {
+		ids = append(ids, strings.TrimRight(string(data[i:i+16]), "\x00"))
+	}
+	return ids, nil
+}
+
+// CVNs reads the calibration verification numbers, one for each calibration ID
+func (d *Device) CVNs(ctx context.Context) ([]uint32, error) {
+	data, err := d.VehicleInfo(ctx, InfoCVNs)
+	if err != nil {
+		return nil, err
+	}
+
+	var cvns []uint32
+	for i := 0; i+4 <= len(data); i += 4 {
+		cvns = append(cvns, uint32(data[i])<<24|uint32(data[i+1])<<16|uint32(data[i+2])<<8|uint32(data[i+3]))
+	}
+	return cvns, nil
+}
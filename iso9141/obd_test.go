@@ -0,0 +1,134 @@
+package iso9141
+
+import (
+	"bytes"
+	"context"
+	"hash/crc32"
+	"testing"
+)
+
+// OBD-II Tests
+////////////////..........
+
+func TestDTCString(t *testing.T) {
+	tests := map[DTC]string{0x0171: "P0171", 0x1234: "P1234", 0x4123: "C0123", 0x8A01: "B0A01", 0xC001: "U0001"}
+	for c, want := range tests {
+		if c.String() != want {
+			t.Errorf("%.4X: got %s, want %s", uint16(c), c, want)
+		}
+	}
+}
+
+func TestSupportedPIDs(t *testing.T) {
+	sim, d := newTestSim(t, "mp3")
+	sim.PIDs[0x46] = []byte{0x3C}
+	ctx := context.Background()
+
+	// 0x46 is past two bitmaps
+	pids, err := d.SupportedPIDs(ctx, ModeCurrentData)
+	want := []byte{0x01, 0x04, 0x05, 0x0B, 0x0C, 0x0D, 0x0E, 0x0F, 0x11, 0x46}
+	if err != nil || !bytes.Equal(pids, want) {
+		t.Errorf("mode 01: got % X, %v", pids, err)
+	}
+	if got := countRequests(sim, ModeCurrentData); got != 3 {
+		t.Errorf("%d bitmaps read, want 3", got)
+	}
+
+	pids, err = d.SupportedPIDs(ctx, ModeFreezeFrame)
+	if err != nil || !bytes.Equal(pids, []byte{0x02, 0x04, 0x05, 0x0C}) {
+		t.Errorf("mode 02: got % X, %v", pids, err)
+	}
+
+	pids, err = d.SupportedPIDs(ctx, ModeVehicleInfo)
+	if err != nil || !bytes.Equal(pids, []byte{InfoVIN, InfoCalibrationIDs, InfoCVNs}) {
+		t.Errorf("mode 09: got % X, %v", pids, err)
+	}
+}
+
+func TestReadPID(t *testing.T) {
+	_, d := newTestSim(t, "mp3")
+	ctx := context.Background()
+
+	tests := []struct {
+		pid   byte
+		value float64
+		str   string
+	}{
+		{0x0C, 800, "0C Engine speed: 800.00 rpm"},
+		{0x05, 90, "05 Coolant temperature: 90.00 C"},
+		{0x0E, 6, "0E Timing advance: 6.00 deg"},
+		{0x0F, 25, "0F Intake air temperature: 25.00 C"},
+	}
+	for _, test := range tests {
+		v, err := d.ReadPID(ctx, test.pid)
+		if err != nil || v.Value != test.value || v.String() != test.str {
+			t.Errorf("%.2X: got %s, %v", test.pid, v, err)
+		}
+	}
+
+	// MIL on with one code
+	v, err := d.ReadPID(ctx, 0x01)
+	if err != nil || v.Scaled() || !bytes.Equal(v.Raw, []byte{0x81, 0x07, 0x65, 0x00}) {
+		t.Errorf("01: got %s, %v", v, err)
+	}
+
+	if _, err := d.ReadPID(ctx, 0x10); ResponseCode(err) != 0x12 {
+		t.Errorf("unsupported PID: got %v", err)
+	}
+}
+
+func TestTroubleCodes(t *testing.T) {
+	sim, d := newTestSim(t, "mp3")
+	ctx := context.Background()
+
+	v, err := d.FreezeFrame(ctx, 0x0C, 0)
+	if err != nil || v.Value != 1750 {
+		t.Errorf("freeze frame rpm: got %s, %v", v, err)
+	}
+	v, err = d.FreezeFrame(ctx, 0x02, 0)
+	if err != nil || DTC(v.Raw[0])<<8|DTC(v.Raw[1]) != 0x0171 {
+		t.Errorf("freeze frame DTC: got %s, %v", v, err)
+	}
+
+	// Four codes take two frames
+	sim.DTCs = []DTC{0x0171, 0x0300, 0x4123, 0xC001}
+	codes, err := d.ReadDTCs(ctx)
+	if err != nil || len(codes) != 4 || codes[0].String() != "P0171" || codes[3].String() != "U0001" {
+		t.Errorf("got %v, %v", codes, err)
+	}
+
+	if err := d.ClearDTCs(ctx); err != nil {
+		t.Fatal(err)
+	}
+	codes, err = d.ReadDTCs(ctx)
+	if err != nil || len(codes) != 0 {
+		t.Errorf("after clearing: got %v, %v", codes, err)
+	}
+	if _, err := d.FreezeFrame(ctx, 0x0C, 0); err == nil {
+		t.Error("freeze frame kept after clearing")
+	}
+	v, err = d.ReadPID(ctx, 0x01)
+	if err != nil || v.Raw[0] != 0x00 {
+		t.Errorf("MIL after clearing: got %s, %v", v, err)
+	}
+}
+
+func TestVehicleInfo(t *testing.T) {
+	sim, d := newTestSim(t, "mp3")
+	ctx := context.Background()
+
+	vin, err := d.VIN(ctx)
+	if err != nil || vin != sim.VIN {
+		t.Errorf("VIN: got %q, %v", vin, err)
+	}
+
+	ids, err := d.CalibrationIDs(ctx)
+	if err != nil || len(ids) != 1 || ids[0] != "DXAI4U0" {
+		t.Errorf("calibration IDs: got %q, %v", ids, err)
+	}
+
+	cvns, err := d.CVNs(ctx)
+	if err != nil || len(cvns) != 1 || cvns[0] != crc32.ChecksumIEEE(sim.Memory[simCalStart:simFlashStop]) {
+		t.Errorf("CVNs: got %X, %v", cvns, err)
+	}
+}
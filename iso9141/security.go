@@ -0,0 +1,97 @@
+package iso9141
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Security Access
+////////////////..........
+
+// A KeyAlgorithm turns the seed from 27 01 into the key for 27 02
+type KeyAlgorithm interface {
+	Key(seed []byte) ([]byte, error)
+}
+
+// KeyFunc lets a plain function be a KeyAlgorithm
+type KeyFunc func(seed []byte) ([]byte, error)
+
+func (f KeyFunc) Key(seed []byte) ([]byte, error) {
+	return f(seed)
+}
+
+// Captured knows the keys for seeds sniffed from the factory tool, by hex seed, and nothing else
+type Captured map[string][]byte
+
+func (c Captured) Key(seed []byte) ([]byte, error) {
+	key, ok := c[strings.ToUpper(hex.EncodeToString(seed))]
+	if !ok {
+		return nil, fmt.Errorf("No key captured for seed %X", seed)
+	}
+	return key, nil
+}
+
+// Seeds returns the captured seeds, sorted
+func (c Captured) Seeds() [][]byte {
+	var seeds [][]byte
+	for s := range c {
+		seed, err := hex.DecodeString(s)
+		if err == nil {
+			seeds = append(seeds, seed)
+		}
+	}
+	sort.Slice(seeds, func(i, j int) bool { return bytes.Compare(seeds[i], seeds[j]) < 0 })
+	return seeds
+}
+
+// Algorithms by the ID that picks them in 31 A0 02 00 <ID> 01
+var algorithms = map[byte]KeyAlgorithm{
+	0x4C: Captured{"ABEDCC": {0x84, 0xC4}},
+	0x67: Captured{"D3FB8C": {0xAB, 0xD9}},
+}
+
+// RegisterAlgorithm adds or replaces the algorithm for an ID
+func RegisterAlgorithm(id byte, algo KeyAlgorithm) {
+	algorithms[id] = algo
+}
+
+// SupportedAlgorithms returns the IDs EnableSecurity can try, in the order it tries them
+func SupportedAlgorithms() []byte {
+	var ids []byte
+	for id := range algorithms {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// ComputeKey answers a seed with the algorithm for id
+func ComputeKey(id byte, seed []byte) ([]byte, error) {
+	algo, ok := algorithms[id]
+	if !ok {
+		return nil, fmt.Errorf("Unsupported security algorithm 0x%.2X", id)
+	}
+	return algo.Key(seed)
+}
+
+// ParseSeed pulls the seed out of the response to 27 01
+func ParseSeed(resp Packet) ([]byte, error) {
+	// The message still has the checksum on the end
+	if len(resp.Message) < 4 || resp.Message[0] != 0x67 || resp.Message[1] != 0x01 {
+		return nil, fmt.Errorf("Not a seed: %X", resp.Message)
+	}
+	return resp.Message[2 : len(resp.Message)-1], nil
+}
+
+// A seed of all zeros means security access is already granted
+func unlocked(seed []byte) bool {
+	for _, b := range seed {
+		if b != 0x00 {
+			return false
+		}
+	}
+	return true
+}
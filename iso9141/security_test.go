@@ -0,0 +1,83 @@
+package iso9141
+
+import (
+	"bytes"
+	"context"
+	"testing"
+)
+
+// Security Tests
+////////////////..........
+
+func TestCapturedKeys(t *testing.T) {
+	tests := []struct {
+		id   byte
+		seed []byte
+		key  []byte
+	}{
+		{0x4C, []byte{0xAB, 0xED, 0xCC}, []byte{0x84, 0xC4}},
+		{0x67, []byte{0xD3, 0xFB, 0x8C}, []byte{0xAB, 0xD9}},
+	}
+
+	for _, test := range tests {
+		key, err := ComputeKey(test.id, test.seed)
+		if err != nil {
+			t.Errorf("0x%.2X %X: %s", test.id, test.seed, err)
+			continue
+		}
+		if !bytes.Equal(key, test.key) {
+			t.Errorf("0x%.2X %X: got %X, want %X", test.id, test.seed, key, test.key)
+		}
+	}
+
+	if _, err := ComputeKey(0x4C, []byte{0xD3, 0xFB, 0x8C}); err == nil {
+		t.Error("uncaptured seed: no error")
+	}
+	if _, err := ComputeKey(0x00, []byte{0xAB, 0xED, 0xCC}); err == nil {
+		t.Error("unknown algorithm: no error")
+	}
+}
+
+func TestSupportedAlgorithms(t *testing.T) {
+	ids := SupportedAlgorithms()
+	if !bytes.Equal(ids, []byte{0x4C, 0x67}) {
+		t.Errorf("got % X", ids)
+	}
+}
+
+func TestParseSeed(t *testing.T) {
+	seed, err := ParseSeed(Packet{Message: []byte{0x67, 0x01, 0xAB, 0xED, 0xCC, 0x5A}})
+	if err != nil || !bytes.Equal(seed, []byte{0xAB, 0xED, 0xCC}) {
+		t.Errorf("got %X, %v", seed, err)
+	}
+
+	for _, msg := range [][]byte{nil, {0x7F, 0x27, 0x37, 0x00}, {0x67, 0x02, 0x34, 0x00}, {0x67, 0x01, 0x00}} {
+		if _, err := ParseSeed(Packet{Message: msg}); err == nil {
+			t.Errorf("% X: no error", msg)
+		}
+	}
+}
+
+func TestRegisterAlgorithm(t *testing.T) {
+	const id = 0x99
+	RegisterAlgorithm(id, KeyFunc(func(seed []byte) ([]byte, error) {
+		return []byte{seed[0] ^ 0xFF, seed[1] ^ 0xFF}, nil
+	}))
+	defer delete(algorithms, id)
+
+	sim, d := newTestSim(t, "mp3")
+
+	// Only the new algorithm's seed is handed out, so the captured ones have to be skipped
+	sim.Seeds = map[byte][]byte{id: {0x12, 0x34}}
+
+	err := d.EnableSecurity(context.Background())
+	if err != nil || !d.SecurityMode || !sim.unlocked {
+		t.Fatalf("EnableSecurity: %v", err)
+	}
+	if sim.algo != id {
+		t.Errorf("unlocked with 0x%.2X, want 0x%.2X", sim.algo, id)
+	}
+	if sim.attempts != 0 {
+		t.Errorf("%d wrong keys sent", sim.attempts)
+	}
+}
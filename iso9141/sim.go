@@ -0,0 +1,670 @@
+package iso9141
+
+import (
+	"bytes"
+	"encoding/hex"
+	"hash/crc32"
+	"io"
+	"strings"
+)
+
+// Simulated ELM327 + ECU
+////////////////..........
+
+const simVersion = "ELM327 v1.5"
+
+// Where things are in the simulated ECU's address space
+const (
+	simCalStart   = 0x108000 // first byte the erase routine clears
+	simFlashStop  = 0x180000
+	simAddrMax    = 0x1FFFFF // 21 address lines
+	simUploadHigh = 0x1A0000 // 0x34 addresses from here up land 0x80000 lower in flash
+	simUploadDrop = 0x80000
+	simFrameMax   = 12 // message bytes in one frame, the length nibble can't count higher
+)
+
+// Sim is an ELM327 with an ECU behind it, serving a calibration image from memory.
+// It reads and writes like the serial port, so a Device can't tell the difference.
+type Sim struct {
+	Memory    []byte          // the ECU's address space
+	CommonIDs map[int][]byte  // answers to service 0x22 by ID, up to 9 bytes each
+	LocalIDs  map[byte][]byte // answers to service 0x21 by ID, up to 10 bytes each
+	Requests  [][]byte        // every request the ECU answered, in order
+	Seeds     map[byte][]byte // the seed 27 01 hands out, by security algorithm ID
+
+	// OBD-II
+	PIDs   map[byte][]byte // mode 01 answers by PID
+	Freeze map[byte][]byte // mode 02 answers for frame 0 by PID, kept until the codes are cleared
+	DTCs   []DTC           // stored trouble codes
+	VIN    string
+	CalIDs []string
+	CVNs   []uint32
+
+	// Fault can stand in for a flaky line, it gets each request with the ECU's answer and returns the frames to send instead
+	Fault func(msg []byte, frames [][]byte) [][]byte
+
+	// ELM327 settings
+	echo      bool
+	spaces    bool
+	headers   bool
+	linefeeds bool
+	target    byte
+
+	// ECU state
+	algo     byte
+	seeded   bool
+	unlocked bool
+	attempts int
+	routines map[byte]bool // started and not yet stopped
+	transfer *simTransfer
+
+	line []byte
+	out  bytes.Buffer
+}
+
+type simTransfer struct {
+	toECU  bool // 0x34, the tester is writing
+	start  int
+	length int
+	data   []byte
+}
+
+// NewSim makes a simulator serving a copy of block
+func NewSim(block []byte) *Sim {
+	s := &Sim{
+		Memory:    append([]byte(nil), block...),
+		CommonIDs: make(map[int][]byte),
+		LocalIDs:  make(map[byte][]byte),
+		Seeds:     make(map[byte][]byte),
+		routines:  make(map[byte]bool),
+	}
+
+	// A warm idle with one code stored, and the freeze frame it left
+	s.PIDs = map[byte][]byte{
+		0x01: {0x00, 0x07, 0x65, 0x00},
+		0x04: {0x33},
+		0x05: {0x82},
+		0x0B: {0x24},
+		0x0C: {0x0C, 0x80},
+		0x0D: {0x00},
+		0x0E: {0x8C},
+		0x0F: {0x41},
+		0x11: {0x24},
+	}
+	s.Freeze = map[byte][]byte{0x02: {0x01, 0x71}, 0x04: {0x5A}, 0x05: {0x7E}, 0x0C: {0x1B, 0x58}}
+	s.DTCs = []DTC{0x0171}
+	s.VIN = "JM1BJ225010000000"
+
+	// Hand out seeds we know the answer to, so EnableSecurity can get in
+	for _, id := range SupportedAlgorithms() {
+		if c, ok := algorithms[id].(Captured); ok && len(c) > 0 {
+			s.Seeds[id] = c.Seeds()[0]
+		}
+	}
+	if ids := SupportedAlgorithms(); len(ids) > 0 {
+		s.algo = ids[0]
+	}
+
+	// UploadBIN reads 0x1100 before it erases anything, answer it with the strategy name
+	if len(s.Memory) >= simCalStart+13 {
+		s.CommonIDs[0x1100] = s.Memory[simCalStart+6 : simCalStart+13]
+		s.CalIDs = []string{string(s.Memory[simCalStart+6 : simCalStart+13])}
+	}
+	if len(s.Memory) >= simFlashStop {
+		s.CVNs = []uint32{crc32.ChecksumIEEE(s.Memory[simCalStart:simFlashStop])}
+	}
+
+	s.reset()
+	return s
+}
+
+// NewSimulated returns a Device connected to a simulated ECU that serves a calibration by catalog name or path
+func NewSimulated(calName string) (*Device, error) {
+	return Connect(SimTransport{Calibration: calName})
+}
+
+func (s *Sim) reset() {
+	s.echo = true
+	s.spaces = true
+	s.headers = false
+	s.linefeeds = true
+	s.target = ecuAddr
+}
+
+// Write takes commands, each one ends with a carriage return
+func (s *Sim) Write(p []byte) (int, error) {
+	for _, c := range p {
+		if c == '\r' {
+			s.command(string(s.line))
+			s.line = s.line[:0]
+			continue
+		}
+		s.line = append(s.line, c)
+	}
+	return len(p), nil
+}
+
+// Read returns what the ELM327 printed, there is nothing to wait for because every command is answered as it's written
+func (s *Sim) Read(p []byte) (int, error) {
+	if s.out.Len() == 0 {
+		return 0, io.EOF
+	}
+	return s.out.Read(p)
+}
+
+func (s *Sim) Close() error {
+	return nil
+}
+
+// Serve answers commands from conn until it closes, so the simulator can sit behind a TCP port or a pseudo-terminal
+func (s *Sim) Serve(conn io.ReadWriter) error {
+	buf := make([]byte, 256)
+	for {
+		n, err := conn.Read(buf)
+		if n > 0 {
+			s.Write(buf[:n])
+			if _, werr := s.out.WriteTo(conn); werr != nil {
+				return werr
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (s *Sim) command(cmd string) {
+	if s.echo {
+		s.out.WriteString(cmd + "\r")
+	}
+
+	compact := strings.ToUpper(strings.Replace(cmd, " ", "", -1))
+
+	var reply string
+	if strings.HasPrefix(compact, "AT") {
+		reply = s.at(compact[2:])
+	} else {
+		reply = s.request(compact)
+	}
+
+	eol := "\r"
+	if s.linefeeds {
+		eol = "\r\n"
+	}
+	s.out.WriteString(reply + eol + eol + ">")
+}
+
+func (s *Sim) at(cmd string) string {
+	switch cmd {
+	case "Z":
+		s.reset()
+		return simVersion
+	case "D":
+		s.reset()
+		return "OK"
+	case "I":
+		return simVersion
+	case "RV":
+		return "12.6V"
+	case "DP":
+		return "ISO 9141-2"
+	case "E0", "E1":
+		s.echo = cmd[1] == '1'
+		return "OK"
+	case "S0", "S1":
+		s.spaces = cmd[1] == '1'
+		return "OK"
+	case "H0", "H1":
+		s.headers = cmd[1] == '1'
+		return "OK"
+	case "L0", "L1":
+		s.linefeeds = cmd[1] == '1'
+		return "OK"
+	case "AL", "SI":
+		return "OK"
+	}
+
+	if strings.HasPrefix(cmd, "SH") {
+		header, err := hex.DecodeString(cmd[2:])
+		if err != nil || len(header) != 3 {
+			return "?"
+		}
+		s.target = header[1]
+		return "OK"
+	}
+
+	for _, prefix := range []string{"SP", "ST", "AT", "CAF"} {
+		if strings.HasPrefix(cmd, prefix) {
+			return "OK"
+		}
+	}
+
+	return "?"
+}
+
+// request sends a message to the ECU and formats the frames it answers with
+func (s *Sim) request(cmd string) string {
+	msg, err := hex.DecodeString(cmd)
+	if err != nil || len(msg) == 0 {
+		return "?"
+	}
+
+	if s.target != ecuAddr {
+		return "NO DATA"
+	}
+
+	s.Requests = append(s.Requests, msg)
+
+	// Frames are run together on one line, the way Msg unpacks them
+	frames := s.service(msg)
+	if s.Fault != nil {
+		frames = s.Fault(msg, frames)
+		if len(frames) == 0 {
+			return "NO DATA"
+		}
+	}
+
+	var reply string
+	for _, m := range frames {
+		reply += s.frame(m)
+	}
+	return reply
+}
+
+func (s *Sim) frame(m []byte) string {
+	if len(m) > simFrameMax {
+		m = m[:simFrameMax]
+	}
+
+	frame := append([]byte{byte((len(m)+3)<<4) | 0x04, testerAddr, ecuAddr}, m...)
+	sum := byte(0)
+	for _, b := range frame {
+		sum += b
+	}
+	frame = append(frame, sum)
+
+	if !s.headers {
+		frame = frame[3 : len(frame)-1]
+	}
+
+	str := strings.ToUpper(hex.EncodeToString(frame))
+	if !s.spaces {
+		return str
+	}
+
+	var spaced []string
+	for i := 0; i < len(str); i += 2 {
+		spaced = append(spaced, str[i:i+2])
+	}
+	return strings.Join(spaced, " ") + " "
+}
+
+func negative(sid, code byte) [][]byte {
+	return [][]byte{{errResp, sid, code}}
+}
+
+func positive(m ...byte) [][]byte {
+	return [][]byte{m}
+}
+
+// service answers one request the way the ECU does, each returned message is one frame
+func (s *Sim) service(msg []byte) [][]byte {
+	sid := msg[0]
+
+	switch sid {
+
+	case ModeCurrentData, ModeFreezeFrame, ModeReadDTCs, ModeClearDTCs, ModeVehicleInfo:
+		return s.obd(msg)
+
+	case 0x10: // Start Diagnostic Session
+		return positive(append([]byte{0x50}, msg[1:]...)...)
+
+	case 0x21: // Read Data By Local ID
+		if len(msg) != 2 {
+			return negative(sid, 0x12)
+		}
+		data, ok := s.LocalIDs[msg[1]]
+		if !ok {
+			return negative(sid, 0x31)
+		}
+		return positive(append([]byte{0x61, msg[1]}, data...)...)
+
+	case 0x22: // Read Data By Common ID
+		if len(msg) != 3 {
+			return negative(sid, 0x12)
+		}
+		data, ok := s.CommonIDs[int(msg[1])<<8|int(msg[2])]
+		if !ok {
+			return negative(sid, 0x31)
+		}
+		return positive(append([]byte{0x62, msg[1], msg[2]}, data...)...)
+
+	case 0x23: // Read Memory By Address, 4 bytes at a time
+		if len(msg) != 4 {
+			return negative(sid, 0x12)
+		}
+		adr := int(msg[1])<<16 | int(msg[2])<<8 | int(msg[3])
+		if adr+3 > simAddrMax {
+			return negative(sid, 0x31)
+		}
+		resp := []byte{0x63, msg[2], msg[3]}
+		for i := 0; i < 4; i++ {
+			resp = append(resp, s.read(adr+i))
+		}
+		return positive(resp...)
+
+	case 0x27: // Security Access
+		return s.security(msg)
+
+	case 0x31: // Start Routine
+		return s.startRoutine(msg)
+
+	case 0x32: // Stop Routine
+		if len(msg) < 2 {
+			return negative(sid, 0x12)
+		}
+		if !s.routines[msg[1]] {
+			return negative(sid, 0x22)
+		}
+		delete(s.routines, msg[1])
+
+		// A routine that finished cleanly reports 7F 32 00, which is what RunRoutine waits for
+		return [][]byte{{errResp, sid, 0x00}}
+
+	case 0x34, 0x35: // Request Download / Upload, the tester writing or reading a block
+		return s.requestTransfer(msg)
+
+	case 0x36: // Transfer Data
+		t := s.transfer
+		if t == nil || !t.toECU {
+			return negative(sid, 0x22)
+		}
+		t.data = append(t.data, msg[1:]...)
+		if len(t.data) > t.length+2 {
+			s.transfer = nil
+			return negative(sid, 0x75)
+		}
+		return positive(0x76)
+
+	case 0x37: // Request Transfer Exit
+		t := s.transfer
+		s.transfer = nil
+		if t == nil {
+			return negative(sid, 0x22)
+		}
+		if t.toECU {
+			return s.program(t)
+		}
+		return positive(0x77)
+
+	case 0xA0: // Wake up, the ignition is always on
+		return positive(0xE0)
+	}
+
+	return negative(sid, 0x11)
+}
+
+// obd answers the standard J1979 modes the way a 9141 ECU does
+func (s *Sim) obd(msg []byte) [][]byte {
+	sid := msg[0]
+
+	switch {
+
+	case sid == ModeCurrentData && len(msg) == 2:
+		if msg[1]%0x20 == 0 {
+			return positive(append([]byte{0x41, msg[1]}, simBitmap(s.PIDs, msg[1])...)...)
+		}
+		data, ok := s.PIDs[msg[1]]
+		if !ok {
+			return negative(sid, 0x12)
+		}
+		if msg[1] == 0x01 {
+			// The MIL and code count follow the stored codes
+			data = append([]byte{byte(len(s.DTCs))}, data[1:]...)
+			if len(s.DTCs) > 0 {
+				data[0] |= 0x80
+			}
+		}
+		return positive(append([]byte{0x41, msg[1]}, data...)...)
+
+	case sid == ModeFreezeFrame && len(msg) == 3:
+		if msg[2] != 0x00 || len(s.Freeze) == 0 {
+			return negative(sid, 0x12)
+		}
+		if msg[1]%0x20 == 0 {
+			return positive(append([]byte{0x42, msg[1], 0x00}, simBitmap(s.Freeze, msg[1])...)...)
+		}
+		data, ok := s.Freeze[msg[1]]
+		if !ok {
+			return negative(sid, 0x12)
+		}
+		return positive(append([]byte{0x42, msg[1], 0x00}, data...)...)
+
+	case sid == ModeReadDTCs && len(msg) == 1:
+		// Three codes to a frame, the last one padded with zeros
+		var frames [][]byte
+		for i := 0; i == 0 || i < len(s.DTCs); i += 3 {
+			f := []byte{0x43}
+			for j := i; j < i+3; j++ {
+				var c DTC
+				if j < len(s.DTCs) {
+					c = s.DTCs[j]
+				}
+				f = append(f, byte(c>>8), byte(c))
+			}
+			frames = append(frames, f)
+		}
+		return frames
+
+	case sid == ModeClearDTCs && len(msg) == 1:
+		s.DTCs = nil
+		s.Freeze = nil
+		return positive(0x44)
+
+	case sid == ModeVehicleInfo && len(msg) == 2:
+		var data []byte
+		switch msg[1] {
+		case 0x00:
+			return positive(0x49, 0x00, 0x01, 0x54, 0x00, 0x00, 0x00) // 02, 04 and 06
+		case InfoVIN:
+			data = append(make([]byte, 20-len(s.VIN)), s.VIN...)
+		case InfoCalibrationIDs:
+			for _, id := range s.CalIDs {
+				cal := make([]byte, 16)
+				copy(cal, id)
+				data = append(data, cal...)
+			}
+		case InfoCVNs:
+			for _, cvn := range s.CVNs {
+				data = append(data, byte(cvn>>24), byte(cvn>>16), byte(cvn>>8), byte(cvn))
+			}
+		}
+		if len(data) == 0 {
+			return negative(sid, 0x12)
+		}
+
+		// Four bytes to a numbered frame
+		var frames [][]byte
+		for i := 0; i < len(data); i += 4 {
+			frames = append(frames, append([]byte{0x49, msg[1], byte(i/4 + 1)}, data[i:i+4]...))
+		}
+		return frames
+	}
+
+	return negative(sid, 0x12)
+}
+
+// simBitmap is the supported PID bitmap for the 32 PIDs after base, with the bit for the next bitmap set when there are PIDs past it
+func simBitmap(pids map[byte][]byte, base byte) []byte {
+	bitmap := make([]byte, 4)
+	for pid := range pids {
+		switch {
+		case int(pid) > int(base) && int(pid) <= int(base)+0x20:
+			i := int(pid) - int(base) - 1
+			bitmap[i/8] |= 0x80 >> uint(i%8)
+		case int(pid) > int(base)+0x20:
+			bitmap[3] |= 0x01
+		}
+	}
+	return bitmap
+}
+
+func (s *Sim) security(msg []byte) [][]byte {
+	if len(msg) < 2 {
+		return negative(0x27, 0x12)
+	}
+
+	switch msg[1] {
+
+	case 0x01: // Request Seed
+		if s.attempts >= 3 {
+			return negative(0x27, 0x37)
+		}
+		if s.unlocked {
+			s.seeded = true
+			return positive(0x67, 0x01, 0x00, 0x00, 0x00)
+		}
+		seed, ok := s.Seeds[s.algo]
+		if !ok {
+			return negative(0x27, 0x22)
+		}
+		s.seeded = true
+		return positive(append([]byte{0x67, 0x01}, seed...)...)
+
+	case 0x02: // Send Key
+		if !s.seeded {
+			return negative(0x27, 0x22)
+		}
+		s.seeded = false
+
+		key, err := ComputeKey(s.algo, s.Seeds[s.algo])
+		if err == nil && bytes.Equal(msg[2:], key) {
+			s.unlocked = true
+			s.attempts = 0
+			return positive(0x67, 0x02, 0x34)
+		}
+
+		s.attempts++
+		if s.attempts >= 3 {
+			return negative(0x27, 0x36)
+		}
+		return negative(0x27, 0x35)
+	}
+
+	return negative(0x27, 0x12)
+}
+
+func (s *Sim) startRoutine(msg []byte) [][]byte {
+	if len(msg) < 2 {
+		return negative(0x31, 0x12)
+	}
+
+	switch msg[1] {
+
+	case 0xA0: // Pick the security algorithm, 31 A0 02 00 <ID> 01
+		if len(msg) < 5 {
+			return negative(0x31, 0x12)
+		}
+		if _, ok := algorithms[msg[4]]; !ok {
+			return negative(0x31, 0x31)
+		}
+		s.algo = msg[4]
+		return positive(0x71, 0xA0)
+
+	case 0xA1, 0xA2, 0xA3: // Erase, check a block, finish programming
+		if !s.unlocked {
+			return negative(0x31, 0x33)
+		}
+		if msg[1] == 0xA1 {
+			for i := simCalStart; i < simFlashStop && i < len(s.Memory); i++ {
+				s.Memory[i] = 0xFF
+			}
+		}
+		s.routines[msg[1]] = true
+
+		// The tester waits for "not complete" before it asks for the result
+		return negative(0x31, 0x23)
+	}
+
+	return negative(0x31, 0x31)
+}
+
+func (s *Sim) requestTransfer(msg []byte) [][]byte {
+	sid := msg[0]
+
+	if len(msg) != 7 || msg[1] != 0x82 {
+		return negative(sid, 0x12)
+	}
+	if !s.unlocked {
+		return negative(sid, 0x33)
+	}
+
+	length := int(msg[2])<<8 | int(msg[3])
+	start := int(msg[4])<<16 | int(msg[5])<<8 | int(msg[6])
+
+	if length != 0x100 && length != 0x200 && length != 0x400 {
+		if sid == 0x34 {
+			return negative(sid, 0x43)
+		}
+		return negative(sid, 0x53)
+	}
+
+	if sid == 0x34 {
+		if start >= simUploadHigh {
+			start -= simUploadDrop
+		}
+		if start < simCalStart || start+length > simFlashStop || start+length > len(s.Memory) {
+			return negative(sid, 0x42)
+		}
+		s.transfer = &simTransfer{toECU: true, start: start, length: length}
+		return positive(0x74)
+	}
+
+	if start+length > len(s.Memory) {
+		return negative(sid, 0x52)
+	}
+	s.transfer = &simTransfer{start: start, length: length}
+
+	// The data follows the positive response, as many bytes to a frame as fit
+	frames := positive(0x75)
+	for i := 0; i < length; i += simFrameMax - 1 {
+		end := i + simFrameMax - 1
+		if end > length {
+			end = length
+		}
+		frames = append(frames, append([]byte{0x76}, s.Memory[start+i:start+end]...))
+	}
+	return frames
+}
+
+// program writes a finished 0x34 transfer, the block is followed by a 16 bit sum of its bytes
+func (s *Sim) program(t *simTransfer) [][]byte {
+	if len(t.data) != t.length+2 {
+		return negative(0x37, 0x79)
+	}
+
+	sum := uint16(0)
+	for _, b := range t.data[:t.length] {
+		sum += uint16(b)
+	}
+	if t.data[t.length] != byte(sum>>8) || t.data[t.length+1] != byte(sum) {
+		return negative(0x37, 0x77)
+	}
+
+	// Flash can only clear bits, anything not erased first comes out mangled
+	for i, b := range t.data[:t.length] {
+		s.Memory[t.start+i] &= b
+	}
+
+	return positive(0x77)
+}
+
+func (s *Sim) read(adr int) byte {
+	if adr < len(s.Memory) {
+		return s.Memory[adr]
+	}
+	return 0xFF
+}
@@ -0,0 +1,184 @@
+package iso9141
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/murdinc/ELMFlash/image"
+)
+
+// Simulator Tests
+////////////////..........
+
+func newTestSim(t *testing.T, calName string) (*Sim, *Device) {
+	dir, err := filepath.Abs("../calibrations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	image.Dir = dir
+
+	img, err := image.Load(calName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sim := NewSim(img.Block)
+	d, err := Open(sim)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return sim, d
+}
+
+// inTempDir runs f with a temporary working directory, for the functions that write their output to ./
+func inTempDir(t *testing.T, f func(dir string)) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	dir, err := ioutil.TempDir("", "iso9141")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	err = os.Chdir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f(dir)
+}
+
+func readOutput(t *testing.T, dir, prefix string) []byte {
+	matches, err := filepath.Glob(filepath.Join(dir, prefix+"*.BIN"))
+	if err != nil || len(matches) != 1 {
+		t.Fatalf("expected one %s file, found %v (%v)", prefix, matches, err)
+	}
+
+	data, err := ioutil.ReadFile(matches[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestSimSecurity(t *testing.T) {
+	sim, d := newTestSim(t, "mp3")
+
+	// Transfers need security first
+	_, err := d.Msg(context.Background(), []byte{0x35, 0x82, 0x04, 0x00, 0x10, 0x80, 0x00})
+	if err == nil || d.SecurityMode {
+		t.Fatal("download before security access was accepted")
+	}
+
+	// A wrong key is refused
+	d.Msg(context.Background(), []byte{0x27, 0x01})
+	resp, err := d.Msg(context.Background(), []byte{0x27, 0x02, 0x00, 0x00})
+	if err == nil || resp.ErrCode != 0x35 {
+		t.Fatalf("wrong key: got %X, %v", resp.ErrCode, err)
+	}
+
+	err = d.EnableSecurity(context.Background())
+	if err != nil || !d.SecurityMode || !sim.unlocked {
+		t.Fatalf("EnableSecurity: %v", err)
+	}
+}
+
+func TestSimNegativeResponses(t *testing.T) {
+	_, d := newTestSim(t, "mp3")
+
+	tests := []struct {
+		msg  []byte
+		code byte
+	}{
+		{[]byte{0x99}, 0x11},
+		{[]byte{0x22, 0xFE, 0xFE}, 0x31},
+		{[]byte{0x34, 0x82, 0x04, 0x00, 0x10, 0x80, 0x00}, 0x33},
+		{[]byte{0x27, 0x02, 0x84, 0xC4}, 0x22},
+		{[]byte{0x36, 0x00}, 0x22},
+		{[]byte{0x37, 0x82}, 0x22},
+	}
+
+	for _, test := range tests {
+		resp, err := d.Msg(context.Background(), test.msg)
+		if err == nil || resp.ErrCode != test.code {
+			t.Errorf("% X: got %X, %v, want %X", test.msg, resp.ErrCode, err, test.code)
+		}
+	}
+}
+
+func TestSimReadMemory(t *testing.T) {
+	sim, d := newTestSim(t, "mp3")
+
+	resp, err := d.Msg(context.Background(), []byte{0x23, 0x10, 0x80, 0x80})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(resp.Message[3:7], sim.Memory[0x108080:0x108084]) {
+		t.Errorf("got % X, want % X", resp.Message[3:7], sim.Memory[0x108080:0x108084])
+	}
+}
+
+func TestSimDownloadBIN(t *testing.T) {
+	_, d := newTestSim(t, "mp3")
+
+	want, err := ioutil.ReadFile(filepath.Join(image.Dir, "MP3.BIN"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inTempDir(t, func(dir string) {
+		err := d.DownloadBIN(context.Background(), "DOWNLOAD")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := readOutput(t, dir, "DOWNLOAD"); !bytes.Equal(got, want) {
+			t.Errorf("downloaded 0x%X bytes that don't match MP3.BIN", len(got))
+		}
+	})
+}
+
+func TestSimUploadBIN(t *testing.T) {
+	sim, d := newTestSim(t, "mp3")
+
+	want, err := ioutil.ReadFile(filepath.Join(image.Dir, "MP3.BIN"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = d.UploadBIN(context.Background(), "MP3.BIN")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(sim.Memory[0x108000:0x180000], want) {
+		t.Error("flash doesn't match MP3.BIN after the upload")
+	}
+}
+
+func TestSimLocalIdDump(t *testing.T) {
+	sim, d := newTestSim(t, "mp3")
+	sim.LocalIDs[0x01] = []byte{0x12, 0x34, 0x56, 0x78}
+
+	inTempDir(t, func(dir string) {
+		err := d.LocalIdDump(context.Background(), "LOCAL_ID")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		lines := strings.Split(strings.TrimSpace(string(readOutput(t, dir, "LOCAL_ID"))), "\n")
+		if len(lines) != 1 || lines[0] != "Local ID: 01 Response: 345678" {
+			t.Errorf("got %q", lines)
+		}
+	})
+}
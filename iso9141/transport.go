@@ -0,0 +1,244 @@
+package iso9141
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	serial "github.com/huin/goserial"
+	"github.com/murdinc/ELMFlash/image"
+)
+
+// Transports
+////////////////..........
+
+// PortEnv is read when no port is given on the command line
+const PortEnv = "ELMFLASH_PORT"
+
+// WiFi ELM327 dongles all seem to sit at this address
+const wifiAddress = "192.168.0.10:35000"
+
+const dialTimeout = 5 * time.Second
+
+// A Transport opens the link to the ELM327
+type Transport interface {
+	Open() (io.ReadWriteCloser, error)
+	String() string
+}
+
+// USB serial adapters, like the ELMScan 5
+type SerialTransport struct {
+	Location string
+	Baud     int
+}
+
+func (t SerialTransport) Open() (io.ReadWriteCloser, error) {
+	return serial.OpenPort(&serial.Config{Name: t.Location, Baud: t.Baud})
+}
+
+func (t SerialTransport) String() string {
+	return fmt.Sprintf("serial:%s@%d", t.Location, t.Baud)
+}
+
+// WiFi adapters, which take the ELM327 commands over a TCP connection
+type TCPTransport struct {
+	Address string
+}
+
+func (t TCPTransport) Open() (io.ReadWriteCloser, error) {
+	return net.DialTimeout("tcp", t.Address, dialTimeout)
+}
+
+func (t TCPTransport) String() string {
+	return "tcp:" + t.Address
+}
+
+// A pseudo-terminal, or anything else that reads and writes like a file
+type FileTransport struct {
+	Path string
+}
+
+func (t FileTransport) Open() (io.ReadWriteCloser, error) {
+	return os.OpenFile(t.Path, os.O_RDWR, 0)
+}
+
+func (t FileTransport) String() string {
+	return "pty:" + t.Path
+}
+
+// A connection that is already open, like one end of a pipe in a test
+type PipeTransport struct {
+	Port io.ReadWriteCloser
+}
+
+func (t PipeTransport) Open() (io.ReadWriteCloser, error) {
+	if t.Port == nil {
+		return nil, errors.New("No pipe to open")
+	}
+	return t.Port, nil
+}
+
+func (t PipeTransport) String() string {
+	return "pipe"
+}
+
+// The simulated ECU, serving a calibration by catalog name or path
+type SimTransport struct {
+	Calibration string
+}
+
+func (t SimTransport) Open() (io.ReadWriteCloser, error) {
+	img, err := image.Load(t.Calibration)
+	if err != nil {
+		return nil, err
+	}
+	return NewSim(img.Block), nil
+}
+
+func (t SimTransport) String() string {
+	return "sim:" + t.Calibration
+}
+
+// ParseTransport reads a port setting:
+//
+//	/dev/ttyUSB0, serial:/dev/ttyUSB0@115200   USB serial
+//	wifi, tcp:192.168.0.10:35000                WiFi dongles
+//	pty:/dev/pts/3                              a pseudo-terminal
+//	sim:mp3                                     the simulated ECU
+//	replay:session.capture                      a captured session played back
+//
+// An empty setting falls back to $ELMFLASH_PORT, and then to the first ELMScan 5 in /dev.
+func ParseTransport(port string) (Transport, error) {
+	if port == "" {
+		port = os.Getenv(PortEnv)
+	}
+
+	if port == "" {
+		location := FindDevice()
+		if location == "" {
+			return nil, fmt.Errorf("No %s device found in /dev, set the port with --port or $%s", obdDevice, PortEnv)
+		}
+		return SerialTransport{Location: location, Baud: baud}, nil
+	}
+
+	if port == "wifi" {
+		return TCPTransport{Address: wifiAddress}, nil
+	}
+
+	scheme := "serial"
+	if i := strings.Index(port, ":"); i > 0 && !strings.HasPrefix(port, "/") {
+		scheme, port = port[:i], port[i+1:]
+	}
+
+	if port == "" {
+		return nil, fmt.Errorf("Missing the address after %s:", scheme)
+	}
+
+	switch scheme {
+
+	case "serial":
+		t := SerialTransport{Location: port, Baud: baud}
+		if i := strings.LastIndex(port, "@"); i > 0 {
+			b, err := strconv.Atoi(port[i+1:])
+			if err != nil {
+				return nil, fmt.Errorf("Bad baud rate in %s", port)
+			}
+			t.Location, t.Baud = port[:i], b
+		}
+		return t, nil
+
+	case "tcp":
+		if _, _, err := net.SplitHostPort(port); err != nil {
+			return nil, err
+		}
+		return TCPTransport{Address: port}, nil
+
+	case "pty":
+		return FileTransport{Path: port}, nil
+
+	case "sim":
+		return SimTransport{Calibration: port}, nil
+
+	case "replay":
+		return ReplayTransport{Path: port}, nil
+	}
+
+	return nil, fmt.Errorf("Unknown port type %s, use serial, tcp, pty, sim or replay", scheme)
+}
+
+// FindDevice looks in /dev for what is most likely the ELMScan 5
+func FindDevice() string {
+	contents, _ := ioutil.ReadDir("/dev")
+
+	for _, f := range contents {
+		if strings.Contains(f.Name(), obdDevice) && strings.Contains(f.Name(), "tty") {
+			dbg("Found Device: /dev/"+f.Name(), nil)
+			return "/dev/" + f.Name()
+		}
+	}
+	return ""
+}
+
+// Connect opens a transport and sets up the ELM327 on the other end
+func Connect(t Transport) (*Device, error) {
+	return connect(t, nil)
+}
+
+func connect(t Transport, capture *Capture) (*Device, error) {
+	dbg("Opening connection to device: "+t.String(), nil)
+
+	port, err := t.Open()
+	if err != nil {
+		log("Connect - [FAIL", err)
+		return nil, err
+	}
+
+	d, err := open(port, capture)
+	if err != nil {
+		port.Close()
+		return nil, err
+	}
+	d.transport = t
+
+	return d, nil
+}
+
+// ListenAndServe puts a simulated ECU serving a calibration on a TCP port, one client at a time, like a WiFi dongle
+func ListenAndServe(address, calName string) error {
+	img, err := image.Load(calName)
+	if err != nil {
+		log("ListenAndServe - Error loading calibration", err)
+		return err
+	}
+	sim := NewSim(img.Block)
+
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		log("ListenAndServe - [FAIL", err)
+		return err
+	}
+	defer l.Close()
+
+	log(fmt.Sprintf("Simulating an ELM327 on tcp:%s", l.Addr()), nil)
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			log("ListenAndServe - [FAIL", err)
+			return err
+		}
+
+		log(fmt.Sprintf("Connection from %s", conn.RemoteAddr()), nil)
+		err = sim.Serve(conn)
+		conn.Close()
+		if err != nil {
+			log("ListenAndServe - Connection closed", err)
+		}
+	}
+}
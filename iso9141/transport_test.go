@@ -0,0 +1,102 @@
+package iso9141
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"os"
+	"testing"
+)
+
+// Transport Tests
+////////////////..........
+
+func TestParseTransport(t *testing.T) {
+	tests := []struct {
+		port string
+		want Transport
+	}{
+		{"/dev/ttyUSB0", SerialTransport{Location: "/dev/ttyUSB0", Baud: baud}},
+		{"serial:/dev/tty.usbserial@38400", SerialTransport{Location: "/dev/tty.usbserial", Baud: 38400}},
+		{"COM3", SerialTransport{Location: "COM3", Baud: baud}},
+		{"wifi", TCPTransport{Address: "192.168.0.10:35000"}},
+		{"tcp:10.0.0.5:23", TCPTransport{Address: "10.0.0.5:23"}},
+		{"pty:/dev/pts/3", FileTransport{Path: "/dev/pts/3"}},
+		{"sim:mp3", SimTransport{Calibration: "mp3"}},
+	}
+
+	for _, test := range tests {
+		got, err := ParseTransport(test.port)
+		if err != nil {
+			t.Errorf("%s: %s", test.port, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%s: got %#v, want %#v", test.port, got, test.want)
+		}
+	}
+
+	for _, port := range []string{"tcp:nope", "bluetooth:00:11", "sim:", "serial:/dev/ttyUSB0@fast"} {
+		if _, err := ParseTransport(port); err == nil {
+			t.Errorf("%s: no error", port)
+		}
+	}
+
+	os.Setenv(PortEnv, "tcp:127.0.0.1:35000")
+	defer os.Unsetenv(PortEnv)
+	if got, err := ParseTransport(""); err != nil || got != (TCPTransport{Address: "127.0.0.1:35000"}) {
+		t.Errorf("$%s: got %#v, %v", PortEnv, got, err)
+	}
+}
+
+// Everything the simulator sees over a pipe or a socket should work the same as talking to it directly
+func checkTransport(t *testing.T, sim *Sim, tr Transport) {
+	d, err := Connect(tr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.DisconnectDevice()
+
+	err = d.EnableSecurity(context.Background())
+	if err != nil || !d.SecurityMode {
+		t.Fatalf("EnableSecurity: %v", err)
+	}
+
+	block, err := d.DownloadBlock(context.Background(), 0x108000, 0x400)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(block, sim.Memory[0x108000:0x108400]) {
+		t.Error("downloaded block doesn't match the image")
+	}
+}
+
+func TestPipeTransport(t *testing.T) {
+	sim, _ := newTestSim(t, "mp3")
+
+	client, server := net.Pipe()
+	go sim.Serve(server)
+
+	checkTransport(t, sim, PipeTransport{Port: client})
+}
+
+func TestTCPTransport(t *testing.T) {
+	sim, _ := newTestSim(t, "mp3")
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		sim.Serve(conn)
+	}()
+
+	checkTransport(t, sim, TCPTransport{Address: l.Addr().String()})
+}
@@ -0,0 +1,353 @@
+package iso9141
+
+import (
+	"context"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/cheggaaa/pb"
+	"github.com/murdinc/ELMFlash/image"
+)
+
+// Uploads
+////////////////..........
+
+const (
+	uploadBlock   = 0x400
+	uploadSize    = 0x78000 // the calibration area, 0x108000 - 0x17FFFF
+	uploadChunk   = 0x8000  // the factory tool sends 32K at a time, top block first
+	uploadRemap   = 0x18000 // from this far into the calibration the ECU wants addresses 0x80000 higher
+	uploadRemapBy = 0x80000
+)
+
+// UploadOptions are the checks a flash has to pass before anything is erased
+type UploadOptions struct {
+	ECU   string // strategy the ECU has to report, like DXAI4U0, as well as the calibration's own
+	CRC   uint32 // crc32 the calibration area has to have, 0 to skip
+	Force bool   // erase an ECU reporting another strategy than the calibration's
+}
+
+// BlockResult is what happened to one block of an upload
+type BlockResult struct {
+	Offset   int // in the calibration
+	Flash    int // where it lives in flash, and where it's read back from
+	Addr     int // where it was sent
+	Written  bool
+	Verified bool
+	Err      error
+}
+
+// Remapped is true when the block was sent to a different address than it lands at
+func (b BlockResult) Remapped() bool {
+	return b.Addr != b.Flash
+}
+
+// UploadReport is the pass/fail record of an upload, from the pre-flight checks to the read back
+type UploadReport struct {
+	CalFile  string
+	Layout   string
+	Strategy string
+	ECU      string // strategy the ECU reported before the erase
+	CRC      uint32
+	Erased   bool
+	Finished bool // routine A3 passed
+	Blocks   []BlockResult
+	Err      error // the first thing that went wrong
+}
+
+// uploadPlan lists the blocks in the order the factory tool sends them
+func uploadPlan() []BlockResult {
+	var plan []BlockResult
+	for chunk := 0; chunk < uploadSize; chunk += uploadChunk {
+		for offset := chunk + uploadChunk - uploadBlock; offset >= chunk; offset -= uploadBlock {
+			b := BlockResult{Offset: offset, Flash: image.CalStart + offset, Addr: image.CalStart + offset}
+			if offset >= uploadRemap {
+				b.Addr += uploadRemapBy
+			}
+			plan = append(plan, b)
+		}
+	}
+	return plan
+}
+
+// CheckUpload is the pre-flight check of a calibration file, it returns the calibration area to write
+func CheckUpload(calName string, opts UploadOptions) (*UploadReport, []byte, error) {
+	r := &UploadReport{Blocks: uploadPlan()}
+
+	calFile, data, err := image.ReadFile(calName)
+	if err != nil {
+		r.Err = err
+		return r, nil, err
+	}
+	r.CalFile = calFile
+
+	layout, err := image.Detect(data)
+	if err != nil {
+		r.Err = fmt.Errorf("%s: %s", calFile, err)
+		return r, nil, r.Err
+	}
+	r.Layout = layout.Name
+
+	cal := layout.Calibration(data)
+	if cal == nil {
+		r.Err = fmt.Errorf("%s is a %s image (%s), only %s calibrations can be uploaded", calFile, layout.Family, layout.Name, image.Family196EA)
+		return r, nil, r.Err
+	}
+	if len(cal) != uploadSize {
+		r.Err = fmt.Errorf("%s has a 0x%X byte calibration area, it has to be 0x%X", calFile, len(cal), uploadSize)
+		return r, nil, r.Err
+	}
+	r.Strategy = layout.Strategy(data)
+
+	// There is no checksum in the calibration we know of, so a crc32 given by the user is the check against a damaged file
+	r.CRC = crc32.ChecksumIEEE(cal)
+	if opts.CRC != 0 && r.CRC != opts.CRC {
+		r.Err = fmt.Errorf("%s has crc32 0x%.8X, expected 0x%.8X", calFile, r.CRC, opts.CRC)
+		return r, nil, r.Err
+	}
+
+	// A calibration that's all erased flash or all zeros would leave the ECU with nothing to run
+	blank := true
+	for _, b := range cal {
+		if b != 0xFF && b != 0x00 {
+			blank = false
+			break
+		}
+	}
+	if blank {
+		r.Err = fmt.Errorf("%s has an empty calibration area", calFile)
+		return r, nil, r.Err
+	}
+
+	return r, cal, nil
+}
+
+// UploadBIN flashes a calibration with the default checks, the ECU has to report the calibration's strategy, and
+// prints the report
+func (d *Device) UploadBIN(ctx context.Context, calName string) error {
+	r, err := d.FlashBIN(ctx, calName, UploadOptions{})
+	r.Write(os.Stdout)
+	return err
+}
+
+// FlashBIN checks a calibration and the ECU, erases, writes every block, then reads every block back to compare
+func (d *Device) FlashBIN(ctx context.Context, calName string, opts UploadOptions) (*UploadReport, error) {
+	r, cal, err := CheckUpload(calName, opts)
+	if err != nil {
+		log("UploadBIN - Pre-flight [FAIL", err)
+		return r, err
+	}
+	log(fmt.Sprintf("Calibration File: %s (%s, %s)", r.CalFile, r.Layout, r.Strategy), nil)
+
+	fail := func(err error) (*UploadReport, error) {
+		r.Err = err
+		log("UploadBIN - [FAIL", err)
+		return r, err
+	}
+
+	// Make sure we have Security Access
+	if d.SecurityMode == false {
+		err := d.EnableSecurity(ctx)
+		if err != nil {
+			return fail(err)
+		}
+	}
+
+	// Confirm the ECU before touching it
+	if d.Dummy != true {
+		r.ECU, err = d.strategy(ctx)
+		if err != nil {
+			return fail(err)
+		}
+		if opts.ECU != "" && r.ECU != opts.ECU {
+			return fail(fmt.Errorf("ECU reports %s, expected %s", r.ECU, opts.ECU))
+		}
+		if r.ECU != r.Strategy && !opts.Force {
+			return fail(fmt.Errorf("ECU reports %s, the calibration is for %q, force the upload to flash it anyway", r.ECU, r.Strategy))
+		}
+		log(fmt.Sprintf("ECU Strategy: %s", r.ECU), nil)
+	}
+
+	// Read some bytes
+	_, err = d.Msg(ctx, []byte{0x23, 0x10, 0x80, 0x80})
+	if err != nil {
+		return fail(err)
+	}
+
+	// Delete BIN on ECU
+	err = d.RunRoutine(ctx, RoutineErase)
+	if err != nil {
+		return fail(fmt.Errorf("Erase: %s", err))
+	}
+	r.Erased = true
+
+	// Write, stopping at the first block that fails, there's no telling what state the ECU is in after that
+	log("Starting Upload...", nil)
+	bar := pb.StartNew(len(r.Blocks))
+	for i := range r.Blocks {
+		b := &r.Blocks[i]
+		bar.Increment()
+
+		// Cancelling stops between blocks, the ECU is left erased with the blocks so far written
+		if ctx.Err() != nil {
+			return fail(ctx.Err())
+		}
+
+		block := cal[b.Offset : b.Offset+uploadBlock]
+		dbg(fmt.Sprintf("UploadBIN - writing 0x%X to 0x%.6X (flash 0x%.6X)", b.Offset, b.Addr, b.Flash), nil)
+
+		// Append the Checksum
+		sum := uint16(0x0000)
+		for _, c := range block {
+			sum += uint16(c)
+		}
+		blockChk := append(append([]byte{}, block...), byte(sum>>8), byte(sum))
+
+		// Upload the Calibration
+		b.Err = d.UploadBlock(ctx, b.Addr, uploadBlock, blockChk)
+		if b.Err != nil {
+			return fail(fmt.Errorf("Block 0x%.6X: %s", b.Flash, b.Err))
+		}
+		b.Written = true
+	}
+	bar.FinishPrint("Upload Finished!")
+
+	// Run Routine A3
+	err = d.RunRoutine(ctx, RoutineFinish)
+	if err != nil {
+		return fail(fmt.Errorf("Finish: %s", err))
+	}
+	r.Finished = true
+
+	if d.Dummy == true {
+		return r, nil
+	}
+
+	// Read every block back from where it landed
+	log("Verifying Upload...", nil)
+	bar = pb.StartNew(len(r.Blocks))
+	for i := range r.Blocks {
+		b := &r.Blocks[i]
+		bar.Increment()
+
+		got, err := d.VerifiedBlock(ctx, b.Flash, uploadBlock)
+		if ctx.Err() != nil {
+			return fail(ctx.Err())
+		}
+		if err != nil {
+			b.Err = err
+		} else if diff := firstDiff(got, cal[b.Offset:b.Offset+uploadBlock]); diff >= 0 {
+			b.Err = fmt.Errorf("Reads back 0x%.2X at 0x%.6X, wrote 0x%.2X", got[diff], b.Flash+diff, cal[b.Offset+diff])
+		} else {
+			b.Verified = true
+			continue
+		}
+
+		if r.Err == nil {
+			r.Err = fmt.Errorf("Block 0x%.6X: %s", b.Flash, b.Err)
+		}
+	}
+	bar.FinishPrint("Verify Finished!")
+
+	if r.Err != nil {
+		log("UploadBIN - Verify [FAIL", r.Err)
+	}
+	return r, r.Err
+}
+
+// firstDiff returns the index of the first byte that differs between two blocks of the same length, or -1
+func firstDiff(a, b []byte) int {
+	for i := range a {
+		if a[i] != b[i] {
+			return i
+		}
+	}
+	return -1
+}
+
+// Passed is true when every block was written and read back the same
+func (r *UploadReport) Passed() bool {
+	if r.Err != nil || !r.Erased || !r.Finished {
+		return false
+	}
+	for _, b := range r.Blocks {
+		if !b.Written || !b.Verified {
+			return false
+		}
+	}
+	return true
+}
+
+func passFail(ok bool) string {
+	if ok {
+		return "PASS"
+	}
+	return "FAIL"
+}
+
+// Write prints the report
+func (r *UploadReport) Write(w io.Writer) {
+	written, verified := 0, 0
+	for _, b := range r.Blocks {
+		if b.Written {
+			written++
+		}
+		if b.Verified {
+			verified++
+		}
+	}
+
+	fmt.Fprintf(w, "Upload Report - %s - %s\n", passFail(r.Passed()), time.Now().Format(time.RFC3339))
+	fmt.Fprintf(w, "  Calibration: %s (%s, %s)\n", r.CalFile, r.Layout, r.Strategy)
+	fmt.Fprintf(w, "  CRC32:       0x%.8X\n", r.CRC)
+	fmt.Fprintf(w, "  ECU:         %s\n", r.ECU)
+	fmt.Fprintf(w, "  Erase:       %s\n", passFail(r.Erased))
+	fmt.Fprintf(w, "  Written:     %d of %d blocks\n", written, len(r.Blocks))
+	fmt.Fprintf(w, "  Finish:      %s\n", passFail(r.Finished))
+	fmt.Fprintf(w, "  Verified:    %d of %d blocks\n", verified, len(r.Blocks))
+
+	fmt.Fprintf(w, "  Remapped:\n")
+	for _, rng := range remappedRanges(r.Blocks) {
+		fmt.Fprintf(w, "    0x%.6X - 0x%.6X sent to 0x%.6X - 0x%.6X\n", rng[0], rng[1], rng[2], rng[3])
+	}
+
+	for _, b := range r.Blocks {
+		if b.Err != nil {
+			fmt.Fprintf(w, "  Block 0x%.6X: %s\n", b.Flash, b.Err)
+		}
+	}
+
+	if r.Err != nil {
+		fmt.Fprintf(w, "  Error:       %s\n", r.Err)
+		if r.Erased && !r.Passed() {
+			fmt.Fprintf(w, "  The ECU was erased, upload again before turning the ignition off!\n")
+		}
+	}
+}
+
+// remappedRanges joins the remapped blocks into runs of flash addresses: flash start, flash end, sent start, sent end
+func remappedRanges(blocks []BlockResult) [][4]int {
+	var remapped []BlockResult
+	for _, b := range blocks {
+		if b.Remapped() {
+			remapped = append(remapped, b)
+		}
+	}
+	sort.Slice(remapped, func(i, j int) bool { return remapped[i].Flash < remapped[j].Flash })
+
+	var ranges [][4]int
+	for _, b := range remapped {
+		n := len(ranges)
+		if n > 0 && ranges[n-1][1]+1 == b.Flash && ranges[n-1][3]+1 == b.Addr {
+			ranges[n-1][1] = b.Flash + uploadBlock - 1
+			ranges[n-1][3] = b.Addr + uploadBlock - 1
+			continue
+		}
+		ranges = append(ranges, [4]int{b.Flash, b.Flash + uploadBlock - 1, b.Addr, b.Addr + uploadBlock - 1})
+	}
+	return ranges
+}
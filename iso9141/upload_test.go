@@ -0,0 +1,156 @@
+package iso9141
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+)
+
+// Upload Tests
+////////////////..........
+
+func TestUploadPlan(t *testing.T) {
+	plan := uploadPlan()
+	if len(plan) != 480 {
+		t.Fatalf("%d blocks, want 480", len(plan))
+	}
+
+	// The order and addresses the factory tool uses
+	tests := []struct {
+		i           int
+		flash, addr int
+	}{
+		{0, 0x10FC00, 0x10FC00},
+		{31, 0x108000, 0x108000},
+		{32, 0x117C00, 0x117C00},
+		{95, 0x118000, 0x118000},
+		{96, 0x127C00, 0x1A7C00},
+		{479, 0x178000, 0x1F8000},
+	}
+	for _, test := range tests {
+		b := plan[test.i]
+		if b.Flash != test.flash || b.Addr != test.addr {
+			t.Errorf("block %d: got 0x%.6X at 0x%.6X, want 0x%.6X at 0x%.6X", test.i, b.Flash, b.Addr, test.flash, test.addr)
+		}
+	}
+
+	seen := make(map[int]bool)
+	for _, b := range plan {
+		if seen[b.Flash] || b.Flash < 0x108000 || b.Flash >= 0x180000 || b.Flash != 0x108000+b.Offset {
+			t.Errorf("bad block 0x%.6X", b.Flash)
+		}
+		seen[b.Flash] = true
+	}
+
+	ranges := remappedRanges(plan)
+	if len(ranges) != 1 || ranges[0] != [4]int{0x120000, 0x17FFFF, 0x1A0000, 0x1FFFFF} {
+		t.Errorf("remapped %X", ranges)
+	}
+}
+
+func TestCheckUpload(t *testing.T) {
+	newTestSim(t, "mp3")
+
+	_, msp, err := CheckUpload("MSP.BIN", UploadOptions{CRC: 0xC88F0EC2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A full dump uploads the same calibration area
+	r, back, err := CheckUpload("BACK.MSP.BIN", UploadOptions{})
+	if err != nil || !bytes.Equal(back, msp) || r.Layout != "196ea-flash" {
+		t.Errorf("BACK.MSP.BIN: %s, %v", r.Layout, err)
+	}
+
+	for _, test := range []struct {
+		calName string
+		opts    UploadOptions
+	}{
+		{"MSP.BIN", UploadOptions{CRC: 0x12345678}},
+		{"DKAM0IN.BIN", UploadOptions{}},
+		{"PRE.BIN", UploadOptions{}},
+		{"nope", UploadOptions{}},
+	} {
+		if _, _, err := CheckUpload(test.calName, test.opts); err == nil {
+			t.Errorf("%s: no error", test.calName)
+		}
+	}
+}
+
+func TestFlashWrongECU(t *testing.T) {
+	sim, d := newTestSim(t, "mp3")
+	before := append([]byte(nil), sim.Memory...)
+
+	r, err := d.FlashBIN(context.Background(), "MP3.BIN", UploadOptions{ECU: "QOAP4C0"})
+	if err == nil || r.ECU != "DXAI4U0" {
+		t.Fatalf("flashed an ECU reporting %s: %v", r.ECU, err)
+	}
+	for _, req := range sim.Requests {
+		if req[0] == 0x34 || bytes.HasPrefix(req, []byte{0x31, 0xA1}) {
+			t.Errorf("sent % X to the wrong ECU", req)
+		}
+	}
+	if !bytes.Equal(sim.Memory, before) {
+		t.Error("the ECU was touched")
+	}
+}
+
+func TestFlashOtherStrategy(t *testing.T) {
+	sim, d := newTestSim(t, "mp3")
+	fastRetries(d)
+	before := append([]byte(nil), sim.Memory...)
+
+	// Without being told to, an ECU running another strategy isn't erased
+	r, err := d.FlashBIN(context.Background(), "MSP.BIN", UploadOptions{})
+	if err == nil || r.Erased || r.ECU != "DXAI4U0" || r.Strategy != "QOAP4C0" {
+		t.Fatalf("flashed an ECU reporting %s: %v", r.ECU, err)
+	}
+	if !bytes.Equal(sim.Memory, before) {
+		t.Error("the ECU was touched")
+	}
+
+	r, err = d.FlashBIN(context.Background(), "MSP.BIN", UploadOptions{Force: true})
+	if err != nil || !r.Passed() {
+		t.Errorf("forced upload failed: %v", err)
+	}
+}
+
+func TestFlashReport(t *testing.T) {
+	sim, d := newTestSim(t, "mp3")
+	fastRetries(d)
+
+	r, err := d.FlashBIN(context.Background(), "MP3.BIN", UploadOptions{ECU: "DXAI4U0"})
+	if err != nil || !r.Passed() {
+		t.Fatalf("upload failed: %v", err)
+	}
+
+	var out bytes.Buffer
+	r.Write(&out)
+	for _, want := range []string{"Upload Report - PASS", "Verified:    480 of 480", "0x120000 - 0x17FFFF sent to 0x1A0000 - 0x1FFFFF"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("report is missing %q:\n%s", want, out.String())
+		}
+	}
+
+	// A block that doesn't read back the same fails the upload
+	sim.Fault = func(msg []byte, frames [][]byte) [][]byte {
+		if msg[0] == 0x35 && msg[4] == 0x15 && msg[5] == 0x04 && len(frames) > 1 {
+			bad := append([]byte(nil), frames[1]...)
+			bad[1] ^= 0x01
+			return append([][]byte{frames[0], bad}, frames[2:]...)
+		}
+		return frames
+	}
+
+	r, err = d.FlashBIN(context.Background(), "MP3.BIN", UploadOptions{})
+	if err == nil || r.Passed() {
+		t.Fatal("bad read back passed")
+	}
+
+	out.Reset()
+	r.Write(&out)
+	if !strings.Contains(out.String(), "Upload Report - FAIL") || !strings.Contains(out.String(), "Block 0x150400: Reads back") {
+		t.Errorf("report doesn't show the bad block:\n%s", out.String())
+	}
+}
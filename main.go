@@ -1,18 +1,33 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/murdinc/ELMFlash/asm"
 	"github.com/murdinc/ELMFlash/calibrate"
 	"github.com/murdinc/ELMFlash/compare"
 	"github.com/murdinc/ELMFlash/disasm"
 	"github.com/murdinc/ELMFlash/hexstuff"
+	"github.com/murdinc/ELMFlash/image"
 	"github.com/murdinc/ELMFlash/iso9141"
 	"github.com/murdinc/ELMFlash/j3"
 	"github.com/murdinc/legacy-cli"
 )
 
+// The ELM327 connection, for every command that talks to the car
+var portFlag = cli.StringFlag{Name: "port", Value: "", Usage: "ELM327 connection: /dev/ttyUSB0, wifi, tcp:host:port, pty:/dev/pts/N, sim:calibration or replay:file (default $ELMFLASH_PORT)"}
+
+// Records the session, for the decode command or to replay with --port replay:file
+var captureFlag = cli.StringFlag{Name: "capture", Value: "", Usage: "File to record everything sent to and read from the ELM327 in"}
+
 // Main Function
 ////////////////..........
 func main() {
@@ -38,10 +53,27 @@ func main() {
 			Name:        "download",
 			ShortName:   "d",
 			Example:     "download",
-			Description: "Download the calibration from the ECU",
+			Description: "Download the calibration from the ECU, resuming an interrupted download",
+			Flags: []cli.Flag{
+				portFlag,
+				captureFlag,
+				cli.BoolFlag{Name: "restart", Usage: "Start over instead of resuming an interrupted download"},
+			},
 			Action: func(c *cli.Context) {
-				obd := iso9141.New(false)
-				obd.DownloadBIN("DOWNLOAD")
+				if c.Bool("restart") {
+					if err := iso9141.RestartDownload("DOWNLOAD"); err != nil {
+						log("Download - Can't restart", err)
+						return
+					}
+				}
+				obd, err := connect(c, false)
+				if err != nil {
+					return
+				}
+				defer obd.DisconnectDevice()
+				ctx, stop := interruptible()
+				defer stop()
+				obd.DownloadBIN(ctx, "DOWNLOAD")
 			},
 		},
 		{
@@ -49,9 +81,19 @@ func main() {
 			ShortName:   "du",
 			Example:     "dump",
 			Description: "Dump the calibration from the ECU without security mode (slow)",
+			Flags: []cli.Flag{
+				portFlag,
+				captureFlag,
+			},
 			Action: func(c *cli.Context) {
-				obd := iso9141.New(false)
-				obd.DumpBIN("DUMP")
+				obd, err := connect(c, false)
+				if err != nil {
+					return
+				}
+				defer obd.DisconnectDevice()
+				ctx, stop := interruptible()
+				defer stop()
+				obd.DumpBIN(ctx, "DUMP")
 			},
 		},
 		{
@@ -60,15 +102,36 @@ func main() {
 			Example:     "upload msp",
 			Description: "Upload a calibration to the ECU",
 			Arguments: []cli.Argument{
-				cli.Argument{Name: "calibration", Usage: "upload msp", Description: "The name of the calibration to upload", Optional: false},
+				cli.Argument{Name: "calibration", Usage: "upload msp", Description: "The catalog name or file path of the calibration to upload", Optional: false},
 			},
 			Flags: []cli.Flag{
 				cli.BoolFlag{Name: "test", Usage: "Test upload"},
+				cli.StringFlag{Name: "ecu", Value: "", Usage: "Strategy the ECU has to report before it is erased, like DXAI4U0"},
+				cli.StringFlag{Name: "crc", Value: "", Usage: "crc32 the calibration area has to have, like 0xC88F0EC2"},
+				cli.BoolFlag{Name: "force", Usage: "Upload even if the ECU reports another strategy than the calibration's"},
+				portFlag,
+				captureFlag,
 			},
 			Action: func(c *cli.Context) {
+				opts := iso9141.UploadOptions{ECU: c.String("ecu"), Force: c.Bool("force")}
+				if c.String("crc") != "" {
+					crc, err := strconv.ParseUint(c.String("crc"), 0, 32)
+					if err != nil {
+						fmt.Println("Bad crc32:", err)
+						return
+					}
+					opts.CRC = uint32(crc)
+				}
 
-				obd := iso9141.New(c.Bool("test"))
-				obd.UploadBIN(c.NamedArg("calibration"))
+				obd, err := connect(c, c.Bool("test"))
+				if err != nil {
+					return
+				}
+				defer obd.DisconnectDevice()
+				ctx, stop := interruptible()
+				defer stop()
+				r, _ := obd.FlashBIN(ctx, c.NamedArg("calibration"), opts)
+				r.Write(os.Stdout)
 			},
 		},
 		{
@@ -76,9 +139,19 @@ func main() {
 			ShortName:   "c",
 			Example:     "common",
 			Description: "Crawls all Common ID's",
+			Flags: []cli.Flag{
+				portFlag,
+				captureFlag,
+			},
 			Action: func(c *cli.Context) {
-				obd := iso9141.New(false)
-				obd.CommonIdDump("COMMON_ID")
+				obd, err := connect(c, false)
+				if err != nil {
+					return
+				}
+				defer obd.DisconnectDevice()
+				ctx, stop := interruptible()
+				defer stop()
+				obd.CommonIdDump(ctx, "COMMON_ID")
 			},
 		},
 		{
@@ -86,9 +159,141 @@ func main() {
 			ShortName:   "l",
 			Example:     "local",
 			Description: "Crawls all Local ID's",
+			Flags: []cli.Flag{
+				portFlag,
+				captureFlag,
+			},
+			Action: func(c *cli.Context) {
+				obd, err := connect(c, false)
+				if err != nil {
+					return
+				}
+				defer obd.DisconnectDevice()
+				ctx, stop := interruptible()
+				defer stop()
+				obd.LocalIdDump(ctx, "LOCAL_ID")
+			},
+		},
+		{
+			Name:        "ids",
+			ShortName:   "ids",
+			Example:     "ids ids.json COMMON_ID2016-06-03T21:47:47-07:00.BIN",
+			Description: "Record the IDs of a Common or Local ID scan in a definitions file, where they can be named, scaled and logged",
+			Arguments: []cli.Argument{
+				cli.Argument{Name: "store", Usage: "ids ids.json scan.BIN", Description: "The json definitions file, created if it doesn't exist", Optional: false},
+				cli.Argument{Name: "scan", Usage: "ids ids.json scan.BIN", Description: "A file written by the common or local command", Optional: false},
+			},
+			Action: func(c *cli.Context) {
+				store, err := iso9141.LoadIDStore(c.NamedArg("store"))
+				if err != nil {
+					log("IDs - Error", err)
+					return
+				}
+				scan, err := iso9141.LoadScan(c.NamedArg("scan"))
+				if err != nil {
+					log("IDs - Error", err)
+					return
+				}
+
+				added := store.Add(scan)
+				if err := store.Save(c.NamedArg("store")); err != nil {
+					log("IDs - Error", err)
+					return
+				}
+				log(fmt.Sprintf("IDs - %d IDs from %s, %d of them new, %d in the store", len(scan.Values), scan.Name, added, len(store.IDs)), nil)
+			},
+		},
+		{
+			Name:        "scandiff",
+			ShortName:   "sd",
+			Example:     "scandiff idle.BIN revved.BIN",
+			Description: "List the IDs whose answers changed between two Common or Local ID scans",
+			Arguments: []cli.Argument{
+				cli.Argument{Name: "before", Usage: "scandiff before.BIN after.BIN", Description: "The first scan", Optional: false},
+				cli.Argument{Name: "after", Usage: "scandiff before.BIN after.BIN", Description: "The scan after moving an input", Optional: false},
+			},
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "store", Value: "", Usage: "Definitions file to name the IDs from"},
+			},
+			Action: func(c *cli.Context) {
+				before, err := iso9141.LoadScan(c.NamedArg("before"))
+				if err != nil {
+					log("Scan Diff - Error", err)
+					return
+				}
+				after, err := iso9141.LoadScan(c.NamedArg("after"))
+				if err != nil {
+					log("Scan Diff - Error", err)
+					return
+				}
+
+				var store *iso9141.IDStore
+				if c.String("store") != "" {
+					store, err = iso9141.LoadIDStore(c.String("store"))
+					if err != nil {
+						log("Scan Diff - Error", err)
+						return
+					}
+				}
+
+				diffs, err := iso9141.DiffScans(before, after)
+				if err != nil {
+					log("Scan Diff - Error", err)
+					return
+				}
+				iso9141.WriteDiffs(os.Stdout, diffs, store)
+			},
+		},
+		{
+			Name:        "log",
+			ShortName:   "log",
+			Example:     "log params.json",
+			Description: "Log Local and Common ID's to a CSV file at a fixed rate, until Ctrl-C",
+			Arguments: []cli.Argument{
+				cli.Argument{Name: "definitions", Usage: "log params.json", Description: "json list of the parameters to log, with their ID, scaling and units", Optional: false},
+			},
+			Flags: []cli.Flag{
+				portFlag,
+				captureFlag,
+				cli.StringFlag{Name: "rate", Value: "100ms", Usage: "Time between samples"},
+				cli.IntFlag{Name: "samples", Value: 0, Usage: "Stop after this many samples, 0 logs until Ctrl-C"},
+				cli.StringFlag{Name: "out", Value: "", Usage: "CSV file to write (default ./DATALOG<time>.csv)"},
+			},
 			Action: func(c *cli.Context) {
-				obd := iso9141.New(false)
-				obd.LocalIdDump("LOCAL_ID")
+				params, err := iso9141.LoadParams(c.NamedArg("definitions"))
+				if err != nil {
+					log("Log - Error", err)
+					return
+				}
+				rate, err := time.ParseDuration(c.String("rate"))
+				if err != nil {
+					log("Log - Bad rate", err)
+					return
+				}
+
+				out := c.String("out")
+				if out == "" {
+					out = "./DATALOG" + time.Now().Format(time.RFC3339) + ".csv"
+				}
+
+				// Connect first, so a missing ECU doesn't leave an empty log behind
+				obd, err := connect(c, false)
+				if err != nil {
+					return
+				}
+				defer obd.DisconnectDevice()
+
+				f, err := os.Create(out)
+				if err != nil {
+					log("Log - Error", err)
+					return
+				}
+				defer f.Close()
+
+				ctx, stop := interruptible()
+				defer stop()
+				log("Log - Writing "+out, nil)
+				obd.LogData(ctx, params, iso9141.LogOptions{Rate: rate, Samples: c.Int("samples")}, f)
 			},
 		},
 		{
@@ -96,9 +301,225 @@ func main() {
 			ShortName:   "i",
 			Example:     "ecuId",
 			Description: "Retrieve the ECU ID",
+			Flags: []cli.Flag{
+				portFlag,
+				captureFlag,
+			},
 			Action: func(c *cli.Context) {
-				obd := iso9141.New(false)
-				obd.EcuId()
+				obd, err := connect(c, false)
+				if err != nil {
+					return
+				}
+				defer obd.DisconnectDevice()
+				ctx, stop := interruptible()
+				defer stop()
+				obd.EcuId(ctx)
+			},
+		},
+		{
+			Name:        "dtc",
+			ShortName:   "dtc",
+			Example:     "dtc",
+			Description: "Read the stored OBD-II trouble codes and the freeze frame",
+			Flags: []cli.Flag{
+				portFlag,
+				captureFlag,
+			},
+			Action: func(c *cli.Context) {
+				obd, err := connect(c, false)
+				if err != nil {
+					return
+				}
+				defer obd.DisconnectDevice()
+				ctx, stop := interruptible()
+				defer stop()
+
+				codes, err := obd.ReadDTCs(ctx)
+				if err != nil {
+					log("DTC - Error", err)
+					return
+				}
+				if len(codes) == 0 {
+					fmt.Println("No stored trouble codes")
+					return
+				}
+				for _, code := range codes {
+					fmt.Println(code)
+				}
+
+				pids, err := obd.SupportedPIDs(ctx, iso9141.ModeFreezeFrame)
+				if err != nil || len(pids) == 0 {
+					return
+				}
+				fmt.Println("\nFreeze Frame:")
+				for _, pid := range pids {
+					v, err := obd.FreezeFrame(ctx, pid, 0)
+					if err != nil {
+						log(fmt.Sprintf("DTC - Freeze frame PID %.2X", pid), err)
+						continue
+					}
+					fmt.Println(v)
+				}
+			},
+		},
+		{
+			Name:        "clear-dtc",
+			ShortName:   "cdtc",
+			Example:     "clear-dtc",
+			Description: "Clear the OBD-II trouble codes and freeze frame, and turn the MIL off",
+			Flags: []cli.Flag{
+				portFlag,
+				captureFlag,
+			},
+			Action: func(c *cli.Context) {
+				obd, err := connect(c, false)
+				if err != nil {
+					return
+				}
+				defer obd.DisconnectDevice()
+				ctx, stop := interruptible()
+				defer stop()
+				if err := obd.ClearDTCs(ctx); err != nil {
+					log("Clear DTC - Error", err)
+					return
+				}
+				fmt.Println("Trouble codes cleared")
+			},
+		},
+		{
+			Name:        "pids",
+			ShortName:   "pids",
+			Example:     "pids",
+			Description: "Read every OBD-II mode 01 PID the ECU supports once",
+			Flags: []cli.Flag{
+				portFlag,
+				captureFlag,
+			},
+			Action: func(c *cli.Context) {
+				obd, err := connect(c, false)
+				if err != nil {
+					return
+				}
+				defer obd.DisconnectDevice()
+				ctx, stop := interruptible()
+				defer stop()
+
+				pids, err := obd.SupportedPIDs(ctx, iso9141.ModeCurrentData)
+				if err != nil {
+					log("PIDs - Error", err)
+					return
+				}
+				for _, pid := range pids {
+					v, err := obd.ReadPID(ctx, pid)
+					if err != nil {
+						log(fmt.Sprintf("PIDs - PID %.2X", pid), err)
+						continue
+					}
+					fmt.Println(v)
+				}
+			},
+		},
+		{
+			Name:        "vin",
+			ShortName:   "vin",
+			Example:     "vin",
+			Description: "Read the VIN, calibration IDs and CVNs (OBD-II mode 09)",
+			Flags: []cli.Flag{
+				portFlag,
+				captureFlag,
+			},
+			Action: func(c *cli.Context) {
+				obd, err := connect(c, false)
+				if err != nil {
+					return
+				}
+				defer obd.DisconnectDevice()
+				ctx, stop := interruptible()
+				defer stop()
+
+				vin, err := obd.VIN(ctx)
+				if err != nil {
+					log("VIN - Error", err)
+				} else {
+					fmt.Println("VIN:", vin)
+				}
+				ids, err := obd.CalibrationIDs(ctx)
+				if err != nil {
+					log("VIN - Calibration IDs", err)
+				}
+				for _, id := range ids {
+					fmt.Println("Calibration ID:", id)
+				}
+				cvns, err := obd.CVNs(ctx)
+				if err != nil {
+					log("VIN - CVNs", err)
+				}
+				for _, cvn := range cvns {
+					fmt.Printf("CVN: %.8X\n", cvn)
+				}
+			},
+		},
+		{
+			Name:        "security",
+			ShortName:   "sec",
+			Example:     "security",
+			Description: "Unlock Security Access, or list the seed/key algorithms we can answer",
+			Flags: []cli.Flag{
+				portFlag,
+				captureFlag,
+				cli.BoolFlag{Name: "list", Usage: "List the supported algorithm IDs"},
+			},
+			Action: func(c *cli.Context) {
+				if c.Bool("list") {
+					for _, id := range iso9141.SupportedAlgorithms() {
+						fmt.Printf("0x%.2X\n", id)
+					}
+					return
+				}
+				obd, err := connect(c, false)
+				if err != nil {
+					return
+				}
+				defer obd.DisconnectDevice()
+				ctx, stop := interruptible()
+				defer stop()
+				if err := obd.EnableSecurity(ctx); err != nil {
+					fmt.Println(err)
+					return
+				}
+				fmt.Println("Security Access granted")
+			},
+		},
+		{
+			Name:        "decode",
+			ShortName:   "dec",
+			Example:     "decode session.capture",
+			Description: "Print a session captured with --capture as the ISO9141/KWP services that went back and forth",
+			Arguments: []cli.Argument{
+				cli.Argument{Name: "capture", Usage: "decode session.capture", Description: "The capture file", Optional: false},
+			},
+			Action: func(c *cli.Context) {
+				lines, err := iso9141.LoadCapture(c.NamedArg("capture"))
+				if err != nil {
+					log("Decode - Error", err)
+					return
+				}
+				iso9141.DecodeCapture(os.Stdout, lines)
+			},
+		},
+		{
+			Name:        "simulate",
+			ShortName:   "sim",
+			Example:     "simulate mp3",
+			Description: "Serve a Calibration File from a simulated ELM327 and ECU on a TCP port, like a WiFi dongle",
+			Arguments: []cli.Argument{
+				cli.Argument{Name: "calibration", Usage: "simulate msp", Description: "The catalog name or file path of the calibration to serve", Optional: false},
+			},
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "listen", Value: "127.0.0.1:35000", Usage: "Address to listen on"},
+			},
+			Action: func(c *cli.Context) {
+				iso9141.ListenAndServe(c.String("listen"), c.NamedArg("calibration"))
 			},
 		},
 		{
@@ -107,11 +528,14 @@ func main() {
 			Example:     "maptest1",
 			Description: "Map Test 1",
 			Arguments: []cli.Argument{
-				cli.Argument{Name: "calibration", Usage: "maptest1 msp", Description: "The name of the calibration to run map tests on", Optional: false},
+				cli.Argument{Name: "calibration", Usage: "maptest1 msp", Description: "The catalog name or file path of the calibration to run map tests on", Optional: false},
 			},
 
 			Action: func(c *cli.Context) {
-				hs, _ := hexstuff.New(c.NamedArg("calibration"))
+				hs, err := hexstuff.New(c.NamedArg("calibration"))
+				if err != nil {
+					return
+				}
 				hs.TestM1()
 			},
 		},
@@ -121,11 +545,14 @@ func main() {
 			Example:     "maptest2",
 			Description: "Map Test 2",
 			Arguments: []cli.Argument{
-				cli.Argument{Name: "calibration", Usage: "maptest2 msp", Description: "The name of the calibration to run map tests on", Optional: false},
+				cli.Argument{Name: "calibration", Usage: "maptest2 msp", Description: "The catalog name or file path of the calibration to run map tests on", Optional: false},
 			},
 
 			Action: func(c *cli.Context) {
-				hs, _ := hexstuff.New(c.NamedArg("calibration"))
+				hs, err := hexstuff.New(c.NamedArg("calibration"))
+				if err != nil {
+					return
+				}
 				hs.TestM2()
 			},
 		},
@@ -135,28 +562,73 @@ func main() {
 			Example:     "compare mp3 mp3-2",
 			Description: "Compare",
 			Arguments: []cli.Argument{
-				cli.Argument{Name: "pre1", Usage: "compare pre mp3 pre2 mp3x2", Description: "The name of the first pre calibrations to compare", Optional: false},
-				cli.Argument{Name: "calibration1", Usage: "compare pre mp3 pre2 mp3x2", Description: "The name of the first calibrations to compare", Optional: false},
-				cli.Argument{Name: "pre2", Usage: "compare pre mp3 pre2 mp3x2", Description: "The name of the second pre calibrations to compare", Optional: false},
-				cli.Argument{Name: "calibration2", Usage: "compare pre mp3 pre2 mp3x2", Description: "The name of the second calibrations to compare", Optional: false},
+				cli.Argument{Name: "pre1", Usage: "compare pre1 mp3 pre2 mp3x2", Description: "The catalog name or file path of the first pre-calibration", Optional: false},
+				cli.Argument{Name: "calibration1", Usage: "compare pre1 mp3 pre2 mp3x2", Description: "The catalog name or file path of the first calibration", Optional: false},
+				cli.Argument{Name: "pre2", Usage: "compare pre1 mp3 pre2 mp3x2", Description: "The catalog name or file path of the second pre-calibration", Optional: false},
+				cli.Argument{Name: "calibration2", Usage: "compare pre1 mp3 pre2 mp3x2", Description: "The catalog name or file path of the second calibration", Optional: false},
 			},
 
 			Action: func(c *cli.Context) {
-				cmp := compare.New(c.NamedArg("pre1"), c.NamedArg("calibration1"), c.NamedArg("pre2"), c.NamedArg("calibration2"))
+				cmp, err := compare.New(c.NamedArg("pre1"), c.NamedArg("calibration1"), c.NamedArg("pre2"), c.NamedArg("calibration2"))
+				if err != nil {
+					return
+				}
 				cmp.Compare()
 			},
 		},
+		{
+			Name:        "identify",
+			ShortName:   "id",
+			Example:     "identify QKAABA0.BIN",
+			Description: "Identify the ECU family and flash layout of a Calibration File",
+			Arguments: []cli.Argument{
+				cli.Argument{Name: "calibration", Usage: "identify msp", Description: "The catalog name or file path of the calibration to identify", Optional: false},
+			},
+			Action: func(c *cli.Context) {
+				layout, strategy, err := image.Identify(c.NamedArg("calibration"))
+				if err != nil {
+					log("Identify - Error", err)
+					return
+				}
+
+				log(fmt.Sprintf("Identify - %s: %s, %s", layout.Name, layout.Family, layout.Description), nil)
+				if strategy != "" {
+					log(fmt.Sprintf("Identify - Strategy: %s", strategy), nil)
+				}
+				if !layout.Supported {
+					log("Identify - This family can't be analysed yet", nil)
+				}
+			},
+		},
 		{
 			Name:        "disasm",
 			ShortName:   "x",
 			Example:     "disasm",
 			Description: "Disassemble Calibration File",
 			Arguments: []cli.Argument{
-				cli.Argument{Name: "calibration", Usage: "disasm msp", Description: "The name of the calibration to disassemble", Optional: false},
+				cli.Argument{Name: "calibration", Usage: "disasm msp", Description: "The catalog name or file path of the calibration to disassemble", Optional: false},
+			},
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "format", Value: "text", Usage: "Output format, text or json"},
+				cli.StringFlag{Name: "out", Value: "./disasm.json", Usage: "File to write the json listing to"},
 			},
 			Action: func(c *cli.Context) {
-				d := disasm.New(c.NamedArg("calibration"))
-				d.DisAsm()
+				format := c.String("format")
+				if format != "text" && format != "json" {
+					log("Disassemble - Error", fmt.Errorf("Unknown format: %s, give text or json", format))
+					return
+				}
+
+				d, err := disasm.New(c.NamedArg("calibration"))
+				if err != nil {
+					return
+				}
+				switch format {
+				case "json":
+					d.ExportJSON(c.String("out"))
+				case "text":
+					d.DisAsm()
+				}
 			},
 		},
 		{
@@ -165,23 +637,347 @@ func main() {
 			Example:     "interrupt",
 			Description: "List Interrupt Vector Addresses in Calibration File",
 			Arguments: []cli.Argument{
-				cli.Argument{Name: "calibration", Usage: "interrupt msp", Description: "The name of the calibration to scan", Optional: false},
+				cli.Argument{Name: "calibration", Usage: "interrupt msp", Description: "The catalog name or file path of the calibration to scan", Optional: false},
 			},
 			Action: func(c *cli.Context) {
-				d := disasm.New(c.NamedArg("calibration"))
+				d, err := disasm.New(c.NamedArg("calibration"))
+				if err != nil {
+					return
+				}
 				d.GetInterrupts()
 			},
 		},
+		{
+			Name:        "cfg",
+			ShortName:   "cfg",
+			Example:     "cfg mp3",
+			Description: "Export the Control Flow Graph of each Subroutine in the Calibration File as Graphviz DOT files",
+			Arguments: []cli.Argument{
+				cli.Argument{Name: "calibration", Usage: "cfg msp", Description: "The catalog name or file path of the calibration to graph", Optional: false},
+			},
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "out", Value: "./cfg", Usage: "Directory to write the .dot files to"},
+			},
+			Action: func(c *cli.Context) {
+				d, err := disasm.New(c.NamedArg("calibration"))
+				if err != nil {
+					return
+				}
+				d.ExportCFG(c.String("out"))
+			},
+		},
+		{
+			Name:        "script",
+			ShortName:   "script",
+			Example:     "script mp3",
+			Description: "Write a Ghidra or IDA script that applies ELMFlash names and comments to a loaded image",
+			Arguments: []cli.Argument{
+				cli.Argument{Name: "calibration", Usage: "script msp", Description: "The catalog name or file path of the calibration to label", Optional: false},
+			},
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "format", Value: "ghidra", Usage: "Script format, ghidra or idc"},
+				cli.StringFlag{Name: "out", Value: "", Usage: "File to write the script to"},
+				cli.StringFlag{Name: "maps", Value: "pattern", Usage: "Where the table addresses come from, pattern (byte patterns) or code (lookup routine calls)"},
+			},
+			Action: func(c *cli.Context) {
+				calName := c.NamedArg("calibration")
+				format := c.String("format")
+
+				out := c.String("out")
+				if out == "" {
+					ext := ".py"
+					if format == "idc" {
+						ext = ".idc"
+					}
+					out = "./ELMFlash_" + strings.TrimSuffix(filepath.Base(calName), filepath.Ext(calName)) + ext
+				}
+
+				d, err := disasm.New(calName)
+				if err != nil {
+					return
+				}
+
+				maps, err := mapAddresses(calName, c.String("maps"))
+				if err != nil {
+					return
+				}
+				d.ExportScript(format, out, calName, maps)
+			},
+		},
+		{
+			Name:        "findmaps",
+			ShortName:   "fm",
+			Example:     "findmaps mp3",
+			Description: "Find the Maps from the Code, the Lookup Routines and every Table passed to them",
+			Arguments: []cli.Argument{
+				cli.Argument{Name: "calibration", Usage: "findmaps msp", Description: "The catalog name or file path of the calibration to search", Optional: false},
+			},
+			Action: func(c *cli.Context) {
+				d, err := disasm.New(c.NamedArg("calibration"))
+				if err != nil {
+					return
+				}
+				if err := d.WriteMaps(os.Stdout); err != nil {
+					log("Find Maps", err)
+				}
+			},
+		},
+		{
+			Name:        "export-xdf",
+			ShortName:   "xdf",
+			Example:     "export-xdf mp3 --defs tables.json",
+			Description: "Write a TunerPro XDF of the Maps/Tables in a Calibration File, named and scaled by a definitions file",
+			Arguments: []cli.Argument{
+				cli.Argument{Name: "calibration", Usage: "export-xdf msp", Description: "The catalog name or file path of the calibration to describe", Optional: false},
+			},
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "defs", Value: "", Usage: "json table definitions file, with the names, units, scaling and axis tables"},
+				cli.StringFlag{Name: "out", Value: "", Usage: "File to write the XDF to"},
+				cli.StringFlag{Name: "maps", Value: "pattern", Usage: "Where the table addresses come from, pattern (byte patterns) or code (lookup routine calls)"},
+			},
+			Action: func(c *cli.Context) {
+				calName := c.NamedArg("calibration")
+
+				out := c.String("out")
+				if out == "" {
+					out = "./ELMFlash_" + strings.TrimSuffix(filepath.Base(calName), filepath.Ext(calName)) + ".xdf"
+				}
+
+				defs, err := loadDefinitions(c.String("defs"))
+				if err != nil {
+					return
+				}
+
+				cal, err := calibrate.New(calName)
+				if err != nil {
+					return
+				}
+
+				maps, err := mapAddresses(calName, c.String("maps"))
+				if err != nil {
+					return
+				}
+				cal.ExportXDF(out, maps, defs)
+			},
+		},
+		{
+			Name:        "export-a2l",
+			ShortName:   "a2l",
+			Example:     "export-a2l mp3 --defs tables.json",
+			Description: "Write an ASAM A2L of the Maps/Tables in a Calibration File, named and scaled by a definitions file",
+			Arguments: []cli.Argument{
+				cli.Argument{Name: "calibration", Usage: "export-a2l msp", Description: "The catalog name or file path of the calibration to describe", Optional: false},
+			},
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "defs", Value: "", Usage: "json table definitions file, with the names, units, scaling and axis tables"},
+				cli.StringFlag{Name: "out", Value: "", Usage: "File to write the A2L to"},
+				cli.StringFlag{Name: "maps", Value: "pattern", Usage: "Where the table addresses come from, pattern (byte patterns) or code (lookup routine calls)"},
+			},
+			Action: func(c *cli.Context) {
+				calName := c.NamedArg("calibration")
+
+				out := c.String("out")
+				if out == "" {
+					out = "./ELMFlash_" + strings.TrimSuffix(filepath.Base(calName), filepath.Ext(calName)) + ".a2l"
+				}
+
+				defs, err := loadDefinitions(c.String("defs"))
+				if err != nil {
+					return
+				}
+
+				cal, err := calibrate.New(calName)
+				if err != nil {
+					return
+				}
+				maps, err := mapAddresses(calName, c.String("maps"))
+				if err != nil {
+					return
+				}
+				cal.ExportA2L(out, maps, defs)
+			},
+		},
+		{
+			Name:        "import-a2l",
+			ShortName:   "ia2l",
+			Example:     "import-a2l mp3 MP3.a2l tables.json",
+			Description: "Seed a definitions file with the names and conversions an A2L gives the tables of a Calibration File",
+			Arguments: []cli.Argument{
+				cli.Argument{Name: "calibration", Usage: "import-a2l msp MSP.a2l tables.json", Description: "The catalog name or file path of the calibration the A2L describes", Optional: false},
+				cli.Argument{Name: "a2l", Usage: "import-a2l msp MSP.a2l tables.json", Description: "The A2L file", Optional: false},
+				cli.Argument{Name: "defs", Usage: "import-a2l msp MSP.a2l tables.json", Description: "The json definitions file, created if it doesn't exist", Optional: false},
+			},
+			Action: func(c *cli.Context) {
+				defs, err := calibrate.LoadDefinitions(c.NamedArg("defs"))
+				if err != nil {
+					log("A2L - Error", err)
+					return
+				}
+				a2l, err := calibrate.LoadA2L(c.NamedArg("a2l"))
+				if err != nil {
+					log("A2L - Error", err)
+					return
+				}
+				cal, err := calibrate.New(c.NamedArg("calibration"))
+				if err != nil {
+					return
+				}
+
+				seeded, missing := cal.ImportA2L(a2l, defs)
+				if err := defs.Save(c.NamedArg("defs")); err != nil {
+					log("A2L - Error", err)
+					return
+				}
+				log(fmt.Sprintf("A2L - Seeded %d definitions, %d A2L tables aren't in the calibration, %d in the file", seeded, missing, len(defs.Tables)), nil)
+			},
+		},
+		{
+			Name:        "emulate",
+			ShortName:   "emu",
+			Example:     "emulate mp3",
+			Description: "Run the Calibration File in the 196EA Emulator and list Map reads",
+			Arguments: []cli.Argument{
+				cli.Argument{Name: "calibration", Usage: "emulate msp", Description: "The catalog name or file path of the calibration to run", Optional: false},
+			},
+			Flags: []cli.Flag{
+				cli.IntFlag{Name: "steps", Value: 100000, Usage: "Number of instructions to run"},
+				cli.BoolFlag{Name: "trace", Usage: "Print every instruction as it runs"},
+			},
+			Action: func(c *cli.Context) {
+				d, err := disasm.New(c.NamedArg("calibration"))
+				if err != nil {
+					return
+				}
+				d.Emulate(c.Int("steps"), c.Bool("trace"))
+			},
+		},
+		{
+			Name:        "assemble",
+			ShortName:   "asm",
+			Example:     "assemble patch.a96 mp3",
+			Description: "Assemble a source file and patch it into a copy of the Calibration File",
+			Arguments: []cli.Argument{
+				cli.Argument{Name: "source", Usage: "assemble patch.a96 msp", Description: "The assembler source file", Optional: false},
+				cli.Argument{Name: "calibration", Usage: "assemble patch.a96 msp", Description: "The catalog name or file path of the calibration to patch", Optional: false},
+			},
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "out", Value: "./PATCHED.BIN", Usage: "File to write the patched calibration to"},
+			},
+			Action: func(c *cli.Context) {
+				d, err := disasm.New(c.NamedArg("calibration"))
+				if err != nil {
+					return
+				}
+				patched := d.Image()
+
+				prog, err := asm.AssembleFile(c.NamedArg("source"), d.CalibrationStart())
+				if err != nil {
+					log("Assemble - Error assembling source", err)
+					return
+				}
+
+				for _, chunk := range prog.Chunks {
+					if chunk.Address < d.CalibrationStart() {
+						log("Assemble - Error patching", fmt.Errorf("0x%X is before the calibration, only the calibration file is written", chunk.Address))
+						return
+					}
+					log(fmt.Sprintf("Assemble - 0x%X bytes at 0x%X", len(chunk.Bytes), chunk.Address), nil)
+				}
+
+				err = prog.Patch(patched)
+				if err != nil {
+					log("Assemble - Error patching", err)
+					return
+				}
+
+				err = ioutil.WriteFile(c.String("out"), patched[d.CalibrationStart():], 0644)
+				if err != nil {
+					log("Assemble - Error writing file", err)
+					return
+				}
+
+				log(fmt.Sprintf("Assemble - wrote %s", c.String("out")), nil)
+			},
+		},
 		{
 			Name:        "calibrate",
 			ShortName:   "cal",
 			Example:     "interrupt",
 			Description: "Calibrate",
 			Arguments: []cli.Argument{
-				cli.Argument{Name: "calibration", Usage: "calibrate msp", Description: "The name of the calibration to edit", Optional: false},
+				cli.Argument{Name: "calibration", Usage: "calibrate msp", Description: "The catalog name or file path of the calibration to edit", Optional: false},
+			},
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "defs", Value: "", Usage: "json table definitions file, with the names, units, scaling and axis tables"},
+				cli.StringFlag{Name: "out", Value: "./CALIBRATED.BIN", Usage: "File to write the edited calibration to, in the layout it was read in"},
 			},
 			Action: func(c *cli.Context) {
-				calibrate.Calibrate(true)
+				defs, err := loadDefinitions(c.String("defs"))
+				if err != nil {
+					return
+				}
+				calibrate.Calibrate(c.NamedArg("calibration"), defs, c.String("out"), true)
+			},
+		},
+		{
+			Name:        "table",
+			ShortName:   "t",
+			Example:     "table mp3 0x10AA60 --defs tables.json",
+			Description: "Show a Map/Table of a Calibration File in its units, named by a definitions file, and edit it with --set",
+			Arguments: []cli.Argument{
+				cli.Argument{Name: "calibration", Usage: "table msp 0x10AA60", Description: "The catalog name or file path of the calibration", Optional: false},
+				cli.Argument{Name: "address", Usage: "table msp 0x10AA60", Description: "The address of the table header", Optional: false},
+			},
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "defs", Value: "", Usage: "json table definitions file, with the names, units, scaling and axis tables"},
+				cli.StringFlag{Name: "set", Value: "", Usage: "Cells to change, in the table's units: \"row,col=value row,col=value\""},
+				cli.StringFlag{Name: "out", Value: "./CALIBRATED.BIN", Usage: "File to write the edited calibration to, in the layout it was read in"},
+			},
+			Action: func(c *cli.Context) {
+				defs, err := loadDefinitions(c.String("defs"))
+				if err != nil {
+					return
+				}
+				address, err := calibrate.ParseAddress(c.NamedArg("address"))
+				if err != nil {
+					log("Table - Error", err)
+					return
+				}
+				cal, err := calibrate.New(c.NamedArg("calibration"))
+				if err != nil {
+					return
+				}
+				cal.Use(defs)
+
+				for _, cell := range strings.Fields(c.String("set")) {
+					var row, col int
+					var value float64
+					if _, err := fmt.Sscanf(cell, "%d,%d=%g", &row, &col, &value); err != nil {
+						log(fmt.Sprintf("Table - Error, %q isn't row,col=value", cell), err)
+						return
+					}
+					raw, err := cal.SetValue(address, row, col, value)
+					if err != nil {
+						log("Table - Error", err)
+						return
+					}
+					log(fmt.Sprintf("Table - [%d, %d] = %v (raw %d)", row, col, value, raw), nil)
+				}
+
+				table, err := cal.GetTable(address)
+				if err != nil {
+					log("Table - Error", err)
+					return
+				}
+				calibrate.WriteTable(os.Stdout, table)
+
+				if c.String("set") != "" {
+					if err := cal.Save(c.String("out")); err != nil {
+						log("Table - Error writing file", err)
+						return
+					}
+					log("Table - wrote "+c.String("out"), nil)
+				}
 			},
 		},
 	}
@@ -193,6 +989,76 @@ func main() {
 	app.Run(os.Args)
 }
 
+// loadDefinitions reads the --defs file, if there is one
+func loadDefinitions(path string) (*calibrate.Definitions, error) {
+	if path == "" {
+		return nil, nil
+	}
+	defs, err := calibrate.LoadDefinitions(path)
+	if err != nil {
+		log("Definitions - Error", err)
+	}
+	return defs, err
+}
+
+// mapAddresses finds the table headers of a calibration, from byte patterns or, for "code", from the lookup routine calls
+func mapAddresses(calName string, source string) ([]int, error) {
+	var maps []int
+	switch source {
+	case "code":
+		d, err := disasm.New(calName)
+		if err != nil {
+			return nil, err
+		}
+		maps, err = d.MapAddresses()
+		if err != nil {
+			log("Maps - Error finding the lookup routine calls", err)
+			return nil, err
+		}
+	default:
+		hs, err := hexstuff.New(calName)
+		if err != nil {
+			return nil, err
+		}
+		maps, err = hs.TestM1()
+		if err != nil {
+			log("Maps - Error matching the table headers", err)
+			return nil, err
+		}
+	}
+	return maps, nil
+}
+
+// interruptible is cancelled by Ctrl-C, so a command talking to the ECU can close its transfer and stop cleanly
+func interruptible() (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(context.Background(), os.Interrupt)
+}
+
+// connect opens the ELM327 given by --port, or the dummy device for --test
+func connect(c *cli.Context, test bool) (*iso9141.Device, error) {
+	if test {
+		return iso9141.New(true), nil
+	}
+
+	t, err := iso9141.ParseTransport(c.String("port"))
+	if err != nil {
+		log("Connect - Error", err)
+		return nil, err
+	}
+
+	if c.String("capture") != "" {
+		f, err := os.Create(c.String("capture"))
+		if err != nil {
+			log("Connect - Error", err)
+			return nil, err
+		}
+		log("Connect - Capturing to "+c.String("capture"), nil)
+		return iso9141.ConnectCapture(t, f)
+	}
+
+	return iso9141.Connect(t)
+}
+
 // Log Function
 ////////////////..........
 func log(kind string, err error) {
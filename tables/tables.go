@@ -0,0 +1,305 @@
+package tables
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Table Descriptors
+////////////////..........
+
+// The calibration keeps its tables behind small headers:
+//
+//	Map:   H1 H2 H3 H4 H5 H6 H7 H8 data...   H5+1 rows of H6+1 cols, H7/H8 the row/col axis
+//	Array: H1 H2 H3 H4 data...               H3+1 elements, H4 the axis
+//	Item:  02 data...                        a 4 byte constant
+//
+// H1 is 0x00, 0x40, 0x60 or 0x80, H2 never has more than its low 3 bits set.
+
+// ErrNoHeader is returned for addresses that don't hold a table header
+var ErrNoHeader = errors.New("not a table header")
+
+// Kind of table a header describes
+type Kind int
+
+const (
+	Map   Kind = iota // 8 byte header, rows x cols
+	Array             // 4 byte header, one row
+	Item              // 0x02 and a 4 byte constant
+)
+
+func (k Kind) String() string {
+	switch k {
+	case Map:
+		return "3D Map"
+	case Array:
+		return "Array"
+	case Item:
+		return "4 Bytes"
+	}
+	return fmt.Sprintf("Kind(%d)", int(k))
+}
+
+// Packing is how the elements are laid out after the header
+type Packing int
+
+const (
+	Packed        Packing = iota // one element after another
+	EscapedZero                  // a 0x00 element is followed by an escape byte
+	EscapedNibble                // an element on an even address with a low nibble of 0 is followed by an escape byte
+	LowPadded                    // bytes under 0x05 are padding, up to one per element
+	Marked                       // a byte between 0x00 and H2 is a marker for the element after it
+)
+
+func (p Packing) String() string {
+	switch p {
+	case Packed:
+		return "packed"
+	case EscapedZero:
+		return "escaped 0x00"
+	case EscapedNibble:
+		return "escaped 0x?0"
+	case LowPadded:
+		return "low padded"
+	case Marked:
+		return "marked"
+	}
+	return fmt.Sprintf("Packing(%d)", int(p))
+}
+
+// A Table is a decoded header and the data it describes
+type Table struct {
+	Address int
+	Header  []byte
+	Kind    Kind
+
+	Rows    int
+	Cols    int
+	Width   int // bytes per element
+	Signed  bool
+	Packing Packing
+
+	// The axis bytes, which input the rows and cols are looked up by. The breakpoints are in the code, not here.
+	RowAxis int
+	ColAxis int
+
+	Start int // first data byte
+	End   int // first byte after the data, escapes and padding included
+
+	Data []int
+}
+
+// Size is the number of elements
+func (t *Table) Size() int {
+	return t.Rows * t.Cols
+}
+
+// Next is where the next table can start, tables are word aligned
+func (t *Table) Next() int {
+	if t.Kind == Item || t.End%2 == 0 {
+		return t.End
+	}
+	return t.End + 1
+}
+
+func (t *Table) String() string {
+	sign := "unsigned"
+	if t.Signed {
+		sign = "signed"
+	}
+	return fmt.Sprintf("0x%.6X %s %d x %d, %d-bit %s %s, data 0x%.6X-0x%.6X", t.Address, t.Kind, t.Rows, t.Cols, t.Width*8, sign, t.Packing, t.Start, t.End)
+}
+
+// Decode reads the table with its header at addr in block
+func Decode(block []byte, addr int) (*Table, error) {
+	t, err := decodeHeader(block, addr)
+	if err != nil {
+		return nil, err
+	}
+	t.fit(block)
+
+	t.Data, t.End, err = t.walk(block)
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// IsHeader is true if a map or an array header starts at addr
+func IsHeader(block []byte, addr int) bool {
+	t, err := decodeHeader(block, addr)
+	return err == nil && t.Kind != Item
+}
+
+func decodeHeader(block []byte, addr int) (*Table, error) {
+	if addr < 0 || addr+4 > len(block) {
+		return nil, fmt.Errorf("0x%X: %w", addr, ErrNoHeader)
+	}
+	h := block[addr : addr+4]
+	h1, h2, h3, h4 := h[0], h[1], h[2], h[3]
+
+	// 4 byte items aren't word aligned
+	if h1 == 0x02 {
+		return &Table{Address: addr, Header: block[addr : addr+1], Kind: Item, Rows: 1, Cols: 1, Width: 4, Start: addr + 1}, nil
+	}
+
+	if addr%2 != 0 || !(h1 == 0x00 || h1 == 0x40 || h1 == 0x60 || h1 == 0x80) || h2&0xF8 != 0x00 {
+		return nil, fmt.Errorf("0x%X: %w", addr, ErrNoHeader)
+	}
+
+	// 3D Maps
+	if addr+8 <= len(block) && ((h3 == 0x00 && h4&0xF8 == 0x00) || (h3&0x1F == 0x00 && h4 == 0x00)) && block[addr+4] > 0x00 {
+		h = block[addr : addr+8]
+		t := &Table{
+			Address: addr,
+			Header:  h,
+			Kind:    Map,
+			Rows:    int(h[4]) + 1,
+			Cols:    int(h[5]) + 1,
+			Width:   1,
+			Signed:  h1&0x80 == 0x80,
+			RowAxis: int(h[6]),
+			ColAxis: int(h[7]),
+			Start:   addr + 8,
+		}
+		if h2 == 0x01 {
+			t.Width = 2
+		}
+		if (h2 == 0x02 || h2 == 0x04) && h[6]&0x01 == 0x01 {
+			t.Packing = EscapedZero
+		}
+		return t, nil
+	}
+
+	// Arrays
+	if h3&0xF0 == 0x00 && h3 > 0x00 {
+		t := &Table{
+			Address: addr,
+			Header:  h,
+			Kind:    Array,
+			Rows:    1,
+			Cols:    int(h3) + 1,
+			Width:   1,
+			Signed:  h1&0x80 == 0x80,
+			ColAxis: int(h4),
+			Start:   addr + 4,
+		}
+		if h1 == 0x40 && h4&0x04 == 0x04 {
+			t.Width = 2
+		}
+		switch {
+		case h2 == 0x04 && h4 == 0x05:
+			t.Packing = EscapedNibble
+		case h1 == 0x00 && h2 == 0x00 && h3 == 0x07 && h4 == 0x05:
+			t.Packing = LowPadded
+		case h1 == 0x00 && h2 == 0x02 && h3 == 0x0D && h4 == 0x09:
+			t.Packing = Marked
+		}
+		return t, nil
+	}
+
+	return nil, fmt.Errorf("0x%X: %w", addr, ErrNoHeader)
+}
+
+// fit checks a map's element width against the layout. H2 = 0x01 only mostly means 16-bit data, but maps are
+// stored back to back: if only the other width ends where the next header starts, or 16-bit data would run over
+// the next header, the map is the other width.
+func (t *Table) fit(block []byte) {
+	if t.Kind != Map {
+		return
+	}
+
+	next := func(width int, packing Packing) int {
+		try := *t
+		try.Width, try.Packing = width, packing
+		_, end, err := try.walk(block)
+		if err != nil {
+			return -1
+		}
+		try.End = end
+		return try.Next()
+	}
+
+	if IsHeader(block, next(t.Width, t.Packing)) {
+		return
+	}
+
+	if t.Width == 1 {
+		if IsHeader(block, next(2, Packed)) {
+			t.Width, t.Packing = 2, Packed
+		}
+		return
+	}
+
+	narrow, wide := next(1, Packed), next(2, Packed)
+	for addr := narrow; addr >= 0 && addr < wide; addr += 2 {
+		if IsHeader(block, addr) {
+			t.Width = 1
+			return
+		}
+	}
+}
+
+// walk reads the elements from Start, returning them and the first byte after them
+func (t *Table) walk(block []byte) ([]int, int, error) {
+	n := t.Size()
+	data := make([]int, 0, n)
+	pad := 0
+
+	i := t.Start
+	for len(data) < n {
+		if i+t.Width+1 > len(block) {
+			return nil, i, fmt.Errorf("0x%X: data runs past the end of the image", t.Address)
+		}
+		b := block[i]
+
+		switch t.Packing {
+		case LowPadded:
+			if b < 0x05 && pad < n {
+				pad++
+				i++
+				continue
+			}
+		case Marked:
+			if b > 0x00 && b < t.Header[1] {
+				i++
+			}
+		}
+
+		data = append(data, t.value(block[i:i+t.Width]))
+		at := i
+		i += t.Width
+
+		switch t.Packing {
+		case EscapedZero:
+			if b == 0x00 {
+				i++
+			}
+		case EscapedNibble:
+			if at%2 == 0 && b&0x0F == 0x00 {
+				i++
+			}
+		}
+	}
+
+	return data, i, nil
+}
+
+// value reads one little endian element
+func (t *Table) value(b []byte) int {
+	var v uint32
+	for i := len(b) - 1; i >= 0; i-- {
+		v = v<<8 | uint32(b[i])
+	}
+	if !t.Signed {
+		return int(v)
+	}
+
+	switch len(b) {
+	case 1:
+		return int(int8(v))
+	case 2:
+		return int(int16(v))
+	}
+	return int(int32(v))
+}
@@ -0,0 +1,143 @@
+package tables
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/murdinc/ELMFlash/image"
+)
+
+// Table Tests
+////////////////..........
+
+func loadMP3(t *testing.T) []byte {
+	dir, err := filepath.Abs("../calibrations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	image.Dir = dir
+
+	img, err := image.Load("mp3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return img.Block
+}
+
+func TestDecodeMP3(t *testing.T) {
+	block := loadMP3(t)
+
+	tests := []struct {
+		addr       int
+		kind       Kind
+		rows, cols int
+		width      int
+		packing    Packing
+		end        int
+		first      int
+	}{
+		{0x10AA60, Map, 15, 14, 1, Packed, 0x10AB3A, 0x60},
+		{0x10AB3A, Map, 5, 7, 1, Packed, 0x10AB65, -1},
+		{0x10B720, Map, 2, 3, 1, Packed, 0x10B72E, 0x19},
+		{0x10C60E, Map, 15, 8, 2, Packed, 0x10C706, 0x147A},
+		{0x10AE62, Map, 7, 14, 1, EscapedZero, 0x10AF2E, 0x00},
+		{0x10EB20, Map, 20, 14, 1, Packed, 0x10EC40, 0x85},
+		{0x10F146, Map, 16, 1, 2, Packed, 0x10F16E, -1},
+
+		// H2 = 0x01 but 8-bit, the next map starts right after 120 bytes
+		{0x10DB04, Map, 15, 8, 1, Packed, 0x10DB84, 0x32},
+		// H2 = 0x02 but 16-bit
+		{0x10D6D8, Map, 8, 13, 2, Packed, 0x10D7B0, 0x8582},
+
+		{0x10A552, Array, 1, 14, 1, Marked, 0x10A564, 0x60},
+		{0x10A3BE, Item, 1, 1, 4, Packed, 0x10A3C3, 0x00010355},
+	}
+
+	for _, test := range tests {
+		tbl, err := Decode(block, test.addr)
+		if err != nil {
+			t.Errorf("0x%X: %v", test.addr, err)
+			continue
+		}
+		if tbl.Kind != test.kind || tbl.Rows != test.rows || tbl.Cols != test.cols || tbl.Width != test.width || tbl.Packing != test.packing {
+			t.Errorf("0x%X: got %s", test.addr, tbl)
+		}
+		if tbl.End != test.end || len(tbl.Data) != test.rows*test.cols {
+			t.Errorf("0x%X: data 0x%X-0x%X, %d elements", test.addr, tbl.Start, tbl.End, len(tbl.Data))
+		}
+		if test.first >= 0 && tbl.Data[0] != test.first {
+			t.Errorf("0x%X: first element 0x%X, want 0x%X", test.addr, tbl.Data[0], test.first)
+		}
+	}
+}
+
+func TestDecodeLayout(t *testing.T) {
+	block := loadMP3(t)
+
+	// Maps are stored back to back
+	for _, addr := range []int{0x10A586, 0x10A660, 0x10AB3A, 0x10B720, 0x10C60E, 0x10DC84, 0x10E2E4} {
+		tbl, err := Decode(block, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !IsHeader(block, tbl.Next()) {
+			t.Errorf("0x%X: no header after the data at 0x%X", addr, tbl.Next())
+		}
+	}
+
+	// H5 is the rows even past 0x10, every row of this one starts 85 81 7B
+	tbl, err := Decode(block, 0x10EB20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for r := 0; r < 2; r++ {
+		if row := tbl.Data[r*tbl.Cols : r*tbl.Cols+3]; row[0] != 0x85 || row[1] != 0x81 || row[2] != 0x7B {
+			t.Errorf("row %d starts % X", r, row)
+		}
+	}
+	if tbl.RowAxis != 0x08 || tbl.ColAxis != 0x09 {
+		t.Errorf("axes %X %X", tbl.RowAxis, tbl.ColAxis)
+	}
+
+	for _, addr := range []int{0x10AA68, 0x10AA69, -1, len(block) - 2} {
+		if _, err := Decode(block, addr); !errors.Is(err, ErrNoHeader) {
+			t.Errorf("0x%X: got %v", addr, err)
+		}
+	}
+}
+
+func TestDecodePacking(t *testing.T) {
+	tests := []struct {
+		block []byte
+		data  []int
+		end   int
+	}{
+		// Signed map, 0x00 escaped
+		{[]byte{0x80, 0x02, 0x00, 0x00, 0x01, 0x01, 0x01, 0x00, 0xFF, 0x00, 0x00, 0x80, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}, []int{-1, 0, -128, 1}, 13},
+		// Escaped low nibble
+		{[]byte{0x00, 0x04, 0x02, 0x05, 0x10, 0xEE, 0x11, 0x20, 0xEE, 0x00, 0x00, 0x00, 0x00, 0x00}, []int{0x10, 0x11, 0x20}, 8},
+		// Padding under 0x05
+		{[]byte{0x00, 0x00, 0x07, 0x05, 0x10, 0x00, 0x11, 0x12, 0x13, 0x01, 0x14, 0x15, 0x16, 0x17, 0x00, 0x00}, []int{0x10, 0x11, 0x12, 0x13, 0x14, 0x15, 0x16, 0x17}, 14},
+		// 16-bit array
+		{[]byte{0x40, 0x00, 0x01, 0x04, 0x34, 0x12, 0x78, 0x56, 0x00, 0x00}, []int{0x1234, 0x5678}, 8},
+	}
+
+	for i, test := range tests {
+		tbl, err := Decode(test.block, 0)
+		if err != nil {
+			t.Errorf("%d: %v", i, err)
+			continue
+		}
+		if tbl.End != test.end || len(tbl.Data) != len(test.data) {
+			t.Errorf("%d: got %s %v", i, tbl, tbl.Data)
+			continue
+		}
+		for j := range test.data {
+			if tbl.Data[j] != test.data[j] {
+				t.Errorf("%d: got %v, want %v", i, tbl.Data, test.data)
+				break
+			}
+		}
+	}
+}